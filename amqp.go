@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// amqpHeartbeat is how often the publisher and the broker check on each
+	// other. The connection is kept open between batches of events, so without
+	// heartbeats a broker that went away would only be noticed the next time
+	// something was published.
+	amqpHeartbeat = 10 * time.Second
+
+	// amqpHandshakeTimeout limits connecting to the broker when the context
+	// has no deadline of its own.
+	amqpHandshakeTimeout = 30 * time.Second
+)
+
+// amqpConnection is an open connection with a channel in confirm mode.
+type amqpConnection struct {
+	conn     *amqp.Connection
+	channel  *amqp.Channel
+	confirms chan amqp.Confirmation
+}
+
+// dialAMQP connects to the broker, opens a channel in confirm mode and
+// declares the exchange.
+func dialAMQP(ctx context.Context, uri, exchange, exchangeType string) (*amqpConnection, error) {
+	conn, err := amqp.DialConfig(uri, amqp.Config{
+		Heartbeat: amqpHeartbeat,
+		Locale:    "en_US",
+		Properties: amqp.Table{
+			"product": "user-info",
+		},
+		// The library clears the deadline once the handshake is done and
+		// leaves it to the heartbeats from then on.
+		Dial: func(network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				deadline = time.Now().Add(amqpHandshakeTimeout)
+			}
+			if err = conn.SetDeadline(deadline); err != nil {
+				conn.Close() // nolint:errcheck
+				return nil, err
+			}
+			return conn, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the AMQP broker: %w", err)
+	}
+
+	c := &amqpConnection{conn: conn}
+	if err = c.open(exchange, exchangeType); err != nil {
+		conn.Close() // nolint:errcheck
+		return nil, fmt.Errorf("error connecting to the AMQP broker: %w", err)
+	}
+	return c, nil
+}
+
+func (c *amqpConnection) open(exchange, exchangeType string) error {
+	var err error
+	if c.channel, err = c.conn.Channel(); err != nil {
+		return err
+	}
+	// The exchange is durable so that it survives a broker restart.
+	if err = c.channel.ExchangeDeclare(exchange, exchangeType, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err = c.channel.Confirm(false); err != nil {
+		return err
+	}
+	// Only one message is ever waiting to be confirmed, and the connection is
+	// dropped if it isn't, so the library never blocks on a full channel.
+	c.confirms = c.channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	return nil
+}
+
+// publish sends a persistent message and waits for the broker to confirm it.
+func (c *amqpConnection) publish(ctx context.Context, exchange, routingKey string, payload []byte) error {
+	err := c.channel.Publish(exchange, routingKey, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		AppId:        "user-info",
+		Body:         payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case confirm, ok := <-c.confirms:
+		if !ok {
+			return errors.New("the connection to the AMQP broker closed before the message was confirmed")
+		}
+		if !confirm.Ack {
+			return errors.New("the AMQP broker rejected the message")
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close closes the connection, politely if the broker is still listening.
+func (c *amqpConnection) close() error {
+	if c.conn.IsClosed() {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// AMQPPublisher publishes messages to an AMQP exchange, connecting on first
+// use and reconnecting after any error.
+type AMQPPublisher struct {
+	uri          string
+	exchange     string
+	exchangeType string
+
+	mu   sync.Mutex
+	conn *amqpConnection
+}
+
+// NewAMQPPublisher returns a publisher for the exchange at the broker. It
+// doesn't connect until the first message is published.
+func NewAMQPPublisher(uri, exchange, exchangeType string) *AMQPPublisher {
+	return &AMQPPublisher{
+		uri:          uri,
+		exchange:     exchange,
+		exchangeType: exchangeType,
+	}
+}
+
+func (p *AMQPPublisher) publish(ctx context.Context, routingKey string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// A connection the heartbeats found dead is replaced before it's used.
+	if p.conn != nil && p.conn.conn.IsClosed() {
+		p.conn = nil
+	}
+	if p.conn == nil {
+		conn, err := dialAMQP(ctx, p.uri, p.exchange, p.exchangeType)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+	}
+
+	if err := p.conn.publish(ctx, p.exchange, routingKey, payload); err != nil {
+		// Whether or not the broker got the message is unknown, so the
+		// connection is dropped and the caller retries on a new one. A broker
+		// that stopped answering holds up the close until the heartbeats give
+		// up on it, so the caller doesn't wait for that.
+		go p.conn.close() // nolint:errcheck
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the broker, if there is one.
+func (p *AMQPPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.close()
+	p.conn = nil
+	return err
+}
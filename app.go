@@ -1,45 +1,227 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
 
-func badRequest(writer http.ResponseWriter, msg string) {
-	http.Error(writer, msg, http.StatusBadRequest)
-	log.Error(msg)
+// requestLog returns a log entry that identifies the request and its caller.
+func requestLog(r *http.Request) *log.Entry {
+	entry := contextLog(r.Context())
+	if _, ok := entry.Data["request_id"]; !ok {
+		if id := requestID(r); id != "" {
+			entry = entry.WithField("request_id", id)
+		}
+	}
+	return entry
+}
+
+// contextLog returns a log entry that identifies the request that ctx belongs
+// to and its caller, for code that only has the request's context.
+func contextLog(ctx context.Context) *log.Entry {
+	fields := log.Fields{}
+	if info := requestInfoFromContext(ctx); info != nil && info.id != "" {
+		fields["request_id"] = info.id
+	}
+	if id, ok := IdentityFromContext(ctx); ok {
+		if id.Client != "" {
+			fields["client"] = id.Client
+		}
+		if id.Subject != "" {
+			fields["subject"] = id.Subject
+		}
+	}
+	return log.WithFields(fields)
+}
+
+// responseRecorder wraps an http.ResponseWriter to keep track of the status
+// code and the number of bytes written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
 }
 
-func errored(writer http.ResponseWriter, msg string) {
-	http.Error(writer, msg, http.StatusInternalServerError)
-	log.Error(msg)
+func newResponseRecorder(writer http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: writer, status: http.StatusOK}
 }
 
-func notFound(writer http.ResponseWriter, msg string) {
-	http.Error(writer, msg, http.StatusNotFound)
-	log.Error(msg)
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
 }
 
-func handleNonUser(writer http.ResponseWriter, username string) {
-	var (
-		retval []byte
-		err    error
-	)
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush passes flushes through to the wrapped writer, if it supports them.
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
 
-	retval, err = json.Marshal(map[string]string{
-		"user": username,
-	})
+// requestIDHeader is the header used to pass request IDs between services.
+const requestIDHeader = "X-Request-ID"
+
+// problemTypeBase prefixes the type URI of every problem returned by the
+// service. Clients may rely on these URIs, so they must not change.
+const problemTypeBase = "urn:cyverse-de:user-info:problem:"
+
+type problemType struct {
+	slug   string
+	title  string
+	status int
+}
+
+var (
+	problemBadRequest       = problemType{"bad-request", "Bad request", http.StatusBadRequest}
+	problemUnauthorized     = problemType{"unauthorized", "Authentication required", http.StatusUnauthorized}
+	problemForbidden        = problemType{"forbidden", "Forbidden", http.StatusForbidden}
+	problemNotFound         = problemType{"not-found", "Not found", http.StatusNotFound}
+	problemUserNotFound     = problemType{"user-not-found", "User not found", http.StatusNotFound}
+	problemMethodNotAllowed = problemType{"method-not-allowed", "Method not allowed", http.StatusMethodNotAllowed}
+	problemConflict         = problemType{"conflict", "Conflict", http.StatusConflict}
+	problemTooLarge         = problemType{"too-large", "Request body too large", http.StatusRequestEntityTooLarge}
+	problemRateLimited      = problemType{"rate-limited", "Too many requests", http.StatusTooManyRequests}
+	problemInternal         = problemType{"internal-error", "Internal server error", http.StatusInternalServerError}
+	problemUnavailable      = problemType{"unavailable", "Service unavailable", http.StatusServiceUnavailable}
+	problemTimeout          = problemType{"timeout", "Timed out", http.StatusGatewayTimeout}
+)
+
+// internalErrorDetail is returned in place of the real cause of an internal
+// error, which is only logged, so that database errors don't leak to clients.
+const internalErrorDetail = "An internal error occurred. Include the request ID when reporting it."
+
+// Problem is an RFC 7807 problem details object.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	User      string `json:"user,omitempty"`
+}
+
+func newProblem(r *http.Request, pt problemType, detail string) *Problem {
+	return &Problem{
+		Type:      problemTypeBase + pt.slug,
+		Title:     pt.title,
+		Status:    pt.status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: requestID(r),
+	}
+}
+
+func (p *Problem) write(writer http.ResponseWriter) {
+	jsoned, err := json.Marshal(p)
 	if err != nil {
-		errored(writer, fmt.Sprintf("Error generating json for non-user %s", err))
+		// This can't really happen, but fall back to plain text if it does.
+		http.Error(writer, p.Detail, p.Status)
+		log.WithField("request_id", p.RequestID).Error(err)
 		return
 	}
 
-	notFound(writer, string(retval))
+	writer.Header().Set("Content-Type", "application/problem+json")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(p.Status)
+	if _, err = writer.Write(jsoned); err != nil {
+		log.WithField("request_id", p.RequestID).Error(err)
+	}
+}
+
+func badRequest(writer http.ResponseWriter, r *http.Request, msg string) {
+	newProblem(r, problemBadRequest, msg).write(writer)
+	requestLog(r).Error(msg)
+}
+
+// errored logs msg and responds with a generic internal error, since msg
+// usually contains error text from the database. If the error happened
+// because the request was cancelled, or because a storage operation ran out
+// of time, the response is a 503 or a 504 instead.
+func errored(writer http.ResponseWriter, r *http.Request, msg string) {
+	info := requestInfoFromContext(r.Context())
+	switch {
+	case r.Context().Err() != nil:
+		newProblem(r, problemUnavailable, "The request was cancelled before it could be completed.").write(writer)
+	case info != nil && info.timedOut:
+		newProblem(r, problemTimeout, "The database did not respond in time.").write(writer)
+	default:
+		newProblem(r, problemInternal, internalErrorDetail).write(writer)
+	}
+	requestLog(r).Error(msg)
+}
+
+func notFound(writer http.ResponseWriter, r *http.Request, msg string) {
+	newProblem(r, problemNotFound, msg).write(writer)
+	requestLog(r).Error(msg)
+}
+
+func conflict(writer http.ResponseWriter, r *http.Request, msg string) {
+	newProblem(r, problemConflict, msg).write(writer)
+	requestLog(r).Error(msg)
+}
+
+func tooLarge(writer http.ResponseWriter, r *http.Request, msg string) {
+	newProblem(r, problemTooLarge, msg).write(writer)
+	requestLog(r).Error(msg)
+}
+
+func unauthorized(writer http.ResponseWriter, r *http.Request, msg string) {
+	writer.Header().Set("WWW-Authenticate", `Bearer realm="user-info"`)
+	newProblem(r, problemUnauthorized, msg).write(writer)
+	requestLog(r).Error(msg)
+}
+
+func tooManyRequests(writer http.ResponseWriter, r *http.Request, retryAfter time.Duration, msg string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	writer.Header().Set("Retry-After", strconv.Itoa(seconds))
+	newProblem(r, problemRateLimited, msg).write(writer)
+	requestLog(r).Error(msg)
+}
+
+func forbidden(writer http.ResponseWriter, r *http.Request, msg string) {
+	newProblem(r, problemForbidden, msg).write(writer)
+	requestLog(r).Error(msg)
+}
+
+func handleNonUser(writer http.ResponseWriter, r *http.Request, username string) {
+	msg := fmt.Sprintf("user %s does not exist", username)
+	p := newProblem(r, problemUserNotFound, msg)
+	p.User = username
+	p.write(writer)
+	requestLog(r).Error(msg)
+}
+
+// writeJSON writes value out as a JSON response body.
+func writeJSON(writer http.ResponseWriter, r *http.Request, value interface{}) {
+	jsoned, err := json.Marshal(value)
+	if err != nil {
+		errored(writer, r, fmt.Sprintf("error JSON encoding response: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if _, err = writer.Write(jsoned); err != nil {
+		requestLog(r).Error(err)
+	}
 }
 
 func fixAddr(addr string) string {
@@ -70,7 +252,19 @@ func AppVersion() {
 
 func makeRouter() *mux.Router {
 	router := mux.NewRouter()
+	router.Use(requestMiddleware)
+
+	// Middleware isn't applied when no route matches, so these need to be
+	// wrapped separately.
+	router.NotFoundHandler = requestMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		newProblem(r, problemNotFound, fmt.Sprintf("no resource found at %s", r.URL.Path)).write(writer)
+	}))
+	router.MethodNotAllowedHandler = requestMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		newProblem(r, problemMethodNotAllowed, fmt.Sprintf("%s is not supported for %s", r.Method, r.URL.Path)).write(writer)
+	}))
 	router.Handle("/debug/vars", http.DefaultServeMux)
+	router.HandleFunc("/openapi.json", serveOpenAPI).Methods("GET")
+	router.Handle("/metrics", metrics).Methods("GET")
 	router.HandleFunc("/", func(writer http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(writer, "Hello from user-info.\n")
 	}).Methods("GET")
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// AuditEntry records a change made to a user's data. The hashes identify the
+// state of the changed document before and after the change, and are empty
+// when there was no document.
+type AuditEntry struct {
+	ID         int64           `json:"id,omitempty"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Actor      string          `json:"actor"`
+	TargetUser string          `json:"target_user"`
+	Resource   string          `json:"resource"`
+	Operation  string          `json:"operation"`
+	RequestID  string          `json:"request_id,omitempty"`
+	BeforeHash string          `json:"before_hash,omitempty"`
+	AfterHash  string          `json:"after_hash,omitempty"`
+	Detail     json.RawMessage `json:"detail,omitempty"`
+}
+
+// contextActor describes who made the request: "client:<name>" for service
+// clients, the token's subject for users and "anonymous" when authentication
+// is disabled.
+func contextActor(ctx context.Context) string {
+	id, ok := IdentityFromContext(ctx)
+	switch {
+	case !ok:
+		return "anonymous"
+	case id.Scopes != nil:
+		return "client:" + id.Client
+	default:
+		return id.Subject
+	}
+}
+
+// requestActor is contextActor for the request's context.
+func requestActor(r *http.Request) string {
+	return contextActor(r.Context())
+}
+
+// newContextAuditEntry returns an entry for a change made to the target user's
+// data while handling the request that ctx belongs to.
+func newContextAuditEntry(ctx context.Context, targetUser, resource, operation string) *AuditEntry {
+	entry := &AuditEntry{
+		OccurredAt: time.Now().UTC(),
+		Actor:      contextActor(ctx),
+		TargetUser: targetUser,
+		Resource:   resource,
+		Operation:  operation,
+	}
+	if info := requestInfoFromContext(ctx); info != nil {
+		entry.RequestID = info.id
+	}
+	return entry
+}
+
+// newAuditEntry returns an entry for a change that the request makes to the
+// target user's data.
+func newAuditEntry(r *http.Request, targetUser, resource, operation string) *AuditEntry {
+	entry := newContextAuditEntry(r.Context(), targetUser, resource, operation)
+	if entry.RequestID == "" {
+		entry.RequestID = requestID(r)
+	}
+	return entry
+}
+
+// auditHash returns the SHA-256 of a document, or an empty string if there's
+// no document.
+func auditHash(document string) string {
+	if document == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(document))
+	return hex.EncodeToString(sum[:])
+}
+
+// insertAuditEntry writes the entry to the audit_log table. Pass the
+// transaction that makes the change so that the entry is only kept if the
+// change is.
+func insertAuditEntry(ctx context.Context, q queryer, entry *AuditEntry) error {
+	detail := entry.Detail
+	if detail == nil {
+		detail = json.RawMessage("{}")
+	}
+	query := `INSERT INTO audit_log (occurred_at, actor, target_user, resource, operation, request_id, before_hash, after_hash, detail)
+                   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := q.ExecContext(ctx, query, entry.OccurredAt, entry.Actor, entry.TargetUser, entry.Resource, entry.Operation, entry.RequestID,
+		entry.BeforeHash, entry.AfterHash, string(detail))
+	return err
+}
+
+// eventAudit returns the audit entry for the change that the event describes.
+// before and after are the changed document as it was and as the change left
+// it. The stores write the entry in the same transaction as the change, so a
+// change that can't be audited isn't made.
+func eventAudit(event *ChangeEvent, before, after string) *AuditEntry {
+	entry := &AuditEntry{
+		OccurredAt: event.OccurredAt,
+		Actor:      event.Actor,
+		TargetUser: event.Username,
+		Resource:   event.Resource,
+		Operation:  event.Operation,
+		RequestID:  event.RequestID,
+		BeforeHash: auditHash(before),
+		AfterHash:  auditHash(after),
+	}
+	// The bag that was changed is named in the entry's detail. A bag ID can
+	// always be encoded.
+	if data, ok := event.Data.(bagEventData); ok {
+		entry.Detail, _ = json.Marshal(bagAuditDetail{BagID: data.BagID})
+	}
+	return entry
+}
+
+type bagAuditDetail struct {
+	BagID string `json:"bag_id,omitempty"`
+}
+
+// bagAuditDocument returns the bag's contents in the form that's hashed for
+// the audit log, so that the hashes don't depend on how the backend stores
+// JSON. It returns an empty string if there's no bag.
+func bagAuditDocument(contents string) string {
+	var decoded BagContents
+	if contents == "" || json.Unmarshal([]byte(contents), &decoded) != nil {
+		return ""
+	}
+	encoded, err := json.Marshal(decoded)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// bagsAuditDocument is bagAuditDocument for all of a user's bags, keyed by
+// bag ID.
+func bagsAuditDocument(bags map[string]string) string {
+	if len(bags) == 0 {
+		return ""
+	}
+	decoded := make(map[string]BagContents, len(bags))
+	for id, contents := range bags {
+		var bag BagContents
+		if json.Unmarshal([]byte(contents), &bag) == nil {
+			decoded[id] = bag
+		}
+	}
+	encoded, err := json.Marshal(decoded)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// The limits on how many entries a single audit log query returns.
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditApp lets administrators query the audit log.
+type AuditApp struct {
+	audit  auditDB
+	router *mux.Router
+}
+
+// NewAuditApp returns a new *AuditApp.
+func NewAuditApp(db auditDB, router *mux.Router) *AuditApp {
+	auditApp := &AuditApp{
+		audit:  db,
+		router: router,
+	}
+	auditApp.router.HandleFunc("/admin/audit", auditApp.GetAudit).Methods(http.MethodGet)
+	return auditApp
+}
+
+// parseAuditFilter reads the filter from the query parameters: user, actor,
+// resource, since and until (RFC 3339 timestamps) and limit.
+func parseAuditFilter(r *http.Request) (*AuditFilter, error) {
+	query := r.URL.Query()
+	filter := &AuditFilter{
+		TargetUser: query.Get("user"),
+		Actor:      query.Get("actor"),
+		Resource:   query.Get("resource"),
+		Limit:      defaultAuditLimit,
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	} {
+		if value := query.Get(param.name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s value %q; use an RFC 3339 timestamp", param.name, value)
+			}
+			*param.value = parsed
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			return nil, fmt.Errorf("invalid limit %q; use a number from 1 to %d", value, maxAuditLimit)
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+// GetAudit returns the audit log entries that match the query, newest first.
+func (a *AuditApp) GetAudit(writer http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	entries, err := a.audit.queryAudit(r.Context(), filter)
+	if err != nil {
+		errored(writer, r, fmt.Sprintf("error querying the audit log: %s", err))
+		return
+	}
+
+	writeJSON(writer, r, map[string][]AuditEntry{"entries": entries})
+}
+
+// AuditRetention periodically deletes audit log entries older than the
+// retention period.
+type AuditRetention struct {
+	audit     auditDB
+	retention time.Duration
+	interval  time.Duration
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewAuditRetentionFromConfig starts pruning the audit log according to
+// user_info.audit.retention, or returns nil if the retention is zero, which
+// keeps every entry forever.
+func NewAuditRetentionFromConfig(cfg *viper.Viper, audit auditDB) *AuditRetention {
+	cfg.SetDefault("user_info.audit.retention", "0")
+	cfg.SetDefault("user_info.audit.prune_interval", "1h")
+
+	retention := cfg.GetDuration("user_info.audit.retention")
+	if retention <= 0 {
+		return nil
+	}
+
+	r := &AuditRetention{
+		audit:     audit,
+		retention: retention,
+		interval:  cfg.GetDuration("user_info.audit.prune_interval"),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// prune deletes the entries that have passed the retention period.
+func (r *AuditRetention) prune(ctx context.Context) {
+	pruned, err := r.audit.pruneAudit(ctx, time.Now().Add(-r.retention))
+	if err != nil {
+		log.Errorf("error pruning the audit log: %s", err)
+		return
+	}
+	if pruned > 0 {
+		log.Infof("pruned %d audit log entries older than %s", pruned, r.retention)
+	}
+}
+
+func (r *AuditRetention) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	r.prune(context.Background())
+	for {
+		select {
+		case <-ticker.C:
+			r.prune(context.Background())
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Close stops pruning the audit log.
+func (r *AuditRetention) Close(ctx context.Context) error {
+	close(r.stop)
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditFilter selects audit log entries. Empty fields match everything.
+type AuditFilter struct {
+	TargetUser string
+	Actor      string
+	Resource   string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+}
+
+// matches returns whether the entry is selected by the filter, ignoring the
+// limit.
+func (f *AuditFilter) matches(entry *AuditEntry) bool {
+	return (f.TargetUser == "" || entry.TargetUser == f.TargetUser) &&
+		(f.Actor == "" || entry.Actor == f.Actor) &&
+		(f.Resource == "" || entry.Resource == f.Resource) &&
+		(f.Since.IsZero() || !entry.OccurredAt.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.OccurredAt.Before(f.Until))
+}
+
+// where returns the WHERE clause for the filter and its arguments, using
+// placeholder to number them.
+func (f *AuditFilter) where(placeholder func(n int) string) (string, []interface{}) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, condition+" "+placeholder(len(args)))
+	}
+
+	if f.TargetUser != "" {
+		add("target_user =", f.TargetUser)
+	}
+	if f.Actor != "" {
+		add("actor =", f.Actor)
+	}
+	if f.Resource != "" {
+		add("resource =", f.Resource)
+	}
+	if !f.Since.IsZero() {
+		add("occurred_at >=", f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		add("occurred_at <", f.Until.UTC())
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// auditDB defines the interface for the audit log.
+type auditDB interface {
+	recordAudit(ctx context.Context, entry *AuditEntry) error
+
+	// queryAudit returns the entries selected by the filter, newest first.
+	queryAudit(ctx context.Context, filter *AuditFilter) ([]AuditEntry, error)
+
+	// pruneAudit deletes the entries that occurred before the cutoff and
+	// returns how many it deleted.
+	pruneAudit(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// AuditDB implements the auditDB interface on top of the DE database.
+type AuditDB struct {
+	db *tracedDB
+}
+
+// NewAuditDB returns a newly created *AuditDB.
+func NewAuditDB(db *sql.DB) *AuditDB {
+	return &AuditDB{
+		db: newTracedDB(db),
+	}
+}
+
+func (a *AuditDB) recordAudit(ctx context.Context, entry *AuditEntry) error {
+	ctx, done := startOperation(ctx, "AuditDB.recordAudit")
+	defer done()
+
+	return insertAuditEntry(ctx, a.db, entry)
+}
+
+// auditColumns are the columns that scanAuditEntries reads, in order.
+const auditColumns = `id, occurred_at, actor, target_user, resource, operation, request_id, before_hash, after_hash, detail`
+
+// scanAuditEntries reads audit log entries selected with auditColumns.
+func scanAuditEntries(rows *sql.Rows) ([]AuditEntry, error) {
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var (
+			entry  AuditEntry
+			detail string
+		)
+		err := rows.Scan(&entry.ID, &entry.OccurredAt, &entry.Actor, &entry.TargetUser, &entry.Resource, &entry.Operation,
+			&entry.RequestID, &entry.BeforeHash, &entry.AfterHash, &detail)
+		if err != nil {
+			return nil, err
+		}
+		entry.OccurredAt = entry.OccurredAt.UTC()
+		entry.Detail = exportJSON(detail)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (a *AuditDB) queryAudit(ctx context.Context, filter *AuditFilter) ([]AuditEntry, error) {
+	ctx, done := startOperation(ctx, "AuditDB.queryAudit")
+	defer done()
+
+	where, args := filter.where(func(n int) string { return fmt.Sprintf("$%d", n) })
+	args = append(args, filter.Limit)
+	query := fmt.Sprintf(`SELECT %s FROM audit_log%s ORDER BY occurred_at DESC, id DESC LIMIT $%d`, auditColumns, where, len(args))
+
+	rows, err := a.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAuditEntries(rows)
+}
+
+func (a *AuditDB) pruneAudit(ctx context.Context, cutoff time.Time) (int64, error) {
+	ctx, done := startOperation(ctx, "AuditDB.pruneAudit")
+	defer done()
+
+	result, err := a.db.ExecContext(ctx, `DELETE FROM audit_log WHERE occurred_at < $1`, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// publicPaths lists the route templates that can be reached without a token.
+var publicPaths = map[string]bool{
+	"/":             true,
+	"/openapi.json": true,
+	"/metrics":      true,
+	"/healthz":      true,
+	"/readyz":       true,
+	"/preferences/": true,
+	"/sessions/":    true,
+	"/searches/":    true,
+	"/bags/":        true,
+}
+
+// Identity describes the authenticated caller of a request. Client is the
+// name of the calling service, taken from the API key for service clients and
+// from the "azp" claim for bearer tokens. Scopes is only set for service
+// clients; users are limited by the username check instead.
+type Identity struct {
+	Subject    string
+	Client     string
+	Roles      []string
+	Scopes     []string
+	Privileged bool
+	Admin      bool
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the Identity stored in the context by the
+// authentication middleware, if any.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
+
+// Authenticator validates JWT bearer tokens and service client API keys and
+// makes sure that the caller is allowed to act on the user named in the
+// request path.
+type Authenticator struct {
+	clients       cDB
+	hmacKey       []byte
+	rsaKeys       map[string]*rsa.PublicKey
+	audience      string
+	usernameClaim string
+	adminRole     string
+	serviceRole   string
+	leeway        time.Duration
+	userDomain    string
+	now           func() time.Time
+}
+
+// NewAuthenticator returns a new *Authenticator configured from the
+// user_info.auth section of the configuration. Service client API keys are
+// only accepted if clients is not nil.
+func NewAuthenticator(cfg *viper.Viper, userDomain string, clients cDB) (*Authenticator, error) {
+	cfg.SetDefault("user_info.auth.username_claim", "preferred_username")
+	cfg.SetDefault("user_info.auth.admin_role", "admin")
+	cfg.SetDefault("user_info.auth.service_role", "service")
+	cfg.SetDefault("user_info.auth.leeway", "30s")
+
+	a := &Authenticator{
+		clients:       clients,
+		audience:      cfg.GetString("user_info.auth.audience"),
+		usernameClaim: cfg.GetString("user_info.auth.username_claim"),
+		adminRole:     cfg.GetString("user_info.auth.admin_role"),
+		serviceRole:   cfg.GetString("user_info.auth.service_role"),
+		leeway:        cfg.GetDuration("user_info.auth.leeway"),
+		userDomain:    userDomain,
+		now:           time.Now,
+	}
+
+	if key := cfg.GetString("user_info.auth.hmac_key"); key != "" {
+		a.hmacKey = []byte(key)
+	}
+
+	if path := cfg.GetString("user_info.auth.jwks_file"); path != "" {
+		keys, err := loadJWKS(path)
+		if err != nil {
+			return nil, err
+		}
+		a.rsaKeys = keys
+	}
+
+	if a.hmacKey == nil && len(a.rsaKeys) == 0 && a.clients == nil {
+		return nil, errors.New("user_info.auth requires hmac_key, jwks_file or service clients to be set")
+	}
+
+	return a, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// loadJWKS reads the RSA signing keys out of a JWKS document on disk.
+func loadJWKS(path string) (map[string]*rsa.PublicKey, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWKS file %s: %w", path, err)
+	}
+	return parseJWKS(contents)
+}
+
+func parseJWKS(contents []byte) (map[string]*rsa.PublicKey, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(contents, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding modulus for key %s: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding exponent for key %s: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// bearerToken pulls the token out of the Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks the token's signature, expiry and audience and returns its
+// claims.
+func (a *Authenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	var header jwtHeader
+	if err = json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	if err = a.checkSignature(header, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	claims := make(map[string]interface{})
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+
+	if err = a.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (a *Authenticator) checkSignature(header jwtHeader, signed string, signature []byte) error {
+	var (
+		hashFunc  crypto.Hash
+		newHash   func() hash.Hash
+		algFamily string
+	)
+
+	if len(header.Alg) != 5 {
+		return fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	algFamily = header.Alg[:2]
+
+	switch header.Alg[2:] {
+	case "256":
+		hashFunc, newHash = crypto.SHA256, sha256.New
+	case "384":
+		hashFunc, newHash = crypto.SHA384, sha512.New384
+	case "512":
+		hashFunc, newHash = crypto.SHA512, sha512.New
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+
+	switch algFamily {
+	case "HS":
+		if a.hmacKey == nil {
+			return errors.New("HMAC signed tokens are not accepted")
+		}
+		mac := hmac.New(newHash, a.hmacKey)
+		mac.Write([]byte(signed)) // nolint:errcheck
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+
+	case "RS":
+		key, err := a.rsaKey(header.Kid)
+		if err != nil {
+			return err
+		}
+		h := hashFunc.New()
+		h.Write([]byte(signed)) // nolint:errcheck
+		if err = rsa.VerifyPKCS1v15(key, hashFunc, h.Sum(nil), signature); err != nil {
+			return errors.New("invalid token signature")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+}
+
+func (a *Authenticator) rsaKey(kid string) (*rsa.PublicKey, error) {
+	if key, ok := a.rsaKeys[kid]; ok {
+		return key, nil
+	}
+
+	// Tokens without a key ID are only accepted when there's no ambiguity
+	// about which key signed them.
+	if kid == "" && len(a.rsaKeys) == 1 {
+		for _, key := range a.rsaKeys {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func numericClaim(claims map[string]interface{}, name string) (time.Time, bool) {
+	value, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+func stringsClaim(value interface{}) []string {
+	var retval []string
+	switch v := value.(type) {
+	case string:
+		retval = append(retval, v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				retval = append(retval, s)
+			}
+		}
+	}
+	return retval
+}
+
+func (a *Authenticator) checkClaims(claims map[string]interface{}) error {
+	now := a.now()
+
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return errors.New("token has no expiration time")
+	}
+	if now.After(exp.Add(a.leeway)) {
+		return errors.New("token has expired")
+	}
+
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(a.leeway).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+
+	if a.audience != "" {
+		found := false
+		for _, aud := range stringsClaim(claims["aud"]) {
+			if aud == a.audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("token was not issued for this audience")
+		}
+	}
+
+	return nil
+}
+
+// identity builds an Identity from a verified set of claims. Roles are read
+// from a top-level "roles" claim and from Keycloak's "realm_access" claim.
+func (a *Authenticator) identity(claims map[string]interface{}) *Identity {
+	id := &Identity{}
+
+	if client, ok := claims["azp"].(string); ok {
+		id.Client = client
+	} else if client, ok := claims["client_id"].(string); ok {
+		id.Client = client
+	}
+
+	if subject, ok := claims[a.usernameClaim].(string); ok && subject != "" {
+		id.Subject = subject
+	} else if subject, ok := claims["sub"].(string); ok {
+		id.Subject = subject
+	}
+
+	id.Roles = stringsClaim(claims["roles"])
+	if realmAccess, ok := claims["realm_access"].(map[string]interface{}); ok {
+		id.Roles = append(id.Roles, stringsClaim(realmAccess["roles"])...)
+	}
+
+	for _, role := range id.Roles {
+		if role == a.adminRole {
+			id.Admin = true
+		}
+		if role == a.adminRole || role == a.serviceRole {
+			id.Privileged = true
+		}
+	}
+
+	return id
+}
+
+// authenticate works out who is making the request from either the API key or
+// the bearer token.
+func (a *Authenticator) authenticate(r *http.Request) (*Identity, error) {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		if a.clients == nil {
+			return nil, errors.New("API keys are not accepted")
+		}
+		client, err := authenticateClient(r.Context(), a.clients, key)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{
+			Client:     client.Name,
+			Scopes:     client.Scopes,
+			Privileged: true,
+		}, nil
+	}
+
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, errors.New("missing bearer token or API key")
+	}
+
+	if a.hmacKey == nil && len(a.rsaKeys) == 0 {
+		return nil, errors.New("bearer tokens are not accepted")
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bearer token: %w", err)
+	}
+
+	return a.identity(claims), nil
+}
+
+// authorize checks that the caller may perform the request against the given
+// route template.
+func (a *Authenticator) authorize(id *Identity, r *http.Request, tpl string) error {
+	resource := routeResource(tpl)
+	action := methodAction(r.Method)
+
+	// Service clients are limited to the scopes they were granted, which is
+	// also how they're given access to the admin endpoints.
+	if id.Scopes != nil {
+		if !scopesAllow(id.Scopes, resource, action) {
+			return fmt.Errorf("client %s does not have the %s:%s scope", id.Client, resource, action)
+		}
+	} else if adminResources[resource] && !id.Admin {
+		return fmt.Errorf("%s is not an administrator", id.Subject)
+	}
+
+	if username, ok := mux.Vars(r)["username"]; ok && !id.Privileged {
+		if a.qualifyUsername(username) != a.qualifyUsername(id.Subject) {
+			return fmt.Errorf("%s may not access data belonging to %s", id.Subject, username)
+		}
+	}
+
+	return nil
+}
+
+// qualifyUsername adds the user domain to usernames that don't have one so
+// that "ipcdev" and "ipcdev@iplantcollaborative.org" compare as equal.
+func (a *Authenticator) qualifyUsername(username string) string {
+	if strings.Contains(username, "@") {
+		return username
+	}
+	return username + a.userDomain
+}
+
+// Middleware is a mux.MiddlewareFunc that rejects unauthenticated requests,
+// requests for another user's data from unprivileged callers and requests
+// outside of a service client's scopes.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		var tpl string
+		if route := mux.CurrentRoute(r); route != nil {
+			tpl, _ = route.GetPathTemplate()
+		}
+
+		if publicPaths[tpl] {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		id, err := a.authenticate(r)
+		if err != nil {
+			unauthorized(writer, r, err.Error())
+			return
+		}
+
+		if err = a.authorize(id, r, tpl); err != nil {
+			forbidden(writer, r, err.Error())
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+		if info := requestInfoFromContext(r.Context()); info != nil {
+			info.identity = id
+		}
+		next.ServeHTTP(writer, r)
+	})
+}
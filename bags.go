@@ -1,7 +1,7 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,24 +9,20 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/cyverse-de/queries"
 	"github.com/gorilla/mux"
-	log "github.com/sirupsen/logrus"
 )
 
 // BagsApp contains the routing and request handling code for bags.
 type BagsApp struct {
-	api        *BagsAPI
+	api        bDB
 	router     *mux.Router
 	userDomain string
 }
 
 // NewBagsApp creates a new BagsApp instance.
-func NewBagsApp(db *sql.DB, router *mux.Router, userDomain string) *BagsApp {
+func NewBagsApp(db bDB, router *mux.Router, userDomain string) *BagsApp {
 	bagsApp := &BagsApp{
-		api: &BagsAPI{
-			db: db,
-		},
+		api:        db,
 		router:     router,
 		userDomain: userDomain,
 	}
@@ -61,11 +57,11 @@ func (b *BagsApp) Greeting(writer http.ResponseWriter, request *http.Request) {
 	fmt.Fprintf(writer, "Hello from the bags handler")
 }
 
-func (b *BagsApp) getUser(vars map[string]string) (string, int, error) {
+func (b *BagsApp) getUser(ctx context.Context, vars map[string]string) (string, int, error) {
 	var (
-		username       string
-		err            error
-		ok, userExists bool
+		username   string
+		err        error
+		ok, exists bool
 	)
 	if username, ok = vars["username"]; !ok {
 		return "", http.StatusBadRequest, errors.New("missing username in the URL")
@@ -73,17 +69,29 @@ func (b *BagsApp) getUser(vars map[string]string) (string, int, error) {
 
 	username = b.AddUsernameSuffix(username)
 
-	if userExists, err = queries.IsUser(b.api.db, username); err != nil {
+	if exists, err = b.api.IsUser(ctx, username); err != nil {
 		return "", http.StatusInternalServerError, fmt.Errorf("error checking for bags %s: %s", username, err)
 	}
 
-	if !userExists {
-		return "", http.StatusNotFound, fmt.Errorf("user %s does not exist", username)
+	if !exists {
+		return username, http.StatusNotFound, fmt.Errorf("user %s does not exist", username)
 	}
 
 	return username, http.StatusOK, nil
 }
 
+// userError writes out the response for an error returned by getUser.
+func (b *BagsApp) userError(writer http.ResponseWriter, request *http.Request, username string, status int, err error) {
+	switch status {
+	case http.StatusBadRequest:
+		badRequest(writer, request, err.Error())
+	case http.StatusNotFound:
+		handleNonUser(writer, request, username)
+	default:
+		errored(writer, request, err.Error())
+	}
+}
+
 // GetBags returns a listing of the bags for the user.
 func (b *BagsApp) GetBags(writer http.ResponseWriter, request *http.Request) {
 	var (
@@ -94,25 +102,25 @@ func (b *BagsApp) GetBags(writer http.ResponseWriter, request *http.Request) {
 		vars     = mux.Vars(request)
 	)
 
-	if username, status, err = b.getUser(vars); err != nil {
-		http.Error(writer, err.Error(), status)
+	if username, status, err = b.getUser(request.Context(), vars); err != nil {
+		b.userError(writer, request, username, status, err)
 		return
 	}
 
-	if bags, err = b.api.GetBags(username); err != nil {
-		http.Error(writer, fmt.Sprintf("error getting bags for %s: %s", username, err), http.StatusInternalServerError)
+	if bags, err = b.api.GetBags(request.Context(), username); err != nil {
+		errored(writer, request, fmt.Sprintf("error getting bags for %s: %s", username, err))
 		return
 	}
 
 	jsonBytes, err := json.Marshal(map[string][]BagRecord{"bags": bags})
 	if err != nil {
-		http.Error(writer, fmt.Sprintf("error JSON encoding result for %s: %s", username, err), http.StatusInternalServerError)
+		errored(writer, request, fmt.Sprintf("error JSON encoding result for %s: %s", username, err))
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
 	if _, err = writer.Write(jsonBytes); err != nil {
-		log.Error(err)
+		requestLog(request).Error(err)
 	}
 }
 
@@ -128,38 +136,39 @@ func (b *BagsApp) GetBag(writer http.ResponseWriter, request *http.Request) {
 		jsonBytes       []byte
 	)
 
-	if username, status, err = b.getUser(vars); err != nil {
-		http.Error(writer, err.Error(), status)
+	if username, status, err = b.getUser(request.Context(), vars); err != nil {
+		b.userError(writer, request, username, status, err)
+		return
 	}
 
 	if bagID, ok = vars["bagID"]; !ok {
-		badRequest(writer, "missing bagID in the URL")
+		badRequest(writer, request, "missing bagID in the URL")
 		return
 	}
 
-	if ok, err = b.api.HasBag(username, bagID); err != nil {
-		badRequest(writer, fmt.Sprintf("error checking database for bag %s for %s: %s", bagID, username, err))
+	if ok, err = b.api.HasBag(request.Context(), username, bagID); err != nil {
+		errored(writer, request, fmt.Sprintf("error checking database for bag %s for %s: %s", bagID, username, err))
 		return
 	}
 
 	if !ok {
-		http.Error(writer, fmt.Sprintf("bag %s not found for user %s", bagID, username), http.StatusNotFound)
+		notFound(writer, request, fmt.Sprintf("bag %s not found for user %s", bagID, username))
 		return
 	}
 
-	if bag, err = b.api.GetBag(username, bagID); err != nil {
-		http.Error(writer, fmt.Sprintf("error getting bags for %s: %s", username, err), http.StatusInternalServerError)
+	if bag, err = b.api.GetBag(request.Context(), username, bagID); err != nil {
+		errored(writer, request, fmt.Sprintf("error getting bags for %s: %s", username, err))
 		return
 	}
 
 	if jsonBytes, err = json.Marshal(bag); err != nil {
-		http.Error(writer, fmt.Sprintf("error JSON encoding result for %s: %s", username, err), http.StatusInternalServerError)
+		errored(writer, request, fmt.Sprintf("error JSON encoding result for %s: %s", username, err))
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
 	if _, err = writer.Write(jsonBytes); err != nil {
-		log.Error(err)
+		requestLog(request).Error(err)
 	}
 }
 
@@ -175,23 +184,24 @@ func (b *BagsApp) GetDefaultBag(writer http.ResponseWriter, request *http.Reques
 		vars      = mux.Vars(request)
 	)
 
-	if username, status, err = b.getUser(vars); err != nil {
-		http.Error(writer, err.Error(), status)
+	if username, status, err = b.getUser(request.Context(), vars); err != nil {
+		b.userError(writer, request, username, status, err)
+		return
 	}
 
-	if bag, err = b.api.GetDefaultBag(username); err != nil {
-		http.Error(writer, fmt.Sprintf("error getting default bag for %s: %s", username, err), http.StatusInternalServerError)
+	if bag, err = b.api.GetDefaultBag(request.Context(), username); err != nil {
+		errored(writer, request, fmt.Sprintf("error getting default bag for %s: %s", username, err))
 		return
 	}
 
 	if jsonBytes, err = json.Marshal(bag); err != nil {
-		http.Error(writer, fmt.Sprintf("error JSON encoding result for %s: %s", username, err), http.StatusInternalServerError)
+		errored(writer, request, fmt.Sprintf("error JSON encoding result for %s: %s", username, err))
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
 	if _, err = writer.Write(jsonBytes); err != nil {
-		log.Error(err)
+		requestLog(request).Error(err)
 	}
 }
 
@@ -207,33 +217,34 @@ func (b *BagsApp) AddBag(writer http.ResponseWriter, request *http.Request) {
 		vars            = mux.Vars(request)
 	)
 
-	if username, status, err = b.getUser(vars); err != nil {
-		http.Error(writer, err.Error(), status)
+	if username, status, err = b.getUser(request.Context(), vars); err != nil {
+		b.userError(writer, request, username, status, err)
+		return
 	}
 
 	if body, err = ioutil.ReadAll(request.Body); err != nil {
-		errored(writer, fmt.Sprintf("error reading body: %s", err))
+		errored(writer, request, fmt.Sprintf("error reading body: %s", err))
 		return
 	}
 
 	if err = json.Unmarshal(body, &bag); err != nil {
-		badRequest(writer, fmt.Sprintf("failed to JSON decode body: %s", err))
+		badRequest(writer, request, fmt.Sprintf("failed to JSON decode body: %s", err))
 		return
 	}
 
-	if bagID, err = b.api.AddBag(username, string(body)); err != nil {
-		errored(writer, fmt.Sprintf("failed to add bag for %s: %s", username, err))
+	if bagID, err = b.api.AddBag(request.Context(), username, string(body)); err != nil {
+		errored(writer, request, fmt.Sprintf("failed to add bag for %s: %s", username, err))
 		return
 	}
 
 	if retval, err = json.Marshal(map[string]string{"id": bagID}); err != nil {
-		errored(writer, fmt.Sprintf("failed to JSON encode response body: %s", err))
+		errored(writer, request, fmt.Sprintf("failed to JSON encode response body: %s", err))
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
 	if _, err = writer.Write(retval); err != nil {
-		log.Error(err)
+		requestLog(request).Error(err)
 	}
 }
 
@@ -249,37 +260,38 @@ func (b *BagsApp) UpdateBag(writer http.ResponseWriter, request *http.Request) {
 		vars            = mux.Vars(request)
 	)
 
-	if username, status, err = b.getUser(vars); err != nil {
-		http.Error(writer, err.Error(), status)
+	if username, status, err = b.getUser(request.Context(), vars); err != nil {
+		b.userError(writer, request, username, status, err)
+		return
 	}
 
 	if bagID, ok = vars["bagID"]; !ok {
-		badRequest(writer, "missing bagID in the URL")
+		badRequest(writer, request, "missing bagID in the URL")
 		return
 	}
 
-	if ok, err = b.api.HasBag(username, bagID); err != nil {
-		badRequest(writer, fmt.Sprintf("error checking database for bag %s for %s: %s", bagID, username, err))
+	if ok, err = b.api.HasBag(request.Context(), username, bagID); err != nil {
+		errored(writer, request, fmt.Sprintf("error checking database for bag %s for %s: %s", bagID, username, err))
 		return
 	}
 
 	if !ok {
-		http.Error(writer, fmt.Sprintf("bag %s not found for user %s", bagID, username), http.StatusNotFound)
+		notFound(writer, request, fmt.Sprintf("bag %s not found for user %s", bagID, username))
 		return
 	}
 
 	if body, err = ioutil.ReadAll(request.Body); err != nil {
-		errored(writer, fmt.Sprintf("error reading body: %s", err))
+		errored(writer, request, fmt.Sprintf("error reading body: %s", err))
 		return
 	}
 
 	if err = json.Unmarshal(body, &bag); err != nil {
-		errored(writer, fmt.Sprintf("failed to JSON decode body: %s", err))
+		badRequest(writer, request, fmt.Sprintf("failed to JSON decode body: %s", err))
 		return
 	}
 
-	if err = b.api.UpdateBag(username, bagID, string(body)); err != nil {
-		errored(writer, fmt.Sprintf("error updating bag for user %s: %s", username, err))
+	if err = b.api.UpdateBag(request.Context(), username, bagID, string(body)); err != nil {
+		errored(writer, request, fmt.Sprintf("error updating bag for user %s: %s", username, err))
 		return
 	}
 }
@@ -296,38 +308,39 @@ func (b *BagsApp) UpdateDefaultBag(writer http.ResponseWriter, request *http.Req
 		retval      []byte
 	)
 
-	if username, status, err = b.getUser(vars); err != nil {
-		http.Error(writer, err.Error(), status)
+	if username, status, err = b.getUser(request.Context(), vars); err != nil {
+		b.userError(writer, request, username, status, err)
+		return
 	}
 
 	if body, err = ioutil.ReadAll(request.Body); err != nil {
-		errored(writer, fmt.Sprintf("error reading body: %s", err))
+		errored(writer, request, fmt.Sprintf("error reading body: %s", err))
 		return
 	}
 
 	if err = json.Unmarshal(body, &bag); err != nil {
-		errored(writer, fmt.Sprintf("failed to JSON decode body: %s", err))
+		badRequest(writer, request, fmt.Sprintf("failed to JSON decode body: %s", err))
 		return
 	}
 
-	if err = b.api.UpdateDefaultBag(username, string(body)); err != nil {
-		errored(writer, fmt.Sprintf("error updating default bag for user %s: %s", username, err))
+	if err = b.api.UpdateDefaultBag(request.Context(), username, string(body)); err != nil {
+		errored(writer, request, fmt.Sprintf("error updating default bag for user %s: %s", username, err))
 		return
 	}
 
-	if newBag, err = b.api.GetDefaultBag(username); err != nil {
-		errored(writer, fmt.Sprintf("error getting new bag value for user %s: %s", username, err))
+	if newBag, err = b.api.GetDefaultBag(request.Context(), username); err != nil {
+		errored(writer, request, fmt.Sprintf("error getting new bag value for user %s: %s", username, err))
 		return
 	}
 
 	if retval, err = json.Marshal(newBag); err != nil {
-		errored(writer, fmt.Sprintf("error serializing new bag value for user %s: %s", username, err))
+		errored(writer, request, fmt.Sprintf("error serializing new bag value for user %s: %s", username, err))
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
 	if _, err = writer.Write(retval); err != nil {
-		log.Error(err)
+		requestLog(request).Error(err)
 	}
 }
 
@@ -341,17 +354,18 @@ func (b *BagsApp) DeleteBag(writer http.ResponseWriter, request *http.Request) {
 		vars            = mux.Vars(request)
 	)
 
-	if username, status, err = b.getUser(vars); err != nil {
-		http.Error(writer, err.Error(), status)
+	if username, status, err = b.getUser(request.Context(), vars); err != nil {
+		b.userError(writer, request, username, status, err)
+		return
 	}
 
 	if bagID, ok = vars["bagID"]; !ok {
-		badRequest(writer, "missing bagID in the URL")
+		badRequest(writer, request, "missing bagID in the URL")
 		return
 	}
 
-	if err = b.api.DeleteBag(username, bagID); err != nil {
-		errored(writer, fmt.Sprintf("error deleting bag for user %s: %s", username, err))
+	if err = b.api.DeleteBag(request.Context(), username, bagID); err != nil {
+		errored(writer, request, fmt.Sprintf("error deleting bag for user %s: %s", username, err))
 		return
 	}
 }
@@ -367,28 +381,29 @@ func (b *BagsApp) DeleteDefaultBag(writer http.ResponseWriter, request *http.Req
 		retval   []byte
 	)
 
-	if username, status, err = b.getUser(vars); err != nil {
-		http.Error(writer, err.Error(), status)
+	if username, status, err = b.getUser(request.Context(), vars); err != nil {
+		b.userError(writer, request, username, status, err)
+		return
 	}
 
-	if err = b.api.DeleteDefaultBag(username); err != nil {
-		errored(writer, fmt.Sprintf("error deleting default bag for user %s: %s", username, err))
+	if err = b.api.DeleteDefaultBag(request.Context(), username); err != nil {
+		errored(writer, request, fmt.Sprintf("error deleting default bag for user %s: %s", username, err))
 		return
 	}
 
-	if newBag, err = b.api.GetDefaultBag(username); err != nil {
-		errored(writer, fmt.Sprintf("error getting new bag value for user %s: %s", username, err))
+	if newBag, err = b.api.GetDefaultBag(request.Context(), username); err != nil {
+		errored(writer, request, fmt.Sprintf("error getting new bag value for user %s: %s", username, err))
 		return
 	}
 
 	if retval, err = json.Marshal(newBag); err != nil {
-		errored(writer, fmt.Sprintf("error serializing new bag value for user %s: %s", username, err))
+		errored(writer, request, fmt.Sprintf("error serializing new bag value for user %s: %s", username, err))
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
 	if _, err = writer.Write(retval); err != nil {
-		log.Error(err)
+		requestLog(request).Error(err)
 	}
 
 }
@@ -402,12 +417,13 @@ func (b *BagsApp) DeleteAllBags(writer http.ResponseWriter, request *http.Reques
 		vars     = mux.Vars(request)
 	)
 
-	if username, status, err = b.getUser(vars); err != nil {
-		http.Error(writer, err.Error(), status)
+	if username, status, err = b.getUser(request.Context(), vars); err != nil {
+		b.userError(writer, request, username, status, err)
+		return
 	}
 
-	if err = b.api.DeleteAllBags(username); err != nil {
-		errored(writer, fmt.Sprintf("error deleting bag for user %s: %s", username, err))
+	if err = b.api.DeleteAllBags(request.Context(), username); err != nil {
+		errored(writer, request, fmt.Sprintf("error deleting bag for user %s: %s", username, err))
 		return
 	}
 }
@@ -422,12 +438,13 @@ func (b *BagsApp) HasBags(writer http.ResponseWriter, request *http.Request) {
 		vars     = mux.Vars(request)
 	)
 
-	if username, status, err = b.getUser(vars); err != nil {
-		http.Error(writer, err.Error(), status)
+	if username, status, err = b.getUser(request.Context(), vars); err != nil {
+		b.userError(writer, request, username, status, err)
+		return
 	}
 
-	if hasBags, err = b.api.HasBags(username); err != nil {
-		errored(writer, fmt.Sprintf("error looking for bags for %s: %s", username, err))
+	if hasBags, err = b.api.HasBags(request.Context(), username); err != nil {
+		errored(writer, request, fmt.Sprintf("error looking for bags for %s: %s", username, err))
 		return
 	}
 
@@ -1,18 +1,43 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
-
-	"github.com/cyverse-de/queries"
 )
 
-// BagsAPI provides an API for interacting with bags.
+// bDB defines the interface for interacting with the bag storage.
+type bDB interface {
+	IsUser(ctx context.Context, username string) (bool, error)
+	HasBags(ctx context.Context, username string) (bool, error)
+	HasDefaultBag(ctx context.Context, username string) (bool, error)
+	HasBag(ctx context.Context, username, bagID string) (bool, error)
+	GetBags(ctx context.Context, username string) ([]BagRecord, error)
+	GetBag(ctx context.Context, username, bagID string) (BagRecord, error)
+	GetDefaultBag(ctx context.Context, username string) (BagRecord, error)
+	SetDefaultBag(ctx context.Context, username, bagID string) error
+	AddBag(ctx context.Context, username, contents string) (string, error)
+	UpdateBag(ctx context.Context, username, bagID, contents string) error
+	UpdateDefaultBag(ctx context.Context, username, contents string) error
+	DeleteBag(ctx context.Context, username, bagID string) error
+	DeleteDefaultBag(ctx context.Context, username string) error
+	DeleteAllBags(ctx context.Context, username string) error
+}
+
+// BagsAPI implements the bDB interface for interacting with the bags and
+// default_bags tables.
 type BagsAPI struct {
-	db *sql.DB
+	db *tracedDB
+}
+
+// NewBagsAPI returns a newly created *BagsAPI.
+func NewBagsAPI(db *sql.DB) *BagsAPI {
+	return &BagsAPI{
+		db: newTracedDB(db),
+	}
 }
 
 // BagRecord represents a bag as stored in the database.
@@ -39,29 +64,43 @@ func (b *BagContents) Scan(value interface{}) error {
 	return json.Unmarshal(valueBytes, &b)
 }
 
+// IsUser returns true if the user exists.
+func (b *BagsAPI) IsUser(ctx context.Context, username string) (bool, error) {
+	ctx, done := startOperation(ctx, "BagsAPI.IsUser")
+	defer done()
+
+	return userExists(ctx, b.db, username)
+}
+
 // HasBags returns true if the user has bags and false otherwise.
-func (b *BagsAPI) HasBags(username string) (bool, error) {
+func (b *BagsAPI) HasBags(ctx context.Context, username string) (bool, error) {
+	ctx, done := startOperation(ctx, "BagsAPI.HasBags")
+	defer done()
+
 	query := `SELECT count(*)
 				FROM bags b,
 					 users u
 			   WHERE b.user_id = u.id
 				 AND u.username = $1`
 	var count int64
-	if err := b.db.QueryRow(query, username).Scan(&count); err != nil {
+	if err := b.db.QueryRowContext(ctx, query, username).Scan(&count); err != nil {
 		return false, fmt.Errorf("error checking if %s has any bags: %w", username, err)
 	}
 	return count > 0, nil
 }
 
 // HasDefaultBag returns true if the user has a default bag.
-func (b *BagsAPI) HasDefaultBag(username string) (bool, error) {
+func (b *BagsAPI) HasDefaultBag(ctx context.Context, username string) (bool, error) {
+	ctx, done := startOperation(ctx, "BagsAPI.HasDefaultBag")
+	defer done()
+
 	query := `SELECT count(*)
 				FROM default_bags d,
 					 users u
 			   WHERE d.user_id = u.id
 				 AND u.username = $1`
 	var count int64
-	if err := b.db.QueryRow(query, username).Scan(&count); err != nil {
+	if err := b.db.QueryRowContext(ctx, query, username).Scan(&count); err != nil {
 		return false, fmt.Errorf("error checking if %s has a default bag: %w", username, err)
 	}
 	return count > 0, nil
@@ -69,7 +108,10 @@ func (b *BagsAPI) HasDefaultBag(username string) (bool, error) {
 }
 
 // HasBag returns true if the specified bag exists in the database.
-func (b *BagsAPI) HasBag(username, bagID string) (bool, error) {
+func (b *BagsAPI) HasBag(ctx context.Context, username, bagID string) (bool, error) {
+	ctx, done := startOperation(ctx, "BagsAPI.HasBag")
+	defer done()
+
 	query := `SELECT count(*)
 				FROM bags b,
 					 users u
@@ -77,14 +119,17 @@ func (b *BagsAPI) HasBag(username, bagID string) (bool, error) {
 				 AND u.username = $1
 				 AND b.id = $2`
 	var count int64
-	if err := b.db.QueryRow(query, username, bagID).Scan(&count); err != nil {
+	if err := b.db.QueryRowContext(ctx, query, username, bagID).Scan(&count); err != nil {
 		return false, fmt.Errorf("error checking for bag %s for %s: %w", bagID, username, err)
 	}
 	return count > 0, nil
 }
 
 // GetBags returns all of the bags for the provided user.
-func (b *BagsAPI) GetBags(username string) ([]BagRecord, error) {
+func (b *BagsAPI) GetBags(ctx context.Context, username string) ([]BagRecord, error) {
+	ctx, done := startOperation(ctx, "BagsAPI.GetBags")
+	defer done()
+
 	query := `SELECT b.id,
 					 b.contents,
 					 b.user_id
@@ -93,7 +138,7 @@ func (b *BagsAPI) GetBags(username string) ([]BagRecord, error) {
 			   WHERE b.user_id = u.id
 				 AND u.username = $1`
 
-	rows, err := b.db.Query(query, username)
+	rows, err := b.db.QueryContext(ctx, query, username)
 	if err != nil {
 		return nil, fmt.Errorf("error getting all bags for %s: %w", username, err)
 	}
@@ -116,7 +161,10 @@ func (b *BagsAPI) GetBags(username string) ([]BagRecord, error) {
 
 // GetBag returns the specified bag for the specified user according to the specified specifier for the
 // bag record.
-func (b *BagsAPI) GetBag(username, bagID string) (BagRecord, error) {
+func (b *BagsAPI) GetBag(ctx context.Context, username, bagID string) (BagRecord, error) {
+	ctx, done := startOperation(ctx, "BagsAPI.GetBag")
+	defer done()
+
 	query := `SELECT b.id,
 					 b.contents,
 					 b.user_id
@@ -126,7 +174,7 @@ func (b *BagsAPI) GetBag(username, bagID string) (BagRecord, error) {
 				 AND u.username = $2
 				 AND b.id = $1`
 	var record BagRecord
-	err := b.db.QueryRow(query, bagID, username).Scan(&record.ID, &record.Contents, &record.UserID)
+	err := b.db.QueryRowContext(ctx, query, bagID, username).Scan(&record.ID, &record.Contents, &record.UserID)
 	if err != nil {
 		return record, fmt.Errorf("error getting bag id %s for %s: %w", bagID, username, err)
 	}
@@ -134,7 +182,10 @@ func (b *BagsAPI) GetBag(username, bagID string) (BagRecord, error) {
 
 }
 
-func (b *BagsAPI) createDefaultBag(username string) (BagRecord, error) {
+func (b *BagsAPI) createDefaultBag(ctx context.Context, username string) (BagRecord, error) {
+	ctx, done := startOperation(ctx, "BagsAPI.createDefaultBag")
+	defer done()
+
 	var (
 		err         error
 		record      BagRecord
@@ -149,17 +200,17 @@ func (b *BagsAPI) createDefaultBag(username string) (BagRecord, error) {
 		return record, fmt.Errorf("error marshaling default bag: %w", err)
 	}
 
-	if newBagID, err = b.AddBag(username, string(newContents)); err != nil {
+	if newBagID, err = b.AddBag(ctx, username, string(newContents)); err != nil {
 		return record, fmt.Errorf("error adding bag for user %s: %w", username, err)
 	}
 
 	record.ID = newBagID
 
-	if err = b.SetDefaultBag(username, newBagID); err != nil {
+	if err = b.SetDefaultBag(ctx, username, newBagID); err != nil {
 		return record, fmt.Errorf("error setting the default bag for %s: %w", username, err)
 	}
 
-	if userID, err = queries.UserID(b.db, username); err != nil {
+	if userID, err = lookupUserID(ctx, b.db, username); err != nil {
 		return record, fmt.Errorf("error getting the user id for %s: %w", username, err)
 	}
 
@@ -169,7 +220,10 @@ func (b *BagsAPI) createDefaultBag(username string) (BagRecord, error) {
 }
 
 // GetDefaultBag returns the specified bag for the indicated user.
-func (b *BagsAPI) GetDefaultBag(username string) (BagRecord, error) {
+func (b *BagsAPI) GetDefaultBag(ctx context.Context, username string) (BagRecord, error) {
+	ctx, done := startOperation(ctx, "BagsAPI.GetDefaultBag")
+	defer done()
+
 	var (
 		err        error
 		hasDefault bool
@@ -177,12 +231,12 @@ func (b *BagsAPI) GetDefaultBag(username string) (BagRecord, error) {
 	)
 
 	// if the user doesn't have a default bag, add bag and set it as the default, then return it.
-	if hasDefault, err = b.HasDefaultBag(username); err != nil {
+	if hasDefault, err = b.HasDefaultBag(ctx, username); err != nil {
 		return record, fmt.Errorf("error from HasDefaultBag in GetDefaultBag for %s: %w", username, err)
 	}
 
 	if !hasDefault {
-		return b.createDefaultBag(username)
+		return b.createDefaultBag(ctx, username)
 	}
 
 	query := `SELECT b.id,
@@ -193,7 +247,7 @@ func (b *BagsAPI) GetDefaultBag(username string) (BagRecord, error) {
 				JOIN users u ON d.user_id = u.id
 			   WHERE u.username = $1`
 
-	if err = b.db.QueryRow(query, username).Scan(&record.ID, &record.Contents, &record.UserID); err != nil {
+	if err = b.db.QueryRowContext(ctx, query, username).Scan(&record.ID, &record.Contents, &record.UserID); err != nil {
 		return record, fmt.Errorf("error getting default bag for %s from the database: %w", username, err)
 	}
 
@@ -201,115 +255,216 @@ func (b *BagsAPI) GetDefaultBag(username string) (BagRecord, error) {
 }
 
 // SetDefaultBag allows the user to update their default bag.
-func (b *BagsAPI) SetDefaultBag(username, bagID string) error {
+func (b *BagsAPI) SetDefaultBag(ctx context.Context, username, bagID string) error {
+	ctx, done := startOperation(ctx, "BagsAPI.SetDefaultBag")
+	defer done()
+
 	var (
 		err    error
 		userID string
 	)
 
-	if userID, err = queries.UserID(b.db, username); err != nil {
-		return fmt.Errorf("error getting user ID for %s while setting default bag: %w", username, err)
-	}
+	event := newChangeEvent(ctx, username, "bags", "set_default", bagEventData{BagID: bagID})
+	return withEvent(ctx, b.db, event, bagID, func(tx *tracedTx) (string, error) {
+		if userID, err = lookupUserID(ctx, tx, username); err != nil {
+			return "", fmt.Errorf("error getting user ID for %s while setting default bag: %w", username, err)
+		}
 
-	query := `INSERT INTO default_bags VALUES ( $1, $2 ) ON CONFLICT (user_id) DO UPDATE SET bag_id = $2`
-	if _, err = b.db.Exec(query, userID, bagID); err != nil {
-		return fmt.Errorf("error setting the default bag for %s: %w", username, err)
-	}
-	return nil
+		before, err := defaultBagID(ctx, tx, userID)
+		if err != nil {
+			return "", fmt.Errorf("error getting the default bag for %s: %w", username, err)
+		}
+
+		query := `INSERT INTO default_bags VALUES ( $1, $2 ) ON CONFLICT (user_id) DO UPDATE SET bag_id = $2`
+		if _, err = tx.ExecContext(ctx, query, userID, bagID); err != nil {
+			return "", fmt.Errorf("error setting the default bag for %s: %w", username, err)
+		}
+		return before, nil
+	})
 
 }
 
 // AddBag adds (not updates) a new bag for the user. Returns the ID of the new bag record in the database.
-func (b *BagsAPI) AddBag(username, contents string) (string, error) {
-	query := `INSERT INTO bags (contents, user_id) VALUES ($1, $2) RETURNING id`
+func (b *BagsAPI) AddBag(ctx context.Context, username, contents string) (string, error) {
+	ctx, done := startOperation(ctx, "BagsAPI.AddBag")
+	defer done()
+	observeDocument("bags", contents)
 
-	userID, err := queries.UserID(b.db, username)
-	if err != nil {
-		return "", fmt.Errorf("error from queries.UserID in AddBag for %s: %w", username, err)
-	}
+	query := `INSERT INTO bags (contents, user_id) VALUES ($1, $2) RETURNING id`
 
 	var bagID string
-	if err = b.db.QueryRow(query, contents, userID).Scan(&bagID); err != nil {
-		return "", fmt.Errorf("error adding bag for %s: %w", username, err)
+	event := newChangeEvent(ctx, username, "bags", "create", nil)
+	err := withEvent(ctx, b.db, event, bagAuditDocument(contents), func(tx *tracedTx) (string, error) {
+		userID, err := lookupUserID(ctx, tx, username)
+		if err != nil {
+			return "", fmt.Errorf("error looking up the user ID in AddBag for %s: %w", username, err)
+		}
+
+		if err = tx.QueryRowContext(ctx, query, contents, userID).Scan(&bagID); err != nil {
+			return "", fmt.Errorf("error adding bag for %s: %w", username, err)
+		}
+
+		event.Data = bagEventData{BagID: bagID, Contents: exportJSON(contents)}
+		return "", nil
+	})
+	if err != nil {
+		return "", err
 	}
 
 	return bagID, nil
 }
 
 // UpdateBag updates a specific bag with new contents.
-func (b *BagsAPI) UpdateBag(username, bagID, contents string) error {
+func (b *BagsAPI) UpdateBag(ctx context.Context, username, bagID, contents string) error {
+	ctx, done := startOperation(ctx, "BagsAPI.UpdateBag")
+	defer done()
+	observeDocument("bags", contents)
+
 	query := `UPDATE ONLY bags SET contents = $1 WHERE id = $2 and user_id = $3`
 
-	userID, err := queries.UserID(b.db, username)
-	if err != nil {
-		return fmt.Errorf("error from queries.UserID in UpdateBag for %s: %w", username, err)
-	}
+	event := newChangeEvent(ctx, username, "bags", "update", bagEventData{BagID: bagID, Contents: exportJSON(contents)})
+	return withEvent(ctx, b.db, event, bagAuditDocument(contents), func(tx *tracedTx) (string, error) {
+		userID, err := lookupUserID(ctx, tx, username)
+		if err != nil {
+			return "", fmt.Errorf("error looking up the user ID in UpdateBag for %s: %w", username, err)
+		}
 
-	if _, err = b.db.Exec(query, contents, bagID, userID); err != nil {
-		return fmt.Errorf("error updating bag %s for %s: %w", bagID, username, err)
-	}
+		before, err := lockBag(ctx, tx, userID, bagID)
+		if err != nil {
+			return "", fmt.Errorf("error getting bag %s for %s: %w", bagID, username, err)
+		}
+
+		if _, err = tx.ExecContext(ctx, query, contents, bagID, userID); err != nil {
+			return "", fmt.Errorf("error updating bag %s for %s: %w", bagID, username, err)
+		}
 
-	return nil
+		return before, nil
+	})
 }
 
 // UpdateDefaultBag updates the default bag with new content.
-func (b *BagsAPI) UpdateDefaultBag(username, contents string) error {
+func (b *BagsAPI) UpdateDefaultBag(ctx context.Context, username, contents string) error {
+	ctx, done := startOperation(ctx, "BagsAPI.UpdateDefaultBag")
+	defer done()
+
 	var (
 		err        error
 		defaultBag BagRecord
 	)
 
-	if defaultBag, err = b.GetDefaultBag(username); err != nil {
+	if defaultBag, err = b.GetDefaultBag(ctx, username); err != nil {
 		return fmt.Errorf("error updating default bag for %s: %w", username, err)
 	}
 
-	return b.UpdateBag(username, defaultBag.ID, contents)
+	return b.UpdateBag(ctx, username, defaultBag.ID, contents)
 }
 
 // DeleteBag deletes the specified bag for the user.
-func (b *BagsAPI) DeleteBag(username, bagID string) error {
+func (b *BagsAPI) DeleteBag(ctx context.Context, username, bagID string) error {
+	ctx, done := startOperation(ctx, "BagsAPI.DeleteBag")
+	defer done()
+
 	query := `DELETE FROM ONLY bags WHERE id = $1 and user_id = $2`
 
-	userID, err := queries.UserID(b.db, username)
-	if err != nil {
-		return fmt.Errorf("error from queries.UserID in DeleteBag for %s: %w", username, err)
-	}
+	event := newChangeEvent(ctx, username, "bags", "delete", bagEventData{BagID: bagID})
+	return withEvent(ctx, b.db, event, "", func(tx *tracedTx) (string, error) {
+		userID, err := lookupUserID(ctx, tx, username)
+		if err != nil {
+			return "", fmt.Errorf("error looking up the user ID in DeleteBag for %s: %w", username, err)
+		}
 
-	if _, err = b.db.Exec(query, bagID, userID); err != nil {
-		return fmt.Errorf("error deleting bag %s for %s: %w", bagID, username, err)
-	}
+		before, err := lockBag(ctx, tx, userID, bagID)
+		if err != nil {
+			return "", fmt.Errorf("error getting bag %s for %s: %w", bagID, username, err)
+		}
 
-	return nil
+		if _, err = tx.ExecContext(ctx, query, bagID, userID); err != nil {
+			return "", fmt.Errorf("error deleting bag %s for %s: %w", bagID, username, err)
+		}
+
+		return before, nil
+	})
 }
 
 // DeleteDefaultBag deletes the default bag for the user. It will get
 // recreated with nothing in it the next time it is retrieved through
 // GetDefaultBag.
-func (b *BagsAPI) DeleteDefaultBag(username string) error {
+func (b *BagsAPI) DeleteDefaultBag(ctx context.Context, username string) error {
+	ctx, done := startOperation(ctx, "BagsAPI.DeleteDefaultBag")
+	defer done()
+
 	var (
 		err        error
 		defaultBag BagRecord
 	)
 
-	if defaultBag, err = b.GetDefaultBag(username); err != nil {
+	if defaultBag, err = b.GetDefaultBag(ctx, username); err != nil {
 		return fmt.Errorf("error deleting default bag for %s: %w", username, err)
 	}
 
-	return b.DeleteBag(username, defaultBag.ID)
+	return b.DeleteBag(ctx, username, defaultBag.ID)
 }
 
 // DeleteAllBags deletes all of the bags for the specified user.
-func (b *BagsAPI) DeleteAllBags(username string) error {
+func (b *BagsAPI) DeleteAllBags(ctx context.Context, username string) error {
+	ctx, done := startOperation(ctx, "BagsAPI.DeleteAllBags")
+	defer done()
+
 	query := `DELETE FROM ONLY bags WHERE user_id = $1`
 
-	userID, err := queries.UserID(b.db, username)
+	event := newChangeEvent(ctx, username, "bags", "delete_all", nil)
+	return withEvent(ctx, b.db, event, "", func(tx *tracedTx) (string, error) {
+		userID, err := lookupUserID(ctx, tx, username)
+		if err != nil {
+			return "", fmt.Errorf("error looking up the user ID for %s: %w", username, err)
+		}
+
+		before, err := lockBags(ctx, tx, userID)
+		if err != nil {
+			return "", fmt.Errorf("error getting the bags for %s: %w", username, err)
+		}
+
+		if _, err = tx.ExecContext(ctx, query, userID); err != nil {
+			return "", fmt.Errorf("error deleting all bags for %s: %w", username, err)
+		}
+
+		return before, nil
+	})
+}
+
+// lockBag locks one of the user's bags and returns its contents for the audit
+// log, or an empty string if the user doesn't have the bag.
+func lockBag(ctx context.Context, tx *tracedTx, userID, bagID string) (string, error) {
+	var contents string
+	err := tx.QueryRowContext(ctx, `SELECT contents FROM bags WHERE id = $1 AND user_id = $2 FOR UPDATE`, bagID, userID).Scan(&contents)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
 	if err != nil {
-		return fmt.Errorf("error from queries.UserID for %s: %w", username, err)
+		return "", err
 	}
+	return bagAuditDocument(contents), nil
+}
 
-	if _, err = b.db.Exec(query, userID); err != nil {
-		return fmt.Errorf("error deleting all bags for %s: %w", username, err)
+// lockBags locks all of the user's bags and returns their contents for the
+// audit log.
+func lockBags(ctx context.Context, tx *tracedTx, userID string) (string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, contents FROM bags WHERE user_id = $1 FOR UPDATE`, userID)
+	if err != nil {
+		return "", err
 	}
+	defer rows.Close()
 
-	return nil
+	bags := make(map[string]string)
+	for rows.Next() {
+		var id, contents string
+		if err = rows.Scan(&id, &contents); err != nil {
+			return "", err
+		}
+		bags[id] = contents
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+	return bagsAuditDocument(bags), nil
 }
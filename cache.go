@@ -0,0 +1,526 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// The kinds of cached values. Each kind has its own LRU so that a burst of
+// one kind of read doesn't evict everything else.
+const (
+	cacheUsers       = "users"
+	cachePreferences = "preferences"
+	cacheSessions    = "sessions"
+	cacheSearches    = "searches"
+)
+
+var (
+	cacheHits = metrics.NewCounterVec(
+		"user_info_cache_hits_total",
+		"Number of reads served from the cache, by cache.",
+		"cache",
+	)
+	cacheMisses = metrics.NewCounterVec(
+		"user_info_cache_misses_total",
+		"Number of reads that weren't in the cache, by cache.",
+		"cache",
+	)
+	cacheInvalidations = metrics.NewCounterVec(
+		"user_info_cache_invalidations_total",
+		"Number of cache entries invalidated, by cache and source.",
+		"cache", "source",
+	)
+)
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// lruCache is a size-limited cache whose entries also expire after a TTL.
+type lruCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	order      *list.List
+	entries    map[string]*list.Element
+	now        func() time.Time
+}
+
+func newLRUCache(maxEntries int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+		now:        time.Now,
+	}
+}
+
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*lruEntry)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+func (c *lruCache) set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+func (c *lruCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// Cache holds the read caches for each kind of value, keyed by username.
+// Writes invalidate the local entry and, when a publisher is set, the entries
+// held by the other replicas.
+//
+// A read that races with a write on another replica can still put a stale
+// value in the cache, so the TTL bounds how long a stale value can be served.
+type Cache struct {
+	caches  map[string]*lruCache
+	publish func(ctx context.Context, key string) error
+}
+
+// NewCache returns a new *Cache where each kind of value is limited to
+// maxEntries entries that live for at most ttl.
+func NewCache(maxEntries int, ttl time.Duration) *Cache {
+	c := &Cache{caches: make(map[string]*lruCache)}
+	for _, kind := range []string{cacheUsers, cachePreferences, cacheSessions, cacheSearches} {
+		c.caches[kind] = newLRUCache(maxEntries, ttl)
+	}
+	return c
+}
+
+// cacheChannel is the channel that cache invalidations are sent on. It's set
+// from user_info.cache.channel by configureCacheChannel.
+var cacheChannel = "user_info_cache"
+
+// configureCacheChannel loads the cache invalidation channel from the
+// configuration. It's needed whether or not this process caches anything,
+// since the stores that change many documents at once notify the other
+// replicas themselves.
+func configureCacheChannel(cfg *viper.Viper) {
+	cfg.SetDefault("user_info.cache.channel", "user_info_cache")
+	cacheChannel = cfg.GetString("user_info.cache.channel")
+}
+
+// notifyInvalidation sends an invalidation for the user's cached entry from
+// inside a transaction. Postgres only delivers it if the transaction commits,
+// so no replica drops an entry for a change that was rolled back or keeps one
+// that was replaced.
+func notifyInvalidation(ctx context.Context, q queryer, kind, username string) error {
+	_, err := q.ExecContext(ctx, `SELECT pg_notify($1, $2)`, cacheChannel, kind+":"+username)
+	return err
+}
+
+// NewCacheFromConfig returns a new *Cache configured from the user_info.cache
+// section of the configuration, or nil if caching is disabled. Caching is off
+// unless it's turned on: other DE services write to the same tables without
+// sending invalidations, so what they write can be hidden for up to the TTL.
+func NewCacheFromConfig(cfg *viper.Viper) *Cache {
+	cfg.SetDefault("user_info.cache.enabled", false)
+	cfg.SetDefault("user_info.cache.max_entries", 10000)
+	cfg.SetDefault("user_info.cache.ttl", "30s")
+	cfg.SetDefault("user_info.cache.channel", "user_info_cache")
+
+	if !cfg.GetBool("user_info.cache.enabled") {
+		return nil
+	}
+	return NewCache(cfg.GetInt("user_info.cache.max_entries"), cfg.GetDuration("user_info.cache.ttl"))
+}
+
+func (c *Cache) get(kind, username string) (interface{}, bool) {
+	value, ok := c.caches[kind].get(username)
+	if ok {
+		cacheHits.Inc(kind)
+	} else {
+		cacheMisses.Inc(kind)
+	}
+	return value, ok
+}
+
+func (c *Cache) set(kind, username string, value interface{}) {
+	c.caches[kind].set(username, value)
+}
+
+// invalidate removes the user's entry locally and asks the other replicas to
+// do the same. Failing to notify them is logged rather than returned, since
+// the write itself has already succeeded.
+func (c *Cache) invalidate(ctx context.Context, kind, username string) {
+	c.caches[kind].remove(username)
+	cacheInvalidations.Inc(kind, "local")
+
+	if c.publish != nil {
+		if err := c.publish(ctx, kind+":"+username); err != nil {
+			contextLog(ctx).Errorf("error publishing cache invalidation for %s %s: %s", kind, username, err)
+		}
+	}
+}
+
+// forget removes the user's entry locally without notifying the other
+// replicas, for writes whose stores notify them on their own.
+func (c *Cache) forget(kind, username string) {
+	c.caches[kind].remove(username)
+	cacheInvalidations.Inc(kind, "local")
+}
+
+// handleInvalidation removes the entry named by a "<kind>:<username>"
+// message received from another replica.
+func (c *Cache) handleInvalidation(message string) {
+	i := strings.Index(message, ":")
+	if i < 0 {
+		log.Warnf("ignoring malformed cache invalidation %q", message)
+		return
+	}
+	if cache, ok := c.caches[message[:i]]; ok {
+		cache.remove(message[i+1:])
+		cacheInvalidations.Inc(message[:i], "remote")
+	}
+}
+
+// purge empties every cache.
+func (c *Cache) purge() {
+	for _, cache := range c.caches {
+		cache.purge()
+	}
+}
+
+// CacheListener relays cache invalidations between replicas using Postgres
+// LISTEN/NOTIFY.
+type CacheListener struct {
+	cache    *Cache
+	listener *pq.Listener
+	done     chan struct{}
+}
+
+// ListenForInvalidations starts listening for invalidations on the channel and
+// makes the cache publish its own invalidations there. Every cache is purged
+// whenever the listener reconnects, since notifications sent while it was
+// disconnected are lost.
+func ListenForInvalidations(cache *Cache, db queryer, dburi, channel string) (*CacheListener, error) {
+	listener := pq.NewListener(dburi, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Errorf("cache invalidation listener: %s", err)
+		}
+	})
+	if err := listener.Listen(channel); err != nil {
+		listener.Close() // nolint:errcheck
+		return nil, err
+	}
+
+	cache.publish = func(ctx context.Context, key string) error {
+		_, err := db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, channel, key)
+		return err
+	}
+
+	l := &CacheListener{cache: cache, listener: listener, done: make(chan struct{})}
+	go l.run()
+	return l, nil
+}
+
+func (l *CacheListener) run() {
+	defer close(l.done)
+	for notification := range l.listener.Notify {
+		// A nil notification means the connection was re-established.
+		if notification == nil {
+			l.cache.purge()
+			continue
+		}
+		l.cache.handleInvalidation(notification.Extra)
+	}
+}
+
+// Close stops listening for invalidations.
+func (l *CacheListener) Close(ctx context.Context) error {
+	err := l.listener.Close()
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+	}
+	return err
+}
+
+// cachedUsers caches positive isUser results. Users are never renamed or
+// removed through this service, so there's nothing to invalidate.
+type cachedUsers struct {
+	cache      *Cache
+	isUserFunc func(context.Context, string) (bool, error)
+}
+
+func (u cachedUsers) isUser(ctx context.Context, username string) (bool, error) {
+	if _, ok := u.cache.get(cacheUsers, username); ok {
+		return true, nil
+	}
+	exists, err := u.isUserFunc(ctx, username)
+	if err == nil && exists {
+		u.cache.set(cacheUsers, username, true)
+	}
+	return exists, err
+}
+
+// cachedPrefs is a pDB that caches preferences.
+type cachedPrefs struct {
+	pDB
+	users cachedUsers
+	cache *Cache
+}
+
+func (p *cachedPrefs) isUser(ctx context.Context, username string) (bool, error) {
+	return p.users.isUser(ctx, username)
+}
+
+func (p *cachedPrefs) hasPreferences(ctx context.Context, username string) (bool, error) {
+	prefs, err := p.getPreferences(ctx, username)
+	return len(prefs) > 0, err
+}
+
+func (p *cachedPrefs) getPreferences(ctx context.Context, username string) ([]UserPreferencesRecord, error) {
+	if value, ok := p.cache.get(cachePreferences, username); ok {
+		return value.([]UserPreferencesRecord), nil
+	}
+	prefs, err := p.pDB.getPreferences(ctx, username)
+	if err == nil {
+		p.cache.set(cachePreferences, username, prefs)
+	}
+	return prefs, err
+}
+
+func (p *cachedPrefs) insertPreferences(ctx context.Context, username, prefs string) error {
+	defer p.cache.invalidate(ctx, cachePreferences, username)
+	return p.pDB.insertPreferences(ctx, username, prefs)
+}
+
+func (p *cachedPrefs) updatePreferences(ctx context.Context, username, prefs string) error {
+	defer p.cache.invalidate(ctx, cachePreferences, username)
+	return p.pDB.updatePreferences(ctx, username, prefs)
+}
+
+func (p *cachedPrefs) deletePreferences(ctx context.Context, username string) error {
+	defer p.cache.invalidate(ctx, cachePreferences, username)
+	return p.pDB.deletePreferences(ctx, username)
+}
+
+// cachedSessions is an sDB that caches sessions.
+type cachedSessions struct {
+	sDB
+	users cachedUsers
+	cache *Cache
+}
+
+func (s *cachedSessions) isUser(ctx context.Context, username string) (bool, error) {
+	return s.users.isUser(ctx, username)
+}
+
+func (s *cachedSessions) hasSessions(ctx context.Context, username string) (bool, error) {
+	sessions, err := s.getSessions(ctx, username)
+	return len(sessions) > 0, err
+}
+
+func (s *cachedSessions) getSessions(ctx context.Context, username string) ([]UserSessionRecord, error) {
+	if value, ok := s.cache.get(cacheSessions, username); ok {
+		return value.([]UserSessionRecord), nil
+	}
+	sessions, err := s.sDB.getSessions(ctx, username)
+	if err == nil {
+		s.cache.set(cacheSessions, username, sessions)
+	}
+	return sessions, err
+}
+
+func (s *cachedSessions) insertSession(ctx context.Context, username, session string) error {
+	defer s.cache.invalidate(ctx, cacheSessions, username)
+	return s.sDB.insertSession(ctx, username, session)
+}
+
+func (s *cachedSessions) updateSession(ctx context.Context, username, session string) error {
+	defer s.cache.invalidate(ctx, cacheSessions, username)
+	return s.sDB.updateSession(ctx, username, session)
+}
+
+func (s *cachedSessions) deleteSession(ctx context.Context, username string) error {
+	defer s.cache.invalidate(ctx, cacheSessions, username)
+	return s.sDB.deleteSession(ctx, username)
+}
+
+// cachedSearches is a seDB that caches saved searches.
+type cachedSearches struct {
+	seDB
+	users cachedUsers
+	cache *Cache
+}
+
+func (se *cachedSearches) isUser(ctx context.Context, username string) (bool, error) {
+	return se.users.isUser(ctx, username)
+}
+
+func (se *cachedSearches) hasSavedSearches(ctx context.Context, username string) (bool, error) {
+	searches, err := se.getSavedSearches(ctx, username)
+	return len(searches) > 0, err
+}
+
+func (se *cachedSearches) getSavedSearches(ctx context.Context, username string) ([]string, error) {
+	if value, ok := se.cache.get(cacheSearches, username); ok {
+		return value.([]string), nil
+	}
+	searches, err := se.seDB.getSavedSearches(ctx, username)
+	if err == nil {
+		se.cache.set(cacheSearches, username, searches)
+	}
+	return searches, err
+}
+
+func (se *cachedSearches) insertSavedSearches(ctx context.Context, username, searches string) error {
+	defer se.cache.invalidate(ctx, cacheSearches, username)
+	return se.seDB.insertSavedSearches(ctx, username, searches)
+}
+
+func (se *cachedSearches) updateSavedSearches(ctx context.Context, username, searches string) error {
+	defer se.cache.invalidate(ctx, cacheSearches, username)
+	return se.seDB.updateSavedSearches(ctx, username, searches)
+}
+
+func (se *cachedSearches) deleteSavedSearches(ctx context.Context, username string) error {
+	defer se.cache.invalidate(ctx, cacheSearches, username)
+	return se.seDB.deleteSavedSearches(ctx, username)
+}
+
+// cachedBags is a bDB whose user checks are cached. Bags themselves aren't.
+type cachedBags struct {
+	bDB
+	users cachedUsers
+}
+
+func (b *cachedBags) IsUser(ctx context.Context, username string) (bool, error) {
+	return b.users.isUser(ctx, username)
+}
+
+// documentCaches are the caches that hold a user's documents.
+var documentCaches = []string{cachePreferences, cacheSessions, cacheSearches}
+
+// cachedPurges is a purgeDB that drops everything cached for a user once
+// their data has been purged. The other replicas are notified by the purge
+// itself.
+type cachedPurges struct {
+	purgeDB
+	cache *Cache
+}
+
+func (p *cachedPurges) purgeUser(ctx context.Context, username string, dryRun bool, entry *AuditEntry) (*PurgeReport, error) {
+	report, err := p.purgeDB.purgeUser(ctx, username, dryRun, entry)
+	if err == nil && !dryRun {
+		for _, kind := range documentCaches {
+			p.cache.forget(kind, username)
+		}
+	}
+	return report, err
+}
+
+// cachedMerges is a mergeDB that drops everything cached for both users once
+// one has been merged into the other. The other replicas are notified by the
+// merge itself.
+type cachedMerges struct {
+	mergeDB
+	cache *Cache
+}
+
+func (m *cachedMerges) mergeUsers(ctx context.Context, source, target, policy string, entry *AuditEntry) (*MergeReport, error) {
+	report, err := m.mergeDB.mergeUsers(ctx, source, target, policy, entry)
+	if err == nil {
+		for _, username := range []string{source, target} {
+			for _, kind := range documentCaches {
+				m.cache.forget(kind, username)
+			}
+		}
+	}
+	return report, err
+}
+
+// importCaches are the caches that hold each kind of imported document.
+var importCaches = map[string]string{
+	"preferences": cachePreferences,
+	"sessions":    cacheSessions,
+	"searches":    cacheSearches,
+}
+
+// cachedImports is an importDB that drops the cached documents that an import
+// replaced. The other replicas are notified by the import itself.
+type cachedImports struct {
+	importDB
+	cache *Cache
+}
+
+func (i *cachedImports) importRecords(ctx context.Context, records []ImportRecord, policy string, dryRun bool, entry *AuditEntry) (*ImportBatch, error) {
+	batch, err := i.importDB.importRecords(ctx, records, policy, dryRun, entry)
+	if err == nil && !dryRun {
+		for n, outcome := range batch.Outcomes {
+			kind, ok := importCaches[records[n].Resource]
+			if ok && (outcome == importCreated || outcome == importUpdated) {
+				i.cache.forget(kind, records[n].Username)
+			}
+		}
+	}
+	return batch, err
+}
+
+// UseCache puts the cache in front of the stores that it supports.
+func (s *Storage) UseCache(cache *Cache) {
+	users := cachedUsers{cache: cache, isUserFunc: s.Users.isUser}
+	s.Preferences = &cachedPrefs{pDB: s.Preferences, users: users, cache: cache}
+	s.Sessions = &cachedSessions{sDB: s.Sessions, users: users, cache: cache}
+	s.Searches = &cachedSearches{seDB: s.Searches, users: users, cache: cache}
+	s.Bags = &cachedBags{bDB: s.Bags, users: users}
+	s.Purges = &cachedPurges{purgeDB: s.Purges, cache: cache}
+	s.Merges = &cachedMerges{mergeDB: s.Merges, cache: cache}
+	s.Imports = &cachedImports{importDB: s.Imports, cache: cache}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ChangeNotifier wakes up the change streams of a user whenever that user's
+// data changes.
+type ChangeNotifier struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan struct{}]bool
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewChangeNotifier returns a new *ChangeNotifier.
+func NewChangeNotifier() *ChangeNotifier {
+	return &ChangeNotifier{
+		subscribers: make(map[string]map[chan struct{}]bool),
+		closed:      make(chan struct{}),
+	}
+}
+
+// subscribe returns a channel that receives a value whenever the user's data
+// changes, and a function that must be called to stop receiving them. Changes
+// that happen in quick succession may be combined into a single value.
+func (n *ChangeNotifier) subscribe(username string) (<-chan struct{}, func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	wake := make(chan struct{}, 1)
+	if n.subscribers[username] == nil {
+		n.subscribers[username] = make(map[chan struct{}]bool)
+	}
+	n.subscribers[username][wake] = true
+
+	return wake, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.subscribers[username], wake)
+		if len(n.subscribers[username]) == 0 {
+			delete(n.subscribers, username)
+		}
+	}
+}
+
+func wakeUp(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// notify wakes up the user's change streams.
+func (n *ChangeNotifier) notify(username string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for wake := range n.subscribers[username] {
+		wakeUp(wake)
+	}
+}
+
+// notifyAll wakes up every change stream, for when changes may have been
+// missed.
+func (n *ChangeNotifier) notifyAll() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, subscribers := range n.subscribers {
+		for wake := range subscribers {
+			wakeUp(wake)
+		}
+	}
+}
+
+// Close ends every change stream, which would otherwise hold up a graceful
+// shutdown until the deadline. Clients reconnect to another replica and
+// resume from the last event they received.
+func (n *ChangeNotifier) Close() {
+	n.closeOnce.Do(func() {
+		close(n.closed)
+	})
+}
+
+// localChangeSource is implemented by the storage backends that live in this
+// process and can report their own changes.
+type localChangeSource interface {
+	onChange(fn func(username string))
+}
+
+// ChangeListener relays the changes made on every replica to a notifier
+// using Postgres LISTEN/NOTIFY.
+type ChangeListener struct {
+	notifier *ChangeNotifier
+	listener *pq.Listener
+	done     chan struct{}
+}
+
+// WatchChanges makes the notifier hear about every change made to the
+// storage. For Postgres, that means listening on changesChannel, and the
+// returned listener must be closed when it's no longer needed. The other
+// backends report their changes directly and nil is returned.
+func WatchChanges(storage *Storage, notifier *ChangeNotifier, dburi string) (*ChangeListener, error) {
+	if source, ok := storage.Changes.(localChangeSource); ok {
+		source.onChange(notifier.notify)
+		return nil, nil
+	}
+
+	listener := pq.NewListener(dburi, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Errorf("change listener: %s", err)
+		}
+	})
+	if err := listener.Listen(changesChannel); err != nil {
+		listener.Close() // nolint:errcheck
+		return nil, err
+	}
+
+	l := &ChangeListener{notifier: notifier, listener: listener, done: make(chan struct{})}
+	go l.run()
+	return l, nil
+}
+
+func (l *ChangeListener) run() {
+	defer close(l.done)
+	for notification := range l.listener.Notify {
+		// A nil notification means the connection was re-established, and
+		// anything sent in the meantime was lost.
+		if notification == nil {
+			l.notifier.notifyAll()
+			continue
+		}
+		l.notifier.notify(notification.Extra)
+	}
+}
+
+// Close stops listening for changes.
+func (l *ChangeListener) Close(ctx context.Context) error {
+	err := l.listener.Close()
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+	}
+	return err
+}
+
+// changeBatchSize is how many changes a stream reads from the change log at a
+// time.
+const changeBatchSize = 100
+
+// ChangeStreamApp streams the changes to a user's data as Server-Sent Events.
+type ChangeStreamApp struct {
+	changes   changesDB
+	users     uDB
+	notifier  *ChangeNotifier
+	router    *mux.Router
+	keepalive time.Duration
+	maxAge    time.Duration
+	retry     time.Duration
+}
+
+// NewChangeStreamApp returns a new *ChangeStreamApp configured from the
+// user_info.changes section of the configuration. Streams are ended before
+// the server's read or write timeout would cut them off, and clients are
+// expected to reconnect.
+func NewChangeStreamApp(cfg *viper.Viper, changes changesDB, users uDB, notifier *ChangeNotifier, router *mux.Router) *ChangeStreamApp {
+	cfg.SetDefault("user_info.changes.keepalive", "15s")
+	cfg.SetDefault("user_info.changes.max_stream_duration", "10m")
+	cfg.SetDefault("user_info.changes.retry", "2s")
+
+	maxAge := cfg.GetDuration("user_info.changes.max_stream_duration")
+	for _, key := range []string{"user_info.server.read_timeout", "user_info.server.write_timeout"} {
+		if timeout := cfg.GetDuration(key); timeout > 0 {
+			if limit := timeout - timeout/10; maxAge <= 0 || maxAge > limit {
+				maxAge = limit
+			}
+		}
+	}
+
+	changeStreamApp := &ChangeStreamApp{
+		changes:   changes,
+		users:     users,
+		notifier:  notifier,
+		router:    router,
+		keepalive: cfg.GetDuration("user_info.changes.keepalive"),
+		maxAge:    maxAge,
+		retry:     cfg.GetDuration("user_info.changes.retry"),
+	}
+	changeStreamApp.router.HandleFunc("/users/{username}/events", changeStreamApp.GetEvents).Methods(http.MethodGet)
+	return changeStreamApp
+}
+
+// lastEventID returns the ID that the stream resumes after, from the
+// Last-Event-ID header or the last_event_id query parameter, and whether
+// either was set.
+func lastEventID(r *http.Request) (int64, bool, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	if value == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false, fmt.Errorf("invalid event ID %q", value)
+	}
+	return id, true, nil
+}
+
+// changeStream writes change events to a single client.
+type changeStream struct {
+	writer    http.ResponseWriter
+	flusher   http.Flusher
+	documents bool
+	last      int64
+}
+
+func (s *changeStream) write(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(s.writer, format, args...); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// send writes out every change after the last one sent.
+func (s *changeStream) send(ctx context.Context, changes changesDB, username string) error {
+	for {
+		batch, err := changes.userChanges(ctx, username, s.last, changeBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, change := range batch {
+			if !s.documents {
+				change.Document = nil
+			}
+			data, err := json.Marshal(change)
+			if err != nil {
+				return err
+			}
+			if err = s.write("id: %d\ndata: %s\n\n", change.ID, data); err != nil {
+				return err
+			}
+			s.last = change.ID
+		}
+		if len(batch) < changeBatchSize {
+			return nil
+		}
+	}
+}
+
+// GetEvents streams the changes to the user's data. Each event carries the
+// resource and operation, the ETag of the new document and, with
+// ?documents=true, the document itself. The ID of each event can be passed
+// back in Last-Event-ID to resume the stream; without one, only changes made
+// after the request are sent.
+func (c *ChangeStreamApp) GetEvents(writer http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	documents := false
+	if value := r.URL.Query().Get("documents"); value != "" {
+		var err error
+		if documents, err = strconv.ParseBool(value); err != nil {
+			badRequest(writer, r, fmt.Sprintf("invalid documents value %q", value))
+			return
+		}
+	}
+
+	last, resume, err := lastEventID(r)
+	if err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	userExists, err := c.users.isUser(r.Context(), username)
+	if err != nil {
+		errored(writer, r, fmt.Sprintf("error checking for username %s: %s", username, err))
+		return
+	}
+	if !userExists {
+		handleNonUser(writer, r, username)
+		return
+	}
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		errored(writer, r, "the response writer doesn't support streaming")
+		return
+	}
+
+	// Subscribing before looking at the change log means that nothing made in
+	// between is missed.
+	wake, unsubscribe := c.notifier.subscribe(username)
+	defer unsubscribe()
+
+	if !resume {
+		if last, err = c.changes.lastChangeID(r.Context()); err != nil {
+			errored(writer, r, fmt.Sprintf("error reading the change log: %s", err))
+			return
+		}
+	}
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+
+	stream := &changeStream{writer: writer, flusher: flusher, documents: documents, last: last}
+	if err = stream.write("retry: %d\n\n", c.retry.Milliseconds()); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(c.keepalive)
+	defer keepalive.Stop()
+
+	var expired <-chan time.Time
+	if c.maxAge > 0 {
+		timer := time.NewTimer(c.maxAge)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		if err = stream.send(r.Context(), c.changes, username); err != nil {
+			if r.Context().Err() == nil {
+				requestLog(r).Errorf("error streaming changes for %s: %s", username, err)
+			}
+			return
+		}
+
+		select {
+		case <-wake:
+		case <-keepalive.C:
+			// The change log is checked again as well, in case a notification
+			// was lost.
+			if err = stream.write(": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-expired:
+			return
+		case <-c.notifier.closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// The limits on how many changes a single page of the change feed returns.
+const (
+	defaultChangeFeedLimit = 100
+	maxChangeFeedLimit     = 1000
+)
+
+// ChangeFeedApp lets administrators read every change to everyone's data, so
+// that other services can keep a copy of it.
+type ChangeFeedApp struct {
+	changes changesDB
+	router  *mux.Router
+}
+
+// NewChangeFeedApp returns a new *ChangeFeedApp.
+func NewChangeFeedApp(changes changesDB, router *mux.Router) *ChangeFeedApp {
+	changeFeedApp := &ChangeFeedApp{
+		changes: changes,
+		router:  router,
+	}
+	changeFeedApp.router.HandleFunc("/changes", changeFeedApp.GetChanges).Methods(http.MethodGet)
+	return changeFeedApp
+}
+
+// ChangeFeedPage is a page of the change feed. The cursor is passed back in
+// ?since= to get the next page, and stays the same when there's nothing new.
+type ChangeFeedPage struct {
+	Changes []ChangeRecord `json:"changes"`
+	Cursor  int64          `json:"cursor"`
+}
+
+// GetChanges returns the changes after the ?since= cursor, oldest first. Only
+// the latest change to each record is kept, so a consumer that starts from 0
+// and follows the cursor ends up with the current data, and deletes show up
+// as tombstones until they pass the retention period.
+func (c *ChangeFeedApp) GetChanges(writer http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var since int64
+	if value := query.Get("since"); value != "" {
+		var err error
+		if since, err = strconv.ParseInt(value, 10, 64); err != nil || since < 0 {
+			badRequest(writer, r, fmt.Sprintf("invalid cursor %q", value))
+			return
+		}
+	}
+
+	limit := defaultChangeFeedLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxChangeFeedLimit {
+			badRequest(writer, r, fmt.Sprintf("invalid limit %q; use a number from 1 to %d", value, maxChangeFeedLimit))
+			return
+		}
+	}
+
+	changes, err := c.changes.changesSince(r.Context(), since, limit)
+	if err != nil {
+		errored(writer, r, fmt.Sprintf("error reading the change log: %s", err))
+		return
+	}
+
+	page := &ChangeFeedPage{Changes: changes, Cursor: since}
+	if len(changes) > 0 {
+		page.Cursor = changes[len(changes)-1].ID
+	}
+	writeJSON(writer, r, page)
+}
+
+// ChangeRetention periodically deletes the tombstones in the change log that
+// are older than the retention period.
+type ChangeRetention struct {
+	changes   changesDB
+	retention time.Duration
+	interval  time.Duration
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewChangeRetentionFromConfig starts pruning tombstones according to
+// user_info.changes.tombstone_retention, or returns nil if the retention is
+// zero, which keeps them forever. Consumers of the change feed that fall
+// further behind than the retention period miss deletes and have to start
+// over from the beginning.
+func NewChangeRetentionFromConfig(cfg *viper.Viper, changes changesDB) *ChangeRetention {
+	cfg.SetDefault("user_info.changes.tombstone_retention", "168h")
+	cfg.SetDefault("user_info.changes.prune_interval", "1h")
+
+	retention := cfg.GetDuration("user_info.changes.tombstone_retention")
+	if retention <= 0 {
+		return nil
+	}
+
+	r := &ChangeRetention{
+		changes:   changes,
+		retention: retention,
+		interval:  cfg.GetDuration("user_info.changes.prune_interval"),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// prune deletes the tombstones that have passed the retention period.
+func (r *ChangeRetention) prune(ctx context.Context) {
+	pruned, err := r.changes.pruneTombstones(ctx, time.Now().Add(-r.retention))
+	if err != nil {
+		log.Errorf("error pruning the change log: %s", err)
+		return
+	}
+	if pruned > 0 {
+		log.Infof("pruned %d tombstones older than %s from the change log", pruned, r.retention)
+	}
+}
+
+func (r *ChangeRetention) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	r.prune(context.Background())
+	for {
+		select {
+		case <-ticker.C:
+			r.prune(context.Background())
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Close stops pruning tombstones.
+func (r *ChangeRetention) Close(ctx context.Context) error {
+	close(r.stop)
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// changesChannel is the Postgres notification channel that announces changes
+// to a user's data. The payload is the username.
+const changesChannel = "user_info_changes"
+
+// changeLogLockKey is the Postgres advisory lock held while positions are
+// assigned to the changes in the log. Only readers of the log take it.
+const changeLogLockKey = 4315736292
+
+// ChangeRecord is an entry in the change log, which holds the latest change to
+// each record of each user's data. The record ID tells a user's bags apart
+// and is empty for the other resources. The document is the data of the event
+// that described the change, and the ETag identifies it.
+//
+// Changes are numbered in the order they were committed, so the ID doubles as
+// a cursor into the log. Deletes are kept as tombstones for a while so that
+// readers of the log find out about them. Deleting all of a user's bags or
+// purging a user leaves a single tombstone that stands for every record it
+// supersedes, rather than one for each.
+type ChangeRecord struct {
+	ID         int64           `json:"id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Username   string          `json:"username"`
+	Resource   string          `json:"resource"`
+	RecordID   string          `json:"record_id,omitempty"`
+	Operation  string          `json:"operation"`
+	Deleted    bool            `json:"deleted,omitempty"`
+	ETag       string          `json:"etag,omitempty"`
+	Document   json.RawMessage `json:"document,omitempty"`
+}
+
+// defaultBagRecordID is the record ID of the changes to which of a user's
+// bags is their default bag.
+const defaultBagRecordID = "default"
+
+// newChangeRecord returns the change log entry for the event. It has no ID
+// until it's stored.
+func newChangeRecord(event *ChangeEvent) (*ChangeRecord, error) {
+	record := &ChangeRecord{
+		OccurredAt: event.OccurredAt,
+		Username:   event.Username,
+		Resource:   event.Resource,
+		Operation:  event.Operation,
+	}
+
+	switch event.Operation {
+	case "delete", "delete_all", "purge":
+		record.Deleted = true
+	}
+	if data, ok := event.Data.(bagEventData); ok {
+		record.RecordID = data.BagID
+	}
+	if event.Operation == "set_default" {
+		record.RecordID = defaultBagRecordID
+	}
+
+	if event.Data != nil {
+		document, err := json.Marshal(event.Data)
+		if err != nil {
+			return nil, err
+		}
+		record.Document = document
+		record.ETag = profileETag(document)
+	}
+	return record, nil
+}
+
+// supersedes returns whether the change makes an earlier change obsolete:
+// one to the same record, to any of the user's bags if all of them were
+// deleted, or to any of the user's data if it was purged.
+func (c *ChangeRecord) supersedes(earlier *ChangeRecord) bool {
+	switch {
+	case earlier.Username != c.Username:
+		return false
+	case c.Resource == "users" && c.Operation == "purge":
+		return true
+	case c.Resource == "bags" && c.Operation == "delete_all":
+		return earlier.Resource == "bags"
+	default:
+		return earlier.Resource == c.Resource && earlier.RecordID == c.RecordID
+	}
+}
+
+// supersededWhere returns the condition that selects the changes that this
+// one supersedes and its arguments, using placeholder to number them.
+func (c *ChangeRecord) supersededWhere(placeholder func(n int) string) (string, []interface{}) {
+	switch {
+	case c.Resource == "users" && c.Operation == "purge":
+		return fmt.Sprintf("username = %s", placeholder(1)), []interface{}{c.Username}
+	case c.Resource == "bags" && c.Operation == "delete_all":
+		return fmt.Sprintf("username = %s AND resource = %s", placeholder(1), placeholder(2)), []interface{}{c.Username, c.Resource}
+	default:
+		return fmt.Sprintf("username = %s AND resource = %s AND record_id = %s", placeholder(1), placeholder(2), placeholder(3)),
+			[]interface{}{c.Username, c.Resource, c.RecordID}
+	}
+}
+
+// documentArg returns the document as a query argument, which is NULL when
+// there's no document.
+func (c *ChangeRecord) documentArg() interface{} {
+	if c.Document == nil {
+		return nil
+	}
+	return string(c.Document)
+}
+
+// changesDB defines the interface for the change log. Changes are added to
+// the log by the stores, in the same transaction as the change itself.
+type changesDB interface {
+	// userChanges returns up to limit of the user's changes that come after
+	// the one with the ID, oldest first.
+	userChanges(ctx context.Context, username string, after int64, limit int) ([]ChangeRecord, error)
+
+	// changesSince returns up to limit of everyone's changes that come after
+	// the one with the ID, oldest first.
+	changesSince(ctx context.Context, after int64, limit int) ([]ChangeRecord, error)
+
+	// lastChangeID returns the ID of the most recent change to anyone's data,
+	// or 0 if the log is empty.
+	lastChangeID(ctx context.Context) (int64, error)
+
+	// pruneTombstones deletes the tombstones of the deletes that occurred
+	// before the cutoff and returns how many it deleted.
+	pruneTombstones(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// insertChange adds the event to the change log, replacing the changes it
+// supersedes, and notifies the listeners on changesChannel, which only
+// happens once the transaction in q commits.
+func insertChange(ctx context.Context, q queryer, event *ChangeEvent) error {
+	record, err := newChangeRecord(event)
+	if err != nil {
+		return err
+	}
+
+	// The change doesn't get its position until it's committed; see
+	// assignPositions.
+	where, args := record.supersededWhere(func(n int) string { return fmt.Sprintf("$%d", n) })
+	if _, err = q.ExecContext(ctx, `DELETE FROM user_changes WHERE `+where, args...); err != nil {
+		return err
+	}
+
+	query := `WITH change AS (
+                  INSERT INTO user_changes (occurred_at, username, resource, record_id, operation, deleted, etag, document)
+                       VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+                    RETURNING username
+              )
+              SELECT pg_notify('` + changesChannel + `', username) FROM change`
+	_, err = q.ExecContext(ctx, query, record.OccurredAt, record.Username, record.Resource, record.RecordID, record.Operation,
+		record.Deleted, record.ETag, record.documentArg())
+	return err
+}
+
+// changeColumns are the columns that scanChanges reads, in order.
+const changeColumns = `id, occurred_at, username, resource, record_id, operation, deleted, etag, document`
+
+// positionedChangeColumns are changeColumns for Postgres, where a change's
+// position in the log stands in for its ID.
+const positionedChangeColumns = `position, occurred_at, username, resource, record_id, operation, deleted, etag, document`
+
+// scanChanges reads change log entries selected with changeColumns.
+func scanChanges(rows *sql.Rows) ([]ChangeRecord, error) {
+	defer rows.Close()
+
+	changes := []ChangeRecord{}
+	for rows.Next() {
+		var (
+			change   ChangeRecord
+			document sql.NullString
+		)
+		err := rows.Scan(&change.ID, &change.OccurredAt, &change.Username, &change.Resource, &change.RecordID, &change.Operation,
+			&change.Deleted, &change.ETag, &document)
+		if err != nil {
+			return nil, err
+		}
+		change.OccurredAt = change.OccurredAt.UTC()
+		if document.Valid {
+			change.Document = exportJSON(document.String)
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// ChangesDB implements the changesDB interface on top of the DE database.
+type ChangesDB struct {
+	db *tracedDB
+}
+
+// NewChangesDB returns a newly created *ChangesDB.
+func NewChangesDB(db *sql.DB) *ChangesDB {
+	return &ChangesDB{
+		db: newTracedDB(db),
+	}
+}
+
+// assignPositions gives the committed changes that don't have a position in
+// the log yet the next ones in line. IDs come from a sequence when a change is
+// inserted, so a transaction can take an ID and commit after a later one, and
+// a reader that had moved past the later ID would never see the change.
+// Positions are only handed out to changes that are already committed, one
+// reader at a time, so they increase in the order the changes became visible
+// without making writers wait on each other.
+func (c *ChangesDB) assignPositions(ctx context.Context) error {
+	var pending bool
+	err := c.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM user_changes WHERE position IS NULL)`).Scan(&pending)
+	if err != nil || !pending {
+		return err
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	if _, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, changeLogLockKey); err != nil {
+		return err
+	}
+	// Within a batch, the changes are numbered in the order of their IDs.
+	// Changes to the same record are made under a lock on the record, so for
+	// them that's also the order they were committed in. Postgres doesn't
+	// promise to call nextval in the order of a subquery that's only used to
+	// pick the rows to update, so the changes are numbered before they're
+	// joined back to the table.
+	query := `UPDATE user_changes
+                 SET position = numbered.position
+                FROM (SELECT id, nextval('user_changes_position_seq') AS position
+                        FROM (SELECT id FROM user_changes WHERE position IS NULL ORDER BY id) AS unnumbered) AS numbered
+               WHERE user_changes.id = numbered.id`
+	if _, err = tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c *ChangesDB) userChanges(ctx context.Context, username string, after int64, limit int) ([]ChangeRecord, error) {
+	ctx, done := startOperation(ctx, "ChangesDB.userChanges")
+	defer done()
+
+	if err := c.assignPositions(ctx); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + positionedChangeColumns + ` FROM user_changes
+               WHERE username = $1 AND position > $2
+               ORDER BY position LIMIT $3`
+	rows, err := c.db.QueryContext(ctx, query, username, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanChanges(rows)
+}
+
+func (c *ChangesDB) changesSince(ctx context.Context, after int64, limit int) ([]ChangeRecord, error) {
+	ctx, done := startOperation(ctx, "ChangesDB.changesSince")
+	defer done()
+
+	if err := c.assignPositions(ctx); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + positionedChangeColumns + ` FROM user_changes WHERE position > $1 ORDER BY position LIMIT $2`
+	rows, err := c.db.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanChanges(rows)
+}
+
+func (c *ChangesDB) lastChangeID(ctx context.Context) (int64, error) {
+	ctx, done := startOperation(ctx, "ChangesDB.lastChangeID")
+	defer done()
+
+	if err := c.assignPositions(ctx); err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err := c.db.QueryRowContext(ctx, `SELECT COALESCE(max(position), 0) FROM user_changes`).Scan(&id)
+	return id, err
+}
+
+func (c *ChangesDB) pruneTombstones(ctx context.Context, cutoff time.Time) (int64, error) {
+	ctx, done := startOperation(ctx, "ChangesDB.pruneTombstones")
+	defer done()
+
+	result, err := c.db.ExecContext(ctx, `DELETE FROM user_changes WHERE deleted AND occurred_at < $1`, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
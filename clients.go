@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errClientExists   = errors.New("client already exists")
+	errClientNotFound = errors.New("client not found")
+
+	clientNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	scopePattern      = regexp.MustCompile(`^(\*|[a-z]+:(\*|read|write))$`)
+)
+
+// apiKeyHeader is the header service clients send their API key in. Keys have
+// the form "<client name>.<secret>".
+const apiKeyHeader = "X-Api-Key"
+
+// newAPIKey generates a new random secret for the named client and returns
+// both the full key to hand to the client and the hash to store.
+func newAPIKey(name string) (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	return fmt.Sprintf("%s.%s", name, encoded), hashSecret(encoded), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitAPIKey separates an API key into the client name and the secret.
+func splitAPIKey(key string) (string, string, bool) {
+	i := strings.Index(key, ".")
+	if i < 1 || i == len(key)-1 {
+		return "", "", false
+	}
+	return key[:i], key[i+1:], true
+}
+
+// authenticateClient looks up the client named in the API key and checks the
+// key's secret against the stored hash.
+func authenticateClient(ctx context.Context, clients cDB, key string) (*ServiceClientRecord, error) {
+	name, secret, ok := splitAPIKey(key)
+	if !ok {
+		return nil, errors.New("malformed API key")
+	}
+
+	client, err := clients.getClient(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up client %s: %w", name, err)
+	}
+
+	// Hash the secret even when the client doesn't exist so that response
+	// times don't reveal which client names are valid.
+	hashed := hashSecret(secret)
+	if client == nil || subtle.ConstantTimeCompare([]byte(hashed), []byte(client.KeyHash)) != 1 {
+		return nil, errors.New("invalid API key")
+	}
+
+	return client, nil
+}
+
+// routeResources are the routes that don't belong to the first segment of
+// their path. Exporting and purging a user's data get resources of their own
+// so that a client that can read or write profiles can't also do either.
+var routeResources = map[string]string{
+	"/users/{username}/export": "export",
+	"/users/{username}/data":   "purge",
+}
+
+// routeResource returns the resource a route template belongs to, which is
+// the first segment of its path, for example "preferences" for
+// "/preferences/{username}", unless it's one of the routeResources.
+func routeResource(tpl string) string {
+	if resource, ok := routeResources[tpl]; ok {
+		return resource
+	}
+	tpl = strings.TrimPrefix(tpl, "/")
+	if i := strings.Index(tpl, "/"); i >= 0 {
+		tpl = tpl[:i]
+	}
+	return tpl
+}
+
+// adminResources are the resources that only administrators, and service
+// clients with the matching scope, may access.
+var adminResources = map[string]bool{
+	"admin":   true,
+	"changes": true,
+	"purge":   true,
+}
+
+// methodAction returns the scope action that an HTTP method requires.
+func methodAction(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return "read"
+	default:
+		return "write"
+	}
+}
+
+// scopesAllow returns true if any of the scopes grants the action on the
+// resource. Scopes look like "preferences:read", "sessions:*" or "*".
+func scopesAllow(scopes []string, resource, action string) bool {
+	for _, scope := range scopes {
+		if scope == "*" {
+			return true
+		}
+		parts := strings.SplitN(scope, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if (parts[0] == resource || parts[0] == "*") && (parts[1] == action || parts[1] == "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceClientsApp contains the routing and request handling code for the
+// administrative service client endpoints.
+type ServiceClientsApp struct {
+	clients cDB
+	router  *mux.Router
+}
+
+// NewServiceClientsApp returns a new *ServiceClientsApp.
+func NewServiceClientsApp(db cDB, router *mux.Router) *ServiceClientsApp {
+	clientsApp := &ServiceClientsApp{
+		clients: db,
+		router:  router,
+	}
+	clientsApp.router.HandleFunc("/admin/clients", clientsApp.ListClients).Methods(http.MethodGet)
+	clientsApp.router.HandleFunc("/admin/clients/{client}", clientsApp.GetClient).Methods(http.MethodGet)
+	clientsApp.router.HandleFunc("/admin/clients/{client}", clientsApp.CreateClient).Methods(http.MethodPut)
+	clientsApp.router.HandleFunc("/admin/clients/{client}", clientsApp.UpdateClient).Methods(http.MethodPost)
+	clientsApp.router.HandleFunc("/admin/clients/{client}/rotate", clientsApp.RotateClient).Methods(http.MethodPost)
+	clientsApp.router.HandleFunc("/admin/clients/{client}", clientsApp.RevokeClient).Methods(http.MethodDelete)
+	return clientsApp
+}
+
+type clientRequest struct {
+	Scopes []string `json:"scopes"`
+}
+
+func readScopes(request *http.Request) ([]string, error) {
+	var body clientRequest
+
+	bodyBuffer, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading body: %w", err)
+	}
+
+	if err = json.Unmarshal(bodyBuffer, &body); err != nil {
+		return nil, fmt.Errorf("error parsing request body: %w", err)
+	}
+
+	if len(body.Scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+
+	for _, scope := range body.Scopes {
+		if !scopePattern.MatchString(scope) {
+			return nil, fmt.Errorf("invalid scope %q", scope)
+		}
+	}
+
+	return body.Scopes, nil
+}
+
+// ListClients lists the active service clients.
+func (c *ServiceClientsApp) ListClients(writer http.ResponseWriter, request *http.Request) {
+	clients, err := c.clients.listClients(request.Context())
+	if err != nil {
+		errored(writer, request, fmt.Sprintf("error listing clients: %s", err))
+		return
+	}
+
+	writeJSON(writer, request, map[string][]ServiceClientRecord{"clients": clients})
+}
+
+// GetClient returns a single service client.
+func (c *ServiceClientsApp) GetClient(writer http.ResponseWriter, request *http.Request) {
+	name := mux.Vars(request)["client"]
+
+	client, err := c.clients.getClient(request.Context(), name)
+	if err != nil {
+		errored(writer, request, fmt.Sprintf("error looking up client %s: %s", name, err))
+		return
+	}
+
+	if client == nil {
+		notFound(writer, request, fmt.Sprintf("client %s does not exist", name))
+		return
+	}
+
+	writeJSON(writer, request, client)
+}
+
+// CreateClient creates a new service client and returns its API key. The key
+// is not stored anywhere and cannot be retrieved again.
+func (c *ServiceClientsApp) CreateClient(writer http.ResponseWriter, request *http.Request) {
+	name := mux.Vars(request)["client"]
+
+	if !clientNamePattern.MatchString(name) {
+		badRequest(writer, request, fmt.Sprintf("invalid client name %q", name))
+		return
+	}
+
+	scopes, err := readScopes(request)
+	if err != nil {
+		badRequest(writer, request, err.Error())
+		return
+	}
+
+	key, keyHash, err := newAPIKey(name)
+	if err != nil {
+		errored(writer, request, fmt.Sprintf("error generating API key for %s: %s", name, err))
+		return
+	}
+
+	err = c.clients.insertClient(request.Context(), name, keyHash, scopes)
+	if err == errClientExists {
+		conflict(writer, request, fmt.Sprintf("client %s already exists", name))
+		return
+	}
+	if err != nil {
+		errored(writer, request, fmt.Sprintf("error creating client %s: %s", name, err))
+		return
+	}
+
+	requestLog(request).WithFields(log.Fields{"service": "clients"}).Infof("created client %s with scopes %v", name, scopes)
+	writer.WriteHeader(http.StatusCreated)
+	writeJSON(writer, request, map[string]interface{}{"name": name, "scopes": scopes, "api_key": key})
+}
+
+// UpdateClient replaces the scopes granted to a service client.
+func (c *ServiceClientsApp) UpdateClient(writer http.ResponseWriter, request *http.Request) {
+	name := mux.Vars(request)["client"]
+
+	scopes, err := readScopes(request)
+	if err != nil {
+		badRequest(writer, request, err.Error())
+		return
+	}
+
+	err = c.clients.updateClientScopes(request.Context(), name, scopes)
+	if err == errClientNotFound {
+		notFound(writer, request, fmt.Sprintf("client %s does not exist", name))
+		return
+	}
+	if err != nil {
+		errored(writer, request, fmt.Sprintf("error updating client %s: %s", name, err))
+		return
+	}
+
+	requestLog(request).WithFields(log.Fields{"service": "clients"}).Infof("updated scopes for client %s to %v", name, scopes)
+	writeJSON(writer, request, map[string]interface{}{"name": name, "scopes": scopes})
+}
+
+// RotateClient replaces a service client's API key with a new one. The old
+// key stops working immediately.
+func (c *ServiceClientsApp) RotateClient(writer http.ResponseWriter, request *http.Request) {
+	name := mux.Vars(request)["client"]
+
+	key, keyHash, err := newAPIKey(name)
+	if err != nil {
+		errored(writer, request, fmt.Sprintf("error generating API key for %s: %s", name, err))
+		return
+	}
+
+	err = c.clients.updateClientKey(request.Context(), name, keyHash)
+	if err == errClientNotFound {
+		notFound(writer, request, fmt.Sprintf("client %s does not exist", name))
+		return
+	}
+	if err != nil {
+		errored(writer, request, fmt.Sprintf("error rotating key for client %s: %s", name, err))
+		return
+	}
+
+	requestLog(request).WithFields(log.Fields{"service": "clients"}).Infof("rotated key for client %s", name)
+	writeJSON(writer, request, map[string]string{"name": name, "api_key": key})
+}
+
+// RevokeClient revokes a service client's credentials.
+func (c *ServiceClientsApp) RevokeClient(writer http.ResponseWriter, request *http.Request) {
+	name := mux.Vars(request)["client"]
+
+	err := c.clients.revokeClient(request.Context(), name)
+	if err == errClientNotFound {
+		notFound(writer, request, fmt.Sprintf("client %s does not exist", name))
+		return
+	}
+	if err != nil {
+		errored(writer, request, fmt.Sprintf("error revoking client %s: %s", name, err))
+		return
+	}
+
+	requestLog(request).WithFields(log.Fields{"service": "clients"}).Infof("revoked client %s", name)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// ServiceClientRecord represents a service client credential stored in the
+// database. Only a hash of the client's API key is ever stored.
+type ServiceClientRecord struct {
+	Name      string    `json:"name"`
+	KeyHash   string    `json:"-"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	RotatedAt time.Time `json:"rotated_at"`
+}
+
+// cDB defines the interface for interacting with the service client storage.
+type cDB interface {
+	getClient(ctx context.Context, name string) (*ServiceClientRecord, error)
+	listClients(ctx context.Context) ([]ServiceClientRecord, error)
+	insertClient(ctx context.Context, name, keyHash string, scopes []string) error
+	updateClientKey(ctx context.Context, name, keyHash string) error
+	updateClientScopes(ctx context.Context, name string, scopes []string) error
+	revokeClient(ctx context.Context, name string) error
+}
+
+// ClientsDB implements the cDB interface for interacting with the
+// service_clients table.
+type ClientsDB struct {
+	db *tracedDB
+}
+
+// NewClientsDB returns a newly created *ClientsDB.
+func NewClientsDB(db *sql.DB) *ClientsDB {
+	return &ClientsDB{
+		db: newTracedDB(db),
+	}
+}
+
+// Scopes are stored as a single space-separated string, the same way they're
+// represented in OAuth2.
+func joinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+func splitScopes(scopes string) []string {
+	return strings.Fields(scopes)
+}
+
+// getClient returns the active client with the given name, or nil if there
+// isn't one.
+func (c *ClientsDB) getClient(ctx context.Context, name string) (*ServiceClientRecord, error) {
+	ctx, done := startOperation(ctx, "ClientsDB.getClient")
+	defer done()
+
+	query := `SELECT name, key_hash, scopes, created_at, rotated_at
+                FROM service_clients
+               WHERE name = $1
+                 AND revoked_at IS NULL`
+
+	var (
+		record ServiceClientRecord
+		scopes string
+	)
+	err := c.db.QueryRowContext(ctx, query, name).Scan(&record.Name, &record.KeyHash, &scopes, &record.CreatedAt, &record.RotatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record.Scopes = splitScopes(scopes)
+	return &record, nil
+}
+
+// listClients returns all of the active clients.
+func (c *ClientsDB) listClients(ctx context.Context) ([]ServiceClientRecord, error) {
+	ctx, done := startOperation(ctx, "ClientsDB.listClients")
+	defer done()
+
+	query := `SELECT name, scopes, created_at, rotated_at
+                FROM service_clients
+               WHERE revoked_at IS NULL
+               ORDER BY name`
+
+	rows, err := c.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []ServiceClientRecord{}
+	for rows.Next() {
+		var (
+			record ServiceClientRecord
+			scopes string
+		)
+		if err = rows.Scan(&record.Name, &scopes, &record.CreatedAt, &record.RotatedAt); err != nil {
+			return nil, err
+		}
+		record.Scopes = splitScopes(scopes)
+		clients = append(clients, record)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+// insertClient adds a new client to the database. A previously revoked client
+// with the same name is replaced.
+func (c *ClientsDB) insertClient(ctx context.Context, name, keyHash string, scopes []string) error {
+	ctx, done := startOperation(ctx, "ClientsDB.insertClient")
+	defer done()
+
+	query := `INSERT INTO service_clients (name, key_hash, scopes, created_at, rotated_at)
+                   VALUES ($1, $2, $3, now(), now())
+              ON CONFLICT (name) DO UPDATE
+                      SET key_hash = $2,
+                          scopes = $3,
+                          created_at = now(),
+                          rotated_at = now(),
+                          revoked_at = NULL
+                    WHERE service_clients.revoked_at IS NOT NULL`
+	result, err := c.db.ExecContext(ctx, query, name, keyHash, joinScopes(scopes))
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, errClientExists)
+}
+
+// updateClientKey replaces the key hash for an active client.
+func (c *ClientsDB) updateClientKey(ctx context.Context, name, keyHash string) error {
+	ctx, done := startOperation(ctx, "ClientsDB.updateClientKey")
+	defer done()
+
+	query := `UPDATE ONLY service_clients
+                 SET key_hash = $2,
+                     rotated_at = now()
+               WHERE name = $1
+                 AND revoked_at IS NULL`
+	result, err := c.db.ExecContext(ctx, query, name, keyHash)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, errClientNotFound)
+}
+
+// updateClientScopes replaces the scopes granted to an active client.
+func (c *ClientsDB) updateClientScopes(ctx context.Context, name string, scopes []string) error {
+	ctx, done := startOperation(ctx, "ClientsDB.updateClientScopes")
+	defer done()
+
+	query := `UPDATE ONLY service_clients
+                 SET scopes = $2
+               WHERE name = $1
+                 AND revoked_at IS NULL`
+	result, err := c.db.ExecContext(ctx, query, name, joinScopes(scopes))
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, errClientNotFound)
+}
+
+// revokeClient marks a client's credentials as revoked.
+func (c *ClientsDB) revokeClient(ctx context.Context, name string) error {
+	ctx, done := startOperation(ctx, "ClientsDB.revokeClient")
+	defer done()
+
+	query := `UPDATE ONLY service_clients
+                 SET revoked_at = now()
+               WHERE name = $1
+                 AND revoked_at IS NULL`
+	result, err := c.db.ExecContext(ctx, query, name)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, errClientNotFound)
+}
+
+// expectOneRow returns notFound if the statement didn't affect any rows.
+func expectOneRow(result sql.Result, notFound error) error {
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return notFound
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// serveCommand is the subcommand that runs the service. It's also what runs
+// when no subcommand is given.
+const serveCommand = "serve"
+
+// storageCommand is a subcommand that works on the configured storage backend
+// instead of running the service.
+type storageCommand func(ctx context.Context, storage *Storage, args []string, stdout io.Writer) error
+
+// storageCommands are the subcommands that need the storage backend, by name.
+var storageCommands = map[string]storageCommand{
+	"export": func(ctx context.Context, storage *Storage, args []string, stdout io.Writer) error {
+		return runExport(ctx, storage.Exports, args, stdout)
+	},
+	"merge": func(ctx context.Context, storage *Storage, args []string, stdout io.Writer) error {
+		return runMerge(ctx, storage.Merges, args, stdout)
+	},
+	"inspect": func(ctx context.Context, storage *Storage, args []string, stdout io.Writer) error {
+		return runInspect(ctx, storage.Exports, args, stdout)
+	},
+	"stats": func(ctx context.Context, storage *Storage, args []string, stdout io.Writer) error {
+		return runStats(ctx, storage.Stats, args, stdout)
+	},
+	"purge-user": func(ctx context.Context, storage *Storage, args []string, stdout io.Writer) error {
+		return runPurgeUser(ctx, storage.Purges, args, stdout)
+	},
+	"import": func(ctx context.Context, storage *Storage, args []string, stdout io.Writer) error {
+		return runImport(ctx, storage.Imports, args, os.Stdin, stdout)
+	},
+}
+
+// knownCommand returns whether the name is one of the subcommands.
+func knownCommand(name string) bool {
+	switch name {
+	case "", serveCommand, "migrate", "validate-config":
+		return true
+	}
+	_, ok := storageCommands[name]
+	return ok
+}
+
+// commandFlags are the flags of an administrative subcommand. Every one of
+// them takes --json to write JSON instead of text meant for people.
+type commandFlags struct {
+	*flag.FlagSet
+	json  *bool
+	usage string
+}
+
+// newCommandFlags returns the flags for the subcommand. The usage is
+// returned as the error when the arguments can't be parsed.
+func newCommandFlags(name, usage string) *commandFlags {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	return &commandFlags{
+		FlagSet: flags,
+		json:    flags.Bool("json", false, "Write JSON instead of text"),
+		usage:   usage,
+	}
+}
+
+// parse parses the arguments, which have to leave between min and max
+// positional arguments.
+func (f *commandFlags) parse(args []string, min, max int) error {
+	if err := f.Parse(args); err != nil || f.NArg() < min || f.NArg() > max {
+		return fmt.Errorf("usage: %s", f.usage)
+	}
+	return nil
+}
+
+// writeCommandJSON writes the value to standard output as indented JSON.
+func writeCommandJSON(stdout io.Writer, value interface{}) error {
+	encoded, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(stdout, string(encoded))
+	return err
+}
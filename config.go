@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// configProblem is a setting that the service would refuse or misread.
+type configProblem struct {
+	Key     string `json:"key"`
+	Message string `json:"message"`
+}
+
+// configDurations are the settings that hold durations. The ones that are
+// true set how often something runs, so they can't be zero.
+var configDurations = map[string]bool{
+	"user_info.audit.prune_interval":        true,
+	"user_info.audit.retention":             false,
+	"user_info.auth.leeway":                 false,
+	"user_info.cache.ttl":                   false,
+	"user_info.changes.keepalive":           true,
+	"user_info.changes.max_stream_duration": false,
+	"user_info.changes.prune_interval":      true,
+	"user_info.changes.retry":               false,
+	"user_info.changes.tombstone_retention": false,
+	"user_info.db.timeout":                  false,
+	"user_info.events.lease":                false,
+	"user_info.events.max_retry":            false,
+	"user_info.events.min_retry":            false,
+	"user_info.events.poll_interval":        true,
+	"user_info.events.publish_timeout":      false,
+	"user_info.health.cache_ttl":            false,
+	"user_info.health.ping_timeout":         false,
+	"user_info.server.drain_delay":          false,
+	"user_info.server.idle_timeout":         false,
+	"user_info.server.read_header_timeout":  false,
+	"user_info.server.read_timeout":         false,
+	"user_info.server.shutdown_timeout":     false,
+	"user_info.server.write_timeout":        false,
+	"user_info.webhooks.lease":              false,
+	"user_info.webhooks.max_retry":          false,
+	"user_info.webhooks.min_retry":          false,
+	"user_info.webhooks.poll_interval":      true,
+	"user_info.webhooks.timeout":            false,
+}
+
+// configCounts are the settings that hold a number of things, which has to be
+// positive.
+var configCounts = []string{
+	"user_info.cache.max_entries",
+	"user_info.events.batch_size",
+	"user_info.rate_limit.max_keys",
+	"user_info.webhooks.batch_size",
+	"user_info.webhooks.max_attempts",
+}
+
+// configSwitches are the settings that turn features on or off.
+var configSwitches = []string{
+	"user_info.auth.enabled",
+	"user_info.cache.enabled",
+	"user_info.events.enabled",
+	"user_info.log.access_log",
+	"user_info.migrations.require_current",
+	"user_info.rate_limit.enabled",
+	"user_info.tracing.enabled",
+	"user_info.validate_requests",
+	"user_info.webhooks.enabled",
+}
+
+// validateConfig checks the configuration without connecting to anything and
+// returns the problems it found, ordered by key.
+func validateConfig(cfg *viper.Viper) []configProblem {
+	var problems []configProblem
+	add := func(key, format string, args ...interface{}) {
+		problems = append(problems, configProblem{Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if _, _, err := loggingSettings(cfg); err != nil {
+		add("user_info.log", "%s", err)
+	}
+
+	switch backend := cfg.GetString("user_info.storage.backend"); backend {
+	case "", "postgres":
+		if cfg.GetString("db.uri") == "" {
+			add("db.uri", "must be set for the postgres storage backend")
+		}
+	case "memory":
+	case "sqlite":
+		if !sqliteSupported {
+			add("user_info.storage.backend", "this build does not include SQLite support")
+		}
+	default:
+		add("user_info.storage.backend", "unknown storage backend %q", backend)
+	}
+
+	for key, mustRun := range configDurations {
+		if cfg.Get(key) == nil {
+			continue
+		}
+		duration, err := cast.ToDurationE(cfg.Get(key))
+		switch {
+		case err != nil:
+			add(key, "invalid duration %v", cfg.Get(key))
+		case duration < 0:
+			add(key, "must not be negative")
+		case duration == 0 && mustRun:
+			add(key, "must be greater than zero")
+		}
+	}
+
+	for _, key := range configCounts {
+		if cfg.Get(key) == nil {
+			continue
+		}
+		if count, err := cast.ToIntE(cfg.Get(key)); err != nil || count < 1 {
+			add(key, "must be a positive whole number")
+		}
+	}
+
+	for _, key := range configSwitches {
+		if cfg.Get(key) == nil {
+			continue
+		}
+		if _, err := cast.ToBoolE(cfg.Get(key)); err != nil {
+			add(key, "must be true or false")
+		}
+	}
+
+	if cfg.GetBool("user_info.auth.enabled") {
+		if path := cfg.GetString("user_info.auth.jwks_file"); path != "" {
+			if _, err := loadJWKS(path); err != nil {
+				add("user_info.auth.jwks_file", "%s", err)
+			}
+		}
+	}
+
+	if cfg.GetBool("user_info.rate_limit.enabled") && cfg.GetInt("user_info.rate_limit.max_keys") >= 1 {
+		if _, err := NewRateLimiter(cfg); err != nil {
+			add("user_info.rate_limit", "%s", err)
+		}
+	}
+
+	if cfg.GetBool("user_info.tracing.enabled") {
+		switch exporter := cfg.GetString("user_info.tracing.exporter"); exporter {
+		case "", "otlp", "stdout":
+		default:
+			add("user_info.tracing.exporter", "unknown tracing exporter %q", exporter)
+		}
+		if cfg.Get("user_info.tracing.sample_ratio") != nil {
+			if ratio, err := cast.ToFloat64E(cfg.Get("user_info.tracing.sample_ratio")); err != nil || ratio < 0 || ratio > 1 {
+				add("user_info.tracing.sample_ratio", "must be a number from 0 to 1")
+			}
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Key < problems[j].Key })
+	return problems
+}
+
+// runValidateConfig implements the validate-config subcommand:
+// "validate-config [--json]". It fails if the configuration has problems,
+// after writing them to standard output.
+func runValidateConfig(cfg *viper.Viper, args []string, stdout io.Writer) error {
+	flags := newCommandFlags("validate-config", "user-info validate-config [--json]")
+	if err := flags.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	problems := validateConfig(cfg)
+	if *flags.json {
+		if err := writeCommandJSON(stdout, struct {
+			Valid    bool            `json:"valid"`
+			Problems []configProblem `json:"problems"`
+		}{len(problems) == 0, append([]configProblem{}, problems...)}); err != nil {
+			return err
+		}
+	} else if len(problems) == 0 {
+		fmt.Fprintln(stdout, "the configuration is valid")
+	} else {
+		for _, problem := range problems {
+			fmt.Fprintf(stdout, "%s: %s\n", problem.Key, problem.Message)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("the configuration has %d problem(s)", len(problems))
+	}
+	return nil
+}
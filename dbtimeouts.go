@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// operationTimeouts holds how long each storage operation may run for.
+// Operations are named the same way as in the metrics, for example
+// "BagsAPI.GetBags".
+type operationTimeouts struct {
+	mu        sync.RWMutex
+	fallback  time.Duration
+	overrides map[string]time.Duration
+}
+
+var dbTimeouts = &operationTimeouts{
+	fallback:  5 * time.Second,
+	overrides: defaultOperationTimeouts(),
+}
+
+// defaultOperationTimeouts returns the operations that get more time than
+// user_info.db.timeout unless they're configured otherwise. Importing a batch
+// runs several statements for each of up to maxImportBatchSize records.
+func defaultOperationTimeouts() map[string]time.Duration {
+	return map[string]time.Duration{
+		"importdb.importrecords": 5 * time.Minute,
+	}
+}
+
+var dbOperationTimeouts = metrics.NewCounterVec(
+	"user_info_db_operation_timeouts_total",
+	"Number of storage operations that ran past their timeout, by operation.",
+	"operation",
+)
+
+// configureDBTimeouts loads the storage timeouts from the configuration. The
+// default comes from user_info.db.timeout and can be overridden for a single
+// operation with a key such as user_info.db.timeouts.BagsAPI.GetBags.
+func configureDBTimeouts(cfg *viper.Viper) {
+	cfg.SetDefault("user_info.db.timeout", "5s")
+
+	overrides := defaultOperationTimeouts()
+	if sub := cfg.Sub("user_info.db.timeouts"); sub != nil {
+		for _, key := range sub.AllKeys() {
+			overrides[strings.ToLower(key)] = sub.GetDuration(key)
+		}
+	}
+
+	dbTimeouts.mu.Lock()
+	defer dbTimeouts.mu.Unlock()
+	dbTimeouts.fallback = cfg.GetDuration("user_info.db.timeout")
+	dbTimeouts.overrides = overrides
+}
+
+func (o *operationTimeouts) get(operation string) time.Duration {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if timeout, ok := o.overrides[strings.ToLower(operation)]; ok {
+		return timeout
+	}
+	return o.fallback
+}
+
+// startOperation derives the context for a storage operation from ctx, with
+// the operation's timeout applied. The returned function must be deferred; it
+// records the operation's duration and, if the operation ran out of time,
+// notes it on the request so the response becomes a 504.
+//
+//	ctx, done := startOperation(ctx, "PrefsDB.getPreferences")
+//	defer done()
+func startOperation(ctx context.Context, operation string) (context.Context, func()) {
+	start := time.Now()
+	opCtx, cancel := context.WithTimeout(ctx, dbTimeouts.get(operation))
+
+	return opCtx, func() {
+		if opCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			dbOperationTimeouts.Inc(operation)
+			if info := requestInfoFromContext(ctx); info != nil {
+				info.timedOut = true
+			}
+		}
+		cancel()
+		observeDB(operation, start)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var eventsPublished = metrics.NewCounterVec(
+	"user_info_events_published_total",
+	"Number of attempts to publish change events from the outbox, by result.",
+	"result",
+)
+
+// eventPublisher sends a message to the message broker, returning once the
+// broker has accepted it.
+type eventPublisher interface {
+	publish(ctx context.Context, routingKey string, payload []byte) error
+}
+
+// OutboxPublisher delivers the events in the outbox to the message broker.
+// Every event is delivered at least once: one that was published but couldn't
+// be removed from the outbox afterwards is published again.
+type OutboxPublisher struct {
+	outbox         outboxDB
+	publisher      eventPublisher
+	interval       time.Duration
+	batchSize      int
+	lease          time.Duration
+	minRetry       time.Duration
+	maxRetry       time.Duration
+	publishTimeout time.Duration
+	stop           chan struct{}
+	done           chan struct{}
+}
+
+// NewOutboxPublisherFromConfig starts publishing the events in the outbox to
+// the exchange configured in amqp.exchange.name, or returns nil if
+// user_info.events.enabled is false or amqp.uri isn't set. Events are still
+// added to the outbox either way, so a publisher started later catches up on
+// the events that are still within user_info.events.retention.
+func NewOutboxPublisherFromConfig(cfg *viper.Viper, outbox outboxDB) *OutboxPublisher {
+	cfg.SetDefault("user_info.events.enabled", true)
+	cfg.SetDefault("user_info.events.poll_interval", "1s")
+	cfg.SetDefault("user_info.events.batch_size", 100)
+	cfg.SetDefault("user_info.events.lease", "1m")
+	cfg.SetDefault("user_info.events.min_retry", "1s")
+	cfg.SetDefault("user_info.events.max_retry", "5m")
+	cfg.SetDefault("user_info.events.publish_timeout", "10s")
+	cfg.SetDefault("amqp.exchange.name", "de")
+	cfg.SetDefault("amqp.exchange.type", "topic")
+
+	uri := cfg.GetString("amqp.uri")
+	if !cfg.GetBool("user_info.events.enabled") || uri == "" {
+		return nil
+	}
+
+	amqp := NewAMQPPublisher(uri, cfg.GetString("amqp.exchange.name"), cfg.GetString("amqp.exchange.type"))
+	p := newOutboxPublisher(outbox, amqp)
+	p.interval = cfg.GetDuration("user_info.events.poll_interval")
+	p.batchSize = cfg.GetInt("user_info.events.batch_size")
+	p.lease = cfg.GetDuration("user_info.events.lease")
+	p.minRetry = cfg.GetDuration("user_info.events.min_retry")
+	p.maxRetry = cfg.GetDuration("user_info.events.max_retry")
+	p.publishTimeout = cfg.GetDuration("user_info.events.publish_timeout")
+	go p.run()
+	return p
+}
+
+// newOutboxPublisher returns a publisher with the default settings that
+// hasn't been started.
+func newOutboxPublisher(outbox outboxDB, publisher eventPublisher) *OutboxPublisher {
+	return &OutboxPublisher{
+		outbox:         outbox,
+		publisher:      publisher,
+		interval:       time.Second,
+		batchSize:      100,
+		lease:          time.Minute,
+		minRetry:       time.Second,
+		maxRetry:       5 * time.Minute,
+		publishTimeout: 10 * time.Second,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+}
+
+// backoff returns the delay after the given number of failed attempts, which
+// starts at minDelay and doubles with every attempt up to maxDelay.
+func backoff(minDelay, maxDelay time.Duration, attempts int) time.Duration {
+	delay := minDelay
+	for i := 0; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// retryDelay returns how long to wait before the next attempt to publish an
+// event, doubling with every failed attempt.
+func (p *OutboxPublisher) retryDelay(attempts int) time.Duration {
+	return backoff(p.minRetry, p.maxRetry, attempts)
+}
+
+// publishPending publishes one batch of the events that are due, oldest
+// first, and returns how many it published. It stops at the first event that
+// can't be published, so that the rest keep their order.
+func (p *OutboxPublisher) publishPending(ctx context.Context) (int, error) {
+	events, err := p.outbox.claimEvents(ctx, p.batchSize, p.lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, event := range events {
+		publishCtx, cancel := context.WithTimeout(ctx, p.publishTimeout)
+		err = p.publisher.publish(publishCtx, event.RoutingKey, event.Payload)
+		cancel()
+
+		if err != nil {
+			eventsPublished.Inc("failed")
+			delay := p.retryDelay(event.Attempts)
+			if retryErr := p.outbox.retryEvent(ctx, event.ID, delay, err.Error()); retryErr != nil {
+				log.Errorf("error scheduling a retry of event %d: %s", event.ID, retryErr)
+			}
+			return i, err
+		}
+
+		eventsPublished.Inc("published")
+		if err = p.outbox.deleteEvent(ctx, event.ID); err != nil {
+			// The event is published again once its lease runs out.
+			return i + 1, err
+		}
+	}
+	return len(events), nil
+}
+
+func (p *OutboxPublisher) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Full batches are published back to back to work through a
+			// backlog.
+			for {
+				published, err := p.publishPending(context.Background())
+				if err != nil {
+					log.Errorf("error publishing change events: %s", err)
+					break
+				}
+				if published < p.batchSize {
+					break
+				}
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Close stops publishing events and closes the connection to the broker.
+// Events that haven't been published yet stay in the outbox.
+func (p *OutboxPublisher) Close(ctx context.Context) error {
+	close(p.stop)
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+	}
+	if closer, ok := p.publisher.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// EventRetention periodically deletes the events in the outbox and the webhook
+// deliveries that are older than their retention periods, so that neither
+// grows without bound while publishing or the dispatcher is turned off or
+// failing.
+type EventRetention struct {
+	outbox            outboxDB
+	webhooks          webhookDB
+	eventRetention    time.Duration
+	deliveryRetention time.Duration
+	interval          time.Duration
+	stop              chan struct{}
+	done              chan struct{}
+}
+
+// NewEventRetentionFromConfig starts pruning events according to
+// user_info.events.retention and webhook deliveries according to
+// user_info.webhooks.retention, or returns nil if both are zero, which keeps
+// them forever. Deliveries on the dead-letter list are pruned along with the
+// pending ones.
+func NewEventRetentionFromConfig(cfg *viper.Viper, outbox outboxDB, webhooks webhookDB) *EventRetention {
+	cfg.SetDefault("user_info.events.retention", "168h")
+	cfg.SetDefault("user_info.webhooks.retention", "168h")
+	cfg.SetDefault("user_info.events.prune_interval", "1h")
+
+	eventRetention := cfg.GetDuration("user_info.events.retention")
+	deliveryRetention := cfg.GetDuration("user_info.webhooks.retention")
+	if eventRetention <= 0 && deliveryRetention <= 0 {
+		return nil
+	}
+
+	r := &EventRetention{
+		outbox:            outbox,
+		webhooks:          webhooks,
+		eventRetention:    eventRetention,
+		deliveryRetention: deliveryRetention,
+		interval:          cfg.GetDuration("user_info.events.prune_interval"),
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// prune deletes the events and deliveries that have passed their retention
+// periods.
+func (r *EventRetention) prune(ctx context.Context) {
+	if r.eventRetention > 0 {
+		pruned, err := r.outbox.pruneEvents(ctx, time.Now().Add(-r.eventRetention))
+		if err != nil {
+			log.Errorf("error pruning the event outbox: %s", err)
+		} else if pruned > 0 {
+			log.Warnf("pruned %d unpublished events older than %s from the outbox", pruned, r.eventRetention)
+		}
+	}
+
+	if r.deliveryRetention > 0 {
+		pruned, err := r.webhooks.pruneDeliveries(ctx, time.Now().Add(-r.deliveryRetention))
+		if err != nil {
+			log.Errorf("error pruning webhook deliveries: %s", err)
+		} else if pruned > 0 {
+			log.Warnf("pruned %d undelivered webhook deliveries older than %s", pruned, r.deliveryRetention)
+		}
+	}
+}
+
+func (r *EventRetention) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	r.prune(context.Background())
+	for {
+		select {
+		case <-ticker.C:
+			r.prune(context.Background())
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Close stops pruning events and deliveries.
+func (r *EventRetention) Close(ctx context.Context) error {
+	close(r.stop)
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+	}
+	return nil
+}
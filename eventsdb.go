@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// ChangeEvent is published whenever a user's data changes. Consumers should
+// use the ID to ignore duplicates, since an event may be delivered more than
+// once.
+type ChangeEvent struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	Username   string      `json:"username"`
+	Resource   string      `json:"resource"`
+	Operation  string      `json:"operation"`
+	Actor      string      `json:"actor"`
+	RequestID  string      `json:"request_id,omitempty"`
+	OccurredAt time.Time   `json:"occurred_at"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+// eventRoutingKeyPrefix starts the routing key of every event, which is
+// followed by the resource and operation, as in
+// "user-info.preferences.update".
+const eventRoutingKeyPrefix = "user-info"
+
+// newChangeEvent returns an event for a change made to the user's data while
+// handling the request that ctx belongs to. The data is included in the event
+// as is; use exportJSON for stored documents.
+func newChangeEvent(ctx context.Context, username, resource, operation string, data interface{}) *ChangeEvent {
+	event := &ChangeEvent{
+		ID:         newUUID(),
+		Type:       resource + "." + operation,
+		Username:   username,
+		Resource:   resource,
+		Operation:  operation,
+		Actor:      contextActor(ctx),
+		OccurredAt: time.Now().UTC(),
+		Data:       data,
+	}
+	if info := requestInfoFromContext(ctx); info != nil {
+		event.RequestID = info.id
+	}
+	return event
+}
+
+func (e *ChangeEvent) routingKey() string {
+	return eventRoutingKeyPrefix + "." + e.Type
+}
+
+// bagEventData is the data of the events for changes to bags.
+type bagEventData struct {
+	BagID    string          `json:"bag_id"`
+	Contents json.RawMessage `json:"contents,omitempty"`
+}
+
+// OutboxEvent is an event waiting in the outbox to be published.
+type OutboxEvent struct {
+	ID         int64
+	RoutingKey string
+	Payload    []byte
+	Attempts   int
+}
+
+// outboxDB defines the interface for the events waiting to be published.
+// Events are added to the outbox by the stores, in the same transaction as the
+// change they describe.
+type outboxDB interface {
+	// claimEvents returns up to limit events that are due to be published,
+	// oldest first, and hides them from other publishers until the lease runs
+	// out.
+	claimEvents(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error)
+
+	// deleteEvent removes an event once it has been published.
+	deleteEvent(ctx context.Context, id int64) error
+
+	// retryEvent records a failed attempt to publish an event and hides it for
+	// the delay.
+	retryEvent(ctx context.Context, id int64, delay time.Duration, lastErr string) error
+
+	// pruneEvents deletes the events added before the cutoff that are still
+	// waiting to be published and returns how many there were.
+	pruneEvents(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// insertEvent adds the event to the outbox, the webhook deliveries and the
+// change log. Pass the transaction that makes the change so that the event is
+// only published if the change is committed.
+func insertEvent(ctx context.Context, q queryer, event *ChangeEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `INSERT INTO event_outbox (routing_key, payload) VALUES ($1, $2)`, event.routingKey(), string(payload))
+	if err != nil {
+		return err
+	}
+	if err = insertWebhookDeliveries(ctx, q, event, payload); err != nil {
+		return err
+	}
+	return insertChange(ctx, q, event)
+}
+
+// withEvent runs fn in a transaction that also adds the event to the outbox
+// and records the change in the audit log. fn makes the change and returns
+// the document as it was before, which it reads in the same transaction with
+// the row locked; after is the document as the change leaves it.
+func withEvent(ctx context.Context, db *tracedDB, event *ChangeEvent, after string, fn func(tx *tracedTx) (string, error)) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	before, err := fn(tx)
+	if err != nil {
+		return err
+	}
+	if err = insertAuditEntry(ctx, tx, eventAudit(event, before, after)); err != nil {
+		return err
+	}
+	if err = insertEvent(ctx, tx, event); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// currentDocument locks the user's document in the table and returns it, or
+// an empty string if they don't have one.
+func currentDocument(ctx context.Context, tx *tracedTx, table, column, userID string) (string, error) {
+	_, document, err := lockDocument(ctx, tx, table, column, userID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return document, err
+}
+
+// OutboxDB implements the outboxDB interface on top of the DE database.
+type OutboxDB struct {
+	db *tracedDB
+}
+
+// NewOutboxDB returns a newly created *OutboxDB.
+func NewOutboxDB(db *sql.DB) *OutboxDB {
+	return &OutboxDB{
+		db: newTracedDB(db),
+	}
+}
+
+func (o *OutboxDB) claimEvents(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	ctx, done := startOperation(ctx, "OutboxDB.claimEvents")
+	defer done()
+
+	// SKIP LOCKED lets every replica run a publisher without any two of them
+	// claiming the same event.
+	query := `UPDATE event_outbox
+                 SET next_attempt_at = now() + $2 * interval '1 second'
+               WHERE id IN (SELECT id
+                              FROM event_outbox
+                             WHERE next_attempt_at <= now()
+                          ORDER BY id
+                             LIMIT $1
+                               FOR UPDATE SKIP LOCKED)
+           RETURNING id, routing_key, payload, attempts`
+	rows, err := o.db.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []OutboxEvent{}
+	for rows.Next() {
+		var (
+			event   OutboxEvent
+			payload string
+		)
+		if err = rows.Scan(&event.ID, &event.RoutingKey, &payload, &event.Attempts); err != nil {
+			return nil, err
+		}
+		event.Payload = []byte(payload)
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+func (o *OutboxDB) deleteEvent(ctx context.Context, id int64) error {
+	ctx, done := startOperation(ctx, "OutboxDB.deleteEvent")
+	defer done()
+
+	_, err := o.db.ExecContext(ctx, `DELETE FROM event_outbox WHERE id = $1`, id)
+	return err
+}
+
+func (o *OutboxDB) retryEvent(ctx context.Context, id int64, delay time.Duration, lastErr string) error {
+	ctx, done := startOperation(ctx, "OutboxDB.retryEvent")
+	defer done()
+
+	query := `UPDATE event_outbox
+                 SET attempts = attempts + 1,
+                     next_attempt_at = now() + $2 * interval '1 second',
+                     last_error = $3
+               WHERE id = $1`
+	_, err := o.db.ExecContext(ctx, query, id, delay.Seconds(), lastErr)
+	return err
+}
+
+func (o *OutboxDB) pruneEvents(ctx context.Context, cutoff time.Time) (int64, error) {
+	ctx, done := startOperation(ctx, "OutboxDB.pruneEvents")
+	defer done()
+
+	result, err := o.db.ExecContext(ctx, `DELETE FROM event_outbox WHERE created_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
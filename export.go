@@ -0,0 +1,308 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// exportFormatVersion is bumped whenever the layout of the export changes.
+const exportFormatVersion = 1
+
+// exportManifest describes the contents of an export.
+type exportManifest struct {
+	FormatVersion int                   `json:"format_version"`
+	Username      string                `json:"username"`
+	UserID        string                `json:"user_id"`
+	ExportedAt    time.Time             `json:"exported_at"`
+	Files         []exportManifestEntry `json:"files"`
+}
+
+type exportManifestEntry struct {
+	Name    string `json:"name"`
+	Records int    `json:"records"`
+	Bytes   int    `json:"bytes"`
+	SHA256  string `json:"sha256"`
+}
+
+// exportJSON returns the document as JSON if it's valid JSON, or as a JSON
+// string otherwise, so that a corrupted document still gets exported.
+func exportJSON(document string) json.RawMessage {
+	if json.Valid([]byte(document)) {
+		return json.RawMessage(document)
+	}
+	quoted, _ := json.Marshal(document)
+	return quoted
+}
+
+type exportedDocument struct {
+	ID       string          `json:"id"`
+	Document json.RawMessage `json:"document"`
+}
+
+type exportedBag struct {
+	ID       string          `json:"id"`
+	Default  bool            `json:"default"`
+	Contents json.RawMessage `json:"contents"`
+}
+
+func exportedDocuments(docs []exportDocument) []exportedDocument {
+	exported := make([]exportedDocument, 0, len(docs))
+	for _, doc := range docs {
+		exported = append(exported, exportedDocument{ID: doc.ID, Document: exportJSON(doc.Document)})
+	}
+	return exported
+}
+
+func exportedBags(bags []exportBag) []exportedBag {
+	exported := make([]exportedBag, 0, len(bags))
+	for _, bag := range bags {
+		exported = append(exported, exportedBag{ID: bag.ID, Default: bag.Default, Contents: exportJSON(bag.Contents)})
+	}
+	return exported
+}
+
+// writeExport writes the export out as a zip archive holding one JSON file
+// for each kind of data and a manifest with the size and checksum of each of
+// them. Each file is written as soon as it's encoded, so the archive can be
+// streamed.
+func writeExport(w io.Writer, export *UserExport, now time.Time) error {
+	files := []struct {
+		name    string
+		records int
+		value   interface{}
+	}{
+		{"preferences.json", len(export.Preferences), exportedDocuments(export.Preferences)},
+		{"sessions.json", len(export.Sessions), exportedDocuments(export.Sessions)},
+		{"saved_searches.json", len(export.SavedSearches), exportedDocuments(export.SavedSearches)},
+		{"bags.json", len(export.Bags), exportedBags(export.Bags)},
+	}
+
+	archive := zip.NewWriter(w)
+	manifest := exportManifest{
+		FormatVersion: exportFormatVersion,
+		Username:      export.Username,
+		UserID:        export.UserID,
+		ExportedAt:    now.UTC(),
+		Files:         []exportManifestEntry{},
+	}
+
+	writeFile := func(name string, value interface{}) ([]byte, error) {
+		encoded, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("error encoding %s: %w", name, err)
+		}
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		header.SetModTime(now)
+		fw, err := archive.CreateHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = fw.Write(encoded); err != nil {
+			return nil, err
+		}
+		return encoded, nil
+	}
+
+	for _, file := range files {
+		encoded, err := writeFile(file.name, file.value)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(encoded)
+		manifest.Files = append(manifest.Files, exportManifestEntry{
+			Name:    file.name,
+			Records: file.records,
+			Bytes:   len(encoded),
+			SHA256:  hex.EncodeToString(sum[:]),
+		})
+	}
+
+	if _, err := writeFile("manifest.json", manifest); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// exportFilename returns the name to save the user's export as.
+func exportFilename(username string, now time.Time) string {
+	return fmt.Sprintf("user-info-export-%s-%s.zip", unsafeFilenameChars.ReplaceAllString(username, "_"), now.UTC().Format("20060102T150405Z"))
+}
+
+// ExportApp serves the personal-data exports.
+type ExportApp struct {
+	exports exportDB
+	router  *mux.Router
+	now     func() time.Time
+}
+
+// NewExportApp returns a new *ExportApp.
+func NewExportApp(db exportDB, router *mux.Router) *ExportApp {
+	exportApp := &ExportApp{
+		exports: db,
+		router:  router,
+		now:     time.Now,
+	}
+	exportApp.router.HandleFunc("/users/{username}/export", exportApp.GetExport).Methods(http.MethodGet)
+	return exportApp
+}
+
+// GetExport streams a zip archive of everything stored for the user.
+func (e *ExportApp) GetExport(writer http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	requestLog(r).WithFields(log.Fields{
+		"service": "export",
+	}).Info("Exporting the data for ", username)
+
+	// Take the whole snapshot before writing anything so that errors can still
+	// be reported with a status code.
+	export, err := e.exports.exportUser(r.Context(), username)
+	if err == sql.ErrNoRows {
+		handleNonUser(writer, r, username)
+		return
+	}
+	if err != nil {
+		errored(writer, r, fmt.Sprintf("error exporting the data for %s: %s", username, err))
+		return
+	}
+
+	now := e.now()
+	writer.Header().Set("Content-Type", "application/zip")
+	writer.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename(username, now)))
+	writer.Header().Set("Cache-Control", "no-store")
+	if err = writeExport(writer, export, now); err != nil {
+		// The headers have already been sent, so all that can be done is to
+		// cut the archive short, which makes it invalid.
+		requestLog(r).Errorf("error writing the export for %s: %s", username, err)
+	}
+}
+
+// runExport implements the export subcommand: "export <username> [file]".
+// The archive is written to standard output if no file is given.
+func runExport(ctx context.Context, exports exportDB, args []string, stdout io.Writer) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: user-info export <username> [file]")
+	}
+	username := args[0]
+
+	export, err := exports.exportUser(ctx, username)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	if err != nil {
+		return fmt.Errorf("error exporting the data for %s: %w", username, err)
+	}
+
+	if len(args) == 1 {
+		return writeExport(stdout, export, time.Now())
+	}
+
+	f, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	if err = writeExport(f, export, time.Now()); err != nil {
+		f.Close() // nolint:errcheck
+		return err
+	}
+	return f.Close()
+}
+
+// userInspection is what the inspect subcommand shows for a user.
+type userInspection struct {
+	Username      string             `json:"username"`
+	UserID        string             `json:"user_id"`
+	Preferences   []exportedDocument `json:"preferences"`
+	Sessions      []exportedDocument `json:"sessions"`
+	SavedSearches []exportedDocument `json:"saved_searches"`
+	Bags          []exportedBag      `json:"bags"`
+}
+
+// runInspect implements the inspect subcommand: "inspect [--json]
+// <username>". It writes everything stored for the user to standard output.
+func runInspect(ctx context.Context, exports exportDB, args []string, stdout io.Writer) error {
+	flags := newCommandFlags("inspect", "user-info inspect [--json] <username>")
+	if err := flags.parse(args, 1, 1); err != nil {
+		return err
+	}
+	username := flags.Arg(0)
+
+	export, err := exports.exportUser(ctx, username)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading the data for %s: %w", username, err)
+	}
+
+	inspection := &userInspection{
+		Username:      export.Username,
+		UserID:        export.UserID,
+		Preferences:   exportedDocuments(export.Preferences),
+		Sessions:      exportedDocuments(export.Sessions),
+		SavedSearches: exportedDocuments(export.SavedSearches),
+		Bags:          exportedBags(export.Bags),
+	}
+	if *flags.json {
+		return writeCommandJSON(stdout, inspection)
+	}
+	return writeInspection(stdout, inspection)
+}
+
+// writeInspection writes the user's data out as text, with each document
+// indented under its ID.
+func writeInspection(w io.Writer, inspection *userInspection) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Username: %s\nUser ID:  %s\n", inspection.Username, inspection.UserID)
+
+	writeDocument := func(heading string, document json.RawMessage) {
+		fmt.Fprintf(&buf, "  %s\n    ", heading)
+		if err := json.Indent(&buf, document, "    ", "  "); err != nil {
+			buf.Write(document)
+		}
+		buf.WriteString("\n")
+	}
+
+	sections := []struct {
+		name      string
+		documents []exportedDocument
+	}{
+		{"Preferences", inspection.Preferences},
+		{"Sessions", inspection.Sessions},
+		{"Saved searches", inspection.SavedSearches},
+	}
+	for _, section := range sections {
+		fmt.Fprintf(&buf, "\n%s (%d)\n", section.name, len(section.documents))
+		for _, doc := range section.documents {
+			writeDocument(doc.ID, doc.Document)
+		}
+	}
+
+	fmt.Fprintf(&buf, "\nBags (%d)\n", len(inspection.Bags))
+	for _, bag := range inspection.Bags {
+		heading := bag.ID
+		if bag.Default {
+			heading += " (default)"
+		}
+		writeDocument(heading, bag.Contents)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// exportDocument is a stored JSON document, exactly as it was stored.
+type exportDocument struct {
+	ID       string
+	Document string
+}
+
+// exportBag is one of a user's bags.
+type exportBag struct {
+	ID       string
+	Contents string
+	Default  bool
+}
+
+// UserExport is a consistent snapshot of everything stored for a user.
+type UserExport struct {
+	Username      string
+	UserID        string
+	Preferences   []exportDocument
+	Sessions      []exportDocument
+	SavedSearches []exportDocument
+	Bags          []exportBag
+}
+
+// exportDB defines the interface for taking a snapshot of a user's data.
+type exportDB interface {
+	// exportUser returns sql.ErrNoRows if the user doesn't exist.
+	exportUser(ctx context.Context, username string) (*UserExport, error)
+}
+
+// ExportDB implements the exportDB interface on top of the DE database.
+type ExportDB struct {
+	db *tracedDB
+}
+
+// NewExportDB returns a newly created *ExportDB.
+func NewExportDB(db *sql.DB) *ExportDB {
+	return &ExportDB{
+		db: newTracedDB(db),
+	}
+}
+
+// exportDocuments reads the id and document columns of a query's results.
+func exportDocuments(ctx context.Context, tx *tracedTx, query, userID string) ([]exportDocument, error) {
+	rows, err := tx.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []exportDocument{}
+	for rows.Next() {
+		var doc exportDocument
+		if err = rows.Scan(&doc.ID, &doc.Document); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+// exportBags reads the id, contents and default columns of a query's
+// results.
+func exportBags(ctx context.Context, tx *tracedTx, query, userID string) ([]exportBag, error) {
+	rows, err := tx.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bags := []exportBag{}
+	for rows.Next() {
+		var bag exportBag
+		if err = rows.Scan(&bag.ID, &bag.Contents, &bag.Default); err != nil {
+			return nil, err
+		}
+		bags = append(bags, bag)
+	}
+	return bags, rows.Err()
+}
+
+// exportUser reads all of the user's data in a single read-only, repeatable
+// read transaction so that every part comes from the same snapshot.
+func (e *ExportDB) exportUser(ctx context.Context, username string) (*UserExport, error) {
+	ctx, done := startOperation(ctx, "ExportDB.exportUser")
+	defer done()
+
+	tx, err := e.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	export := &UserExport{Username: username}
+	if err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE username = $1`, username).Scan(&export.UserID); err != nil {
+		return nil, err
+	}
+
+	if export.Preferences, err = exportDocuments(ctx, tx, `SELECT id, preferences FROM user_preferences WHERE user_id = $1 ORDER BY id`, export.UserID); err != nil {
+		return nil, err
+	}
+	if export.Sessions, err = exportDocuments(ctx, tx, `SELECT id, session FROM user_sessions WHERE user_id = $1 ORDER BY id`, export.UserID); err != nil {
+		return nil, err
+	}
+	if export.SavedSearches, err = exportDocuments(ctx, tx, `SELECT id, saved_searches FROM user_saved_searches WHERE user_id = $1 ORDER BY id`, export.UserID); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT b.id, b.contents, d.bag_id IS NOT NULL
+                FROM bags b
+           LEFT JOIN default_bags d ON d.bag_id = b.id AND d.user_id = b.user_id
+               WHERE b.user_id = $1
+            ORDER BY b.id`
+	if export.Bags, err = exportBags(ctx, tx, query, export.UserID); err != nil {
+		return nil, err
+	}
+
+	return export, tx.Commit()
+}
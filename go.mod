@@ -6,13 +6,13 @@ require (
 	github.com/DATA-DOG/go-sqlmock v1.3.0
 	github.com/cyverse-de/configurate v0.0.0-20171005230251-9b512d37328e
 	github.com/cyverse-de/dbutil v0.0.0-20160615220802-d6ccc51d67cd
-	github.com/cyverse-de/queries v0.0.0-20160412214440-1a09c989c99d
 	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gorilla/context v0.0.0-20160226214623-1ea25387ff6f
 	github.com/gorilla/mux v1.6.1
 	github.com/hashicorp/hcl v0.0.0-20171017181929-23c074d0eceb
 	github.com/lib/pq v0.0.0-20180201184707-88edab080323
 	github.com/magiconair/properties v1.7.6
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/mitchellh/mapstructure v0.0.0-20180220230111-00c29f56e238
 	github.com/pelletier/go-toml v1.1.0
 	github.com/sirupsen/logrus v1.0.5-0.20180129181852-768a92a02685
@@ -21,6 +21,7 @@ require (
 	github.com/spf13/jwalterweatherman v0.0.0-20180109140146-7c0cea34c8ec
 	github.com/spf13/pflag v1.0.0
 	github.com/spf13/viper v1.0.0
+	github.com/streadway/amqp v1.1.0
 	golang.org/x/crypto v0.0.0-20180127211104-1875d0a70c90
 	golang.org/x/sys v0.0.0-20180201153126-8f27ce8a6040
 	golang.org/x/text v0.3.0
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+const (
+	healthOK          = "ok"
+	healthUnavailable = "unavailable"
+)
+
+// dbStatus is the part of *sql.DB that the readiness checks use.
+type dbStatus interface {
+	PingContext(ctx context.Context) error
+	Stats() sql.DBStats
+}
+
+// checkResult is the outcome of a single health check.
+type checkResult struct {
+	Status     string  `json:"status"`
+	Detail     string  `json:"detail,omitempty"`
+	DurationMS float64 `json:"duration_ms,omitempty"`
+}
+
+// healthReport is the response body for both health endpoints.
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// HealthApp serves the liveness and readiness endpoints.
+type HealthApp struct {
+	db           dbStatus
+	router       *mux.Router
+	pingTimeout  time.Duration
+	maxPoolUsage float64
+	cacheTTL     time.Duration
+	draining     int32
+	now          func() time.Time
+
+	mu        sync.Mutex
+	checked   time.Time
+	dbResults map[string]checkResult
+}
+
+// NewHealthApp returns a new *HealthApp configured from the user_info.health
+// section of the configuration.
+func NewHealthApp(db dbStatus, cfg *viper.Viper, router *mux.Router) *HealthApp {
+	cfg.SetDefault("user_info.health.ping_timeout", "1s")
+	cfg.SetDefault("user_info.health.max_pool_usage", 1.0)
+	cfg.SetDefault("user_info.health.cache_ttl", "2s")
+
+	healthApp := &HealthApp{
+		db:           db,
+		router:       router,
+		pingTimeout:  cfg.GetDuration("user_info.health.ping_timeout"),
+		maxPoolUsage: cfg.GetFloat64("user_info.health.max_pool_usage"),
+		cacheTTL:     cfg.GetDuration("user_info.health.cache_ttl"),
+		now:          time.Now,
+	}
+	healthApp.router.HandleFunc("/healthz", healthApp.Liveness).Methods(http.MethodGet)
+	healthApp.router.HandleFunc("/readyz", healthApp.Readiness).Methods(http.MethodGet)
+	return healthApp
+}
+
+// SetDraining marks the service as shutting down, which makes it report that
+// it's not ready so that it stops receiving new traffic.
+func (h *HealthApp) SetDraining(draining bool) {
+	var value int32
+	if draining {
+		value = 1
+	}
+	atomic.StoreInt32(&h.draining, value)
+}
+
+func (h *HealthApp) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// checkDatabase pings the database and checks how many of the pool's
+// connections are in use.
+func (h *HealthApp) checkDatabase(ctx context.Context) map[string]checkResult {
+	results := make(map[string]checkResult)
+
+	ctx, cancel := context.WithTimeout(ctx, h.pingTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := h.db.PingContext(ctx)
+	ping := checkResult{Status: healthOK, DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		ping.Status = healthUnavailable
+		ping.Detail = err.Error()
+	}
+	results["database"] = ping
+
+	stats := h.db.Stats()
+	pool := checkResult{
+		Status: healthOK,
+		Detail: fmt.Sprintf("%d of %d connections in use", stats.InUse, stats.MaxOpenConnections),
+	}
+	if stats.MaxOpenConnections == 0 {
+		pool.Detail = fmt.Sprintf("%d connections in use, no limit", stats.InUse)
+	} else if float64(stats.InUse) >= h.maxPoolUsage*float64(stats.MaxOpenConnections) {
+		pool.Status = healthUnavailable
+	}
+	results["pool"] = pool
+
+	return results
+}
+
+// cachedDatabaseResults returns the results of the database checks, running
+// them again only if the cached results have expired. Probes from every
+// kubelet and load balancer would otherwise each hit the database.
+func (h *HealthApp) cachedDatabaseResults(ctx context.Context) map[string]checkResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.dbResults == nil || h.now().Sub(h.checked) >= h.cacheTTL {
+		h.dbResults = h.checkDatabase(ctx)
+		h.checked = h.now()
+	}
+	return h.dbResults
+}
+
+func writeHealthReport(writer http.ResponseWriter, r *http.Request, report *healthReport) {
+	report.Status = healthOK
+	for _, result := range report.Checks {
+		if result.Status != healthOK {
+			report.Status = healthUnavailable
+		}
+	}
+
+	jsoned, err := json.Marshal(report)
+	if err != nil {
+		errored(writer, r, fmt.Sprintf("error JSON encoding health report: %s", err))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	if report.Status != healthOK {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if _, err = writer.Write(jsoned); err != nil {
+		requestLog(r).Error(err)
+	}
+}
+
+// Liveness reports whether the process is serving requests. It deliberately
+// doesn't check any dependencies, since restarting the service won't fix an
+// unreachable database.
+func (h *HealthApp) Liveness(writer http.ResponseWriter, r *http.Request) {
+	writeHealthReport(writer, r, &healthReport{
+		Checks: map[string]checkResult{"serving": {Status: healthOK}},
+	})
+}
+
+// Readiness reports whether the service should receive traffic. The database
+// checks are skipped for storage backends without a connection pool.
+func (h *HealthApp) Readiness(writer http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]checkResult)
+	if h.db != nil {
+		for name, result := range h.cachedDatabaseResults(r.Context()) {
+			checks[name] = result
+		}
+	}
+
+	checks["draining"] = checkResult{Status: healthOK}
+	if h.isDraining() {
+		checks["draining"] = checkResult{Status: healthUnavailable, Detail: "the service is shutting down"}
+	}
+
+	writeHealthReport(writer, r, &healthReport{Checks: checks})
+}
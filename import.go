@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// The limits on the size of an import batch, and on how many of the lines
+// that weren't imported are listed in the report.
+const (
+	defaultImportBatchSize = 500
+	maxImportBatchSize     = 5000
+	maxImportErrors        = 1000
+)
+
+// The limits on the size of a single line of an import, which holds one
+// record and so is allowed to be as large as any other JSON request body, and
+// on the size of a whole import sent to POST /admin/import.
+const (
+	maxImportLineSize = maxValidatedBodySize
+	maxImportBodySize = 1 << 30
+)
+
+// ImportLineError is a line of an import that wasn't imported, and why.
+type ImportLineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ImportReport describes what happened to the records in an import. Only the
+// first maxImportErrors of the lines that failed are listed.
+type ImportReport struct {
+	Policy        string            `json:"policy"`
+	DryRun        bool              `json:"dry_run"`
+	Records       int               `json:"records"`
+	Created       int               `json:"created"`
+	Updated       int               `json:"updated"`
+	Skipped       int               `json:"skipped"`
+	Failed        int               `json:"failed"`
+	UsersCreated  int               `json:"users_created"`
+	Errors        []ImportLineError `json:"errors"`
+	ErrorsOmitted int               `json:"errors_omitted,omitempty"`
+}
+
+func (r *ImportReport) fail(line int, message string) {
+	r.Failed++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, ImportLineError{Line: line, Error: message})
+	} else {
+		r.ErrorsOmitted++
+	}
+}
+
+// validateImport returns an error if records can't be imported with the
+// policy and batch size.
+func validateImport(policy string, batchSize int) error {
+	if !importPolicies[policy] {
+		return fmt.Errorf("invalid policy %q; use skip, overwrite or fail", policy)
+	}
+	if batchSize < 1 || batchSize > maxImportBatchSize {
+		return fmt.Errorf("the batch size must be from 1 to %d", maxImportBatchSize)
+	}
+	return nil
+}
+
+// parseImportLine reads the record on a line of JSON Lines.
+func parseImportLine(line []byte) (*ImportRecord, error) {
+	var record ImportRecord
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&record); err != nil {
+		return nil, fmt.Errorf("invalid record: %w", err)
+	}
+	if decoder.More() {
+		return nil, errors.New("invalid record: more than one JSON value on the line")
+	}
+	record.ID = strings.ToLower(record.ID)
+	if err := record.validate(); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// importFailure describes why a record that the store turned away wasn't
+// imported.
+func importFailure(record *ImportRecord, outcome string) string {
+	switch {
+	case outcome == importTaken:
+		return fmt.Sprintf("bag %s belongs to another user", record.ID)
+	case record.Resource == "bags":
+		return fmt.Sprintf("%s already has bag %s", record.Username, record.ID)
+	default:
+		return fmt.Sprintf("%s already has %s", record.Username, record.Resource)
+	}
+}
+
+// importLines imports the records in JSON Lines read from r, batchSize
+// records to a transaction. Lines that can't be imported, including every
+// line of a batch that fails, are reported without stopping the import, which
+// only stops early if r can't be read, a line is longer than
+// maxImportLineSize or ctx is done. Blank lines are ignored.
+func importLines(ctx context.Context, imports importDB, r io.Reader, policy string, dryRun bool, batchSize int, entry *AuditEntry) (*ImportReport, error) {
+	report := &ImportReport{Policy: policy, DryRun: dryRun, Errors: []ImportLineError{}}
+
+	var (
+		records []ImportRecord
+		lines   []int
+	)
+	flush := func() error {
+		if len(records) == 0 {
+			return nil
+		}
+		batch, err := imports.importRecords(ctx, records, policy, dryRun, entry)
+		if err != nil {
+			for _, line := range lines {
+				report.fail(line, err.Error())
+			}
+		} else {
+			report.UsersCreated += batch.UsersCreated
+			for i, outcome := range batch.Outcomes {
+				switch outcome {
+				case importCreated:
+					report.Created++
+				case importUpdated:
+					report.Updated++
+				case importSkipped:
+					report.Skipped++
+				case importFailed:
+					report.fail(lines[i], batch.Errors[i])
+				default:
+					report.fail(lines[i], importFailure(&records[i], outcome))
+				}
+			}
+		}
+		records, lines = records[:0], lines[:0]
+		return ctx.Err()
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxImportLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Bytes()
+		if len(bytes.TrimSpace(text)) == 0 {
+			continue
+		}
+
+		report.Records++
+		record, err := parseImportLine(text)
+		if err != nil {
+			report.fail(line, err.Error())
+		} else {
+			records = append(records, *record)
+			lines = append(lines, line)
+		}
+
+		if len(records) >= batchSize {
+			if err = flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		return report, fmt.Errorf("line %d is longer than %d bytes: %w", line+1, maxImportLineSize, err)
+	} else if err != nil {
+		return report, err
+	}
+	return report, flush()
+}
+
+// ImportApp loads users' data in bulk from JSON Lines.
+type ImportApp struct {
+	imports     importDB
+	router      *mux.Router
+	maxBodySize int64
+}
+
+// NewImportApp returns a new *ImportApp.
+func NewImportApp(db importDB, router *mux.Router) *ImportApp {
+	importApp := &ImportApp{
+		imports:     db,
+		router:      router,
+		maxBodySize: maxImportBodySize,
+	}
+	importApp.router.HandleFunc("/admin/import", importApp.Import).Methods(http.MethodPost)
+	return importApp
+}
+
+// Import imports the JSON Lines in the request body, one record per line, and
+// reports what happened to them. The policy query parameter decides what
+// happens to records for documents that already exist: skip (the default),
+// overwrite or fail. With ?dry_run=true nothing is stored and the report says
+// what would have been, though each batch is checked as if the ones before it
+// hadn't been imported.
+//
+// The body isn't JSON, so SpecValidator leaves it alone and it's streamed
+// from the connection a line at a time rather than read into memory first.
+func (i *ImportApp) Import(writer http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	policy := query.Get("policy")
+	if policy == "" {
+		policy = importSkip
+	}
+
+	dryRun := false
+	if value := query.Get("dry_run"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			badRequest(writer, r, fmt.Sprintf("invalid dry_run value %q", value))
+			return
+		}
+	}
+
+	batchSize := defaultImportBatchSize
+	if value := query.Get("batch_size"); value != "" {
+		var err error
+		if batchSize, err = strconv.Atoi(value); err != nil {
+			badRequest(writer, r, fmt.Sprintf("invalid batch_size value %q", value))
+			return
+		}
+	}
+
+	if err := validateImport(policy, batchSize); err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	body := &countingReader{r: http.MaxBytesReader(writer, r.Body, i.maxBodySize)}
+	report, err := importLines(r.Context(), i.imports, body, policy, dryRun, batchSize, newAuditEntry(r, "", "", "import"))
+	if err != nil && (body.n >= i.maxBodySize || errors.Is(err, bufio.ErrTooLong)) {
+		tooLarge(writer, r, fmt.Sprintf("error importing after %d record(s): %s", report.Records, err))
+		return
+	}
+	if err != nil {
+		errored(writer, r, fmt.Sprintf("error importing after %d record(s): %s", report.Records, err))
+		return
+	}
+
+	if !dryRun {
+		requestLog(r).WithFields(log.Fields{
+			"service": "import",
+			"actor":   requestActor(r),
+		}).Infof("imported %d record(s) with the %s policy: %d created, %d updated, %d skipped, %d failed",
+			report.Records, policy, report.Created, report.Updated, report.Skipped, report.Failed)
+	}
+
+	writeJSON(writer, r, report)
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// runImport implements the import subcommand: "import [--policy
+// skip|overwrite|fail] [--dry-run] [--batch-size n] [--json] [file]". The
+// records are read from standard input if no file is given, and the report
+// is written to standard output. It fails if any line wasn't imported.
+func runImport(ctx context.Context, imports importDB, args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := newCommandFlags("import", "user-info import [--policy skip|overwrite|fail] [--dry-run] [--batch-size n] [--json] [file]")
+	policy := flags.String("policy", importSkip, "What to do with records for documents that already exist")
+	dryRun := flags.Bool("dry-run", false, "Report what would be imported without importing it")
+	batchSize := flags.Int("batch-size", defaultImportBatchSize, "The number of records to import in each transaction")
+	if err := flags.parse(args, 0, 1); err != nil {
+		return err
+	}
+	if err := validateImport(*policy, *batchSize); err != nil {
+		return err
+	}
+
+	if path := flags.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		stdin = f
+	}
+
+	entry := &AuditEntry{
+		OccurredAt: time.Now().UTC(),
+		Actor:      "command-line",
+		Operation:  "import",
+	}
+	report, err := importLines(ctx, imports, stdin, *policy, *dryRun, *batchSize, entry)
+	if err != nil {
+		return fmt.Errorf("error importing after %d record(s): %w", report.Records, err)
+	}
+
+	if *flags.json {
+		if err = writeCommandJSON(stdout, report); err != nil {
+			return err
+		}
+	} else {
+		verb := "imported"
+		if report.DryRun {
+			verb = "would import"
+		}
+		fmt.Fprintf(stdout, "%s %d record(s) with the %s policy: %d created, %d updated, %d skipped, %d failed, %d new user(s)\n",
+			verb, report.Records, report.Policy, report.Created, report.Updated, report.Skipped, report.Failed, report.UsersCreated)
+		for _, lineErr := range report.Errors {
+			fmt.Fprintf(stdout, "line %d: %s\n", lineErr.Line, lineErr.Error)
+		}
+		if report.ErrorsOmitted > 0 {
+			fmt.Fprintf(stdout, "... and %d more\n", report.ErrorsOmitted)
+		}
+	}
+
+	if report.Failed > 0 {
+		return fmt.Errorf("%d record(s) were not imported", report.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// The import policies decide what happens to a record when the user already
+// has that document, or a bag with the same ID.
+const (
+	importSkip      = "skip"
+	importOverwrite = "overwrite"
+	importFail      = "fail"
+)
+
+var importPolicies = map[string]bool{
+	importSkip:      true,
+	importOverwrite: true,
+	importFail:      true,
+}
+
+// The outcomes of importing a record. A conflict is a record that wasn't
+// imported under the fail policy, a taken bag ID belongs to another user and
+// a failed record ran into an error that undid it without undoing the rest of
+// its batch.
+const (
+	importCreated  = "created"
+	importUpdated  = "updated"
+	importSkipped  = "skipped"
+	importConflict = "conflict"
+	importTaken    = "taken"
+	importFailed   = "failed"
+)
+
+// ImportRecord is one line of a JSON Lines import. The ID and the default
+// flag only apply to bags; a bag without an ID gets a new one.
+type ImportRecord struct {
+	Resource string          `json:"resource"`
+	Username string          `json:"username"`
+	ID       string          `json:"id,omitempty"`
+	Default  bool            `json:"default,omitempty"`
+	Document json.RawMessage `json:"document"`
+}
+
+// importTables are the single-document resources that can be imported, with
+// the table and column each one is stored in.
+var importTables = map[string]struct{ table, column string }{
+	"preferences": {"user_preferences", "preferences"},
+	"sessions":    {"user_sessions", "session"},
+	"searches":    {"user_saved_searches", "saved_searches"},
+}
+
+// validate returns an error if the record can't be imported, whatever is
+// already stored.
+func (r *ImportRecord) validate() error {
+	if r.Username == "" {
+		return errors.New("a username is required")
+	}
+	if _, ok := importTables[r.Resource]; !ok && r.Resource != "bags" {
+		return fmt.Errorf("unknown resource %q; use preferences, sessions, searches or bags", r.Resource)
+	}
+	if r.Resource != "bags" && (r.ID != "" || r.Default) {
+		return errors.New("only bags can have an id or be the default")
+	}
+	if r.ID != "" && !uuidPattern.MatchString(r.ID) {
+		return fmt.Errorf("invalid bag ID %q", r.ID)
+	}
+	if len(r.Document) == 0 {
+		return errors.New("a document is required")
+	}
+
+	// Saved searches can be any JSON; everything else is an object, just as
+	// the endpoints require.
+	var err error
+	if r.Resource == "searches" {
+		var document interface{}
+		err = json.Unmarshal(r.Document, &document)
+	} else {
+		var document map[string]interface{}
+		err = json.Unmarshal(r.Document, &document)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid document: %w", err)
+	}
+	return nil
+}
+
+// importEvent returns the change event for storing the record, which is an
+// update if replaced.
+func (r *ImportRecord) importEvent(ctx context.Context, bagID string, replaced bool) *ChangeEvent {
+	operation := "create"
+	if replaced {
+		operation = "update"
+	}
+	if r.Resource == "bags" {
+		return newChangeEvent(ctx, r.Username, r.Resource, operation, bagEventData{BagID: bagID, Contents: exportJSON(string(r.Document))})
+	}
+	return newChangeEvent(ctx, r.Username, r.Resource, operation, exportJSON(string(r.Document)))
+}
+
+// importAudit returns the audit entry for storing the record in place of the
+// document before, based on entry.
+func (r *ImportRecord) importAudit(entry *AuditEntry, bagID, before string, replaced bool) (AuditEntry, error) {
+	audited := *entry
+	audited.TargetUser = r.Username
+	audited.Resource = r.Resource
+	audited.Operation = "create"
+	if replaced {
+		audited.Operation = "update"
+	}
+	audited.BeforeHash = auditHash(before)
+	audited.AfterHash = auditHash(string(r.Document))
+	if r.Resource == "bags" {
+		audited.BeforeHash = auditHash(bagAuditDocument(before))
+		audited.AfterHash = auditHash(bagAuditDocument(string(r.Document)))
+		detail, err := json.Marshal(bagAuditDetail{BagID: bagID})
+		if err != nil {
+			return audited, err
+		}
+		audited.Detail = detail
+	}
+	return audited, nil
+}
+
+// defaultBagAudit returns the audit entry for making the imported bag the
+// user's default bag in place of the one before, based on entry.
+func defaultBagAudit(entry *AuditEntry, username, bagID, before string) (AuditEntry, error) {
+	audited := *entry
+	audited.TargetUser = username
+	audited.Resource = "bags"
+	audited.Operation = "set_default"
+	audited.BeforeHash = auditHash(before)
+	audited.AfterHash = auditHash(bagID)
+	detail, err := json.Marshal(bagAuditDetail{BagID: bagID})
+	audited.Detail = detail
+	return audited, err
+}
+
+// ImportBatch is the result of importing a batch of records.
+type ImportBatch struct {
+	// Outcomes holds the outcome of each record, in order.
+	Outcomes []string
+
+	// UsersCreated counts the users that didn't exist before the batch.
+	UsersCreated int
+
+	// Errors holds the error that each failed record ran into, by the
+	// record's index in the batch.
+	Errors map[int]string
+}
+
+// fail records that the next record in the batch failed with err.
+func (b *ImportBatch) fail(record *ImportRecord, err error) {
+	if b.Errors == nil {
+		b.Errors = make(map[int]string)
+	}
+	b.Errors[len(b.Outcomes)] = fmt.Sprintf("error importing %s for %s: %s", record.Resource, record.Username, err)
+	b.Outcomes = append(b.Outcomes, importFailed)
+}
+
+// importDB defines the interface for storing imported records.
+type importDB interface {
+	// importRecords stores valid records in one transaction under the policy,
+	// creating the users that don't exist, along with their events and audit
+	// entries, which are based on entry. A record that runs into an error is
+	// undone on its own and reported as failed; only errors that leave the
+	// transaction unusable, such as running out of time, fail the batch.
+	// Nothing is kept for a dry run, but the outcomes are the same as if it
+	// were.
+	importRecords(ctx context.Context, records []ImportRecord, policy string, dryRun bool, entry *AuditEntry) (*ImportBatch, error)
+}
+
+// ImportDB implements the importDB interface on top of the DE database.
+type ImportDB struct {
+	db *tracedDB
+}
+
+// NewImportDB returns a newly created *ImportDB.
+func NewImportDB(db *sql.DB) *ImportDB {
+	return &ImportDB{
+		db: newTracedDB(db),
+	}
+}
+
+// importUserID returns the user's ID, creating the user if they don't exist
+// and counting them in the batch. IDs are cached in ids.
+func importUserID(ctx context.Context, tx *tracedTx, username string, ids map[string]string, batch *ImportBatch) (string, error) {
+	if id, ok := ids[username]; ok {
+		return id, nil
+	}
+
+	var id string
+	err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE username = $1`, username).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRowContext(ctx, `INSERT INTO users (username) VALUES ($1) RETURNING id`, username).Scan(&id)
+		batch.UsersCreated++
+	}
+	if err != nil {
+		return "", err
+	}
+	ids[username] = id
+	return id, nil
+}
+
+// importDocument stores a single-document record for the user and returns its
+// outcome.
+func importDocument(ctx context.Context, tx *tracedTx, record *ImportRecord, userID, policy string, entry *AuditEntry) (string, error) {
+	t := importTables[record.Resource]
+
+	docID, before, err := lockDocument(ctx, tx, t.table, t.column, userID)
+	replaced := err == nil
+	switch {
+	case err == sql.ErrNoRows:
+		query := fmt.Sprintf(`INSERT INTO %s (user_id, %s) VALUES ($1, $2)`, t.table, t.column)
+		_, err = tx.ExecContext(ctx, query, userID, string(record.Document))
+	case err != nil:
+	case policy == importSkip:
+		return importSkipped, nil
+	case policy == importFail:
+		return importConflict, nil
+	default:
+		query := fmt.Sprintf(`UPDATE %s SET %s = $1 WHERE id = $2`, t.table, t.column)
+		_, err = tx.ExecContext(ctx, query, string(record.Document), docID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return importRecorded(ctx, tx, record, "", before, replaced, entry)
+}
+
+// importBag stores a bag record for the user and returns its outcome.
+func importBag(ctx context.Context, tx *tracedTx, record *ImportRecord, userID, policy string, entry *AuditEntry) (string, error) {
+	bagID := record.ID
+	if bagID == "" {
+		bagID = newUUID()
+	}
+
+	var owner, before string
+	err := tx.QueryRowContext(ctx, `SELECT user_id, contents FROM bags WHERE id = $1 FOR UPDATE`, bagID).Scan(&owner, &before)
+	replaced := err == nil
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.ExecContext(ctx, `INSERT INTO bags (id, user_id, contents) VALUES ($1, $2, $3)`, bagID, userID, string(record.Document))
+	case err != nil:
+	case owner != userID:
+		return importTaken, nil
+	case policy == importSkip:
+		return importSkipped, nil
+	case policy == importFail:
+		return importConflict, nil
+	default:
+		_, err = tx.ExecContext(ctx, `UPDATE bags SET contents = $1 WHERE id = $2`, string(record.Document), bagID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	outcome, err := importRecorded(ctx, tx, record, bagID, before, replaced, entry)
+	if err != nil || !record.Default {
+		return outcome, err
+	}
+
+	previous, err := defaultBagID(ctx, tx, userID)
+	if err != nil {
+		return "", err
+	}
+	query := `INSERT INTO default_bags (user_id, bag_id) VALUES ($1, $2) ON CONFLICT (user_id) DO UPDATE SET bag_id = $2`
+	if _, err = tx.ExecContext(ctx, query, userID, bagID); err != nil {
+		return "", err
+	}
+	audited, err := defaultBagAudit(entry, record.Username, bagID, previous)
+	if err != nil {
+		return "", err
+	}
+	if err = insertAuditEntry(ctx, tx, &audited); err != nil {
+		return "", err
+	}
+	if err = insertEvent(ctx, tx, newChangeEvent(ctx, record.Username, "bags", "set_default", bagEventData{BagID: bagID})); err != nil {
+		return "", err
+	}
+	return outcome, nil
+}
+
+// importRecorded adds the event and audit entry for a record that was stored
+// and returns its outcome.
+func importRecorded(ctx context.Context, tx *tracedTx, record *ImportRecord, bagID, before string, replaced bool, entry *AuditEntry) (string, error) {
+	audited, err := record.importAudit(entry, bagID, before, replaced)
+	if err != nil {
+		return "", err
+	}
+	if err = insertAuditEntry(ctx, tx, &audited); err != nil {
+		return "", err
+	}
+	if err = insertEvent(ctx, tx, record.importEvent(ctx, bagID, replaced)); err != nil {
+		return "", err
+	}
+	if replaced {
+		return importUpdated, nil
+	}
+	return importCreated, nil
+}
+
+// importRecord stores a record, creating its user if they don't exist, and
+// returns its outcome.
+func importRecord(ctx context.Context, tx *tracedTx, record *ImportRecord, policy string, ids map[string]string, batch *ImportBatch, entry *AuditEntry) (string, error) {
+	userID, err := importUserID(ctx, tx, record.Username, ids, batch)
+	if err != nil {
+		return "", err
+	}
+	if record.Resource == "bags" {
+		return importBag(ctx, tx, record, userID, policy, entry)
+	}
+	return importDocument(ctx, tx, record, userID, policy, entry)
+}
+
+func (i *ImportDB) importRecords(ctx context.Context, records []ImportRecord, policy string, dryRun bool, entry *AuditEntry) (*ImportBatch, error) {
+	ctx, done := startOperation(ctx, "ImportDB.importRecords")
+	defer done()
+
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	batch := &ImportBatch{Outcomes: make([]string, 0, len(records))}
+	ids := make(map[string]string)
+	for n := range records {
+		record := &records[n]
+		usersCreated := batch.UsersCreated
+
+		// Each record gets a savepoint, so that one that fails can be rolled
+		// back without the rest of the batch.
+		if _, err = tx.ExecContext(ctx, `SAVEPOINT import_record`); err != nil {
+			return nil, err
+		}
+		outcome, err := importRecord(ctx, tx, record, policy, ids, batch, entry)
+		if err != nil && ctx.Err() != nil {
+			return nil, fmt.Errorf("error importing %s for %s: %w", record.Resource, record.Username, err)
+		}
+		if err != nil {
+			if _, rollbackErr := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT import_record`); rollbackErr != nil {
+				return nil, rollbackErr
+			}
+			// A user created for the record was rolled back along with it.
+			if batch.UsersCreated > usersCreated {
+				delete(ids, record.Username)
+				batch.UsersCreated = usersCreated
+			}
+			batch.fail(record, err)
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, `RELEASE SAVEPOINT import_record`); err != nil {
+			return nil, err
+		}
+		batch.Outcomes = append(batch.Outcomes, outcome)
+	}
+
+	// A dry run goes through all of the same statements so that its outcomes
+	// are exact, and then rolls them back.
+	if dryRun {
+		return batch, nil
+	}
+
+	for n, outcome := range batch.Outcomes {
+		kind, ok := importCaches[records[n].Resource]
+		if !ok || (outcome != importCreated && outcome != importUpdated) {
+			continue
+		}
+		if err = notifyInvalidation(ctx, tx, kind, records[n].Username); err != nil {
+			return nil, err
+		}
+	}
+	return batch, tx.Commit()
+}
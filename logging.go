@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// validRequestID limits the request IDs accepted from callers so that they
+// can't be used to inject anything into the logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestInfo is shared by everything handling a request, so that the access
+// log can include details that are only discovered further down the chain.
+type requestInfo struct {
+	id       string
+	identity *Identity
+	timedOut bool
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// requestID returns the ID of the request.
+func requestID(r *http.Request) string {
+	if info := requestInfoFromContext(r.Context()); info != nil {
+		return info.id
+	}
+	return r.Header.Get(requestIDHeader)
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	randomBytes(id)
+	return hex.EncodeToString(id)
+}
+
+// accessLog is the logger used for access log lines. It always writes JSON,
+// regardless of the format used for the rest of the logs.
+var accessLog = &log.Logger{
+	Out:       os.Stderr,
+	Formatter: &log.JSONFormatter{},
+	Hooks:     make(log.LevelHooks),
+	Level:     log.InfoLevel,
+}
+
+// loggingSettings reads the log level and formatter from the user_info.log
+// section of the configuration.
+func loggingSettings(cfg *viper.Viper) (log.Level, log.Formatter, error) {
+	cfg.SetDefault("user_info.log.level", "info")
+	cfg.SetDefault("user_info.log.format", "text")
+	cfg.SetDefault("user_info.log.access_log", true)
+
+	level, err := log.ParseLevel(cfg.GetString("user_info.log.level"))
+	if err != nil {
+		return level, nil, err
+	}
+
+	switch cfg.GetString("user_info.log.format") {
+	case "text":
+		return level, &log.TextFormatter{}, nil
+	case "json":
+		return level, &log.JSONFormatter{}, nil
+	default:
+		return level, nil, fmt.Errorf("unknown log format %q", cfg.GetString("user_info.log.format"))
+	}
+}
+
+// configureLogging sets up the logger from the user_info.log section of the
+// configuration.
+func configureLogging(cfg *viper.Viper) error {
+	level, formatter, err := loggingSettings(cfg)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	log.SetFormatter(formatter)
+
+	if !cfg.GetBool("user_info.log.access_log") {
+		accessLog.SetLevel(log.WarnLevel)
+	}
+
+	return nil
+}
+
+// requestMiddleware is a mux.MiddlewareFunc that assigns every request an ID
+// and writes an access log line once the request has been handled. Callers
+// may supply their own ID in the X-Request-ID header; it's echoed back in the
+// response either way.
+func requestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		info := &requestInfo{id: id}
+		writer.Header().Set(requestIDHeader, id)
+
+		recorder := newResponseRecorder(writer)
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		var tpl string
+		if route := mux.CurrentRoute(r); route != nil {
+			tpl, _ = route.GetPathTemplate()
+		}
+
+		fields := log.Fields{
+			"request_id":  id,
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"route":       tpl,
+			"status":      recorder.status,
+			"bytes":       recorder.bytes,
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"remote_addr": r.RemoteAddr,
+		}
+		if user, ok := mux.Vars(r)["username"]; ok {
+			fields["user"] = user
+		}
+		if info.identity != nil {
+			if info.identity.Subject != "" {
+				fields["subject"] = info.identity.Subject
+			}
+			if info.identity.Client != "" {
+				fields["client"] = info.identity.Client
+			}
+		}
+		accessLog.WithFields(fields).Info("request handled")
+	})
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	_ "expvar"
 	"flag"
-	"net/http"
+	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/cyverse-de/configurate"
-	"github.com/cyverse-de/dbutil"
 	_ "github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -25,8 +28,20 @@ func main() {
 		cfg         *viper.Viper
 	)
 
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: user-info [flags] [serve|migrate|validate-config|export|merge|inspect|stats|purge-user|import] [args]")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	command, args := flag.Arg(0), []string{}
+	if flag.NArg() > 0 {
+		args = flag.Args()[1:]
+	}
+	if !knownCommand(command) {
+		log.Fatalf("unknown command %q", command)
+	}
+
 	if *showVersion {
 		AppVersion()
 		os.Exit(0)
@@ -40,48 +55,213 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
-	dburi := cfg.GetString("db.uri")
-	connector, err := dbutil.NewDefaultConnector("1m")
-	if err != nil {
+	// Logging problems are among those reported, so the configuration is
+	// checked before logging is configured.
+	if command == "validate-config" {
+		if err = runValidateConfig(cfg, args, os.Stdout); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
+	if err = configureLogging(cfg); err != nil {
 		log.Fatal(err.Error())
 	}
 
-	log.Info("Connecting to the database...")
-	db, err := connector.Connect("postgres", dburi)
+	// The subcommands use the same timeouts and send the same cache
+	// invalidations as the service does.
+	configureDBTimeouts(cfg)
+	configureCacheChannel(cfg)
+
+	if command == "migrate" {
+		db, err := openPostgres(cfg.GetString("db.uri"))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		err = runMigrate(context.Background(), db, args, os.Stdout)
+		db.Close() // nolint:errcheck
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
+	storage, err := OpenStorage(cfg)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	defer db.Close()
-	log.Info("Connected to the database.")
+	log.Infof("Using the %s storage backend", storage.Backend)
+
+	if run, ok := storageCommands[command]; ok {
+		err = run(context.Background(), storage, args, os.Stdout)
+		storage.Close() // nolint:errcheck
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
 
-	if err := db.Ping(); err != nil {
+	if storage.Backend == "postgres" && cfg.GetBool("user_info.migrations.require_current") {
+		if err = NewMigrator(storage.DB).CheckCurrent(context.Background()); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
+	auditRetention := NewAuditRetentionFromConfig(cfg, storage.Audit)
+
+	var cacheListener *CacheListener
+	if cache := NewCacheFromConfig(cfg); cache != nil {
+		storage.UseCache(cache)
+		if storage.Backend == "postgres" {
+			cacheListener, err = ListenForInvalidations(cache, storage.DB, cfg.GetString("db.uri"), cacheChannel)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+		}
+		log.Info("Caching is enabled")
+	}
+
+	eventPublisher := NewOutboxPublisherFromConfig(cfg, storage.Outbox)
+	if eventPublisher != nil {
+		log.Info("Publishing change events is enabled")
+	}
+
+	webhookDispatcher := NewWebhookDispatcherFromConfig(cfg, storage.Webhooks)
+	eventRetention := NewEventRetentionFromConfig(cfg, storage.Outbox, storage.Webhooks)
+
+	changeNotifier := NewChangeNotifier()
+	changeListener, err := WatchChanges(storage, changeNotifier, cfg.GetString("db.uri"))
+	if err != nil {
 		log.Fatal(err.Error())
 	}
-	log.Info("Successfully pinged the database")
+	changeRetention := NewChangeRetentionFromConfig(cfg, storage.Changes)
 
 	userDomain := cfg.GetString("users.domain")
 	if userDomain == "" {
 		userDomain = IplantSuffix
 	}
 
+	// The memory backend has no connection pool to report on or check.
+	var dbHealth dbStatus
+	if storage.DB != nil {
+		registerDBStats(storage.DB)
+		dbHealth = storage.DB
+	}
+
+	if cfg.GetBool("user_info.tracing.enabled") {
+		if tracer, err = NewTracerFromConfig(cfg); err != nil {
+			log.Fatal(err.Error())
+		}
+		log.Info("Tracing is enabled")
+	}
+
 	router := makeRouter()
+	router.Use(tracingMiddleware)
+	router.Use(metricsMiddleware)
+
+	healthApp := NewHealthApp(dbHealth, cfg, router)
+
+	authEnabled := cfg.GetBool("user_info.auth.enabled")
+	if authEnabled {
+		authenticator, err := NewAuthenticator(cfg, userDomain, storage.Clients)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		router.Use(authenticator.Middleware)
+		log.Info("Authentication is enabled")
+	}
 
-	prefsDB := NewPrefsDB(db)
-	prefsApp := NewPrefsApp(prefsDB, router)
+	if cfg.GetBool("user_info.validate_requests") {
+		validator, err := NewSpecValidator()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		router.Use(validator.Middleware)
+		log.Info("Request validation is enabled")
+	}
 
-	sessionsDB := NewSessionsDB(db)
-	sessionsApp := NewSessionsApp(sessionsDB, router)
+	if cfg.GetBool("user_info.rate_limit.enabled") {
+		rateLimiter, err := NewRateLimiter(cfg)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		router.Use(rateLimiter.Middleware)
+		log.Info("Rate limiting is enabled")
+	}
 
-	searchesDB := NewSearchesDB(db)
-	searchesApp := NewSearchesApp(searchesDB, router)
+	prefsApp := NewPrefsApp(storage.Preferences, router)
+	sessionsApp := NewSessionsApp(storage.Sessions, router)
+	searchesApp := NewSearchesApp(storage.Searches, router)
+	bagsApp := NewBagsApp(storage.Bags, router, userDomain)
+	profileApp := NewProfileApp(storage.Profiles, router)
+	exportApp := NewExportApp(storage.Exports, router)
+	changeStreamApp := NewChangeStreamApp(cfg, storage.Changes, storage.Users, changeNotifier, router)
 
-	bagsApp := NewBagsApp(db, router, userDomain)
+	// Nothing but the authenticator keeps callers away from the admin
+	// endpoints, so they're only served when authentication is enabled.
+	if authEnabled {
+		log.Debug(NewServiceClientsApp(storage.Clients, router))
+		log.Debug(NewPurgeApp(storage.Purges, router))
+		log.Debug(NewMergeApp(storage.Merges, router))
+		log.Debug(NewAuditApp(storage.Audit, router))
+		log.Debug(NewChangeFeedApp(storage.Changes, router))
+		log.Debug(NewWebhooksApp(cfg, storage.Webhooks, router))
+		log.Debug(NewImportApp(storage.Imports, router))
+	} else {
+		log.Warn("Authentication is disabled, so the admin endpoints are too")
+	}
 
 	log.Debug(prefsApp)
 	log.Debug(sessionsApp)
 	log.Debug(searchesApp)
 	log.Debug(bagsApp)
+	log.Debug(profileApp)
+	log.Debug(exportApp)
+	log.Debug(changeStreamApp)
+	log.Debug(healthApp)
+
+	server := NewServer(cfg, router, healthApp)
+	server.OnStop(changeNotifier.Close)
+	if cacheListener != nil {
+		server.OnShutdown("cache listener", cacheListener.Close)
+	}
+	if auditRetention != nil {
+		server.OnShutdown("audit retention", auditRetention.Close)
+	}
+	if eventPublisher != nil {
+		server.OnShutdown("event publisher", eventPublisher.Close)
+	}
+	if webhookDispatcher != nil {
+		server.OnShutdown("webhook dispatcher", webhookDispatcher.Close)
+	}
+	if eventRetention != nil {
+		server.OnShutdown("event retention", eventRetention.Close)
+	}
+	if changeListener != nil {
+		server.OnShutdown("change listener", changeListener.Close)
+	}
+	if changeRetention != nil {
+		server.OnShutdown("change retention", changeRetention.Close)
+	}
+	server.OnShutdown("storage", func(context.Context) error {
+		return storage.Close()
+	})
+	// The other hooks still run traced SQL, so the tracer has to be the last
+	// thing to stop.
+	if tracer != nil {
+		server.OnShutdown("tracer", tracer.Shutdown)
+	}
+
+	listener, err := net.Listen("tcp", fixAddr(*port))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
 
 	log.Info("Listening on port ", *port)
-	log.Fatal(http.ListenAndServe(fixAddr(*port), router))
+	if err = server.Run(listener, stop); err != nil {
+		log.Fatal(err.Error())
+	}
 }
@@ -2,18 +2,41 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
 	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
 )
 
 type MockDB struct {
@@ -28,12 +51,12 @@ func NewMockDB() *MockDB {
 	}
 }
 
-func (m *MockDB) isUser(username string) (bool, error) {
+func (m *MockDB) isUser(ctx context.Context, username string) (bool, error) {
 	_, ok := m.users[username]
 	return ok, nil
 }
 
-func (m *MockDB) hasPreferences(username string) (bool, error) {
+func (m *MockDB) hasPreferences(ctx context.Context, username string) (bool, error) {
 	stored, ok := m.storage[username]
 	if !ok {
 		return false, nil
@@ -51,7 +74,7 @@ func (m *MockDB) hasPreferences(username string) (bool, error) {
 	return true, nil
 }
 
-func (m *MockDB) getPreferences(username string) ([]UserPreferencesRecord, error) {
+func (m *MockDB) getPreferences(ctx context.Context, username string) ([]UserPreferencesRecord, error) {
 	return []UserPreferencesRecord{
 		UserPreferencesRecord{
 			ID:          "id",
@@ -61,7 +84,7 @@ func (m *MockDB) getPreferences(username string) ([]UserPreferencesRecord, error
 	}, nil
 }
 
-func (m *MockDB) insertPreferences(username, prefs string) error {
+func (m *MockDB) insertPreferences(ctx context.Context, username, prefs string) error {
 	if _, ok := m.storage[username]["user-prefs"]; !ok {
 		m.storage[username] = make(map[string]interface{})
 	}
@@ -69,11 +92,11 @@ func (m *MockDB) insertPreferences(username, prefs string) error {
 	return nil
 }
 
-func (m *MockDB) updatePreferences(username, prefs string) error {
-	return m.insertPreferences(username, prefs)
+func (m *MockDB) updatePreferences(ctx context.Context, username, prefs string) error {
+	return m.insertPreferences(ctx, username, prefs)
 }
 
-func (m *MockDB) deletePreferences(username string) error {
+func (m *MockDB) deletePreferences(ctx context.Context, username string) error {
 	delete(m.storage, username)
 	return nil
 }
@@ -144,23 +167,48 @@ func TestConvertNormalPreferences(t *testing.T) {
 	}
 }
 
+func decodeProblem(t *testing.T, recorder *httptest.ResponseRecorder) Problem {
+	var p Problem
+	if ct := recorder.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type was '%s' but should have been 'application/problem+json'", ct)
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
 func TestHandleNonUser(t *testing.T) {
 	var (
-		expectedMsg    = "{\"user\":\"test-user\"}\n"
+		expectedType   = problemTypeBase + "user-not-found"
 		expectedStatus = http.StatusNotFound
 	)
 
 	recorder := httptest.NewRecorder()
-	handleNonUser(recorder, "test-user")
-	actualMsg := recorder.Body.String()
+	request := httptest.NewRequest(http.MethodGet, "/preferences/test-user", nil)
+	request.Header.Set(requestIDHeader, "test-request-id")
+	handleNonUser(recorder, request, "test-user")
 	actualStatus := recorder.Code
+	actual := decodeProblem(t, recorder)
 
 	if actualStatus != expectedStatus {
 		t.Errorf("Status code was %d but should have been %d", actualStatus, expectedStatus)
 	}
 
-	if actualMsg != expectedMsg {
-		t.Errorf("Message was '%s' but should have been '%s'", actualMsg, expectedMsg)
+	if actual.Type != expectedType {
+		t.Errorf("Type was '%s' but should have been '%s'", actual.Type, expectedType)
+	}
+
+	if actual.Status != expectedStatus {
+		t.Errorf("Problem status was %d but should have been %d", actual.Status, expectedStatus)
+	}
+
+	if actual.User != "test-user" {
+		t.Errorf("User was '%s' but should have been 'test-user'", actual.User)
+	}
+
+	if actual.RequestID != "test-request-id" {
+		t.Errorf("Request ID was '%s' but should have been 'test-request-id'", actual.RequestID)
 	}
 }
 
@@ -206,11 +254,11 @@ func TestGetUserPreferencesForRequest(t *testing.T) {
 	expected := []byte("{\"one\":\"two\"}")
 	expectedWrapped := []byte("{\"preferences\":{\"one\":\"two\"}}")
 	mock.users["test-user"] = true
-	if err := mock.insertPreferences("test-user", string(expected)); err != nil {
+	if err := mock.insertPreferences(context.Background(), "test-user", string(expected)); err != nil {
 		t.Error(err)
 	}
 
-	actualWrapped, err := n.getUserPreferencesForRequest("test-user", true)
+	actualWrapped, err := n.getUserPreferencesForRequest(context.Background(), "test-user", true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -219,7 +267,7 @@ func TestGetUserPreferencesForRequest(t *testing.T) {
 		t.Errorf("The return value was '%s' instead of '%s'", actualWrapped, expectedWrapped)
 	}
 
-	actual, err := n.getUserPreferencesForRequest("test-user", false)
+	actual, err := n.getUserPreferencesForRequest(context.Background(), "test-user", false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -236,7 +284,7 @@ func TestPreferencesGetRequest(t *testing.T) {
 
 	expected := []byte("{\"one\":\"two\"}")
 	mock.users["test-user"] = true
-	if err := mock.insertPreferences("test-user", string(expected)); err != nil {
+	if err := mock.insertPreferences(context.Background(), "test-user", string(expected)); err != nil {
 		t.Error(err)
 	}
 
@@ -326,7 +374,7 @@ func TestPreferencesPostRequest(t *testing.T) {
 	expected := []byte(`{"one":"two"}`)
 
 	mock.users[username] = true
-	if err := mock.insertPreferences(username, string(expected)); err != nil {
+	if err := mock.insertPreferences(context.Background(), username, string(expected)); err != nil {
 		t.Error(err)
 	}
 
@@ -379,7 +427,7 @@ func TestPreferencesDelete(t *testing.T) {
 	router := mux.NewRouter()
 	n := NewPrefsApp(mock, router)
 
-	if err := mock.insertPreferences(username, string(expected)); err != nil {
+	if err := mock.insertPreferences(context.Background(), username, string(expected)); err != nil {
 		t.Error(err)
 	}
 
@@ -428,7 +476,7 @@ func TestNewPrefsDB(t *testing.T) {
 		t.Error("NewPrefsDB() returned nil")
 	}
 
-	if prefs.db != db {
+	if prefs.db.DB != db {
 		t.Error("dbs did not match")
 	}
 }
@@ -449,7 +497,7 @@ func TestPreferencesIsUser(t *testing.T) {
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(1))
 
-	present, err := p.isUser("test-user")
+	present, err := p.isUser(context.Background(), "test-user")
 	if err != nil {
 		t.Errorf("error calling isUser(): %s", err)
 	}
@@ -479,7 +527,7 @@ func TestHasPreferences(t *testing.T) {
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{""}).AddRow("1"))
 
-	hasPrefs, err := p.hasPreferences("test-user")
+	hasPrefs, err := p.hasPreferences(context.Background(), "test-user")
 	if err != nil {
 		t.Errorf("error from hasPreferences(): %s", err)
 	}
@@ -509,7 +557,7 @@ func TestGetPreferences(t *testing.T) {
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "preferences"}).AddRow("1", "2", "{}"))
 
-	records, err := p.getPreferences("test-user")
+	records, err := p.getPreferences(context.Background(), "test-user")
 	if err != nil {
 		t.Errorf("error from getPreferences(): %s", err)
 	}
@@ -548,15 +596,25 @@ func TestInsertPreferences(t *testing.T) {
 		t.Error("NewPrefsDB returned nil")
 	}
 
+	mock.ExpectBegin()
+
 	mock.ExpectQuery("SELECT id FROM users WHERE username =").
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
+	mock.ExpectQuery("SELECT id, preferences FROM user_preferences WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "preferences"}))
+
 	mock.ExpectExec("INSERT INTO user_preferences \\(user_id, preferences\\) VALUES").
 		WithArgs("1", "{}").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	if err = p.insertPreferences("test-user", "{}"); err != nil {
+	expectAuditedEvent(mock, "preferences", "create", "", `{}`)
+
+	mock.ExpectCommit()
+
+	if err = p.insertPreferences(context.Background(), "test-user", "{}"); err != nil {
 		t.Errorf("error inserting preferences: %s", err)
 	}
 
@@ -577,15 +635,25 @@ func TestUpdatePreferences(t *testing.T) {
 		t.Error("NewPrefsDB returned nil")
 	}
 
+	mock.ExpectBegin()
+
 	mock.ExpectQuery("SELECT id FROM users WHERE username =").
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
+	mock.ExpectQuery("SELECT id, preferences FROM user_preferences WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "preferences"}).AddRow("d1", `{"a":1}`))
+
 	mock.ExpectExec("UPDATE ONLY user_preferences SET preferences =").
 		WithArgs("1", "{}").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	if err = p.updatePreferences("test-user", "{}"); err != nil {
+	expectAuditedEvent(mock, "preferences", "update", `{"a":1}`, `{}`)
+
+	mock.ExpectCommit()
+
+	if err = p.updatePreferences(context.Background(), "test-user", "{}"); err != nil {
 		t.Errorf("error updating preferences: %s", err)
 	}
 
@@ -606,15 +674,25 @@ func TestDeletePreferences(t *testing.T) {
 		t.Error("NewPrefsDB returned nil")
 	}
 
+	mock.ExpectBegin()
+
 	mock.ExpectQuery("SELECT id FROM users WHERE username =").
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
+	mock.ExpectQuery("SELECT id, preferences FROM user_preferences WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "preferences"}).AddRow("d1", `{"a":1}`))
+
 	mock.ExpectExec("DELETE FROM ONLY user_preferences WHERE user_id =").
 		WithArgs("1").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	if err = p.deletePreferences("test-user"); err != nil {
+	expectAuditedEvent(mock, "preferences", "delete", `{"a":1}`, "")
+
+	mock.ExpectCommit()
+
+	if err = p.deletePreferences(context.Background(), "test-user"); err != nil {
 		t.Errorf("error deleting preferences: %s", err)
 	}
 
@@ -626,7 +704,7 @@ func TestDeletePreferences(t *testing.T) {
 // -------- End Preferences --------
 
 // -------- Start Sessions --------
-func (m *MockDB) hasSessions(username string) (bool, error) {
+func (m *MockDB) hasSessions(ctx context.Context, username string) (bool, error) {
 	stored, ok := m.storage[username]
 	if !ok {
 		return false, nil
@@ -644,7 +722,7 @@ func (m *MockDB) hasSessions(username string) (bool, error) {
 	return true, nil
 }
 
-func (m *MockDB) getSessions(username string) ([]UserSessionRecord, error) {
+func (m *MockDB) getSessions(ctx context.Context, username string) ([]UserSessionRecord, error) {
 	return []UserSessionRecord{
 		UserSessionRecord{
 			ID:      "id",
@@ -654,7 +732,7 @@ func (m *MockDB) getSessions(username string) ([]UserSessionRecord, error) {
 	}, nil
 }
 
-func (m *MockDB) insertSession(username, session string) error {
+func (m *MockDB) insertSession(ctx context.Context, username, session string) error {
 	if _, ok := m.storage[username]["user-sessions"]; !ok {
 		m.storage[username] = make(map[string]interface{})
 	}
@@ -662,15 +740,46 @@ func (m *MockDB) insertSession(username, session string) error {
 	return nil
 }
 
-func (m *MockDB) updateSession(username, prefs string) error {
-	return m.insertSession(username, prefs)
+func (m *MockDB) updateSession(ctx context.Context, username, prefs string) error {
+	return m.insertSession(ctx, username, prefs)
 }
 
-func (m *MockDB) deleteSession(username string) error {
+func (m *MockDB) deleteSession(ctx context.Context, username string) error {
 	delete(m.storage, username)
 	return nil
 }
 
+// A change that can't be recorded in the audit log isn't made.
+func TestPreferencesAuditFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM users WHERE username =").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	mock.ExpectQuery("SELECT id, preferences FROM user_preferences WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "preferences"}).AddRow("p1", `{"a":1}`))
+	mock.ExpectExec("UPDATE ONLY user_preferences SET preferences =").
+		WithArgs("1", "{}").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO audit_log").
+		WillReturnError(errors.New("boom"))
+	mock.ExpectRollback()
+
+	if err = NewPrefsDB(db).updatePreferences(context.Background(), "test-user", "{}"); err == nil {
+		t.Error("expected an error")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expectations were not met: %s", err)
+	}
+}
+
 func TestConvertBlankSession(t *testing.T) {
 	record := &UserSessionRecord{
 		ID:      "test_id",
@@ -779,11 +888,11 @@ func TestGetUserSessionForRequest(t *testing.T) {
 	expected := []byte("{\"one\":\"two\"}")
 	expectedWrapped := []byte("{\"session\":{\"one\":\"two\"}}")
 	mock.users["test-user"] = true
-	if err := mock.insertSession("test-user", string(expected)); err != nil {
+	if err := mock.insertSession(context.Background(), "test-user", string(expected)); err != nil {
 		t.Error(err)
 	}
 
-	actualWrapped, err := n.getUserSessionForRequest("test-user", true)
+	actualWrapped, err := n.getUserSessionForRequest(context.Background(), "test-user", true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -792,7 +901,7 @@ func TestGetUserSessionForRequest(t *testing.T) {
 		t.Errorf("The return value was '%s' instead of '%s'", actualWrapped, expectedWrapped)
 	}
 
-	actual, err := n.getUserSessionForRequest("test-user", false)
+	actual, err := n.getUserSessionForRequest(context.Background(), "test-user", false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -809,7 +918,7 @@ func TestSessionsGetRequest(t *testing.T) {
 
 	expected := []byte("{\"one\":\"two\"}")
 	mock.users["test-user"] = true
-	if err := mock.insertSession("test-user", string(expected)); err != nil {
+	if err := mock.insertSession(context.Background(), "test-user", string(expected)); err != nil {
 		t.Error(err)
 	}
 
@@ -899,7 +1008,7 @@ func TestSessionsPostRequest(t *testing.T) {
 	expected := []byte(`{"one":"two"}`)
 
 	mock.users[username] = true
-	if err := mock.insertSession(username, string(expected)); err != nil {
+	if err := mock.insertSession(context.Background(), username, string(expected)); err != nil {
 		t.Error(err)
 	}
 
@@ -952,7 +1061,7 @@ func TestSessionsDelete(t *testing.T) {
 	router := mux.NewRouter()
 	n := NewSessionsApp(mock, router)
 
-	if err := mock.insertSession(username, string(expected)); err != nil {
+	if err := mock.insertSession(context.Background(), username, string(expected)); err != nil {
 		t.Error(err)
 	}
 
@@ -1001,7 +1110,7 @@ func TestNewSessionsDB(t *testing.T) {
 		t.Error("NewSessionsDB returned nil")
 	}
 
-	if db != p.db {
+	if db != p.db.DB {
 		t.Error("dbs did not match")
 	}
 }
@@ -1022,7 +1131,7 @@ func TestSessionsIsUser(t *testing.T) {
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(1))
 
-	present, err := p.isUser("test-user")
+	present, err := p.isUser(context.Background(), "test-user")
 	if err != nil {
 		t.Errorf("error calling isUser(): %s", err)
 	}
@@ -1052,7 +1161,7 @@ func TestHasSessions(t *testing.T) {
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{""}).AddRow("1"))
 
-	hasSessions, err := p.hasSessions("test-user")
+	hasSessions, err := p.hasSessions(context.Background(), "test-user")
 	if err != nil {
 		t.Errorf("error from hasSessions(): %s", err)
 	}
@@ -1082,7 +1191,7 @@ func TestGetSessions(t *testing.T) {
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "session"}).AddRow("1", "2", "{}"))
 
-	records, err := p.getSessions("test-user")
+	records, err := p.getSessions(context.Background(), "test-user")
 	if err != nil {
 		t.Errorf("error from getSessions(): %s", err)
 	}
@@ -1121,15 +1230,25 @@ func TestInsertSession(t *testing.T) {
 		t.Error("NewSessionsDB returned nil")
 	}
 
+	mock.ExpectBegin()
+
 	mock.ExpectQuery("SELECT id FROM users WHERE username =").
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
+	mock.ExpectQuery("SELECT id, session FROM user_sessions WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "session"}))
+
 	mock.ExpectExec("INSERT INTO user_sessions \\(user_id, session\\) VALUES").
 		WithArgs("1", "{}").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	if err = p.insertSession("test-user", "{}"); err != nil {
+	expectAuditedEvent(mock, "sessions", "create", "", `{}`)
+
+	mock.ExpectCommit()
+
+	if err = p.insertSession(context.Background(), "test-user", "{}"); err != nil {
 		t.Errorf("error inserting session: %s", err)
 	}
 
@@ -1150,15 +1269,25 @@ func TestUpdateSession(t *testing.T) {
 		t.Error("NewSessionsDB returned nil")
 	}
 
+	mock.ExpectBegin()
+
 	mock.ExpectQuery("SELECT id FROM users WHERE username =").
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
+	mock.ExpectQuery("SELECT id, session FROM user_sessions WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "session"}).AddRow("d1", `{"a":1}`))
+
 	mock.ExpectExec("UPDATE ONLY user_sessions SET session =").
 		WithArgs("1", "{}").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	if err = p.updateSession("test-user", "{}"); err != nil {
+	expectAuditedEvent(mock, "sessions", "update", `{"a":1}`, `{}`)
+
+	mock.ExpectCommit()
+
+	if err = p.updateSession(context.Background(), "test-user", "{}"); err != nil {
 		t.Errorf("error updating session: %s", err)
 	}
 
@@ -1179,15 +1308,25 @@ func TestDeleteSession(t *testing.T) {
 		t.Error("NewSessionsDB returned nil")
 	}
 
+	mock.ExpectBegin()
+
 	mock.ExpectQuery("SELECT id FROM users WHERE username =").
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
+	mock.ExpectQuery("SELECT id, session FROM user_sessions WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "session"}).AddRow("d1", `{"a":1}`))
+
 	mock.ExpectExec("DELETE FROM ONLY user_sessions WHERE user_id =").
 		WithArgs("1").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	if err = p.deleteSession("test-user"); err != nil {
+	expectAuditedEvent(mock, "sessions", "delete", `{"a":1}`, "")
+
+	mock.ExpectCommit()
+
+	if err = p.deleteSession(context.Background(), "test-user"); err != nil {
 		t.Errorf("error deleting session: %s", err)
 	}
 
@@ -1199,7 +1338,7 @@ func TestDeleteSession(t *testing.T) {
 // -------- End Sessions --------
 
 // -------- Start Searches --------
-func (m *MockDB) hasSavedSearches(username string) (bool, error) {
+func (m *MockDB) hasSavedSearches(ctx context.Context, username string) (bool, error) {
 	stored, ok := m.storage[username]
 	if !ok {
 		return false, nil
@@ -1215,16 +1354,16 @@ func (m *MockDB) hasSavedSearches(username string) (bool, error) {
 
 }
 
-func (m *MockDB) getSavedSearches(username string) ([]string, error) {
+func (m *MockDB) getSavedSearches(ctx context.Context, username string) ([]string, error) {
 	return []string{m.storage[username]["saved_searches"].(string)}, nil
 }
 
-func (m *MockDB) deleteSavedSearches(username string) error {
+func (m *MockDB) deleteSavedSearches(ctx context.Context, username string) error {
 	delete(m.storage, username)
 	return nil
 }
 
-func (m *MockDB) insertSavedSearches(username, savedSearches string) error {
+func (m *MockDB) insertSavedSearches(ctx context.Context, username, savedSearches string) error {
 	if _, ok := m.storage[username]["saved_searches"]; !ok {
 		m.storage[username] = make(map[string]interface{})
 	}
@@ -1232,8 +1371,8 @@ func (m *MockDB) insertSavedSearches(username, savedSearches string) error {
 	return nil
 }
 
-func (m *MockDB) updateSavedSearches(username, savedSearches string) error {
-	return m.insertSavedSearches(username, savedSearches)
+func (m *MockDB) updateSavedSearches(ctx context.Context, username, savedSearches string) error {
+	return m.insertSavedSearches(ctx, username, savedSearches)
 }
 
 func TestSearchesGreeting(t *testing.T) {
@@ -1276,7 +1415,7 @@ func TestGetSavedSearchesForRequest(t *testing.T) {
 
 	mock := NewMockDB()
 	mock.users[username] = true
-	if err := mock.insertSavedSearches(username, expectedBody); err != nil {
+	if err := mock.insertSavedSearches(context.Background(), username, expectedBody); err != nil {
 		t.Error(err)
 	}
 
@@ -1367,7 +1506,7 @@ func TestPutUpdateSavedSearchesForRequest(t *testing.T) {
 
 	mock := NewMockDB()
 	mock.users[username] = true
-	if err := mock.insertSavedSearches(username, expectedBody); err != nil {
+	if err := mock.insertSavedSearches(context.Background(), username, expectedBody); err != nil {
 		t.Error(err)
 	}
 
@@ -1465,7 +1604,7 @@ func TestPostUpdateSavedSearchesForRequest(t *testing.T) {
 
 	mock := NewMockDB()
 	mock.users[username] = true
-	if err := mock.insertSavedSearches(username, expectedBody); err != nil {
+	if err := mock.insertSavedSearches(context.Background(), username, expectedBody); err != nil {
 		t.Error(err)
 	}
 
@@ -1513,7 +1652,7 @@ func TestDeleteSavedSearchesForRequest(t *testing.T) {
 
 	mock := NewMockDB()
 	mock.users[username] = true
-	if err := mock.insertSavedSearches(username, expectedBody); err != nil {
+	if err := mock.insertSavedSearches(context.Background(), username, expectedBody); err != nil {
 		t.Error(err)
 	}
 
@@ -1563,7 +1702,7 @@ func TestNewSearchesDB(t *testing.T) {
 		t.Error("NewSearchesDB() returned nil")
 	}
 
-	if prefs.db != db {
+	if prefs.db.DB != db {
 		t.Error("dbs did not match")
 	}
 }
@@ -1584,7 +1723,7 @@ func TestSavedSearchesIsUser(t *testing.T) {
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(1))
 
-	present, err := p.isUser("test-user")
+	present, err := p.isUser(context.Background(), "test-user")
 	if err != nil {
 		t.Errorf("error calling isUser(): %s", err)
 	}
@@ -1610,7 +1749,7 @@ func TestHasSavedSearches(t *testing.T) {
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
 
-	exists, err := p.hasSavedSearches("test-user")
+	exists, err := p.hasSavedSearches(context.Background(), "test-user")
 	if err != nil {
 		t.Errorf("error from hasSavedSearches(): %s", err)
 	}
@@ -1640,7 +1779,7 @@ func TestGetSavedSearches(t *testing.T) {
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"saved_searches"}).AddRow("{}"))
 
-	retval, err := p.getSavedSearches("test-user")
+	retval, err := p.getSavedSearches(context.Background(), "test-user")
 	if err != nil {
 		t.Errorf("error from getSavedSearches(): %s", err)
 	}
@@ -1670,15 +1809,25 @@ func TestInsertSavedSearches(t *testing.T) {
 		t.Error("NewSearchesDB returned nil")
 	}
 
+	mock.ExpectBegin()
+
 	mock.ExpectQuery("SELECT id FROM users WHERE username =").
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
+	mock.ExpectQuery("SELECT id, saved_searches FROM user_saved_searches WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "saved_searches"}))
+
 	mock.ExpectExec("INSERT INTO user_saved_searches \\(user_id").
 		WithArgs("1", "{}").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	if err := p.insertSavedSearches("test-user", "{}"); err != nil {
+	expectAuditedEvent(mock, "searches", "create", "", `{}`)
+
+	mock.ExpectCommit()
+
+	if err := p.insertSavedSearches(context.Background(), "test-user", "{}"); err != nil {
 		t.Errorf("error inserting saved searches: %s", err)
 	}
 
@@ -1699,15 +1848,25 @@ func TestUpdateSavedSearches(t *testing.T) {
 		t.Error("NewSearchesDB returned nil")
 	}
 
+	mock.ExpectBegin()
+
 	mock.ExpectQuery("SELECT id FROM users WHERE username =").
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
+	mock.ExpectQuery("SELECT id, saved_searches FROM user_saved_searches WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "saved_searches"}).AddRow("d1", `{"a":1}`))
+
 	mock.ExpectExec("UPDATE ONLY user_saved_searches SET saved_searches =").
 		WithArgs("1", "{}").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	if err := p.updateSavedSearches("test-user", "{}"); err != nil {
+	expectAuditedEvent(mock, "searches", "update", `{"a":1}`, `{}`)
+
+	mock.ExpectCommit()
+
+	if err := p.updateSavedSearches(context.Background(), "test-user", "{}"); err != nil {
 		t.Errorf("error updating saved searches: %s", err)
 	}
 
@@ -1728,15 +1887,25 @@ func TestDeleteSavedSearches(t *testing.T) {
 		t.Error("NewSearchesDB returned nil")
 	}
 
+	mock.ExpectBegin()
+
 	mock.ExpectQuery("SELECT id FROM users WHERE username =").
 		WithArgs("test-user").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
 
+	mock.ExpectQuery("SELECT id, saved_searches FROM user_saved_searches WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "saved_searches"}).AddRow("d1", `{"a":1}`))
+
 	mock.ExpectExec("DELETE FROM ONLY user_saved_searches WHERE user_id").
 		WithArgs("1").
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	if err := p.deleteSavedSearches("test-user"); err != nil {
+	expectAuditedEvent(mock, "searches", "delete", `{"a":1}`, "")
+
+	mock.ExpectCommit()
+
+	if err := p.deleteSavedSearches(context.Background(), "test-user"); err != nil {
 		t.Errorf("error deleting saved searches: %s", err)
 	}
 
@@ -1765,41 +1934,61 @@ func TestFixAddrWithPrefix(t *testing.T) {
 
 func TestBadRequest(t *testing.T) {
 	var (
-		expectedMsg    = "test message\n"
+		expectedMsg    = "test message"
 		expectedStatus = http.StatusBadRequest
 	)
 
 	recorder := httptest.NewRecorder()
-	badRequest(recorder, "test message")
-	actualMsg := recorder.Body.String()
+	badRequest(recorder, httptest.NewRequest(http.MethodGet, "/", nil), "test message")
 	actualStatus := recorder.Code
+	actual := decodeProblem(t, recorder)
 
 	if actualStatus != expectedStatus {
 		t.Errorf("Status code was %d but should have been %d", actualStatus, expectedStatus)
 	}
 
-	if actualMsg != expectedMsg {
-		t.Errorf("Message was '%s' but should have been '%s'", actualMsg, expectedMsg)
+	if actual.Detail != expectedMsg {
+		t.Errorf("Detail was '%s' but should have been '%s'", actual.Detail, expectedMsg)
 	}
 }
 
 func TestErrored(t *testing.T) {
 	var (
-		expectedMsg    = "test message\n"
 		expectedStatus = http.StatusInternalServerError
 	)
 
 	recorder := httptest.NewRecorder()
-	errored(recorder, "test message")
-	actualMsg := recorder.Body.String()
+	errored(recorder, httptest.NewRequest(http.MethodGet, "/", nil), "pq: relation does not exist")
 	actualStatus := recorder.Code
+	actual := decodeProblem(t, recorder)
 
 	if actualStatus != expectedStatus {
 		t.Errorf("Status code was %d but should have been %d", actualStatus, expectedStatus)
 	}
 
-	if actualMsg != expectedMsg {
-		t.Errorf("Message was '%s' but should have been '%s'", actualMsg, expectedMsg)
+	if actual.Detail != internalErrorDetail {
+		t.Errorf("Detail was '%s' but should have been '%s'", actual.Detail, internalErrorDetail)
+	}
+}
+
+func TestNonUserStatusIsConsistent(t *testing.T) {
+	mock := NewMockDB()
+	router := mux.NewRouter()
+	NewPrefsApp(mock, router)
+	NewSessionsApp(mock, router)
+	NewSearchesApp(mock, router)
+
+	for _, path := range []string{"/preferences/nobody", "/sessions/nobody", "/searches/nobody"} {
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader("{}")))
+			if recorder.Code != http.StatusNotFound {
+				t.Errorf("%s %s returned %d instead of %d", method, path, recorder.Code, http.StatusNotFound)
+			}
+			if p := decodeProblem(t, recorder); p.Type != problemTypeBase+"user-not-found" {
+				t.Errorf("%s %s returned problem type %s", method, path, p.Type)
+			}
+		}
 	}
 }
 
@@ -1927,3 +2116,4523 @@ func TestRootGreeting(t *testing.T) {
 		t.Errorf("Status code was %d but should have been %d", actualStatus, expectedStatus)
 	}
 }
+
+func signTestToken(t *testing.T, key []byte, claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payloadBytes, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(payloadBytes)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(header + "." + payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	cfg := viper.New()
+	cfg.Set("user_info.auth.hmac_key", "test-key")
+	cfg.Set("user_info.auth.audience", "de")
+	a, err := NewAuthenticator(cfg, IplantSuffix, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	if err := mock.insertPreferences(context.Background(), "test-user", `{"one":"two"}`); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	NewPrefsApp(mock, router)
+	NewChangeFeedApp(NewMemoryStorage().Changes, router)
+	router.Use(newTestAuthenticator(t).Middleware)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"public greeting", "/preferences/", "", http.StatusOK},
+		{"missing token", "/preferences/test-user", "", http.StatusUnauthorized},
+		{"own data", "/preferences/test-user", signTestToken(t, []byte("test-key"), map[string]interface{}{
+			"preferred_username": "test-user", "aud": "de", "exp": exp,
+		}), http.StatusOK},
+		{"qualified subject", "/preferences/test-user", signTestToken(t, []byte("test-key"), map[string]interface{}{
+			"preferred_username": "test-user" + IplantSuffix, "aud": []string{"other", "de"}, "exp": exp,
+		}), http.StatusOK},
+		{"another user's data", "/preferences/test-user", signTestToken(t, []byte("test-key"), map[string]interface{}{
+			"preferred_username": "other-user", "aud": "de", "exp": exp,
+		}), http.StatusForbidden},
+		{"admin role", "/preferences/test-user", signTestToken(t, []byte("test-key"), map[string]interface{}{
+			"preferred_username": "other-user", "aud": "de", "exp": exp,
+			"realm_access": map[string]interface{}{"roles": []string{"admin"}},
+		}), http.StatusOK},
+		{"change feed", "/changes", signTestToken(t, []byte("test-key"), map[string]interface{}{
+			"preferred_username": "test-user", "aud": "de", "exp": exp,
+		}), http.StatusForbidden},
+		{"change feed as an admin", "/changes", signTestToken(t, []byte("test-key"), map[string]interface{}{
+			"preferred_username": "other-user", "aud": "de", "exp": exp,
+			"realm_access": map[string]interface{}{"roles": []string{"admin"}},
+		}), http.StatusOK},
+		{"expired", "/preferences/test-user", signTestToken(t, []byte("test-key"), map[string]interface{}{
+			"preferred_username": "test-user", "aud": "de", "exp": float64(time.Now().Add(-time.Hour).Unix()),
+		}), http.StatusUnauthorized},
+		{"wrong audience", "/preferences/test-user", signTestToken(t, []byte("test-key"), map[string]interface{}{
+			"preferred_username": "test-user", "aud": "other", "exp": exp,
+		}), http.StatusUnauthorized},
+		{"wrong key", "/preferences/test-user", signTestToken(t, []byte("wrong-key"), map[string]interface{}{
+			"preferred_username": "test-user", "aud": "de", "exp": exp,
+		}), http.StatusUnauthorized},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequest(http.MethodGet, server.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.status {
+			t.Errorf("%s: status code was %d but should have been %d", tc.name, res.StatusCode, tc.status)
+		}
+	}
+}
+
+func TestAuthRS256(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test-kid",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(privateKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.E)).Bytes()),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := parseJWKS(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Authenticator{rsaKeys: keys, now: time.Now}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"test-kid"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":"test-user","exp":%d}`, time.Now().Add(time.Hour).Unix())))
+	digest := sha256.Sum256([]byte(header + "." + payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	claims, err := a.verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "test-user" {
+		t.Errorf("sub was %v instead of test-user", claims["sub"])
+	}
+
+	if _, err = a.verify(token[:len(token)-4] + "AAAA"); err == nil {
+		t.Error("a token with a tampered signature was accepted")
+	}
+}
+
+type MockClientsDB struct {
+	clients map[string]*ServiceClientRecord
+}
+
+func NewMockClientsDB() *MockClientsDB {
+	return &MockClientsDB{clients: make(map[string]*ServiceClientRecord)}
+}
+
+func (m *MockClientsDB) getClient(ctx context.Context, name string) (*ServiceClientRecord, error) {
+	return m.clients[name], nil
+}
+
+func (m *MockClientsDB) listClients(ctx context.Context) ([]ServiceClientRecord, error) {
+	retval := []ServiceClientRecord{}
+	for _, c := range m.clients {
+		retval = append(retval, *c)
+	}
+	return retval, nil
+}
+
+func (m *MockClientsDB) insertClient(ctx context.Context, name, keyHash string, scopes []string) error {
+	if _, ok := m.clients[name]; ok {
+		return errClientExists
+	}
+	m.clients[name] = &ServiceClientRecord{Name: name, KeyHash: keyHash, Scopes: scopes}
+	return nil
+}
+
+func (m *MockClientsDB) updateClientKey(ctx context.Context, name, keyHash string) error {
+	c, ok := m.clients[name]
+	if !ok {
+		return errClientNotFound
+	}
+	c.KeyHash = keyHash
+	return nil
+}
+
+func (m *MockClientsDB) updateClientScopes(ctx context.Context, name string, scopes []string) error {
+	c, ok := m.clients[name]
+	if !ok {
+		return errClientNotFound
+	}
+	c.Scopes = scopes
+	return nil
+}
+
+func (m *MockClientsDB) revokeClient(ctx context.Context, name string) error {
+	if _, ok := m.clients[name]; !ok {
+		return errClientNotFound
+	}
+	delete(m.clients, name)
+	return nil
+}
+
+func TestScopesAllow(t *testing.T) {
+	tests := []struct {
+		scopes   []string
+		resource string
+		action   string
+		expected bool
+	}{
+		{[]string{"preferences:read"}, "preferences", "read", true},
+		{[]string{"preferences:read"}, "preferences", "write", false},
+		{[]string{"preferences:read"}, "bags", "read", false},
+		{[]string{"sessions:*"}, "sessions", "write", true},
+		{[]string{"*:read"}, "bags", "read", true},
+		{[]string{"*"}, "admin", "write", true},
+		{[]string{}, "bags", "read", false},
+	}
+	for _, tc := range tests {
+		if actual := scopesAllow(tc.scopes, tc.resource, tc.action); actual != tc.expected {
+			t.Errorf("scopesAllow(%v, %s, %s) was %t instead of %t", tc.scopes, tc.resource, tc.action, actual, tc.expected)
+		}
+	}
+}
+
+func TestRouteResource(t *testing.T) {
+	for tpl, expected := range map[string]string{
+		"/preferences/{username}":   "preferences",
+		"/users/{username}/profile": "users",
+		"/users/{username}/export":  "export",
+		"/users/{username}/data":    "purge",
+		"/admin/clients":            "admin",
+	} {
+		if actual := routeResource(tpl); actual != expected {
+			t.Errorf("routeResource(%s) was %s instead of %s", tpl, actual, expected)
+		}
+	}
+	if !adminResources["purge"] {
+		t.Error("purging isn't limited to administrators")
+	}
+}
+
+func TestServiceClientAuth(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	if err := mock.insertPreferences(context.Background(), "test-user", `{"one":"two"}`); err != nil {
+		t.Fatal(err)
+	}
+	clients := NewMockClientsDB()
+	router := mux.NewRouter()
+	NewPrefsApp(mock, router)
+	NewServiceClientsApp(clients, router)
+
+	cfg := viper.New()
+	a, err := NewAuthenticator(cfg, IplantSuffix, clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.Use(a.Middleware)
+
+	adminKey, adminHash, err := newAPIKey("ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients.clients["ops"] = &ServiceClientRecord{Name: "ops", KeyHash: adminHash, Scopes: []string{"admin:*"}}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	do := func(method, path, key, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := do(http.MethodPut, "/admin/clients/apps", adminKey, `{"scopes":["preferences:read"]}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("creating a client returned %d instead of %d", res.StatusCode, http.StatusCreated)
+	}
+	var created map[string]interface{}
+	if err = json.NewDecoder(res.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	appsKey := created["api_key"].(string)
+
+	if res = do(http.MethodGet, "/preferences/test-user", appsKey, ""); res.StatusCode != http.StatusOK {
+		t.Errorf("reading preferences with preferences:read returned %d", res.StatusCode)
+	}
+	if res = do(http.MethodPost, "/preferences/test-user", appsKey, `{}`); res.StatusCode != http.StatusForbidden {
+		t.Errorf("writing preferences with preferences:read returned %d", res.StatusCode)
+	}
+	if res = do(http.MethodGet, "/admin/clients", appsKey, ""); res.StatusCode != http.StatusForbidden {
+		t.Errorf("listing clients without admin scope returned %d", res.StatusCode)
+	}
+	if res = do(http.MethodGet, "/preferences/test-user", "apps.wrong-secret", ""); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("using a bad secret returned %d", res.StatusCode)
+	}
+
+	res = do(http.MethodPost, "/admin/clients/apps/rotate", adminKey, "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("rotating a client returned %d", res.StatusCode)
+	}
+	var rotated map[string]string
+	if err = json.NewDecoder(res.Body).Decode(&rotated); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res = do(http.MethodGet, "/preferences/test-user", appsKey, ""); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("using a rotated key returned %d", res.StatusCode)
+	}
+	if res = do(http.MethodGet, "/preferences/test-user", rotated["api_key"], ""); res.StatusCode != http.StatusOK {
+		t.Errorf("using the new key returned %d", res.StatusCode)
+	}
+
+	if res = do(http.MethodDelete, "/admin/clients/apps", adminKey, ""); res.StatusCode != http.StatusOK {
+		t.Errorf("revoking a client returned %d", res.StatusCode)
+	}
+	if res = do(http.MethodGet, "/preferences/test-user", rotated["api_key"], ""); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("using a revoked key returned %d", res.StatusCode)
+	}
+}
+
+func TestBucketSet(t *testing.T) {
+	now := time.Now()
+	s := newBucketSet(rateLimit{Rate: 1, Burst: 2}, 2)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := s.take("a", now); !ok {
+			t.Errorf("request %d was limited inside the burst", i)
+		}
+	}
+
+	ok, wait := s.take("a", now)
+	if ok {
+		t.Error("request past the burst was allowed")
+	}
+	if wait != time.Second {
+		t.Errorf("wait was %s instead of 1s", wait)
+	}
+
+	if ok, _ = s.take("a", now.Add(time.Second)); !ok {
+		t.Error("request was limited after the bucket refilled")
+	}
+
+	s.take("b", now)
+	s.take("c", now)
+	if len(s.buckets) != 2 {
+		t.Errorf("there were %d buckets instead of 2", len(s.buckets))
+	}
+	if _, ok = s.buckets["a"]; ok {
+		t.Error("the least recently used bucket was not evicted")
+	}
+}
+
+func TestTakeTokens(t *testing.T) {
+	now := time.Now()
+	users := newBucketSet(rateLimit{Rate: 1, Burst: 2}, 10)
+	clients := newBucketSet(rateLimit{Rate: 1, Burst: 1}, 10)
+	limits := []bucketKey{{users, "a"}, {clients, "c"}}
+
+	if refused, _ := takeTokens(now, limits); refused != -1 {
+		t.Fatalf("the first request was refused by limit %d", refused)
+	}
+	if refused, wait := takeTokens(now, limits); refused != 1 || wait != time.Second {
+		t.Errorf("the second request was refused by limit %d for %s", refused, wait)
+	}
+
+	// The client's limit refused that request, so the user still has the
+	// token it would have used.
+	if ok, _ := users.take("a", now); !ok {
+		t.Error("a refused request used up a token from the user's bucket")
+	}
+}
+
+func TestNewRateLimiterValidation(t *testing.T) {
+	for key, value := range map[string]interface{}{
+		"user_info.rate_limit.max_keys":                0,
+		"user_info.rate_limit.bags.user_burst":         0,
+		"user_info.rate_limit.sessions.client_burst":   0.5,
+		"user_info.rate_limit.preferences.client_rate": -1,
+	} {
+		cfg := viper.New()
+		cfg.Set(key, value)
+		if _, err := NewRateLimiter(cfg); err == nil {
+			t.Errorf("setting %s to %v didn't fail", key, value)
+		}
+	}
+
+	cfg := viper.New()
+	cfg.Set("user_info.rate_limit.bags.user_rate", 0)
+	cfg.Set("user_info.rate_limit.bags.user_burst", 0)
+	if _, err := NewRateLimiter(cfg); err != nil {
+		t.Errorf("a disabled limit failed with %s", err)
+	}
+}
+
+func TestRateLimiterClientKey(t *testing.T) {
+	request := func(forwarded ...string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/sessions/test-user", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		for _, value := range forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		return r
+	}
+
+	rl, err := NewRateLimiter(viper.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := rl.clientKey(request("192.0.2.7")); key != "10.0.0.1" {
+		t.Errorf("the header was trusted without being configured: %s", key)
+	}
+
+	cfg := viper.New()
+	cfg.Set("user_info.rate_limit.client_ip_header", "x-forwarded-for")
+	if rl, err = NewRateLimiter(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for expected, r := range map[string]*http.Request{
+		"192.0.2.7":  request("192.0.2.7"),
+		"192.0.2.9":  request("203.0.113.1, 192.0.2.9"),
+		"192.0.2.10": request("203.0.113.1", "192.0.2.10"),
+		"10.0.0.1":   request(),
+	} {
+		if key := rl.clientKey(r); key != expected {
+			t.Errorf("the key was %s instead of %s", key, expected)
+		}
+	}
+
+	r := request("192.0.2.7")
+	r = r.WithContext(context.WithValue(r.Context(), identityKey{}, &Identity{Client: "apps"}))
+	if key := rl.clientKey(r); key != "apps" {
+		t.Errorf("a client was keyed on %s", key)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	router := mux.NewRouter()
+	NewSessionsApp(mock, router)
+
+	cfg := viper.New()
+	cfg.Set("user_info.rate_limit.sessions.user_rate", 1)
+	cfg.Set("user_info.rate_limit.sessions.user_burst", 1)
+	rateLimiter, err := NewRateLimiter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.Use(rateLimiter.Middleware)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	post := func() *http.Response {
+		res, err := http.Post(server.URL+"/sessions/test-user", "application/json", strings.NewReader(`{"a":"b"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if res := post(); res.StatusCode != http.StatusOK {
+		t.Errorf("first request returned %d", res.StatusCode)
+	}
+
+	res := post()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second request returned %d instead of %d", res.StatusCode, http.StatusTooManyRequests)
+	}
+	if res.Header.Get("Retry-After") != "1" {
+		t.Errorf("Retry-After was %q instead of 1", res.Header.Get("Retry-After"))
+	}
+
+	var greeting *http.Response
+	greeting, err = http.Get(server.URL + "/sessions/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	greeting.Body.Close()
+	if greeting.StatusCode != http.StatusOK {
+		t.Errorf("the greeting was limited with status %d", greeting.StatusCode)
+	}
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	mock := NewMockDB()
+	router := makeRouter()
+	NewPrefsApp(mock, router)
+	NewSessionsApp(mock, router)
+	NewSearchesApp(mock, router)
+	NewBagsApp(nil, router, IplantSuffix)
+	NewServiceClientsApp(NewMockClientsDB(), router)
+	NewProfileApp(nil, router)
+	NewExportApp(nil, router)
+	NewPurgeApp(nil, router)
+	NewMergeApp(nil, router)
+	NewAuditApp(nil, router)
+	NewChangeStreamApp(viper.New(), nil, nil, NewChangeNotifier(), router)
+	NewChangeFeedApp(nil, router)
+	NewWebhooksApp(viper.New(), nil, router)
+	NewImportApp(nil, router)
+	NewHealthApp(nil, viper.New(), router)
+
+	spec, err := parseOpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet}
+		}
+		for _, method := range methods {
+			if _, ok := spec.operation(tpl, method); !ok {
+				t.Errorf("%s %s is not described in the OpenAPI document", method, tpl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeOpenAPI(t *testing.T) {
+	server := httptest.NewServer(makeRouter())
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var doc map[string]interface{}
+	if err = json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["openapi"] != "3.0.3" {
+		t.Errorf("openapi was %v instead of 3.0.3", doc["openapi"])
+	}
+}
+
+func TestSpecValidator(t *testing.T) {
+	validator, err := NewSpecValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	router := mux.NewRouter()
+	NewPrefsApp(mock, router)
+	NewServiceClientsApp(NewMockClientsDB(), router)
+	NewImportApp(NewMemoryDB(), router)
+	router.Use(validator.Middleware)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "/preferences/test-user", `{"one":"two"}`, http.StatusOK},
+		{http.MethodPost, "/preferences/test-user", `["one"]`, http.StatusBadRequest},
+		{http.MethodPost, "/preferences/test-user", ``, http.StatusBadRequest},
+		{http.MethodPut, "/admin/clients/apps", `{"scopes":["bags:read"]}`, http.StatusCreated},
+		{http.MethodPut, "/admin/clients/other", `{"scopes":[]}`, http.StatusBadRequest},
+		{http.MethodPut, "/admin/clients/other", `{"scopes":["bags:delete"]}`, http.StatusBadRequest},
+		{http.MethodPut, "/admin/clients/other", `{"scopes":["bags:read"],"extra":1}`, http.StatusBadRequest},
+		{http.MethodPost, "/admin/import", "{\"resource\":\"preferences\",\"username\":\"a\",\"document\":{}}\n{}\n", http.StatusOK},
+		{http.MethodPost, "/admin/import", strings.Repeat("\n", maxValidatedBodySize+1) + "{}\n", http.StatusOK},
+		{http.MethodPost, "/admin/import", `{"big":"` + strings.Repeat("x", maxImportLineSize) + `"}`, http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "/preferences/test-user", `{"big":"` + strings.Repeat("x", maxValidatedBodySize) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		if recorder.Code != tc.status {
+			t.Errorf("%s %s with %q returned %d instead of %d", tc.method, tc.path, tc.body, recorder.Code, tc.status)
+		}
+	}
+}
+
+func TestImportBodySize(t *testing.T) {
+	router := mux.NewRouter()
+	importApp := NewImportApp(NewMemoryDB(), router)
+	importApp.maxBodySize = 100
+
+	record := `{"resource":"preferences","username":"a","document":{}}` + "\n"
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{record, http.StatusOK},
+		{strings.Repeat(record, 2), http.StatusRequestEntityTooLarge},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/import", strings.NewReader(tc.body)))
+		if recorder.Code != tc.status {
+			t.Errorf("importing %d bytes returned %d instead of %d", len(tc.body), recorder.Code, tc.status)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	router := makeRouter()
+	router.Use(metricsMiddleware)
+	NewPrefsApp(mock, router)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/preferences/test-user", "application/json", strings.NewReader(`{"one":"two"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	observeDB("PrefsDB.getPreferences", time.Now())
+	observeDocument("preferences", `{"one":"two"}`)
+
+	res, err = http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`user_info_http_requests_total{route="/preferences/{username}",method="POST",status="200"} 1`,
+		`user_info_http_request_duration_seconds_count{route="/preferences/{username}",method="POST",status="200"} 1`,
+		`user_info_db_query_duration_seconds_bucket{operation="PrefsDB.getPreferences",le="+Inf"}`,
+		`user_info_document_bytes_written_bucket{store="preferences",le="256"}`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("metrics did not contain %s", line)
+		}
+	}
+	if strings.Contains(string(body), "test-user") {
+		t.Error("metrics contained a username")
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok {
+		t.Fatal("valid traceparent was rejected")
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Errorf("traceparent was parsed incorrectly: %+v", sc)
+	}
+	if sc.traceparent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("traceparent was formatted as %s", sc.traceparent())
+	}
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+	for _, value := range invalid {
+		if _, ok := parseTraceparent(value); ok {
+			t.Errorf("invalid traceparent %q was accepted", value)
+		}
+	}
+}
+
+func TestSanitizeSQL(t *testing.T) {
+	query := `SELECT id
+                FROM users
+               WHERE username = 'test-user'
+                 AND id = $1
+               LIMIT 10`
+	expected := "SELECT id FROM users WHERE username = ? AND id = $1 LIMIT ?"
+	if actual := sanitizeSQL(query); actual != expected {
+		t.Errorf("sanitizeSQL returned %q instead of %q", actual, expected)
+	}
+}
+
+func TestTracerShutdown(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewTracer("user-info", 1, NewWriterExporter(&buf, "user-info"))
+
+	before := tr.start(nil, "before", spanKindInternal)
+	before.Finish()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"before"`) {
+		t.Errorf("the span that finished before shutting down wasn't exported: %s", buf.String())
+	}
+
+	// Spans that finish during the rest of the shutdown are dropped instead
+	// of panicking on the closed queue.
+	tr.start(nil, "after", spanKindInternal).Finish()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutting down twice failed with %s", err)
+	}
+}
+
+func TestTracerFlushDuringShutdown(t *testing.T) {
+	// Flushing and closing the queue race, so it's tried a few times to
+	// catch the flush seeing the closed queue.
+	for i := 0; i < 20; i++ {
+		var buf bytes.Buffer
+		tr := NewTracer("user-info", 1, NewWriterExporter(&buf, "user-info"))
+		tr.start(nil, "span", spanKindInternal).Finish()
+
+		flushed := make(chan error, 1)
+		go func() {
+			flushed <- tr.Flush(context.Background())
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := tr.Shutdown(ctx)
+		if err == nil {
+			select {
+			case err = <-flushed:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		cancel()
+		if err != nil {
+			t.Fatalf("flushing while shutting down failed with %s", err)
+		}
+		if strings.Count(buf.String(), `"span"`) != 1 {
+			t.Fatalf("the span was exported %d times", strings.Count(buf.String(), `"span"`))
+		}
+	}
+}
+
+func TestTracedTx(t *testing.T) {
+	var buf bytes.Buffer
+	tracer = NewTracer("user-info", 1, NewWriterExporter(&buf, "user-info"))
+	defer func() { tracer = nil }()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM users").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1"))
+	mock.ExpectExec("DELETE FROM bags").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	ctx := context.Background()
+	tx, err := newTracedDB(db).BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	if err = tx.QueryRowContext(ctx, `SELECT id FROM users`).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM bags`); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tracer.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var exported otlpTraces
+	if err = json.Unmarshal(buf.Bytes(), &exported); err != nil {
+		t.Fatalf("error parsing exported spans: %s", err)
+	}
+	var names []string
+	for _, span := range exported.ResourceSpans[0].ScopeSpans[0].Spans {
+		names = append(names, span.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"SELECT", "DELETE"}) {
+		t.Errorf("the spans were %v", names)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	tracer = NewTracer("user-info", 1, NewWriterExporter(&buf, "user-info"))
+	defer func() { tracer = nil }()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(1))
+	mock.ExpectQuery("SELECT p.id AS id").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "preferences"}).AddRow("1", "2", "{}"))
+
+	router := makeRouter()
+	router.Use(tracingMiddleware)
+	NewPrefsApp(NewPrefsDB(db), router)
+
+	request := httptest.NewRequest(http.MethodGet, "/preferences/test-user", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code was %d", recorder.Code)
+	}
+
+	if err = tracer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var exported otlpTraces
+	if err = json.Unmarshal(buf.Bytes(), &exported); err != nil {
+		t.Fatalf("error parsing exported spans: %s", err)
+	}
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 3 {
+		t.Fatalf("%d spans were exported instead of 3", len(spans))
+	}
+
+	var server otlpSpan
+	for _, span := range spans {
+		if span.Kind == spanKindServer {
+			server = span
+		}
+	}
+	if server.Name != "GET /preferences/{username}" {
+		t.Errorf("server span was named %q", server.Name)
+	}
+	if server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("server span parent was %q", server.ParentSpanID)
+	}
+
+	for _, span := range spans {
+		if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %s has trace ID %s", span.Name, span.TraceID)
+		}
+		if span.Kind != spanKindClient {
+			continue
+		}
+		if span.ParentSpanID != server.SpanID {
+			t.Errorf("span %s is not a child of the server span", span.Name)
+		}
+		if span.Name != "SELECT" {
+			t.Errorf("database span was named %q", span.Name)
+		}
+		for _, attr := range span.Attributes {
+			if strings.Contains(attr.Value.StringValue, "test-user") {
+				t.Errorf("span %s contains the username in %s", span.Name, attr.Key)
+			}
+		}
+	}
+}
+
+func TestContextLog(t *testing.T) {
+	ctx := context.WithValue(context.Background(), requestInfoKey{}, &requestInfo{id: "caller-id-2"})
+	ctx = context.WithValue(ctx, identityKey{}, &Identity{Client: "apps"})
+
+	entry := contextLog(ctx)
+	if entry.Data["request_id"] != "caller-id-2" || entry.Data["client"] != "apps" {
+		t.Errorf("the log fields were %v", entry.Data)
+	}
+	if entry = contextLog(context.Background()); len(entry.Data) != 0 {
+		t.Errorf("the log fields without a request were %v", entry.Data)
+	}
+}
+
+func TestRequestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	accessLog.Out = &buf
+	defer func() { accessLog.Out = os.Stderr }()
+
+	mock := NewMockDB()
+	mock.users["test-user"] = true
+	if err := mock.insertPreferences(context.Background(), "test-user", `{"one":"two"}`); err != nil {
+		t.Fatal(err)
+	}
+	router := makeRouter()
+	NewPrefsApp(mock, router)
+
+	request := httptest.NewRequest(http.MethodGet, "/preferences/test-user", nil)
+	request.Header.Set(requestIDHeader, "caller-id-1")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if id := recorder.Header().Get(requestIDHeader); id != "caller-id-1" {
+		t.Errorf("request ID was %q instead of caller-id-1", id)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("access log line was not JSON: %s", err)
+	}
+	expected := map[string]interface{}{
+		"request_id": "caller-id-1",
+		"method":     "GET",
+		"route":      "/preferences/{username}",
+		"user":       "test-user",
+		"status":     float64(http.StatusOK),
+		"bytes":      float64(recorder.Body.Len()),
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("access log %s was %v instead of %v", key, entry[key], value)
+		}
+	}
+	if _, ok := entry["duration_ms"]; !ok {
+		t.Error("access log did not include the duration")
+	}
+
+	// Unusable IDs are replaced, and unmatched routes still get an ID.
+	request = httptest.NewRequest(http.MethodGet, "/nothing-here", nil)
+	request.Header.Set(requestIDHeader, "bad id\nwith a newline")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	id := recorder.Header().Get(requestIDHeader)
+	if id == "" || strings.Contains(id, " ") {
+		t.Errorf("request ID was %q", id)
+	}
+	problem := decodeProblem(t, recorder)
+	if problem.RequestID != id {
+		t.Errorf("problem request ID was %q instead of %q", problem.RequestID, id)
+	}
+}
+
+type fakeDBStatus struct {
+	pingErr error
+	pings   int
+	stats   sql.DBStats
+}
+
+func (f *fakeDBStatus) PingContext(ctx context.Context) error {
+	f.pings++
+	return f.pingErr
+}
+
+func (f *fakeDBStatus) Stats() sql.DBStats {
+	return f.stats
+}
+
+func getHealth(t *testing.T, router *mux.Router, path string) (int, healthReport) {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+
+	var report healthReport
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("error parsing %s response: %s", path, err)
+	}
+	return recorder.Code, report
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	db := &fakeDBStatus{stats: sql.DBStats{MaxOpenConnections: 10, InUse: 2}}
+	now := time.Now()
+	router := makeRouter()
+	h := NewHealthApp(db, viper.New(), router)
+	h.now = func() time.Time { return now }
+
+	status, report := getHealth(t, router, "/readyz")
+	if status != http.StatusOK || report.Status != healthOK {
+		t.Errorf("/readyz returned %d %s", status, report.Status)
+	}
+	for _, name := range []string{"database", "pool", "draining"} {
+		if report.Checks[name].Status != healthOK {
+			t.Errorf("check %s was %s", name, report.Checks[name].Status)
+		}
+	}
+
+	// Results are cached, so a failing database isn't noticed straight away.
+	db.pingErr = errors.New("connection refused")
+	if status, _ = getHealth(t, router, "/readyz"); status != http.StatusOK {
+		t.Errorf("/readyz returned %d before the cache expired", status)
+	}
+	if db.pings != 1 {
+		t.Errorf("the database was pinged %d times", db.pings)
+	}
+
+	now = now.Add(3 * time.Second)
+	status, report = getHealth(t, router, "/readyz")
+	if status != http.StatusServiceUnavailable || report.Checks["database"].Status != healthUnavailable {
+		t.Errorf("/readyz returned %d with database %s", status, report.Checks["database"].Status)
+	}
+
+	// Liveness doesn't depend on the database.
+	if status, report = getHealth(t, router, "/healthz"); status != http.StatusOK || report.Status != healthOK {
+		t.Errorf("/healthz returned %d %s", status, report.Status)
+	}
+
+	db.pingErr = nil
+	db.stats.InUse = 10
+	now = now.Add(3 * time.Second)
+	status, report = getHealth(t, router, "/readyz")
+	if status != http.StatusServiceUnavailable || report.Checks["pool"].Status != healthUnavailable {
+		t.Errorf("/readyz returned %d with pool %s", status, report.Checks["pool"].Status)
+	}
+
+	db.stats.InUse = 0
+	now = now.Add(3 * time.Second)
+	h.SetDraining(true)
+	status, report = getHealth(t, router, "/readyz")
+	if status != http.StatusServiceUnavailable || report.Checks["draining"].Status != healthUnavailable {
+		t.Errorf("/readyz returned %d with draining %s", status, report.Checks["draining"].Status)
+	}
+}
+
+func TestServerGracefulShutdown(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("user_info.server.drain_delay", "0s")
+	cfg.Set("user_info.server.shutdown_timeout", "5s")
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router := makeRouter()
+	health := NewHealthApp(&fakeDBStatus{}, cfg, router)
+	router.HandleFunc("/slow", func(writer http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		fmt.Fprint(writer, "done")
+	})
+
+	var hooks []string
+	server := NewServer(cfg, router, health)
+	server.OnShutdown("first", func(context.Context) error {
+		hooks = append(hooks, "first")
+		return nil
+	})
+	server.OnShutdown("second", func(context.Context) error {
+		hooks = append(hooks, "second")
+		return nil
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- server.Run(listener, stop)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		res, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		inFlight <- result{body: string(body), err: err}
+	}()
+
+	<-started
+	stop <- os.Interrupt
+
+	// The server shouldn't finish shutting down while a request is running.
+	select {
+	case err = <-runErr:
+		t.Fatalf("Run returned before the in-flight request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !health.isDraining() {
+		t.Error("readiness was not failing during shutdown")
+	}
+
+	close(release)
+	res := <-inFlight
+	if res.err != nil || res.body != "done" {
+		t.Errorf("in-flight request returned %q, %v", res.body, res.err)
+	}
+	if err = <-runErr; err != nil {
+		t.Errorf("Run returned %s", err)
+	}
+	if !reflect.DeepEqual(hooks, []string{"first", "second"}) {
+		t.Errorf("shutdown hooks ran as %v", hooks)
+	}
+
+	if _, err = http.Get("http://" + listener.Addr().String() + "/healthz"); err == nil {
+		t.Error("the server was still accepting connections")
+	}
+}
+
+func TestConfigureDBTimeouts(t *testing.T) {
+	defer configureDBTimeouts(viper.New())
+
+	cfg := viper.New()
+	cfg.Set("user_info.db.timeout", "3s")
+	cfg.Set("user_info.db.timeouts.BagsAPI.GetBags", "1s")
+	configureDBTimeouts(cfg)
+
+	if timeout := dbTimeouts.get("BagsAPI.GetBags"); timeout != time.Second {
+		t.Errorf("BagsAPI.GetBags timeout was %s", timeout)
+	}
+	if timeout := dbTimeouts.get("BagsAPI.GetBag"); timeout != 3*time.Second {
+		t.Errorf("BagsAPI.GetBag timeout was %s", timeout)
+	}
+	if timeout := dbTimeouts.get("ImportDB.importRecords"); timeout != 5*time.Minute {
+		t.Errorf("ImportDB.importRecords timeout was %s", timeout)
+	}
+
+	cfg.Set("user_info.db.timeouts.ImportDB.importRecords", "1m")
+	configureDBTimeouts(cfg)
+	if timeout := dbTimeouts.get("ImportDB.importRecords"); timeout != time.Minute {
+		t.Errorf("ImportDB.importRecords timeout was %s after configuring it", timeout)
+	}
+}
+
+func TestStorageTimeoutStatus(t *testing.T) {
+	defer configureDBTimeouts(viper.New())
+
+	cfg := viper.New()
+	cfg.Set("user_info.db.timeouts.PrefsDB.getPreferences", "20ms")
+	configureDBTimeouts(cfg)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	router := makeRouter()
+	NewPrefsApp(NewPrefsDB(db), router)
+
+	// A query that runs past its timeout results in a 504.
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(1))
+	mock.ExpectQuery("SELECT p.id AS id").
+		WithArgs("test-user").
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "preferences"}).AddRow("1", "2", "{}"))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/preferences/test-user", nil))
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusGatewayTimeout)
+	}
+	if problem := decodeProblem(t, recorder); problem.Type != problemTypeBase+"timeout" {
+		t.Errorf("problem type was %s", problem.Type)
+	}
+
+	// A request that's cancelled while its query is running results in a 503.
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM \\( SELECT DISTINCT id FROM users").
+		WithArgs("test-user").
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"check_user"}).AddRow(1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/preferences/test-user", nil).WithContext(ctx))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code was %d instead of %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// contractUser is the user that testStorageContract expects to exist.
+const contractUser = "test-user@iplantcollaborative.org"
+
+func newStorageRouter(storage *Storage) *mux.Router {
+	router := makeRouter()
+	NewPrefsApp(storage.Preferences, router)
+	NewSessionsApp(storage.Sessions, router)
+	NewSearchesApp(storage.Searches, router)
+	NewBagsApp(storage.Bags, router, IplantSuffix)
+	NewServiceClientsApp(storage.Clients, router)
+	NewProfileApp(storage.Profiles, router)
+	NewExportApp(storage.Exports, router)
+	NewPurgeApp(storage.Purges, router)
+	NewMergeApp(storage.Merges, router)
+	NewAuditApp(storage.Audit, router)
+	NewChangeFeedApp(storage.Changes, router)
+	NewWebhooksApp(viper.New(), storage.Webhooks, router)
+	NewImportApp(storage.Imports, router)
+	return router
+}
+
+func doContractRequest(t *testing.T, router *mux.Router, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+
+	var decoded map[string]interface{}
+	if recorder.Body.Len() > 0 {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &decoded); err != nil {
+			t.Fatalf("%s %s: error decoding body %q: %s", method, path, recorder.Body.String(), err)
+		}
+	}
+	return recorder.Code, decoded
+}
+
+// testStorageContract runs the same requests against the HTTP API backed by
+// storage, so that every backend behaves the same way. The storage must
+// contain contractUser and nothing else.
+// documentsWritten returns how many documents have been written to the store.
+func documentsWritten(store string) uint64 {
+	documentBytesWritten.mu.Lock()
+	defer documentBytesWritten.mu.Unlock()
+	if v, ok := documentBytesWritten.values[labelKey([]string{store})]; ok {
+		return v.count
+	}
+	return 0
+}
+
+func testStorageContract(t *testing.T, storage *Storage) {
+	router := newStorageRouter(storage)
+
+	for _, service := range []string{"preferences", "sessions", "searches"} {
+		t.Run(service, func(t *testing.T) {
+			path := "/" + service + "/" + contractUser
+
+			status, _ := doContractRequest(t, router, http.MethodGet, "/"+service+"/nobody@example.org", "")
+			if status != http.StatusNotFound {
+				t.Errorf("GET for an unknown user returned %d", status)
+			}
+
+			status, body := doContractRequest(t, router, http.MethodGet, path, "")
+			if status != http.StatusOK || len(body) != 0 {
+				t.Errorf("GET before storing returned %d %v", status, body)
+			}
+
+			written := documentsWritten(service)
+			status, _ = doContractRequest(t, router, http.MethodPut, path, `{"first":"1"}`)
+			if status != http.StatusOK {
+				t.Errorf("PUT returned %d", status)
+			}
+
+			status, _ = doContractRequest(t, router, http.MethodPost, path, `{"second":"2"}`)
+			if status != http.StatusOK {
+				t.Errorf("POST returned %d", status)
+			}
+
+			status, body = doContractRequest(t, router, http.MethodGet, path, "")
+			if status != http.StatusOK || body["second"] != "2" || body["first"] != nil {
+				t.Errorf("GET after storing returned %d %v", status, body)
+			}
+			if n := documentsWritten(service) - written; n != 2 {
+				t.Errorf("the size of %d documents was recorded", n)
+			}
+
+			status, _ = doContractRequest(t, router, http.MethodPost, path, `not json`)
+			if status != http.StatusBadRequest {
+				t.Errorf("POST with a bad body returned %d", status)
+			}
+
+			status, _ = doContractRequest(t, router, http.MethodDelete, path, "")
+			if status != http.StatusOK {
+				t.Errorf("DELETE returned %d", status)
+			}
+
+			status, body = doContractRequest(t, router, http.MethodGet, path, "")
+			if status != http.StatusOK || len(body) != 0 {
+				t.Errorf("GET after deleting returned %d %v", status, body)
+			}
+		})
+	}
+
+	t.Run("bags", func(t *testing.T) {
+		path := "/bags/" + contractUser
+
+		status, body := doContractRequest(t, router, http.MethodGet, path, "")
+		if status != http.StatusOK || len(body["bags"].([]interface{})) != 0 {
+			t.Fatalf("GET before adding returned %d %v", status, body)
+		}
+
+		written := documentsWritten("bags")
+		status, body = doContractRequest(t, router, http.MethodPut, path, `{"items":["a"]}`)
+		if status != http.StatusOK {
+			t.Fatalf("PUT returned %d", status)
+		}
+		first, _ := body["id"].(string)
+
+		status, body = doContractRequest(t, router, http.MethodPut, path, `{"items":["b"]}`)
+		if status != http.StatusOK {
+			t.Fatalf("PUT returned %d", status)
+		}
+		second, _ := body["id"].(string)
+
+		status, body = doContractRequest(t, router, http.MethodGet, path, "")
+		bags, _ := body["bags"].([]interface{})
+		if status != http.StatusOK || len(bags) != 2 || bags[0].(map[string]interface{})["id"] != first {
+			t.Errorf("GET after adding returned %d %v", status, body)
+		}
+
+		status, _ = doContractRequest(t, router, http.MethodPost, path+"/"+second, `{"items":["c"]}`)
+		if status != http.StatusOK {
+			t.Errorf("POST returned %d", status)
+		}
+
+		status, body = doContractRequest(t, router, http.MethodGet, path+"/"+second, "")
+		contents, _ := body["contents"].(map[string]interface{})
+		if status != http.StatusOK || !reflect.DeepEqual(contents["items"], []interface{}{"c"}) {
+			t.Errorf("GET for a bag returned %d %v", status, body)
+		}
+		if n := documentsWritten("bags") - written; n != 3 {
+			t.Errorf("the size of %d bags was recorded", n)
+		}
+
+		status, _ = doContractRequest(t, router, http.MethodGet, path+"/"+newUUID(), "")
+		if status != http.StatusNotFound {
+			t.Errorf("GET for an unknown bag returned %d", status)
+		}
+
+		status, body = doContractRequest(t, router, http.MethodGet, path+"/default", "")
+		defaultID, _ := body["id"].(string)
+		if status != http.StatusOK || defaultID == "" {
+			t.Fatalf("GET for the default bag returned %d %v", status, body)
+		}
+
+		status, body = doContractRequest(t, router, http.MethodPost, path+"/default", `{"items":["d"]}`)
+		contents, _ = body["contents"].(map[string]interface{})
+		if status != http.StatusOK || body["id"] != defaultID || !reflect.DeepEqual(contents["items"], []interface{}{"d"}) {
+			t.Errorf("POST for the default bag returned %d %v", status, body)
+		}
+
+		status, body = doContractRequest(t, router, http.MethodDelete, path+"/default", "")
+		if status != http.StatusOK || body["id"] == defaultID {
+			t.Errorf("DELETE for the default bag returned %d %v", status, body)
+		}
+
+		status, _ = doContractRequest(t, router, http.MethodDelete, path+"/"+first, "")
+		if status != http.StatusOK {
+			t.Errorf("DELETE for a bag returned %d", status)
+		}
+
+		status, _ = doContractRequest(t, router, http.MethodDelete, path, "")
+		if status != http.StatusOK {
+			t.Errorf("DELETE for all bags returned %d", status)
+		}
+
+		status, body = doContractRequest(t, router, http.MethodGet, path, "")
+		if status != http.StatusOK || len(body["bags"].([]interface{})) != 0 {
+			t.Errorf("GET after deleting returned %d %v", status, body)
+		}
+	})
+
+	t.Run("profile", func(t *testing.T) {
+		path := "/users/" + contractUser + "/profile"
+
+		status, _ := doContractRequest(t, router, http.MethodGet, "/users/nobody@example.org/profile", "")
+		if status != http.StatusNotFound {
+			t.Errorf("GET for an unknown user returned %d", status)
+		}
+
+		status, body := doContractRequest(t, router, http.MethodGet, path, "")
+		if status != http.StatusOK || body["default_bag"] != nil || len(body["preferences"].(map[string]interface{})) != 0 {
+			t.Errorf("GET for an empty profile returned %d %v", status, body)
+		}
+
+		doContractRequest(t, router, http.MethodPut, "/preferences/"+contractUser, `{"theme":"dark"}`)
+		doContractRequest(t, router, http.MethodPut, "/sessions/"+contractUser, `{"tab":"apps"}`)
+		doContractRequest(t, router, http.MethodPut, "/searches/"+contractUser, `{"saved":["x"]}`)
+		_, bag := doContractRequest(t, router, http.MethodPost, "/bags/"+contractUser+"/default", `{"items":["a"]}`)
+		defer func() {
+			doContractRequest(t, router, http.MethodDelete, "/preferences/"+contractUser, "")
+			doContractRequest(t, router, http.MethodDelete, "/sessions/"+contractUser, "")
+			doContractRequest(t, router, http.MethodDelete, "/searches/"+contractUser, "")
+			doContractRequest(t, router, http.MethodDelete, "/bags/"+contractUser, "")
+		}()
+
+		status, body = doContractRequest(t, router, http.MethodGet, path, "")
+		if status != http.StatusOK {
+			t.Fatalf("GET returned %d %v", status, body)
+		}
+		expected := map[string]interface{}{
+			"username":       contractUser,
+			"preferences":    map[string]interface{}{"theme": "dark"},
+			"session":        map[string]interface{}{"tab": "apps"},
+			"saved_searches": map[string]interface{}{"saved": []interface{}{"x"}},
+			"default_bag":    bag,
+		}
+		if !reflect.DeepEqual(body, expected) {
+			t.Errorf("GET returned %v instead of %v", body, expected)
+		}
+
+		status, body = doContractRequest(t, router, http.MethodGet, path+"?include=session,default_bag", "")
+		if _, ok := body["preferences"]; status != http.StatusOK || ok || body["session"] == nil || body["default_bag"] == nil {
+			t.Errorf("GET with include returned %d %v", status, body)
+		}
+	})
+
+	t.Run("export", func(t *testing.T) {
+		doContractRequest(t, router, http.MethodPut, "/preferences/"+contractUser, `{"theme":"dark"}`)
+		_, bag := doContractRequest(t, router, http.MethodGet, "/bags/"+contractUser+"/default", "")
+		doContractRequest(t, router, http.MethodPut, "/bags/"+contractUser, `{"items":["b"]}`)
+		defer func() {
+			doContractRequest(t, router, http.MethodDelete, "/preferences/"+contractUser, "")
+			doContractRequest(t, router, http.MethodDelete, "/bags/"+contractUser, "")
+		}()
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/users/"+contractUser+"/export", nil))
+		if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/zip" {
+			t.Fatalf("GET returned %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+		}
+
+		files := readExport(t, recorder.Body.Bytes())
+		var prefs []struct {
+			Document map[string]interface{} `json:"document"`
+		}
+		if err := json.Unmarshal(files["preferences.json"], &prefs); err != nil || len(prefs) != 1 || prefs[0].Document["theme"] != "dark" {
+			t.Errorf("preferences.json was %s", files["preferences.json"])
+		}
+		var bags []exportedBag
+		if err := json.Unmarshal(files["bags.json"], &bags); err != nil || len(bags) != 2 {
+			t.Fatalf("bags.json was %s", files["bags.json"])
+		}
+		for _, exported := range bags {
+			if exported.Default != (exported.ID == bag["id"]) {
+				t.Errorf("bag %s has default set to %v", exported.ID, exported.Default)
+			}
+		}
+		var sessions []exportedDocument
+		if err := json.Unmarshal(files["sessions.json"], &sessions); err != nil || len(sessions) != 0 {
+			t.Errorf("sessions.json was %s", files["sessions.json"])
+		}
+
+		status, _ := doContractRequest(t, router, http.MethodGet, "/users/nobody@example.org/export", "")
+		if status != http.StatusNotFound {
+			t.Errorf("GET for an unknown user returned %d", status)
+		}
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		doContractRequest(t, router, http.MethodPut, "/preferences/"+contractUser, `{"theme":"dark"}`)
+		doContractRequest(t, router, http.MethodPut, "/sessions/"+contractUser, `{"open":[]}`)
+		doContractRequest(t, router, http.MethodGet, "/bags/"+contractUser+"/default", "")
+		doContractRequest(t, router, http.MethodPut, "/bags/"+contractUser, `{"items":["b"]}`)
+
+		want := map[string]float64{"preferences": 1, "sessions": 1, "saved_searches": 0, "bags": 2, "default_bags": 1}
+		checkReport := func(body map[string]interface{}, dryRun bool) {
+			t.Helper()
+			if body["dry_run"] != dryRun {
+				t.Errorf("dry_run was %v", body["dry_run"])
+			}
+			for key, count := range want {
+				if body[key] != count {
+					t.Errorf("%s was %v instead of %v", key, body[key], count)
+				}
+			}
+		}
+
+		status, body := doContractRequest(t, router, http.MethodDelete, "/users/"+contractUser+"/data?dry_run=true", "")
+		if status != http.StatusOK {
+			t.Fatalf("dry run returned %d %v", status, body)
+		}
+		checkReport(body, true)
+		if status, _ = doContractRequest(t, router, http.MethodGet, "/preferences/"+contractUser, ""); status != http.StatusOK {
+			t.Errorf("the dry run deleted the preferences")
+		}
+
+		status, body = doContractRequest(t, router, http.MethodDelete, "/users/"+contractUser+"/data", "")
+		if status != http.StatusOK {
+			t.Fatalf("purge returned %d %v", status, body)
+		}
+		checkReport(body, false)
+
+		_, body = doContractRequest(t, router, http.MethodDelete, "/users/"+contractUser+"/data?dry_run=1", "")
+		for key := range want {
+			if body[key] != float64(0) {
+				t.Errorf("%s was %v after the purge", key, body[key])
+			}
+		}
+
+		status, _ = doContractRequest(t, router, http.MethodDelete, "/users/"+contractUser+"/data?dry_run=maybe", "")
+		if status != http.StatusBadRequest {
+			t.Errorf("an invalid dry_run returned %d", status)
+		}
+		status, _ = doContractRequest(t, router, http.MethodDelete, "/users/nobody@example.org/data", "")
+		if status != http.StatusNotFound {
+			t.Errorf("DELETE for an unknown user returned %d", status)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		const renamed = "renamed@example.org"
+		mergePath := "/admin/users/" + contractUser + "/merge"
+		defer doContractRequest(t, router, http.MethodDelete, "/users/"+renamed+"/data", "")
+
+		// Renaming moves everything to the new user.
+		doContractRequest(t, router, http.MethodPut, "/preferences/"+contractUser, `{"theme":"dark","editor":{"font":"mono"}}`)
+		_, first := doContractRequest(t, router, http.MethodGet, "/bags/"+contractUser+"/default", "")
+		doContractRequest(t, router, http.MethodPut, "/bags/"+contractUser, `{"items":["a"]}`)
+
+		status, body := doContractRequest(t, router, http.MethodPost, mergePath, `{"target":"`+renamed+`","policy":"keep-target"}`)
+		if status != http.StatusOK {
+			t.Fatalf("rename returned %d %v", status, body)
+		}
+		if body["preferences"] != mergeMoved || body["sessions"] != mergeNone || body["bags_moved"] != float64(2) || body["default_bag"] != first["id"] {
+			t.Errorf("rename reported %v", body)
+		}
+		if _, prefs := doContractRequest(t, router, http.MethodGet, "/preferences/"+contractUser, ""); len(prefs) != 0 {
+			t.Errorf("the source still has preferences %v", prefs)
+		}
+
+		// Merging into an existing user resolves the conflicts.
+		doContractRequest(t, router, http.MethodPut, "/preferences/"+contractUser, `{"theme":"light","editor":{"size":12}}`)
+		doContractRequest(t, router, http.MethodGet, "/bags/"+contractUser+"/default", "")
+
+		status, body = doContractRequest(t, router, http.MethodPost, mergePath, `{"target":"`+renamed+`","policy":"deep-merge"}`)
+		if status != http.StatusOK {
+			t.Fatalf("merge returned %d %v", status, body)
+		}
+		if body["preferences"] != mergeMerged || body["bags_moved"] != float64(1) || body["default_bag"] != first["id"] {
+			t.Errorf("merge reported %v", body)
+		}
+		_, prefs := doContractRequest(t, router, http.MethodGet, "/preferences/"+renamed, "")
+		editor, _ := prefs["editor"].(map[string]interface{})
+		if prefs["theme"] != "dark" || editor["font"] != "mono" || editor["size"] != float64(12) {
+			t.Errorf("merged preferences were %v", prefs)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/bags/"+renamed, nil))
+		var bags struct {
+			Bags []map[string]interface{} `json:"bags"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &bags); err != nil || len(bags.Bags) != 3 {
+			t.Errorf("the target's bags were %s", recorder.Body.String())
+		}
+
+		for body, want := range map[string]int{
+			`{"target":"` + renamed + `","policy":"newest"}`:           http.StatusBadRequest,
+			`{"target":"` + contractUser + `","policy":"keep-source"}`: http.StatusBadRequest,
+			`not json`: http.StatusBadRequest,
+		} {
+			if status, _ = doContractRequest(t, router, http.MethodPost, mergePath, body); status != want {
+				t.Errorf("merge with %s returned %d", body, status)
+			}
+		}
+		status, _ = doContractRequest(t, router, http.MethodPost, "/admin/users/nobody@example.org/merge", `{"target":"`+renamed+`","policy":"keep-source"}`)
+		if status != http.StatusNotFound {
+			t.Errorf("merge of an unknown user returned %d", status)
+		}
+	})
+
+	t.Run("audit", func(t *testing.T) {
+		prefsPath := "/preferences/" + contractUser
+		doContractRequest(t, router, http.MethodPut, prefsPath, `{"theme":"dark"}`)
+		doContractRequest(t, router, http.MethodPost, prefsPath, `{"theme":"light"}`)
+		doContractRequest(t, router, http.MethodDelete, prefsPath, "")
+		_, bag := doContractRequest(t, router, http.MethodPut, "/bags/"+contractUser, `{"items":["a"]}`)
+		defer doContractRequest(t, router, http.MethodDelete, "/bags/"+contractUser, "")
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/audit?user="+contractUser+"&resource=preferences&limit=3", nil))
+		var result struct {
+			Entries []AuditEntry `json:"entries"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil || len(result.Entries) != 3 {
+			t.Fatalf("GET returned %d %s", recorder.Code, recorder.Body.String())
+		}
+		deleted, updated, created := result.Entries[0], result.Entries[1], result.Entries[2]
+		if created.Operation != "create" || updated.Operation != "update" || deleted.Operation != "delete" {
+			t.Errorf("the operations were %s, %s and %s", created.Operation, updated.Operation, deleted.Operation)
+		}
+		if created.BeforeHash != "" || created.AfterHash == "" || updated.BeforeHash != created.AfterHash ||
+			deleted.BeforeHash != updated.AfterHash || deleted.AfterHash != "" || updated.AfterHash == created.AfterHash {
+			t.Errorf("the hashes don't chain: %+v", result.Entries)
+		}
+		if created.Actor != "anonymous" || created.TargetUser != contractUser {
+			t.Errorf("the entry was %+v", created)
+		}
+
+		recorder = httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/audit?resource=bags&actor=anonymous&limit=1", nil))
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil || len(result.Entries) != 1 || result.Entries[0].Operation != "create" ||
+			!strings.Contains(string(result.Entries[0].Detail), bag["id"].(string)) {
+			t.Errorf("GET for bags returned %s", recorder.Body.String())
+		}
+
+		status, body := doContractRequest(t, router, http.MethodGet, "/admin/audit?user="+contractUser+"&since="+time.Now().Add(time.Hour).UTC().Format(time.RFC3339), "")
+		if entries, _ := body["entries"].([]interface{}); status != http.StatusOK || len(entries) != 0 {
+			t.Errorf("GET for the future returned %d %v", status, body)
+		}
+		for _, query := range []string{"since=yesterday", "limit=0", "limit=1001"} {
+			if status, _ = doContractRequest(t, router, http.MethodGet, "/admin/audit?"+query, ""); status != http.StatusBadRequest {
+				t.Errorf("GET with %s returned %d", query, status)
+			}
+		}
+	})
+
+	t.Run("events", func(t *testing.T) {
+		ctx := context.Background()
+		pending, err := storage.Outbox.claimEvents(ctx, 1000, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range pending {
+			if err = storage.Outbox.deleteEvent(ctx, event.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		doContractRequest(t, router, http.MethodPut, "/preferences/"+contractUser, `{"theme":"dark"}`)
+		_, bag := doContractRequest(t, router, http.MethodPut, "/bags/"+contractUser, `{"items":["a"]}`)
+		doContractRequest(t, router, http.MethodDelete, "/bags/"+contractUser, "")
+		doContractRequest(t, router, http.MethodDelete, "/preferences/"+contractUser, "")
+
+		events, err := storage.Outbox.claimEvents(ctx, 2, time.Minute)
+		if err != nil || len(events) != 2 {
+			t.Fatalf("claimed %v %v", events, err)
+		}
+		var created, added ChangeEvent
+		if err = json.Unmarshal(events[0].Payload, &created); err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(events[1].Payload, &added); err != nil {
+			t.Fatal(err)
+		}
+		if events[0].RoutingKey != "user-info.preferences.create" || created.Username != contractUser || created.RequestID == "" ||
+			created.Actor != "anonymous" || !reflect.DeepEqual(created.Data, map[string]interface{}{"theme": "dark"}) {
+			t.Errorf("the first event was %s %+v", events[0].RoutingKey, created)
+		}
+		if events[1].RoutingKey != "user-info.bags.create" || added.Data.(map[string]interface{})["bag_id"] != bag["id"] {
+			t.Errorf("the second event was %s %+v", events[1].RoutingKey, added)
+		}
+
+		// The claimed events are hidden until their lease runs out or they're
+		// retried.
+		rest, err := storage.Outbox.claimEvents(ctx, 10, time.Minute)
+		if err != nil || len(rest) != 2 || rest[0].RoutingKey != "user-info.bags.delete_all" || rest[1].RoutingKey != "user-info.preferences.delete" {
+			t.Fatalf("claimed %v %v", rest, err)
+		}
+		if err = storage.Outbox.retryEvent(ctx, events[0].ID, 0, "broker unavailable"); err != nil {
+			t.Fatal(err)
+		}
+		retried, err := storage.Outbox.claimEvents(ctx, 10, time.Minute)
+		if err != nil || len(retried) != 1 || retried[0].ID != events[0].ID || retried[0].Attempts != 1 {
+			t.Fatalf("claimed %v %v after a retry", retried, err)
+		}
+
+		for _, event := range append(events, rest...) {
+			if err = storage.Outbox.deleteEvent(ctx, event.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = storage.Outbox.retryEvent(ctx, rest[0].ID, 0, "too late"); err != nil {
+			t.Fatal(err)
+		}
+		if left, err := storage.Outbox.claimEvents(ctx, 10, 0); err != nil || len(left) != 0 {
+			t.Errorf("%v were left in the outbox, %v", left, err)
+		}
+	})
+
+	t.Run("change feed", func(t *testing.T) {
+		ctx := context.Background()
+		since, err := storage.Changes.lastChangeID(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		doContractRequest(t, router, http.MethodPut, "/sessions/"+contractUser, `{"tab":1}`)
+		doContractRequest(t, router, http.MethodPost, "/sessions/"+contractUser, `{"tab":2}`)
+		doContractRequest(t, router, http.MethodPut, "/bags/"+contractUser, `{"items":["a"]}`)
+		doContractRequest(t, router, http.MethodDelete, "/bags/"+contractUser, "")
+
+		// Only the latest change to the session survives, and deleting every bag
+		// replaces the bag's creation with a tombstone.
+		path := fmt.Sprintf("/changes?since=%d", since)
+		status, body := doContractRequest(t, router, http.MethodGet, path, "")
+		changes, _ := body["changes"].([]interface{})
+		if status != http.StatusOK || len(changes) != 2 {
+			t.Fatalf("GET %s returned %d %v", path, status, body)
+		}
+		session, tombstone := changes[0].(map[string]interface{}), changes[1].(map[string]interface{})
+		if session["resource"] != "sessions" || session["deleted"] != nil ||
+			!reflect.DeepEqual(session["document"], map[string]interface{}{"tab": float64(2)}) {
+			t.Errorf("the first change was %v", session)
+		}
+		if tombstone["resource"] != "bags" || tombstone["operation"] != "delete_all" || tombstone["deleted"] != true {
+			t.Errorf("the second change was %v", tombstone)
+		}
+		if session["id"].(float64) >= tombstone["id"].(float64) || body["cursor"] != tombstone["id"] {
+			t.Errorf("the changes were out of order: %v", body)
+		}
+
+		path = fmt.Sprintf("/changes?since=%d&limit=1", since)
+		status, body = doContractRequest(t, router, http.MethodGet, path, "")
+		changes, _ = body["changes"].([]interface{})
+		if status != http.StatusOK || len(changes) != 1 || body["cursor"] != session["id"] {
+			t.Errorf("GET %s returned %d %v", path, status, body)
+		}
+
+		path = fmt.Sprintf("/changes?since=%v", tombstone["id"])
+		status, body = doContractRequest(t, router, http.MethodGet, path, "")
+		changes, _ = body["changes"].([]interface{})
+		if status != http.StatusOK || len(changes) != 0 || body["cursor"] != tombstone["id"] {
+			t.Errorf("GET %s at the end of the feed returned %d %v", path, status, body)
+		}
+
+		for _, path := range []string{"/changes?since=-1", "/changes?since=x", "/changes?limit=0", "/changes?limit=1001"} {
+			if status, _ := doContractRequest(t, router, http.MethodGet, path, ""); status != http.StatusBadRequest {
+				t.Errorf("GET %s returned %d", path, status)
+			}
+		}
+
+		if _, err = storage.Changes.pruneTombstones(ctx, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		path = fmt.Sprintf("/changes?since=%d", since)
+		_, body = doContractRequest(t, router, http.MethodGet, path, "")
+		changes, _ = body["changes"].([]interface{})
+		if len(changes) != 1 || changes[0].(map[string]interface{})["id"] != session["id"] {
+			t.Errorf("the changes after pruning tombstones were %v", body)
+		}
+	})
+
+	t.Run("webhooks", func(t *testing.T) {
+		ctx := context.Background()
+
+		for _, body := range []string{
+			`{"url":"ftp://example.org/hook","event_types":["sessions.update"]}`,
+			`{"url":"https://example.org/hook","event_types":[]}`,
+			`{"url":"https://example.org/hook","event_types":["session.expired"]}`,
+		} {
+			if status, _ := doContractRequest(t, router, http.MethodPost, "/admin/webhooks", body); status != http.StatusBadRequest {
+				t.Errorf("POST %s returned %d", body, status)
+			}
+		}
+
+		body := `{"url":"https://example.org/hook","event_types":["sessions.create","sessions.update"],"username":"` + contractUser + `"}`
+		status, created := doContractRequest(t, router, http.MethodPost, "/admin/webhooks", body)
+		if status != http.StatusCreated || created["secret"] == "" || created["id"] == "" {
+			t.Fatalf("POST returned %d %v", status, created)
+		}
+		id := created["id"].(string)
+		status, other := doContractRequest(t, router, http.MethodPost, "/admin/webhooks",
+			`{"url":"https://example.org/other","event_types":["*"],"username":"someone-else"}`)
+		if status != http.StatusCreated {
+			t.Fatalf("POST returned %d %v", status, other)
+		}
+
+		status, listed := doContractRequest(t, router, http.MethodGet, "/admin/webhooks", "")
+		webhooks, _ := listed["webhooks"].([]interface{})
+		if status != http.StatusOK || len(webhooks) != 2 || webhooks[0].(map[string]interface{})["secret"] != nil {
+			t.Errorf("GET returned %d %v", status, listed)
+		}
+		status, got := doContractRequest(t, router, http.MethodGet, "/admin/webhooks/"+id, "")
+		if status != http.StatusOK || got["url"] != "https://example.org/hook" ||
+			!reflect.DeepEqual(got["event_types"], []interface{}{"sessions.create", "sessions.update"}) {
+			t.Errorf("GET returned %d %v", status, got)
+		}
+		for _, path := range []string{"/admin/webhooks/not-a-uuid", "/admin/webhooks/" + newUUID()} {
+			if status, _ := doContractRequest(t, router, http.MethodGet, path, ""); status != http.StatusNotFound {
+				t.Errorf("GET %s returned %d", path, status)
+			}
+		}
+
+		// Only the first webhook subscribes to this user's sessions, and
+		// deleting them isn't one of its event types.
+		doContractRequest(t, router, http.MethodPost, "/sessions/"+contractUser, `{"tab":3}`)
+		doContractRequest(t, router, http.MethodDelete, "/sessions/"+contractUser, "")
+
+		deliveries, err := storage.Webhooks.claimDeliveries(ctx, 10, time.Minute)
+		if err != nil || len(deliveries) != 1 {
+			t.Fatalf("claimed %+v %v", deliveries, err)
+		}
+		delivery := deliveries[0]
+		var event ChangeEvent
+		if err = json.Unmarshal(delivery.Payload, &event); err != nil {
+			t.Fatal(err)
+		}
+		if delivery.WebhookID != id || delivery.URL != "https://example.org/hook" || delivery.Secret != created["secret"] ||
+			delivery.EventType != event.Type || event.Username != contractUser {
+			t.Errorf("claimed %+v for %+v", delivery, event)
+		}
+		if more, err := storage.Webhooks.claimDeliveries(ctx, 10, time.Minute); err != nil || len(more) != 0 {
+			t.Errorf("claimed %+v %v while the first claim was leased", more, err)
+		}
+
+		if err = storage.Webhooks.retryDelivery(ctx, delivery.ID, 0, "connection refused"); err != nil {
+			t.Fatal(err)
+		}
+		if err = storage.Webhooks.failDelivery(ctx, delivery.ID, "503 Service Unavailable"); err != nil {
+			t.Fatal(err)
+		}
+		if retried, err := storage.Webhooks.claimDeliveries(ctx, 10, 0); err != nil || len(retried) != 0 {
+			t.Errorf("claimed %+v %v after the delivery failed", retried, err)
+		}
+
+		status, dead := doContractRequest(t, router, http.MethodGet, "/admin/webhooks/"+id+"/dead-letters", "")
+		letters, _ := dead["deliveries"].([]interface{})
+		if status != http.StatusOK || len(letters) != 1 {
+			t.Fatalf("GET dead letters returned %d %v", status, dead)
+		}
+		letter := letters[0].(map[string]interface{})
+		if letter["attempts"] != float64(2) || letter["last_error"] != "503 Service Unavailable" || letter["failed_at"] == nil {
+			t.Errorf("the dead letter was %v", letter)
+		}
+
+		path := fmt.Sprintf("/admin/webhooks/%s/dead-letters/%d/redeliver", id, delivery.ID)
+		if status, _ = doContractRequest(t, router, http.MethodPost, path, ""); status != http.StatusAccepted {
+			t.Errorf("POST %s returned %d", path, status)
+		}
+		if status, _ = doContractRequest(t, router, http.MethodPost, path, ""); status != http.StatusNotFound {
+			t.Errorf("POST %s for a delivery that isn't dead returned %d", path, status)
+		}
+		path = fmt.Sprintf("/admin/webhooks/%s/dead-letters/%d/redeliver", other["id"], delivery.ID)
+		if status, _ = doContractRequest(t, router, http.MethodPost, path, ""); status != http.StatusNotFound {
+			t.Errorf("POST %s for another webhook's delivery returned %d", path, status)
+		}
+
+		redelivered, err := storage.Webhooks.claimDeliveries(ctx, 10, time.Minute)
+		if err != nil || len(redelivered) != 1 || redelivered[0].ID != delivery.ID || redelivered[0].Attempts != 0 {
+			t.Fatalf("claimed %+v %v after redelivering", redelivered, err)
+		}
+
+		// Deleting the webhook discards its deliveries.
+		if status, _ = doContractRequest(t, router, http.MethodDelete, "/admin/webhooks/"+id, ""); status != http.StatusOK {
+			t.Errorf("DELETE returned %d", status)
+		}
+		if status, _ = doContractRequest(t, router, http.MethodDelete, "/admin/webhooks/"+id, ""); status != http.StatusNotFound {
+			t.Errorf("DELETE of a deleted webhook returned %d", status)
+		}
+		if left, err := storage.Webhooks.claimDeliveries(ctx, 10, 0); err != nil || len(left) != 0 {
+			t.Errorf("%+v were left after deleting the webhook, %v", left, err)
+		}
+		if status, _ = doContractRequest(t, router, http.MethodDelete, fmt.Sprintf("/admin/webhooks/%s", other["id"]), ""); status != http.StatusOK {
+			t.Errorf("DELETE returned %d", status)
+		}
+	})
+
+	t.Run("event retention", func(t *testing.T) {
+		ctx := context.Background()
+		status, created := doContractRequest(t, router, http.MethodPost, "/admin/webhooks",
+			`{"url":"https://example.org/retained","event_types":["*"]}`)
+		if status != http.StatusCreated {
+			t.Fatalf("POST returned %d %v", status, created)
+		}
+		doContractRequest(t, router, http.MethodPut, "/preferences/"+contractUser, `{"theme":"retained"}`)
+
+		past := time.Now().Add(-time.Hour)
+		if pruned, err := storage.Outbox.pruneEvents(ctx, past); err != nil || pruned != 0 {
+			t.Errorf("pruned %d events, %v, before any had expired", pruned, err)
+		}
+		if pruned, err := storage.Webhooks.pruneDeliveries(ctx, past); err != nil || pruned != 0 {
+			t.Errorf("pruned %d deliveries, %v, before any had expired", pruned, err)
+		}
+
+		future := time.Now().Add(time.Hour)
+		if pruned, err := storage.Outbox.pruneEvents(ctx, future); err != nil || pruned == 0 {
+			t.Errorf("pruned %d events, %v", pruned, err)
+		}
+		if pruned, err := storage.Webhooks.pruneDeliveries(ctx, future); err != nil || pruned == 0 {
+			t.Errorf("pruned %d deliveries, %v", pruned, err)
+		}
+		if left, err := storage.Outbox.claimEvents(ctx, 10, 0); err != nil || len(left) != 0 {
+			t.Errorf("%v were left in the outbox, %v", left, err)
+		}
+		if left, err := storage.Webhooks.claimDeliveries(ctx, 10, 0); err != nil || len(left) != 0 {
+			t.Errorf("%+v were left after pruning, %v", left, err)
+		}
+
+		if status, _ = doContractRequest(t, router, http.MethodDelete, fmt.Sprintf("/admin/webhooks/%s", created["id"]), ""); status != http.StatusOK {
+			t.Errorf("DELETE returned %d", status)
+		}
+	})
+
+	t.Run("import", func(t *testing.T) {
+		const importer = "importer@example.org"
+		const bagID = "0F9A6F4C-3A1B-4D8E-9C2B-7A5D1E6F8B90"
+		lines := strings.Join([]string{
+			`{"resource":"preferences","username":"` + importer + `","document":{"a":1}}`,
+			``,
+			`{"resource":"bags","username":"` + importer + `","id":"` + bagID + `","default":true,"document":{"b":2}}`,
+			`{"resource":"sessions","username":"` + importer + `","document":[1]}`,
+			`not json`,
+			`{"resource":"searches","username":"` + importer + `","document":"anything"}`,
+		}, "\n")
+
+		status, body := doContractRequest(t, router, http.MethodPost, "/admin/import?dry_run=true", lines)
+		if status != http.StatusOK || body["dry_run"] != true || body["created"] != 3.0 || body["failed"] != 2.0 || body["users_created"] != 1.0 {
+			t.Fatalf("a dry run returned %d %v", status, body)
+		}
+		if exists, err := storage.Users.isUser(context.Background(), importer); err != nil || exists {
+			t.Fatalf("a dry run created the user: %v", err)
+		}
+
+		status, body = doContractRequest(t, router, http.MethodPost, "/admin/import?batch_size=2", lines)
+		if status != http.StatusOK || body["records"] != 5.0 || body["created"] != 3.0 || body["failed"] != 2.0 || body["users_created"] != 1.0 {
+			t.Fatalf("POST returned %d %v", status, body)
+		}
+		errs, _ := body["errors"].([]interface{})
+		if len(errs) != 2 || errs[0].(map[string]interface{})["line"] != 4.0 || errs[1].(map[string]interface{})["line"] != 5.0 {
+			t.Errorf("the errors were %v", errs)
+		}
+
+		status, body = doContractRequest(t, router, http.MethodGet, "/preferences/"+importer, "")
+		if status != http.StatusOK || body["a"] != 1.0 {
+			t.Errorf("GET for the imported preferences returned %d %v", status, body)
+		}
+		bag, err := storage.Bags.GetDefaultBag(context.Background(), importer)
+		if err != nil || bag.ID != strings.ToLower(bagID) || bag.Contents["b"] != 2.0 {
+			t.Errorf("the default bag was %+v %v", bag, err)
+		}
+
+		again := `{"resource":"preferences","username":"` + importer + `","document":{"a":2}}`
+		for policy, expected := range map[string]string{importSkip: "skipped", importFail: "failed", importOverwrite: "updated"} {
+			status, body = doContractRequest(t, router, http.MethodPost, "/admin/import?policy="+policy, again)
+			if status != http.StatusOK || body[expected] != 1.0 {
+				t.Errorf("POST with the %s policy returned %d %v", policy, status, body)
+			}
+		}
+		status, body = doContractRequest(t, router, http.MethodGet, "/preferences/"+importer, "")
+		if status != http.StatusOK || body["a"] != 2.0 {
+			t.Errorf("GET after overwriting returned %d %v", status, body)
+		}
+
+		taken := `{"resource":"bags","username":"other-importer@example.org","id":"` + bagID + `","document":{}}`
+		status, body = doContractRequest(t, router, http.MethodPost, "/admin/import?policy=overwrite", taken)
+		errs, _ = body["errors"].([]interface{})
+		if status != http.StatusOK || len(errs) != 1 || !strings.Contains(errs[0].(map[string]interface{})["error"].(string), "belongs to another user") {
+			t.Errorf("importing another user's bag returned %d %v", status, body)
+		}
+
+		status, _ = doContractRequest(t, router, http.MethodPost, "/admin/import?policy=replace", again)
+		if status != http.StatusBadRequest {
+			t.Errorf("POST with an unknown policy returned %d", status)
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		stats, err := storage.Stats.storageStats(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Users < 1 || stats.Changes < 1 || stats.Webhooks != 0 || stats.PendingDeliveries != 0 || stats.DeadDeliveries != 0 {
+			t.Errorf("the stats were %+v", stats)
+		}
+	})
+
+	t.Run("clients", func(t *testing.T) {
+		status, body := doContractRequest(t, router, http.MethodPut, "/admin/clients/contract", `{"scopes":["bags:read"]}`)
+		if status != http.StatusCreated || body["api_key"] == "" {
+			t.Fatalf("PUT returned %d %v", status, body)
+		}
+
+		status, _ = doContractRequest(t, router, http.MethodPut, "/admin/clients/contract", `{"scopes":["bags:read"]}`)
+		if status != http.StatusConflict {
+			t.Errorf("PUT for an existing client returned %d", status)
+		}
+
+		if _, err := authenticateClient(context.Background(), storage.Clients, body["api_key"].(string)); err != nil {
+			t.Errorf("the returned key didn't authenticate: %s", err)
+		}
+
+		status, _ = doContractRequest(t, router, http.MethodPost, "/admin/clients/contract", `{"scopes":["bags:read","bags:write"]}`)
+		if status != http.StatusOK {
+			t.Errorf("POST returned %d", status)
+		}
+
+		status, body = doContractRequest(t, router, http.MethodGet, "/admin/clients", "")
+		clients, _ := body["clients"].([]interface{})
+		if status != http.StatusOK || len(clients) != 1 {
+			t.Fatalf("GET returned %d %v", status, body)
+		}
+		if scopes := clients[0].(map[string]interface{})["scopes"]; !reflect.DeepEqual(scopes, []interface{}{"bags:read", "bags:write"}) {
+			t.Errorf("scopes were %v", scopes)
+		}
+
+		status, _ = doContractRequest(t, router, http.MethodDelete, "/admin/clients/contract", "")
+		if status != http.StatusOK && status != http.StatusNoContent {
+			t.Errorf("DELETE returned %d", status)
+		}
+
+		status, _ = doContractRequest(t, router, http.MethodGet, "/admin/clients/contract", "")
+		if status != http.StatusNotFound {
+			t.Errorf("GET after revoking returned %d", status)
+		}
+
+		status, _ = doContractRequest(t, router, http.MethodPut, "/admin/clients/contract", `{"scopes":["bags:read"]}`)
+		if status != http.StatusCreated {
+			t.Errorf("PUT after revoking returned %d", status)
+		}
+	})
+}
+
+func TestMemoryStorageContract(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.Users.addUser(context.Background(), contractUser); err != nil {
+		t.Fatal(err)
+	}
+	testStorageContract(t, storage)
+}
+
+// TestPostgresStorageContract runs against a scratch database named by
+// USER_INFO_TEST_POSTGRES_URI. The contract user's data is removed first.
+func TestPostgresStorageContract(t *testing.T) {
+	dburi := os.Getenv("USER_INFO_TEST_POSTGRES_URI")
+	if dburi == "" {
+		t.Skip("USER_INFO_TEST_POSTGRES_URI is not set")
+	}
+
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	storage := NewPostgresStorage(db)
+	ctx := context.Background()
+	if err = storage.Users.addUser(ctx, contractUser); err != nil {
+		t.Fatal(err)
+	}
+	for _, cleanup := range []func() error{
+		func() error { return storage.Preferences.deletePreferences(ctx, contractUser) },
+		func() error { return storage.Sessions.deleteSession(ctx, contractUser) },
+		func() error { return storage.Searches.deleteSavedSearches(ctx, contractUser) },
+		func() error { return storage.Bags.DeleteAllBags(ctx, contractUser) },
+		func() error { _, err := db.Exec(`DELETE FROM service_clients`); return err },
+	} {
+		if err = cleanup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testStorageContract(t, storage)
+}
+
+// TestPostgresChangePositions checks, against the database named by
+// USER_INFO_TEST_POSTGRES_URI, that changes committed between two reads of the
+// change log are given positions in the order they were made.
+func TestPostgresChangePositions(t *testing.T) {
+	dburi := os.Getenv("USER_INFO_TEST_POSTGRES_URI")
+	if dburi == "" {
+		t.Skip("USER_INFO_TEST_POSTGRES_URI is not set")
+	}
+
+	db, err := sql.Open("postgres", dburi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	storage := NewPostgresStorage(db)
+	ctx := context.Background()
+	if err = storage.Users.addUser(ctx, contractUser); err != nil {
+		t.Fatal(err)
+	}
+	since, err := storage.Changes.lastChangeID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// None of these changes are read until they've all been committed, so
+	// they're all numbered at once.
+	for i := 0; i < 20; i++ {
+		if _, err = storage.Bags.AddBag(ctx, contractUser, fmt.Sprintf(`{"n":%d}`, i)); err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 0 {
+			if err = storage.Bags.DeleteAllBags(ctx, contractUser); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	lastBag, err := storage.Bags.AddBag(ctx, contractUser, `{"last":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := storage.Changes.userChanges(ctx, contractUser, since, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for _, change := range changes {
+		var id int64
+		if err = db.QueryRow(`SELECT id FROM user_changes WHERE position = $1`, change.ID).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) > 0 && id < ids[len(ids)-1] {
+			t.Errorf("change %d was numbered %d, after a later change", id, change.ID)
+		}
+		ids = append(ids, id)
+	}
+
+	// A replay ends with the bags added after the last time they were all
+	// deleted.
+	if len(changes) < 2 || changes[0].Operation != "delete_all" || changes[len(changes)-1].RecordID != lastBag {
+		t.Errorf("the changes were %+v", changes)
+	}
+}
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			t.Errorf("migration %q has version %d instead of %d", mig.Name, mig.Version, i+1)
+		}
+		if mig.Up == "" {
+			t.Errorf("migration %d has no up statement", mig.Version)
+		}
+	}
+}
+
+func expectMigrationLock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("SELECT pg_advisory_lock\\(\\$1\\)").
+		WithArgs(migrationLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS " + migrationsTable).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func expectMigrationUnlock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("SELECT pg_advisory_unlock\\(\\$1\\)").
+		WithArgs(migrationLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestMigratorUp(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	m := NewMigrator(db)
+	m.migrations = []migration{
+		{Version: 1, Name: "first", Up: "CREATE TABLE first"},
+		{Version: 2, Name: "second", Up: "CREATE TABLE second"},
+	}
+
+	expectMigrationLock(mock)
+	mock.ExpectQuery("SELECT version, applied_at FROM " + migrationsTable).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE second").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO "+migrationsTable).
+		WithArgs(2, "second").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectMigrationUnlock(mock)
+
+	done, err := m.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(done, []int{2}) {
+		t.Errorf("applied %v instead of [2]", done)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigratorUpFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	m := NewMigrator(db)
+	m.migrations = []migration{{Version: 1, Name: "first", Up: "CREATE TABLE first"}}
+
+	expectMigrationLock(mock)
+	mock.ExpectQuery("SELECT version, applied_at FROM " + migrationsTable).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE first").WillReturnError(errors.New("syntax error"))
+	mock.ExpectRollback()
+	expectMigrationUnlock(mock)
+
+	if _, err = m.Up(context.Background()); err == nil {
+		t.Error("no error was returned")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigratorDown(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	m := NewMigrator(db)
+	m.migrations = []migration{
+		{Version: 1, Name: "first", Up: "CREATE TABLE first"},
+		{Version: 2, Name: "second", Up: "CREATE TABLE second", Down: "DROP TABLE second"},
+	}
+
+	applied := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()).AddRow(2, time.Now())
+	}
+
+	expectMigrationLock(mock)
+	mock.ExpectQuery("SELECT version, applied_at FROM " + migrationsTable).WillReturnRows(applied())
+	mock.ExpectBegin()
+	mock.ExpectExec("DROP TABLE second").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM " + migrationsTable).
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectMigrationUnlock(mock)
+
+	done, err := m.Down(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(done, []int{2}) {
+		t.Errorf("reverted %v instead of [2]", done)
+	}
+
+	// The first migration can't be reverted.
+	expectMigrationLock(mock)
+	mock.ExpectQuery("SELECT version, applied_at FROM " + migrationsTable).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+	expectMigrationUnlock(mock)
+
+	if _, err = m.Down(context.Background(), 1); err == nil {
+		t.Error("reverting an irreversible migration didn't fail")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigratorStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	m := NewMigrator(db)
+	m.migrations = []migration{
+		{Version: 1, Name: "first", Up: "CREATE TABLE first"},
+		{Version: 2, Name: "second", Up: "CREATE TABLE second"},
+	}
+
+	// Nothing has been applied to a fresh database.
+	mock.ExpectQuery("SELECT to_regclass").
+		WithArgs(migrationsTable).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	if err = m.CheckCurrent(context.Background()); err == nil {
+		t.Error("CheckCurrent didn't fail for a fresh database")
+	}
+
+	mock.ExpectQuery("SELECT to_regclass").
+		WithArgs(migrationsTable).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT version, applied_at FROM " + migrationsTable).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+
+	var out bytes.Buffer
+	if err = runMigrate(context.Background(), db, []string{"status"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(migrations)+1 || strings.Contains(lines[1], "pending") || !strings.Contains(lines[2], "pending") {
+		t.Errorf("unexpected status output:\n%s", out.String())
+	}
+
+	mock.ExpectQuery("SELECT to_regclass").
+		WithArgs(migrationsTable).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT version, applied_at FROM " + migrationsTable).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()).AddRow(2, time.Now()))
+	if err = m.CheckCurrent(context.Background()); err != nil {
+		t.Errorf("CheckCurrent failed for a current database: %s", err)
+	}
+
+	if err = runMigrate(context.Background(), db, []string{"sideways"}, &out); err == nil {
+		t.Error("an unknown command didn't fail")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	now := time.Now()
+	cache := newLRUCache(2, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	cache.set("a", 1)
+	cache.set("b", 2)
+	if _, ok := cache.get("a"); !ok {
+		t.Error("a wasn't cached")
+	}
+
+	// b is now the least recently used entry.
+	cache.set("c", 3)
+	if _, ok := cache.get("b"); ok {
+		t.Error("b wasn't evicted")
+	}
+	if value, ok := cache.get("a"); !ok || value != 1 {
+		t.Errorf("a was %v, %v", value, ok)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := cache.get("c"); ok {
+		t.Error("c didn't expire")
+	}
+
+	cache.set("d", 4)
+	cache.remove("d")
+	if _, ok := cache.get("d"); ok {
+		t.Error("d wasn't removed")
+	}
+}
+
+// countingUsers and countingPrefs count the reads that reach the underlying
+// stores.
+type countingUsers struct {
+	uDB
+	isUserCalls int
+}
+
+func (c *countingUsers) isUser(ctx context.Context, username string) (bool, error) {
+	c.isUserCalls++
+	return c.uDB.isUser(ctx, username)
+}
+
+type countingPrefs struct {
+	pDB
+	getCalls int
+}
+
+func (c *countingPrefs) getPreferences(ctx context.Context, username string) ([]UserPreferencesRecord, error) {
+	c.getCalls++
+	return c.pDB.getPreferences(ctx, username)
+}
+
+func TestNewCacheFromConfig(t *testing.T) {
+	if cache := NewCacheFromConfig(viper.New()); cache != nil {
+		t.Error("caching was on without being turned on")
+	}
+
+	cfg := viper.New()
+	cfg.Set("user_info.cache.enabled", true)
+	if cache := NewCacheFromConfig(cfg); cache == nil {
+		t.Error("caching was off after being turned on")
+	}
+}
+
+func TestCachedPreferences(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	if err := storage.Users.addUser(ctx, contractUser); err != nil {
+		t.Fatal(err)
+	}
+	users := &countingUsers{uDB: storage.Users}
+	prefs := &countingPrefs{pDB: storage.Preferences}
+	storage.Users = users
+	storage.Preferences = prefs
+
+	var published []string
+	cache := NewCache(10, time.Minute)
+	cache.publish = func(ctx context.Context, key string) error {
+		published = append(published, key)
+		return nil
+	}
+	storage.UseCache(cache)
+
+	router := newStorageRouter(storage)
+	path := "/preferences/" + contractUser
+
+	doContractRequest(t, router, http.MethodPut, path, `{"theme":"dark"}`)
+	published = nil
+	users.isUserCalls, prefs.getCalls = 0, 0
+
+	for i := 0; i < 3; i++ {
+		if status, body := doContractRequest(t, router, http.MethodGet, path, ""); status != http.StatusOK || body["theme"] != "dark" {
+			t.Fatalf("GET returned %d %v", status, body)
+		}
+	}
+	if users.isUserCalls != 0 || prefs.getCalls != 0 {
+		t.Errorf("cached reads reached the store: %d isUser, %d getPreferences", users.isUserCalls, prefs.getCalls)
+	}
+
+	// A write is visible immediately and tells the other replicas.
+	doContractRequest(t, router, http.MethodPost, path, `{"theme":"light"}`)
+	if status, body := doContractRequest(t, router, http.MethodGet, path, ""); status != http.StatusOK || body["theme"] != "light" {
+		t.Errorf("GET after POST returned %d %v", status, body)
+	}
+	if !reflect.DeepEqual(published, []string{"preferences:" + contractUser}) {
+		t.Errorf("published %v", published)
+	}
+
+	// An invalidation from another replica evicts the entry.
+	prefs.getCalls = 0
+	cache.handleInvalidation("preferences:" + contractUser)
+	doContractRequest(t, router, http.MethodGet, path, "")
+	if prefs.getCalls != 1 {
+		t.Errorf("getPreferences was called %d times after a remote invalidation", prefs.getCalls)
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, expected := range []string{`user_info_cache_hits_total{cache="preferences"}`, `user_info_cache_misses_total{cache="users"}`} {
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("the metrics didn't include %s", expected)
+		}
+	}
+}
+
+func TestCachedStorageContract(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.Users.addUser(context.Background(), contractUser); err != nil {
+		t.Fatal(err)
+	}
+	storage.UseCache(NewCache(10, time.Minute))
+	testStorageContract(t, storage)
+}
+
+func TestProfilesDB(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT COALESCE\\(\\(SELECT p.preferences FROM user_preferences").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"preferences", "session", "saved_searches", "user_id", "bag_id", "contents"}).
+			AddRow(`{"a":1}`, "", "", "u1", "b1", []byte(`{"items":[]}`)))
+
+	profile, err := NewProfilesDB(db).getProfile(context.Background(), "test-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Preferences != `{"a":1}` || profile.Session != "" || profile.DefaultBag == nil || profile.DefaultBag.ID != "b1" || profile.DefaultBag.UserID != "u1" {
+		t.Errorf("unexpected profile %+v", profile)
+	}
+
+	mock.ExpectQuery("SELECT COALESCE").
+		WithArgs("nobody").
+		WillReturnError(sql.ErrNoRows)
+	if _, err = NewProfilesDB(db).getProfile(context.Background(), "nobody"); err != sql.ErrNoRows {
+		t.Errorf("error was %v instead of sql.ErrNoRows", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBuildProfileInvalidSearches(t *testing.T) {
+	record := &UserProfileRecord{SavedSearches: "not json"}
+	profile, err := buildProfile("test-user", record, map[string]bool{"saved_searches": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsoned, err := json.Marshal(profile)
+	if err != nil {
+		t.Fatalf("the profile couldn't be encoded: %s", err)
+	}
+	if !strings.Contains(string(jsoned), `"saved_searches":"not json"`) {
+		t.Errorf("the profile was %s", jsoned)
+	}
+}
+
+func TestProfileETag(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.Users.addUser(context.Background(), contractUser); err != nil {
+		t.Fatal(err)
+	}
+	router := newStorageRouter(storage)
+	path := "/users/" + contractUser + "/profile"
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			request.Header.Set("If-None-Match", etag)
+		}
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	first := get("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET returned %d with ETag %q", first.Code, etag)
+	}
+
+	if recorder := get(etag); recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 {
+		t.Errorf("GET with a matching ETag returned %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	doContractRequest(t, router, http.MethodPut, "/sessions/"+contractUser, `{"tab":"data"}`)
+	second := get(etag)
+	if second.Code != http.StatusOK || second.Header().Get("ETag") == etag {
+		t.Errorf("GET after a change returned %d with ETag %q", second.Code, second.Header().Get("ETag"))
+	}
+
+	status, _ := doContractRequest(t, router, http.MethodGet, path+"?include=bogus", "")
+	if status != http.StatusBadRequest {
+		t.Errorf("GET with an unknown part returned %d", status)
+	}
+}
+
+// readExport unzips an export and checks it against its manifest.
+func readExport(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("error opening the export: %s", err)
+	}
+
+	files := make(map[string][]byte)
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = contents
+	}
+
+	var manifest exportManifest
+	if err = json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatalf("error reading the manifest: %s", err)
+	}
+	if len(manifest.Files) != len(files)-1 {
+		t.Errorf("the manifest lists %d files but the export has %d", len(manifest.Files), len(files)-1)
+	}
+	for _, entry := range manifest.Files {
+		sum := sha256.Sum256(files[entry.Name])
+		if hex.EncodeToString(sum[:]) != entry.SHA256 || len(files[entry.Name]) != entry.Bytes {
+			t.Errorf("%s doesn't match the manifest", entry.Name)
+		}
+	}
+	return files
+}
+
+func TestExportDB(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	mock.ExpectQuery("SELECT id, preferences FROM user_preferences").
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "preferences"}).AddRow("p1", `{"a":1}`))
+	mock.ExpectQuery("SELECT id, session FROM user_sessions").
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "session"}).AddRow("s1", `{}`).AddRow("s2", `not json`))
+	mock.ExpectQuery("SELECT id, saved_searches FROM user_saved_searches").
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "saved_searches"}))
+	mock.ExpectQuery("SELECT b.id, b.contents, d.bag_id IS NOT NULL").
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "contents", "default"}).AddRow("b1", `{"items":[]}`, true))
+	mock.ExpectCommit()
+
+	export, err := NewExportDB(db).exportUser(context.Background(), "test-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Preferences) != 1 || len(export.Sessions) != 2 || len(export.SavedSearches) != 0 || len(export.Bags) != 1 || !export.Bags[0].Default {
+		t.Errorf("unexpected export %+v", export)
+	}
+
+	var buf bytes.Buffer
+	if err = writeExport(&buf, export, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	files := readExport(t, buf.Bytes())
+	if !strings.Contains(string(files["sessions.json"]), `"not json"`) {
+		t.Errorf("an invalid document wasn't exported as a string: %s", files["sessions.json"])
+	}
+
+	// An unknown user rolls the transaction back.
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
+		WithArgs("nobody").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+	if _, err = NewExportDB(db).exportUser(context.Background(), "nobody"); err != sql.ErrNoRows {
+		t.Errorf("error was %v instead of sql.ErrNoRows", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPurgeDB(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	entry := &AuditEntry{OccurredAt: time.Now(), Actor: "client:admin", TargetUser: "test-user", Resource: "users", Operation: "purge"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1 FOR UPDATE").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	for i, t := range purgeTables {
+		mock.ExpectExec("DELETE FROM " + t.table + " WHERE user_id = \\$1").
+			WithArgs("u1").
+			WillReturnResult(sqlmock.NewResult(0, int64(i)))
+	}
+	mock.ExpectExec("INSERT INTO audit_log").
+		WithArgs(entry.OccurredAt, "client:admin", "test-user", "users", "purge", "", "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "users", "purge")
+	for _, kind := range documentCaches {
+		expectInvalidation(mock, kind, "test-user")
+	}
+	mock.ExpectCommit()
+
+	report, err := NewPurgeDB(db).purgeUser(context.Background(), "test-user", false, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PurgeReport{Username: "test-user", DefaultBags: 0, Bags: 1, Preferences: 2, Sessions: 3, SavedSearches: 4}
+	if *report != want {
+		t.Errorf("report was %+v", report)
+	}
+	var detail PurgeReport
+	if err = json.Unmarshal(entry.Detail, &detail); err != nil || detail != want {
+		t.Errorf("audit detail was %s", entry.Detail)
+	}
+
+	// A dry run only counts, and doesn't write an audit entry.
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1 FOR UPDATE").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	for _, t := range purgeTables {
+		mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM " + t.table).
+			WithArgs("u1").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	}
+	mock.ExpectRollback()
+
+	if report, err = NewPurgeDB(db).purgeUser(context.Background(), "test-user", true, entry); err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || report.Bags != 1 || report.DefaultBags != 1 {
+		t.Errorf("dry run report was %+v", report)
+	}
+
+	// A failure part way through rolls everything back.
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1 FOR UPDATE").
+		WithArgs("test-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	mock.ExpectExec("DELETE FROM default_bags").
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM bags").
+		WithArgs("u1").
+		WillReturnError(errors.New("boom"))
+	mock.ExpectRollback()
+
+	if _, err = NewPurgeDB(db).purgeUser(context.Background(), "test-user", false, entry); err == nil {
+		t.Error("expected an error")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResolveDocuments(t *testing.T) {
+	source := `{"theme":"light","editor":{"size":12,"font":"serif"},"recent":["b"]}`
+	target := `{"theme":"dark","editor":{"font":"mono"},"recent":["a"]}`
+
+	tests := []struct {
+		policy, want, outcome string
+	}{
+		{mergeKeepSource, source, mergeKeptSource},
+		{mergeKeepTarget, target, mergeKeptTarget},
+		{mergeDeep, `{"editor":{"font":"mono","size":12},"recent":["a"],"theme":"dark"}`, mergeMerged},
+	}
+	for _, test := range tests {
+		document, outcome, err := resolveDocuments(test.policy, source, target)
+		if err != nil || document != test.want || outcome != test.outcome {
+			t.Errorf("%s returned %s %s %v", test.policy, document, outcome, err)
+		}
+	}
+
+	if _, _, err := resolveDocuments(mergeDeep, `not json`, target); err == nil {
+		t.Error("expected an error for an invalid source document")
+	}
+
+	if got := resolveDefaultBag(mergeKeepTarget, "s", "t"); got != "t" {
+		t.Errorf("keep-target kept default bag %s", got)
+	}
+	if got := resolveDefaultBag(mergeKeepSource, "s", "t"); got != "s" {
+		t.Errorf("keep-source kept default bag %s", got)
+	}
+	if got := resolveDefaultBag(mergeDeep, "s", ""); got != "s" {
+		t.Errorf("a target without a default bag kept %q", got)
+	}
+}
+
+func TestMergeDB(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	entry := &AuditEntry{OccurredAt: time.Now(), Actor: "client:admin", TargetUser: "new-user", Resource: "users", Operation: "merge"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT username, id FROM users WHERE username IN \\(\\$1, \\$2\\) ORDER BY username FOR UPDATE").
+		WithArgs("old-user", "new-user").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "id"}).AddRow("old-user", "u1"))
+	mock.ExpectQuery("INSERT INTO users \\(username\\) VALUES \\(\\$1\\) RETURNING id").
+		WithArgs("new-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u2"))
+	mock.ExpectQuery("SELECT id, preferences FROM user_preferences WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "preferences"}).AddRow("p1", `{}`))
+	mock.ExpectQuery("SELECT id, preferences FROM user_preferences").
+		WithArgs("u2").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("UPDATE user_preferences SET user_id = \\$1 WHERE id = \\$2").
+		WithArgs("u2", "p1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT id, session FROM user_sessions").
+		WithArgs("u1").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT id, saved_searches FROM user_saved_searches").
+		WithArgs("u1").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT bag_id FROM default_bags").
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"bag_id"}).AddRow("b1"))
+	mock.ExpectQuery("SELECT bag_id FROM default_bags").
+		WithArgs("u2").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("UPDATE bags SET user_id = \\$1 WHERE user_id = \\$2").
+		WithArgs("u2", "u1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM default_bags WHERE user_id = \\$1").
+		WithArgs("u2").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE default_bags SET user_id = \\$1 WHERE user_id = \\$2").
+		WithArgs("u2", "u1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO audit_log").
+		WithArgs(entry.OccurredAt, "client:admin", "new-user", "users", "merge", "", "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "users", "merge")
+	expectChange(mock, "users", "purge")
+	for _, username := range []string{"old-user", "new-user"} {
+		for _, kind := range documentCaches {
+			expectInvalidation(mock, kind, username)
+		}
+	}
+	mock.ExpectCommit()
+
+	report, err := NewMergeDB(db).mergeUsers(context.Background(), "old-user", "new-user", mergeKeepTarget, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MergeReport{
+		Source:        "old-user",
+		Target:        "new-user",
+		Policy:        mergeKeepTarget,
+		CreatedTarget: true,
+		Preferences:   mergeMoved,
+		Sessions:      mergeNone,
+		SavedSearches: mergeNone,
+		BagsMoved:     2,
+		DefaultBag:    "b1",
+	}
+	if *report != want {
+		t.Errorf("report was %+v", report)
+	}
+
+	// A document that can't be deep-merged rolls everything back.
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT username, id FROM users").
+		WithArgs("old-user", "new-user").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "id"}).AddRow("new-user", "u2").AddRow("old-user", "u1"))
+	mock.ExpectQuery("SELECT id, preferences FROM user_preferences").
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "preferences"}).AddRow("p1", `not json`))
+	mock.ExpectQuery("SELECT id, preferences FROM user_preferences").
+		WithArgs("u2").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "preferences"}).AddRow("p2", `{}`))
+	mock.ExpectRollback()
+
+	if _, err = NewMergeDB(db).mergeUsers(context.Background(), "old-user", "new-user", mergeDeep, entry); err == nil {
+		t.Error("expected an error")
+	}
+
+	// An unknown source user is reported as sql.ErrNoRows.
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT username, id FROM users").
+		WithArgs("nobody", "new-user").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "id"}).AddRow("new-user", "u2"))
+	mock.ExpectRollback()
+
+	if _, err = NewMergeDB(db).mergeUsers(context.Background(), "nobody", "new-user", mergeDeep, entry); err != sql.ErrNoRows {
+		t.Errorf("error was %v instead of sql.ErrNoRows", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMergeCommand(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.Users.addUser(context.Background(), contractUser); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Preferences.insertPreferences(context.Background(), contractUser, `{"a":1}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runMerge(context.Background(), storage.Merges, []string{contractUser, "renamed"}, ioutil.Discard); err == nil {
+		t.Error("expected a usage error without a policy")
+	}
+	if err := runMerge(context.Background(), storage.Merges, []string{"nobody", "renamed", mergeKeepTarget}, ioutil.Discard); err == nil {
+		t.Error("expected an error for an unknown user")
+	}
+
+	var out bytes.Buffer
+	if err := runMerge(context.Background(), storage.Merges, []string{contractUser, "renamed", mergeKeepTarget}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var report MergeReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil || !report.CreatedTarget || report.Preferences != mergeMoved {
+		t.Errorf("the command printed %s", out.String())
+	}
+
+	prefs, err := storage.Preferences.getPreferences(context.Background(), "renamed")
+	if err != nil || len(prefs) != 1 || prefs[0].Preferences != `{"a":1}` {
+		t.Errorf("the renamed user's preferences were %v %v", prefs, err)
+	}
+}
+
+func TestImportDB(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	entry := &AuditEntry{OccurredAt: time.Now(), Actor: "client:admin", Operation: "import"}
+	bagID := "0f9a6f4c-3a1b-4d8e-9c2b-7a5d1e6f8b90"
+	records := []ImportRecord{
+		{Resource: "preferences", Username: "new-user", Document: json.RawMessage(`{"a":1}`)},
+		{Resource: "bags", Username: "new-user", ID: bagID, Document: json.RawMessage(`{}`)},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SAVEPOINT import_record").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
+		WithArgs("new-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("INSERT INTO users \\(username\\) VALUES \\(\\$1\\) RETURNING id").
+		WithArgs("new-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	mock.ExpectQuery("SELECT id, preferences FROM user_preferences WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "preferences"}))
+	mock.ExpectExec("INSERT INTO user_preferences \\(user_id, preferences\\)").
+		WithArgs("u1", `{"a":1}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO audit_log").
+		WithArgs(entry.OccurredAt, "client:admin", "new-user", "preferences", "create", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, "preferences", "create")
+	mock.ExpectExec("RELEASE SAVEPOINT import_record").WillReturnResult(sqlmock.NewResult(0, 0))
+	// The bag belongs to someone else, so it's left alone.
+	mock.ExpectExec("SAVEPOINT import_record").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT user_id, contents FROM bags WHERE id = \\$1 FOR UPDATE").
+		WithArgs(bagID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "contents"}).AddRow("u2", `{}`))
+	mock.ExpectExec("RELEASE SAVEPOINT import_record").WillReturnResult(sqlmock.NewResult(0, 0))
+	// Creating the last record's user fails, which only undoes that record.
+	mock.ExpectExec("SAVEPOINT import_record").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
+		WithArgs("other-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("INSERT INTO users \\(username\\) VALUES \\(\\$1\\) RETURNING id").
+		WithArgs("other-user").
+		WillReturnError(errors.New("duplicate key"))
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT import_record").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectInvalidation(mock, cachePreferences, "new-user")
+	mock.ExpectCommit()
+
+	failing := append(records, ImportRecord{Resource: "sessions", Username: "other-user", Document: json.RawMessage(`{}`)})
+	batch, err := NewImportDB(db).importRecords(context.Background(), failing, importOverwrite, false, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(batch.Outcomes, []string{importCreated, importTaken, importFailed}) || batch.UsersCreated != 1 ||
+		!strings.Contains(batch.Errors[2], "duplicate key") {
+		t.Errorf("the batch was %+v", batch)
+	}
+
+	// A dry run goes through the same statements and then rolls them back.
+	mock.ExpectBegin()
+	mock.ExpectExec("SAVEPOINT import_record").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT id FROM users WHERE username = \\$1").
+		WithArgs("new-user").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	mock.ExpectQuery("SELECT id, preferences FROM user_preferences WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "preferences"}).AddRow("p1", `{"a":1}`))
+	mock.ExpectExec("RELEASE SAVEPOINT import_record").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	if batch, err = NewImportDB(db).importRecords(context.Background(), records[:1], importFail, true, entry); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(batch.Outcomes, []string{importConflict}) || batch.UsersCreated != 0 {
+		t.Errorf("the dry run batch was %+v", batch)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAuditDB(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	since := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT id, occurred_at, .* FROM audit_log WHERE target_user = \\$1 AND resource = \\$2 AND occurred_at >= \\$3 ORDER BY occurred_at DESC, id DESC LIMIT \\$4").
+		WithArgs("test-user", "preferences", since, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurred_at", "actor", "target_user", "resource", "operation", "request_id", "before_hash", "after_hash", "detail"}).
+			AddRow(2, since.Add(time.Hour), "test-user", "test-user", "preferences", "update", "r2", "a", "b", "{}"))
+
+	filter := &AuditFilter{TargetUser: "test-user", Resource: "preferences", Since: since, Limit: 10}
+	entries, err := NewAuditDB(db).queryAudit(context.Background(), filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != 2 || entries[0].BeforeHash != "a" || entries[0].AfterHash != "b" {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+
+	mock.ExpectQuery("SELECT id, occurred_at, .* FROM audit_log ORDER BY occurred_at DESC, id DESC LIMIT \\$1").
+		WithArgs(defaultAuditLimit).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	if _, err = NewAuditDB(db).queryAudit(context.Background(), &AuditFilter{Limit: defaultAuditLimit}); err != nil {
+		t.Error(err)
+	}
+
+	mock.ExpectExec("DELETE FROM audit_log WHERE occurred_at < \\$1").
+		WithArgs(since).
+		WillReturnResult(sqlmock.NewResult(0, 5))
+	if pruned, err := NewAuditDB(db).pruneAudit(context.Background(), since); err != nil || pruned != 5 {
+		t.Errorf("pruned %d, %v", pruned, err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditRetention(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	for _, age := range []time.Duration{48 * time.Hour, time.Minute} {
+		entry := &AuditEntry{OccurredAt: time.Now().Add(-age), Actor: "test", TargetUser: "test-user", Resource: "preferences", Operation: "update"}
+		if err := storage.Audit.recordAudit(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := viper.New()
+	if NewAuditRetentionFromConfig(cfg, storage.Audit) != nil {
+		t.Error("the audit log was pruned without a retention period")
+	}
+
+	cfg.Set("user_info.audit.retention", "24h")
+	retention := NewAuditRetentionFromConfig(cfg, storage.Audit)
+	if retention == nil {
+		t.Fatal("the audit log isn't being pruned")
+	}
+	if err := retention.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := storage.Audit.queryAudit(ctx, &AuditFilter{Limit: defaultAuditLimit})
+	if err != nil || len(entries) != 1 || entries[0].ID != 2 {
+		t.Errorf("the entries after pruning were %+v %v", entries, err)
+	}
+}
+
+func TestEventRetention(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec("DELETE FROM event_outbox WHERE created_at < \\$1").
+		WithArgs(since).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	if pruned, err := NewOutboxDB(db).pruneEvents(context.Background(), since); err != nil || pruned != 3 {
+		t.Errorf("pruned %d events, %v", pruned, err)
+	}
+	mock.ExpectExec("DELETE FROM webhook_deliveries WHERE created_at < \\$1").
+		WithArgs(since).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	if pruned, err := NewWebhooksDB(db).pruneDeliveries(context.Background(), since); err != nil || pruned != 2 {
+		t.Errorf("pruned %d deliveries, %v", pruned, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	if err = storage.Users.addUser(ctx, contractUser); err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Preferences.insertPreferences(ctx, contractUser, `{"a":1}`); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	cfg := viper.New()
+	cfg.Set("user_info.events.retention", "0")
+	cfg.Set("user_info.webhooks.retention", "0")
+	if NewEventRetentionFromConfig(cfg, storage.Outbox, storage.Webhooks) != nil {
+		t.Error("events were pruned without a retention period")
+	}
+
+	cfg.Set("user_info.events.retention", "5ms")
+	retention := NewEventRetentionFromConfig(cfg, storage.Outbox, storage.Webhooks)
+	if retention == nil {
+		t.Fatal("events aren't being pruned")
+	}
+	if err = retention.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if left, err := storage.Outbox.claimEvents(ctx, 10, 0); err != nil || len(left) != 0 {
+		t.Errorf("%v were left in the outbox, %v", left, err)
+	}
+}
+
+func TestExportCommand(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.Users.addUser(context.Background(), contractUser); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "user-info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/export.zip"
+	if err = runExport(context.Background(), storage.Exports, []string{contractUser, path}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readExport(t, data)
+
+	var stdout bytes.Buffer
+	if err = runExport(context.Background(), storage.Exports, []string{contractUser}, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	readExport(t, stdout.Bytes())
+
+	if err = runExport(context.Background(), storage.Exports, []string{"nobody"}, &stdout); err == nil {
+		t.Error("exporting an unknown user didn't fail")
+	}
+	if err = runExport(context.Background(), storage.Exports, nil, &stdout); err == nil {
+		t.Error("exporting without a username didn't fail")
+	}
+}
+
+func TestInspectCommand(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	if err := storage.Users.addUser(ctx, contractUser); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Preferences.insertPreferences(ctx, contractUser, `{"a":1}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Bags.AddBag(ctx, contractUser, `{"items":[]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runInspect(ctx, storage.Exports, []string{contractUser}, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Username: " + contractUser, "Preferences (1)", "Sessions (0)", "Bags (1)", `"a": 1`} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("the output didn't include %q:\n%s", expected, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := runInspect(ctx, storage.Exports, []string{"--json", contractUser}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var inspection userInspection
+	if err := json.Unmarshal(out.Bytes(), &inspection); err != nil {
+		t.Fatalf("the command printed %s: %s", out.String(), err)
+	}
+	var document bytes.Buffer
+	if len(inspection.Preferences) == 1 {
+		json.Compact(&document, inspection.Preferences[0].Document)
+	}
+	if inspection.Username != contractUser || document.String() != `{"a":1}` || len(inspection.Sessions) != 0 || len(inspection.Bags) != 1 {
+		t.Errorf("the command printed %s", out.String())
+	}
+
+	if err := runInspect(ctx, storage.Exports, []string{"nobody"}, &out); err == nil {
+		t.Error("inspecting an unknown user didn't fail")
+	}
+	if err := runInspect(ctx, storage.Exports, []string{"--verbose", contractUser}, &out); err == nil {
+		t.Error("an unknown flag didn't fail")
+	}
+}
+
+func TestStatsCommand(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	for _, username := range []string{contractUser, "other-user"} {
+		if err := storage.Users.addUser(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.Bags.AddBag(ctx, username, "{}"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := runStats(ctx, storage.Stats, []string{"--json"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var stats StorageStats
+	if err := json.Unmarshal(out.Bytes(), &stats); err != nil {
+		t.Fatalf("the command printed %s: %s", out.String(), err)
+	}
+	if stats.Users != 2 || stats.Bags != 2 || stats.Preferences != 0 || stats.PendingEvents != 2 {
+		t.Errorf("the stats were %+v", stats)
+	}
+
+	out.Reset()
+	if err := runStats(ctx, storage.Stats, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`(?m)^users +2$`).MatchString(out.String()) {
+		t.Errorf("the command printed %s", out.String())
+	}
+
+	if err := runStats(ctx, storage.Stats, []string{"extra"}, &out); err == nil {
+		t.Error("an extra argument didn't fail")
+	}
+}
+
+func TestPurgeUserCommand(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	if err := storage.Users.addUser(ctx, contractUser); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Preferences.insertPreferences(ctx, contractUser, `{"a":1}`); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runPurgeUser(ctx, storage.Purges, []string{"--dry-run", contractUser}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "would delete the data for "+contractUser) ||
+		!regexp.MustCompile(`(?m)^  preferences +1$`).MatchString(out.String()) {
+		t.Errorf("the command printed %s", out.String())
+	}
+	if has, err := storage.Preferences.hasPreferences(ctx, contractUser); err != nil || !has {
+		t.Errorf("a dry run deleted the preferences: %v", err)
+	}
+
+	out.Reset()
+	if err := runPurgeUser(ctx, storage.Purges, []string{"--json", contractUser}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var report PurgeReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil || report.DryRun || report.Preferences != 1 {
+		t.Errorf("the command printed %s", out.String())
+	}
+	if has, err := storage.Preferences.hasPreferences(ctx, contractUser); err != nil || has {
+		t.Errorf("the preferences weren't deleted: %v", err)
+	}
+	entries, err := storage.Audit.queryAudit(ctx, &AuditFilter{Limit: defaultAuditLimit})
+	if err != nil || len(entries) != 2 || entries[0].Actor != "command-line" || entries[0].Operation != "purge" {
+		t.Errorf("the audit log was %+v %v", entries, err)
+	}
+
+	if err := runPurgeUser(ctx, storage.Purges, []string{"nobody"}, &out); err == nil {
+		t.Error("purging an unknown user didn't fail")
+	}
+	if err := runPurgeUser(ctx, storage.Purges, nil, &out); err == nil {
+		t.Error("purging without a username didn't fail")
+	}
+}
+
+func TestImportCommand(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	input := `{"resource":"preferences","username":"` + contractUser + `","document":{"a":1}}
+{"resource":"sessions","username":"` + contractUser + `","document":{"b":2},"extra":true}
+`
+
+	var out bytes.Buffer
+	err := runImport(ctx, storage.Imports, []string{"--dry-run"}, strings.NewReader(input), &out)
+	if err == nil {
+		t.Error("an import with a bad line didn't fail")
+	}
+	if !strings.HasPrefix(out.String(), "would import 2 record(s) with the skip policy: 1 created, 0 updated, 0 skipped, 1 failed") ||
+		!strings.Contains(out.String(), "line 2: invalid record") {
+		t.Errorf("the command printed %s", out.String())
+	}
+	if exists, err := storage.Users.isUser(ctx, contractUser); err != nil || exists {
+		t.Errorf("a dry run created the user: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "user-info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/import.jsonl"
+	if err = ioutil.WriteFile(path, []byte(strings.SplitAfter(input, "\n")[0]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err = runImport(ctx, storage.Imports, []string{"--json", "--policy", "overwrite", path}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	var report ImportReport
+	if err = json.Unmarshal(out.Bytes(), &report); err != nil || report.DryRun || report.Created != 1 || report.UsersCreated != 1 {
+		t.Errorf("the command printed %s", out.String())
+	}
+	entries, err := storage.Audit.queryAudit(ctx, &AuditFilter{Limit: defaultAuditLimit})
+	if err != nil || len(entries) != 1 || entries[0].Actor != "command-line" || entries[0].Resource != "preferences" {
+		t.Errorf("the audit log was %+v %v", entries, err)
+	}
+
+	if err = runImport(ctx, storage.Imports, []string{"--policy", "replace"}, strings.NewReader(input), &out); err == nil {
+		t.Error("an unknown policy didn't fail")
+	}
+	if err = runImport(ctx, storage.Imports, []string{"--batch-size", "0"}, strings.NewReader(input), &out); err == nil {
+		t.Error("an empty batch size didn't fail")
+	}
+}
+
+func TestValidateConfigCommand(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("user_info.storage.backend", "memory")
+	cfg.Set("user_info.events.poll_interval", "500ms")
+	cfg.Set("user_info.webhooks.max_attempts", 5)
+
+	var out bytes.Buffer
+	if err := runValidateConfig(cfg, nil, &out); err != nil {
+		t.Errorf("a valid configuration failed with %s: %s", err, out.String())
+	}
+	if out.String() != "the configuration is valid\n" {
+		t.Errorf("the command printed %s", out.String())
+	}
+
+	cfg = viper.New()
+	cfg.Set("user_info.storage.backend", "postgres")
+	cfg.Set("user_info.server.read_timeout", "soon")
+	cfg.Set("user_info.webhooks.poll_interval", "0s")
+	cfg.Set("user_info.events.batch_size", -1)
+	cfg.Set("user_info.tracing.enabled", true)
+	cfg.Set("user_info.tracing.exporter", "carrier-pigeon")
+	cfg.Set("user_info.log.format", "xml")
+
+	out.Reset()
+	if err := runValidateConfig(cfg, []string{"--json"}, &out); err == nil {
+		t.Error("an invalid configuration didn't fail")
+	}
+	var result struct {
+		Valid    bool
+		Problems []configProblem
+	}
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("the command printed %s: %s", out.String(), err)
+	}
+	var keys []string
+	for _, problem := range result.Problems {
+		keys = append(keys, problem.Key)
+	}
+	expected := []string{
+		"db.uri",
+		"user_info.events.batch_size",
+		"user_info.log",
+		"user_info.server.read_timeout",
+		"user_info.tracing.exporter",
+		"user_info.webhooks.poll_interval",
+	}
+	if result.Valid || !reflect.DeepEqual(keys, expected) {
+		t.Errorf("the command printed %s", out.String())
+	}
+}
+
+func TestKnownCommand(t *testing.T) {
+	for _, command := range []string{"", "serve", "migrate", "validate-config", "export", "merge", "inspect", "stats", "purge-user", "import"} {
+		if !knownCommand(command) {
+			t.Errorf("%q isn't a known command", command)
+		}
+	}
+	if knownCommand("frobnicate") {
+		t.Error("an unknown command is known")
+	}
+}
+
+func TestOutboxDB(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	outbox := NewOutboxDB(db)
+	mock.ExpectQuery("UPDATE event_outbox\\s+SET next_attempt_at = now\\(\\) \\+ \\$2 \\* interval '1 second'.*FOR UPDATE SKIP LOCKED").
+		WithArgs(100, 60.0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "routing_key", "payload", "attempts"}).
+			AddRow(2, "user-info.bags.update", "{}", 0).
+			AddRow(1, "user-info.bags.create", "{}", 3))
+	events, err := outbox.claimEvents(context.Background(), 100, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].ID != 1 || events[0].Attempts != 3 || events[1].RoutingKey != "user-info.bags.update" {
+		t.Errorf("unexpected events %+v", events)
+	}
+
+	mock.ExpectExec("DELETE FROM event_outbox WHERE id = \\$1").
+		WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err = outbox.deleteEvent(context.Background(), 1); err != nil {
+		t.Error(err)
+	}
+
+	mock.ExpectExec("UPDATE event_outbox\\s+SET attempts = attempts \\+ 1").
+		WithArgs(int64(2), 4.0, "broker unavailable").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err = outbox.retryEvent(context.Background(), 2, 4*time.Second, "broker unavailable"); err != nil {
+		t.Error(err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// This is just enough of AMQP 0-9-1 for the fake broker to talk to the
+// publisher.
+
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xCE
+
+	// amqpChannel is the only channel the publisher opens.
+	amqpChannel = 1
+)
+
+var amqpProtocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// amqpMethodID identifies an AMQP method by its class and method IDs.
+type amqpMethodID struct {
+	class, method uint16
+}
+
+var (
+	amqpConnectionStart   = amqpMethodID{10, 10}
+	amqpConnectionStartOk = amqpMethodID{10, 11}
+	amqpConnectionTune    = amqpMethodID{10, 30}
+	amqpConnectionTuneOk  = amqpMethodID{10, 31}
+	amqpConnectionOpen    = amqpMethodID{10, 40}
+	amqpConnectionOpenOk  = amqpMethodID{10, 41}
+	amqpConnectionClose   = amqpMethodID{10, 50}
+	amqpConnectionCloseOk = amqpMethodID{10, 51}
+	amqpChannelOpen       = amqpMethodID{20, 10}
+	amqpChannelOpenOk     = amqpMethodID{20, 11}
+	amqpChannelClose      = amqpMethodID{20, 40}
+	amqpExchangeDeclare   = amqpMethodID{40, 10}
+	amqpExchangeDeclareOk = amqpMethodID{40, 11}
+	amqpBasicPublish      = amqpMethodID{60, 40}
+	amqpBasicAck          = amqpMethodID{60, 80}
+	amqpBasicNack         = amqpMethodID{60, 120}
+	amqpConfirmSelect     = amqpMethodID{85, 10}
+	amqpConfirmSelectOk   = amqpMethodID{85, 11}
+)
+
+// amqpFrame is a single frame read from or written to the connection.
+type amqpFrame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+// method returns the ID of a method frame and a decoder for its arguments.
+func (f *amqpFrame) method() (amqpMethodID, *amqpDecoder) {
+	d := &amqpDecoder{data: f.payload}
+	id := amqpMethodID{d.short(), d.short()}
+	return id, d
+}
+
+func readAMQPFrame(r io.Reader) (*amqpFrame, error) {
+	var header [7]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	frame := &amqpFrame{
+		kind:    header[0],
+		channel: binary.BigEndian.Uint16(header[1:3]),
+		payload: make([]byte, binary.BigEndian.Uint32(header[3:7])+1),
+	}
+	if _, err := io.ReadFull(r, frame.payload); err != nil {
+		return nil, err
+	}
+	if frame.payload[len(frame.payload)-1] != amqpFrameEnd {
+		return nil, errors.New("malformed AMQP frame")
+	}
+	frame.payload = frame.payload[:len(frame.payload)-1]
+	return frame, nil
+}
+
+func writeAMQPFrame(w io.Writer, frame *amqpFrame) error {
+	buf := make([]byte, 7, 8+len(frame.payload))
+	buf[0] = frame.kind
+	binary.BigEndian.PutUint16(buf[1:3], frame.channel)
+	binary.BigEndian.PutUint32(buf[3:7], uint32(len(frame.payload)))
+	buf = append(buf, frame.payload...)
+	buf = append(buf, amqpFrameEnd)
+	_, err := w.Write(buf)
+	return err
+}
+
+// amqpEncoder builds the arguments of a method or content header.
+type amqpEncoder struct {
+	bytes.Buffer
+}
+
+func newAMQPMethod(id amqpMethodID) *amqpEncoder {
+	e := &amqpEncoder{}
+	e.short(id.class)
+	e.short(id.method)
+	return e
+}
+
+func (e *amqpEncoder) octet(v byte) *amqpEncoder {
+	e.WriteByte(v) // nolint:errcheck
+	return e
+}
+
+func (e *amqpEncoder) short(v uint16) *amqpEncoder {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	e.Write(b[:]) // nolint:errcheck
+	return e
+}
+
+func (e *amqpEncoder) long(v uint32) *amqpEncoder {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.Write(b[:]) // nolint:errcheck
+	return e
+}
+
+func (e *amqpEncoder) longlong(v uint64) *amqpEncoder {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.Write(b[:]) // nolint:errcheck
+	return e
+}
+
+func (e *amqpEncoder) shortstr(v string) *amqpEncoder {
+	e.octet(byte(len(v)))
+	e.WriteString(v) // nolint:errcheck
+	return e
+}
+
+func (e *amqpEncoder) longstr(v string) *amqpEncoder {
+	e.long(uint32(len(v)))
+	e.WriteString(v) // nolint:errcheck
+	return e
+}
+
+// table encodes a field table of string values.
+func (e *amqpEncoder) table(fields map[string]string) *amqpEncoder {
+	var t amqpEncoder
+	for name, value := range fields {
+		t.shortstr(name)
+		t.octet('S')
+		t.longstr(value)
+	}
+	e.long(uint32(t.Len()))
+	e.Write(t.Bytes()) // nolint:errcheck
+	return e
+}
+
+func (e *amqpEncoder) frame(kind byte, channel uint16) *amqpFrame {
+	return &amqpFrame{kind: kind, channel: channel, payload: e.Bytes()}
+}
+
+// amqpDecoder reads the arguments of a method. Reading past the end returns
+// zero values and sets err.
+type amqpDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *amqpDecoder) next(n int) []byte {
+	if d.err != nil || len(d.data) < n {
+		d.err = errors.New("truncated AMQP method")
+		return make([]byte, n)
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *amqpDecoder) octet() byte {
+	return d.next(1)[0]
+}
+
+func (d *amqpDecoder) short() uint16 {
+	return binary.BigEndian.Uint16(d.next(2))
+}
+
+func (d *amqpDecoder) long() uint32 {
+	return binary.BigEndian.Uint32(d.next(4))
+}
+
+func (d *amqpDecoder) longlong() uint64 {
+	return binary.BigEndian.Uint64(d.next(8))
+}
+
+func (d *amqpDecoder) shortstr() string {
+	return string(d.next(int(d.octet())))
+}
+
+func (d *amqpDecoder) longstr() string {
+	return string(d.next(int(d.long())))
+}
+
+// skipTable skips over a field table, whose contents the fake broker never
+// needs.
+func (d *amqpDecoder) skipTable() {
+	d.next(int(d.long()))
+}
+
+// fakeBrokerMessage is a message published to the fake broker.
+type fakeBrokerMessage struct {
+	exchange, routingKey string
+	properties           uint16
+	body                 []byte
+}
+
+// fakeBroker is an AMQP broker that accepts a single channel in confirm mode
+// and records what's published to it. The replies to each publish can be
+// scripted: "ack" (the default), "nack", or "drop", which keeps the message
+// and then closes the connection without confirming it.
+type fakeBroker struct {
+	t        *testing.T
+	listener net.Listener
+
+	mu          sync.Mutex
+	script      []string
+	messages    []fakeBrokerMessage
+	connections int
+	credentials string
+	vhost       string
+	exchange    string
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{t: t, listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) uri() string {
+	return "amqp://publisher:secret@" + b.listener.Addr().String() + "/de"
+}
+
+func (b *fakeBroker) Close() {
+	b.listener.Close()
+}
+
+func (b *fakeBroker) received() []fakeBrokerMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]fakeBrokerMessage(nil), b.messages...)
+}
+
+func (b *fakeBroker) next() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.script) == 0 {
+		return "ack"
+	}
+	reply := b.script[0]
+	b.script = b.script[1:]
+	return reply
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	b.mu.Lock()
+	b.connections++
+	b.mu.Unlock()
+
+	header := make([]byte, len(amqpProtocolHeader))
+	if _, err := io.ReadFull(conn, header); err != nil || !bytes.Equal(header, amqpProtocolHeader) {
+		b.t.Errorf("unexpected protocol header %q, %v", header, err)
+		return
+	}
+
+	expect := func(expected amqpMethodID) *amqpDecoder {
+		frame, err := readAMQPFrame(conn)
+		if err != nil {
+			return nil
+		}
+		id, args := frame.method()
+		if frame.kind != amqpFrameMethod || id != expected {
+			b.t.Errorf("expected method %v, got frame %d method %v", expected, frame.kind, id)
+			return nil
+		}
+		return args
+	}
+	reply := func(e *amqpEncoder, channel uint16) {
+		writeAMQPFrame(conn, e.frame(amqpFrameMethod, channel))
+	}
+
+	// A small frame size makes larger messages span several body frames.
+	reply(newAMQPMethod(amqpConnectionStart).octet(0).octet(9).table(nil).longstr("AMQPLAIN PLAIN").longstr("en_US"), 0)
+	args := expect(amqpConnectionStartOk)
+	if args == nil {
+		return
+	}
+	args.skipTable()
+	args.shortstr()
+	credentials := args.longstr()
+	reply(newAMQPMethod(amqpConnectionTune).short(0).long(4096).short(60), 0)
+	if expect(amqpConnectionTuneOk) == nil {
+		return
+	}
+	if args = expect(amqpConnectionOpen); args == nil {
+		return
+	}
+	vhost := args.shortstr()
+	reply(newAMQPMethod(amqpConnectionOpenOk).shortstr(""), 0)
+	if expect(amqpChannelOpen) == nil {
+		return
+	}
+	reply(newAMQPMethod(amqpChannelOpenOk).longstr(""), amqpChannel)
+	if args = expect(amqpExchangeDeclare); args == nil {
+		return
+	}
+	args.short()
+	exchange := args.shortstr() + " " + args.shortstr()
+	reply(newAMQPMethod(amqpExchangeDeclareOk), amqpChannel)
+	if expect(amqpConfirmSelect) == nil {
+		return
+	}
+	reply(newAMQPMethod(amqpConfirmSelectOk), amqpChannel)
+
+	b.mu.Lock()
+	b.credentials, b.vhost, b.exchange = credentials, vhost, exchange
+	b.mu.Unlock()
+
+	var tag uint64
+	for {
+		frame, err := readAMQPFrame(conn)
+		if err != nil {
+			return
+		}
+		if frame.kind == amqpFrameHeartbeat {
+			continue
+		}
+		id, args := frame.method()
+		if id == amqpConnectionClose {
+			reply(newAMQPMethod(amqpConnectionCloseOk), 0)
+			return
+		}
+		if id != amqpBasicPublish {
+			b.t.Errorf("unexpected method %v", id)
+			return
+		}
+		args.short()
+		message := fakeBrokerMessage{exchange: args.shortstr(), routingKey: args.shortstr()}
+
+		frame, err = readAMQPFrame(conn)
+		if err != nil || frame.kind != amqpFrameHeader {
+			b.t.Errorf("expected a content header, got %v %v", frame, err)
+			return
+		}
+		properties := &amqpDecoder{data: frame.payload}
+		properties.short()
+		properties.short()
+		size := properties.longlong()
+		message.properties = properties.short()
+		for uint64(len(message.body)) < size {
+			if frame, err = readAMQPFrame(conn); err != nil || frame.kind != amqpFrameBody {
+				b.t.Errorf("expected a body frame, got %v %v", frame, err)
+				return
+			}
+			message.body = append(message.body, frame.payload...)
+		}
+
+		tag++
+		action := b.next()
+		if action != "nack" {
+			b.mu.Lock()
+			b.messages = append(b.messages, message)
+			b.mu.Unlock()
+		}
+		switch action {
+		case "drop":
+			return
+		case "nack":
+			reply(newAMQPMethod(amqpBasicNack).longlong(tag).octet(0), amqpChannel)
+		default:
+			reply(newAMQPMethod(amqpBasicAck).longlong(tag).octet(0), amqpChannel)
+		}
+	}
+}
+
+func TestAMQPPublisher(t *testing.T) {
+	broker := newFakeBroker(t)
+	defer broker.Close()
+
+	publisher := NewAMQPPublisher(broker.uri(), "de", "topic")
+	defer publisher.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	large := bytes.Repeat([]byte("x"), 10000)
+	for _, payload := range [][]byte{[]byte(`{"n":1}`), large} {
+		if err := publisher.publish(ctx, "user-info.bags.update", payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages := broker.received()
+	if len(messages) != 2 || string(messages[0].body) != `{"n":1}` || !bytes.Equal(messages[1].body, large) {
+		t.Fatalf("the broker received %d messages", len(messages))
+	}
+	if messages[0].exchange != "de" || messages[0].routingKey != "user-info.bags.update" || messages[0].properties != 1<<15|1<<12|1<<6|1<<3 {
+		t.Errorf("the broker received %+v", messages[0])
+	}
+	if broker.credentials != "\x00publisher\x00secret" || broker.vhost != "de" || broker.exchange != "de topic" {
+		t.Errorf("the broker saw %q, %q and %q", broker.credentials, broker.vhost, broker.exchange)
+	}
+
+	// A rejected message is an error, and the next one goes over a new
+	// connection.
+	broker.script = []string{"nack"}
+	if err := publisher.publish(ctx, "user-info.bags.update", []byte("{}")); err == nil {
+		t.Error("a rejected message was reported as published")
+	}
+	if err := publisher.publish(ctx, "user-info.bags.update", []byte("{}")); err != nil {
+		t.Error(err)
+	}
+	if len(broker.received()) != 3 || broker.connections != 2 {
+		t.Errorf("the broker received %d messages over %d connections", len(broker.received()), broker.connections)
+	}
+
+	if err := NewAMQPPublisher("amqp://127.0.0.1:1", "de", "topic").publish(ctx, "user-info.bags.update", []byte("{}")); err == nil {
+		t.Error("publishing without a broker succeeded")
+	}
+}
+
+func TestOutboxPublisher(t *testing.T) {
+	broker := newFakeBroker(t)
+	defer broker.Close()
+
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	if err := storage.Users.addUser(ctx, contractUser); err != nil {
+		t.Fatal(err)
+	}
+	for _, prefs := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		if err := storage.Preferences.insertPreferences(ctx, contractUser, prefs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	amqp := NewAMQPPublisher(broker.uri(), "de", "topic")
+	publisher := newOutboxPublisher(storage.Outbox, amqp)
+	publisher.lease = 0
+	publisher.minRetry = 0
+
+	// The broker gets the second event but the connection drops before it
+	// confirms it, so it's delivered again.
+	broker.script = []string{"ack", "drop"}
+	if published, err := publisher.publishPending(ctx); err == nil || published != 1 {
+		t.Fatalf("published %d events, %v", published, err)
+	}
+	if published, err := publisher.publishPending(ctx); err != nil || published != 2 {
+		t.Fatalf("published %d events, %v", published, err)
+	}
+
+	messages := broker.received()
+	if len(messages) != 4 {
+		t.Fatalf("the broker received %d messages", len(messages))
+	}
+	var ids []string
+	for _, message := range messages {
+		var event ChangeEvent
+		if err := json.Unmarshal(message.body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if message.routingKey != "user-info.preferences.create" || event.Type != "preferences.create" {
+			t.Errorf("the broker received %s %+v", message.routingKey, event)
+		}
+		ids = append(ids, event.ID)
+	}
+	if ids[1] != ids[2] || ids[0] == ids[1] || ids[2] == ids[3] {
+		t.Errorf("the event IDs were %v", ids)
+	}
+	if left, err := storage.Outbox.claimEvents(ctx, 10, 0); err != nil || len(left) != 0 {
+		t.Errorf("%v were left in the outbox, %v", left, err)
+	}
+
+	publisher.minRetry, publisher.maxRetry = time.Second, 5*time.Minute
+	for attempts, expected := range map[int]time.Duration{0: time.Second, 3: 8 * time.Second, 40: 5 * time.Minute} {
+		if delay := publisher.retryDelay(attempts); delay != expected {
+			t.Errorf("the delay after %d attempts was %s", attempts, delay)
+		}
+	}
+	if err := amqp.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOutboxPublisherFromConfig(t *testing.T) {
+	broker := newFakeBroker(t)
+	defer broker.Close()
+
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	cfg := viper.New()
+	if NewOutboxPublisherFromConfig(cfg, storage.Outbox) != nil {
+		t.Error("events were published without amqp.uri")
+	}
+
+	cfg.Set("amqp.uri", broker.uri())
+	cfg.Set("user_info.events.poll_interval", "10ms")
+	publisher := NewOutboxPublisherFromConfig(cfg, storage.Outbox)
+	if publisher == nil {
+		t.Fatal("events aren't being published")
+	}
+	defer publisher.Close(ctx)
+
+	if err := storage.Users.addUser(ctx, contractUser); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Bags.AddBag(ctx, contractUser, "{}"); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(broker.received()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the event wasn't published")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if message := broker.received()[0]; message.exchange != "de" || message.routingKey != "user-info.bags.create" {
+		t.Errorf("the broker received %+v", message)
+	}
+}
+
+func TestReadWebhookEventTypes(t *testing.T) {
+	tests := []struct {
+		eventType string
+		stored    string
+	}{
+		{"bags.delete", "bags.delete"},
+		{"*", "*"},
+		{"preferences.updated", "preferences.update"},
+		{"bag.deleted", "bags.delete"},
+		{"search.created", "searches.create"},
+		{"user.purged", "users.purge"},
+		{"session.expired", ""},
+		{"bags.renamed", ""},
+	}
+	for _, tc := range tests {
+		body := `{"url":"https://example.org/hook","event_types":["` + tc.eventType + `"]}`
+		webhook, err := readWebhook(httptest.NewRequest(http.MethodPost, "/admin/webhooks", strings.NewReader(body)), false)
+		switch {
+		case tc.stored == "" && err == nil:
+			t.Errorf("%s was accepted as %v", tc.eventType, webhook.EventTypes)
+		case tc.stored != "" && err != nil:
+			t.Errorf("%s was rejected: %s", tc.eventType, err)
+		case tc.stored != "" && !reflect.DeepEqual(webhook.EventTypes, []string{tc.stored}):
+			t.Errorf("%s was stored as %v, not %s", tc.eventType, webhook.EventTypes, tc.stored)
+		}
+	}
+}
+
+func TestReadWebhookDestinations(t *testing.T) {
+	for url, private := range map[string]bool{
+		"https://example.org/hook":         false,
+		"https://203.0.113.7/hook":         false,
+		"http://localhost:8080/hook":       true,
+		"http://127.0.0.1/hook":            true,
+		"http://10.1.2.3/hook":             true,
+		"http://172.20.0.1/hook":           true,
+		"http://192.168.1.1/hook":          true,
+		"http://169.254.169.254/latest":    true,
+		"http://[::1]/hook":                true,
+		"http://[fd00::1]/hook":            true,
+		"http://user-info.localhost./hook": true,
+	} {
+		body := `{"url":"` + url + `","event_types":["*"]}`
+		_, err := readWebhook(httptest.NewRequest(http.MethodPost, "/admin/webhooks", strings.NewReader(body)), false)
+		if private != (err != nil) {
+			t.Errorf("registering %s returned %v", url, err)
+		}
+		if _, err = readWebhook(httptest.NewRequest(http.MethodPost, "/admin/webhooks", strings.NewReader(body)), true); err != nil {
+			t.Errorf("registering %s with private destinations allowed returned %v", url, err)
+		}
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	var (
+		mutex    sync.Mutex
+		statuses = []int{http.StatusInternalServerError, http.StatusOK}
+		received []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		if signature := request.Header.Get(webhookSignatureHeader); signature != signPayload("secret", body) {
+			t.Errorf("the signature was %q", signature)
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, request.Header.Get(webhookEventHeader))
+		status := http.StatusInternalServerError
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		writer.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	webhook := &WebhookRecord{
+		ID:         newUUID(),
+		URL:        server.URL,
+		Secret:     "secret",
+		EventTypes: []string{"bags.create"},
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := storage.Webhooks.insertWebhook(ctx, webhook); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Users.addUser(ctx, contractUser); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Bags.AddBag(ctx, contractUser, "{}"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test server is on the loopback interface, which is off limits
+	// unless private destinations are allowed.
+	dispatcher := newWebhookDispatcher(storage.Webhooks)
+	err := dispatcher.deliver(ctx, &WebhookDelivery{URL: server.URL, Secret: "secret", Payload: []byte("{}")})
+	if err == nil || !strings.Contains(err.Error(), "private destination") || len(received) != 0 {
+		t.Fatalf("delivering to a private address returned %v", err)
+	}
+
+	dispatcher.allowPrivate = true
+	dispatcher.minRetry = 0
+	dispatcher.maxAttempts = 2
+
+	// The first attempt fails and is retried, and the second one succeeds.
+	for attempt := 1; attempt <= 3; attempt++ {
+		if _, err := dispatcher.dispatchPending(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(received, []string{"bags.create", "bags.create"}) {
+		t.Errorf("the webhook received %v", received)
+	}
+
+	// Running out of attempts leaves the delivery in the dead letters until
+	// it's redelivered.
+	if _, err := storage.Bags.AddBag(ctx, contractUser, "{}"); err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		if _, err := dispatcher.dispatchPending(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(received) != 4 {
+		t.Errorf("the webhook received %v", received)
+	}
+	dead, err := storage.Webhooks.failedDeliveries(ctx, webhook.ID, 10)
+	if err != nil || len(dead) != 1 || dead[0].Attempts != 2 || !strings.Contains(dead[0].LastError, "500") {
+		t.Fatalf("the dead letters were %+v %v", dead, err)
+	}
+
+	statuses = []int{http.StatusNoContent}
+	if err = storage.Webhooks.redeliver(ctx, webhook.ID, dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if dispatched, err := dispatcher.dispatchPending(ctx); err != nil || dispatched != 1 {
+		t.Errorf("dispatched %d %v", dispatched, err)
+	}
+	if dead, err = storage.Webhooks.failedDeliveries(ctx, webhook.ID, 10); err != nil || len(dead) != 0 {
+		t.Errorf("the dead letters were %+v %v", dead, err)
+	}
+	if dispatched, err := dispatcher.dispatchPending(ctx); err != nil || dispatched != 0 {
+		t.Errorf("dispatched %d %v after everything was delivered", dispatched, err)
+	}
+
+	for attempts, expected := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second} {
+		if delay := backoff(10*time.Second, time.Minute, attempts); delay != expected {
+			t.Errorf("backoff after %d attempts was %s", attempts, delay)
+		}
+	}
+	if delay := backoff(10*time.Second, time.Minute, 10); delay != time.Minute {
+		t.Errorf("backoff after 10 attempts was %s", delay)
+	}
+}
+
+func TestWebhookDispatcherFromConfig(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("user_info.webhooks.enabled", false)
+	if NewWebhookDispatcherFromConfig(cfg, NewMemoryStorage().Webhooks) != nil {
+		t.Error("webhooks were delivered while disabled")
+	}
+
+	cfg.Set("user_info.webhooks.enabled", true)
+	cfg.Set("user_info.webhooks.max_attempts", 3)
+	dispatcher := NewWebhookDispatcherFromConfig(cfg, NewMemoryStorage().Webhooks)
+	if dispatcher == nil {
+		t.Fatal("webhooks aren't being delivered")
+	}
+	defer dispatcher.Close(context.Background())
+	if dispatcher.maxAttempts != 3 || dispatcher.minRetry != 10*time.Second || dispatcher.client.Timeout != 10*time.Second {
+		t.Errorf("the dispatcher was configured with %+v", dispatcher)
+	}
+}
+
+// expectEvent expects insertEvent to add an event to the outbox, the webhook
+// deliveries and the change log.
+func expectEvent(mock sqlmock.Sqlmock, resource, operation string) {
+	mock.ExpectExec("INSERT INTO event_outbox").
+		WithArgs("user-info."+resource+"."+operation, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO webhook_deliveries").
+		WithArgs(resource+"."+operation, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectChange(mock, resource, operation)
+}
+
+// expectInvalidation expects notifyInvalidation to send a cache invalidation.
+func expectInvalidation(mock sqlmock.Sqlmock, kind, username string) {
+	mock.ExpectExec("SELECT pg_notify\\(\\$1, \\$2\\)").
+		WithArgs(cacheChannel, kind+":"+username).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+// expectAuditedEvent expects withEvent to record the change in the audit log
+// and add its event.
+func expectAuditedEvent(mock sqlmock.Sqlmock, resource, operation, before, after string) {
+	mock.ExpectExec("INSERT INTO audit_log").
+		WithArgs(sqlmock.AnyArg(), "anonymous", "test-user", resource, operation, "", auditHash(before), auditHash(after), "{}").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, resource, operation)
+}
+
+// expectChange expects insertChange to add a change to the change log.
+func expectChange(mock sqlmock.Sqlmock, resource, operation string) {
+	mock.ExpectExec("DELETE FROM user_changes WHERE username = \\$1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO user_changes").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), resource, sqlmock.AnyArg(), operation, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestChangesDB(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	changes := NewChangesDB(db)
+	occurred := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	columns := []string{"position", "occurred_at", "username", "resource", "record_id", "operation", "deleted", "etag", "document"}
+
+	// Changes committed since the last read get their positions first.
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM user_changes WHERE position IS NULL\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	mock.ExpectExec("SELECT pg_advisory_xact_lock\\(\\$1\\)").
+		WithArgs(changeLogLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE user_changes\\s+SET position = numbered.position\\s+FROM \\(SELECT id, nextval\\('user_changes_position_seq'\\) AS position\\s+" +
+		"FROM \\(SELECT id FROM user_changes WHERE position IS NULL ORDER BY id\\) AS unnumbered\\) AS numbered").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT position, occurred_at, .* FROM user_changes\\s+WHERE username = \\$1 AND position > \\$2\\s+ORDER BY position LIMIT \\$3").
+		WithArgs("test-user", int64(5), 100).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(6, occurred, "test-user", "preferences", "", "update", false, `"abc"`, `{"a":1}`).
+			AddRow(8, occurred, "test-user", "bags", "b1", "delete", true, "", nil))
+	records, err := changes.userChanges(context.Background(), "test-user", 5, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].ID != 6 || string(records[0].Document) != `{"a":1}` || records[1].Document != nil ||
+		records[1].RecordID != "b1" || !records[1].Deleted {
+		t.Errorf("unexpected changes %+v", records)
+	}
+
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM user_changes WHERE position IS NULL\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("SELECT position, occurred_at, .* FROM user_changes WHERE position > \\$1 ORDER BY position LIMIT \\$2").
+		WithArgs(int64(6), 2).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(8, occurred, "test-user", "bags", "b1", "delete", true, "", nil).
+			AddRow(9, occurred, "other-user", "sessions", "", "create", false, `"def"`, `{}`))
+	records, err = changes.changesSince(context.Background(), 6, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].ID != 8 || records[1].Username != "other-user" {
+		t.Errorf("unexpected changes %+v", records)
+	}
+
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM user_changes WHERE position IS NULL\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("SELECT COALESCE\\(max\\(position\\), 0\\) FROM user_changes").
+		WillReturnRows(sqlmock.NewRows([]string{"position"}).AddRow(8))
+	if last, err := changes.lastChangeID(context.Background()); err != nil || last != 8 {
+		t.Errorf("the last change was %d, %v", last, err)
+	}
+
+	mock.ExpectExec("DELETE FROM user_changes WHERE deleted AND occurred_at < \\$1").
+		WithArgs(occurred).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	if pruned, err := changes.pruneTombstones(context.Background(), occurred); err != nil || pruned != 3 {
+		t.Errorf("pruned %d, %v", pruned, err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebhooksDB(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	webhooks := NewWebhooksDB(db)
+	ctx := context.Background()
+	created := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec("INSERT INTO webhooks \\(id, url, secret, event_types, username, created_at\\)").
+		WithArgs("w1", "https://example.org/hook", "secret", "bags.create bags.delete", "", created).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	webhook := &WebhookRecord{
+		ID:         "w1",
+		URL:        "https://example.org/hook",
+		Secret:     "secret",
+		EventTypes: []string{"bags.create", "bags.delete"},
+		CreatedAt:  created,
+	}
+	if err = webhooks.insertWebhook(ctx, webhook); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery("SELECT id, url, secret, event_types, username, created_at FROM webhooks WHERE id = \\$1").
+		WithArgs("w1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "url", "secret", "event_types", "username", "created_at"}).
+			AddRow("w1", "https://example.org/hook", "secret", "bags.create bags.delete", "", created))
+	if got, err := webhooks.getWebhook(ctx, "w1"); err != nil || !reflect.DeepEqual(got, webhook) {
+		t.Errorf("got %+v, %v", got, err)
+	}
+
+	columns := []string{"id", "webhook_id", "event_type", "payload", "attempts", "last_error", "created_at", "failed_at", "url", "secret"}
+	mock.ExpectQuery("WITH claimed AS \\(\\s*UPDATE webhook_deliveries .* FOR UPDATE SKIP LOCKED").
+		WithArgs(10, float64(60)).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(3, "w1", "bags.create", `{"type":"bags.create"}`, 1, "timeout", created, nil, "https://example.org/hook", "secret"))
+	deliveries, err := webhooks.claimDeliveries(ctx, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].ID != 3 || deliveries[0].Attempts != 1 || deliveries[0].FailedAt != nil ||
+		deliveries[0].Secret != "secret" || string(deliveries[0].Payload) != `{"type":"bags.create"}` {
+		t.Errorf("claimed %+v", deliveries)
+	}
+
+	mock.ExpectExec("UPDATE webhook_deliveries\\s+SET attempts = attempts \\+ 1,\\s+next_attempt_at").
+		WithArgs(int64(3), float64(20), "timeout").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err = webhooks.retryDelivery(ctx, 3, 20*time.Second, "timeout"); err != nil {
+		t.Error(err)
+	}
+
+	mock.ExpectExec("UPDATE webhook_deliveries\\s+SET attempts = 0,.* AND failed_at IS NOT NULL").
+		WithArgs(int64(3), "w1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err = webhooks.redeliver(ctx, "w1", 3); err != errDeliveryNotFound {
+		t.Errorf("redelivering a delivery that wasn't dead returned %v", err)
+	}
+
+	mock.ExpectExec("DELETE FROM webhooks WHERE id = \\$1").
+		WithArgs("w2").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err = webhooks.deleteWebhook(ctx, "w2"); err != errWebhookNotFound {
+		t.Errorf("deleting a missing webhook returned %v", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInsertChange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		event *ChangeEvent
+		where string
+		args  []driver.Value
+	}{
+		{
+			newChangeEvent(context.Background(), "test-user", "preferences", "update", map[string]interface{}{}),
+			"username = \\$1 AND resource = \\$2 AND record_id = \\$3$",
+			[]driver.Value{"test-user", "preferences", ""},
+		},
+		{
+			newChangeEvent(context.Background(), "test-user", "bags", "delete", bagEventData{BagID: "b1"}),
+			"username = \\$1 AND resource = \\$2 AND record_id = \\$3$",
+			[]driver.Value{"test-user", "bags", "b1"},
+		},
+		{
+			newChangeEvent(context.Background(), "test-user", "bags", "delete_all", nil),
+			"username = \\$1 AND resource = \\$2$",
+			[]driver.Value{"test-user", "bags"},
+		},
+		{
+			newChangeEvent(context.Background(), "test-user", "users", "purge", nil),
+			"username = \\$1$",
+			[]driver.Value{"test-user"},
+		},
+	}
+	for _, tc := range tests {
+		record, err := newChangeRecord(tc.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mock.ExpectExec("DELETE FROM user_changes WHERE " + tc.where).
+			WithArgs(tc.args...).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO user_changes").
+			WithArgs(sqlmock.AnyArg(), "test-user", record.Resource, record.RecordID, record.Operation, record.Deleted, record.ETag, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		if err = insertChange(context.Background(), db, tc.event); err != nil {
+			t.Errorf("%s %s: %s", tc.event.Resource, tc.event.Operation, err)
+		}
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// readChangeEvent reads server-sent events until it gets one with data, and
+// returns its ID and the change it carries.
+func readChangeEvent(t *testing.T, r *bufio.Reader) (string, ChangeRecord) {
+	t.Helper()
+
+	var id, data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading the event stream: %s", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && data != "":
+			var change ChangeRecord
+			if err = json.Unmarshal([]byte(data), &change); err != nil {
+				t.Fatal(err)
+			}
+			return id, change
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestChangeStream(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	if err := storage.Users.addUser(ctx, contractUser); err != nil {
+		t.Fatal(err)
+	}
+
+	notifier := NewChangeNotifier()
+	if listener, err := WatchChanges(storage, notifier, ""); err != nil || listener != nil {
+		t.Fatalf("watching the memory backend returned %v, %v", listener, err)
+	}
+	router := newStorageRouter(storage)
+	NewChangeStreamApp(viper.New(), storage.Changes, storage.Users, notifier, router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	open := func(query, lastEventID string) (*http.Response, *bufio.Reader) {
+		t.Helper()
+		request, err := http.NewRequest(http.MethodGet, server.URL+"/users/"+contractUser+"/events"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastEventID != "" {
+			request.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, bufio.NewReader(res.Body)
+	}
+
+	// Changes made before the stream is opened aren't sent.
+	if err := storage.Preferences.insertPreferences(ctx, contractUser, `{"n":1}`); err != nil {
+		t.Fatal(err)
+	}
+
+	res, events := open("?documents=true", "")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("the stream returned %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	if err := storage.Preferences.updatePreferences(ctx, contractUser, `{"n":2}`); err != nil {
+		t.Fatal(err)
+	}
+	id, change := readChangeEvent(t, events)
+	if change.Resource != "preferences" || change.Operation != "update" || string(change.Document) != `{"n":2}` ||
+		change.ETag != profileETag([]byte(`{"n":2}`)) || id != strconv.FormatInt(change.ID, 10) {
+		t.Errorf("the stream sent %s %+v", id, change)
+	}
+	if _, err := storage.Bags.AddBag(ctx, contractUser, `{"items":[]}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, change = readChangeEvent(t, events); change.Resource != "bags" || change.Operation != "create" {
+		t.Errorf("the stream sent %+v", change)
+	}
+	res.Body.Close()
+
+	// Resuming sends what was missed, without documents unless asked.
+	if err := storage.Sessions.insertSession(ctx, contractUser, `{}`); err != nil {
+		t.Fatal(err)
+	}
+	res, events = open("", id)
+	if _, change = readChangeEvent(t, events); change.Resource != "bags" || change.Document != nil || change.ETag == "" {
+		t.Errorf("the resumed stream sent %+v", change)
+	}
+	if _, change = readChangeEvent(t, events); change.Resource != "sessions" || change.Operation != "create" {
+		t.Errorf("the resumed stream sent %+v", change)
+	}
+
+	// Closing the notifier ends the stream.
+	notifier.Close()
+	if _, err := ioutil.ReadAll(events); err != nil {
+		t.Errorf("the stream didn't end cleanly: %s", err)
+	}
+	res.Body.Close()
+
+	for _, test := range []struct {
+		path        string
+		lastEventID string
+		status      int
+	}{
+		{"/users/nobody/events", "", http.StatusNotFound},
+		{"/users/" + contractUser + "/events", "soon", http.StatusBadRequest},
+		{"/users/" + contractUser + "/events?documents=maybe", "", http.StatusBadRequest},
+	} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.lastEventID != "" {
+			request.Header.Set("Last-Event-ID", test.lastEventID)
+		}
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("GET %s with Last-Event-ID %q returned %d", test.path, test.lastEventID, recorder.Code)
+		}
+	}
+}
+
+func TestChangeRetention(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	if err := storage.Users.addUser(ctx, contractUser); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Preferences.insertPreferences(ctx, contractUser, "{}"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.Bags.DeleteAllBags(ctx, contractUser); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := viper.New()
+	cfg.Set("user_info.changes.tombstone_retention", "0")
+	if NewChangeRetentionFromConfig(cfg, storage.Changes) != nil {
+		t.Error("the change log was pruned without a retention period")
+	}
+
+	cfg.Set("user_info.changes.tombstone_retention", "1ns")
+	retention := NewChangeRetentionFromConfig(cfg, storage.Changes)
+	if retention == nil {
+		t.Fatal("the change log isn't being pruned")
+	}
+	if err := retention.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := storage.Changes.userChanges(ctx, contractUser, 0, 10)
+	if err != nil || len(changes) != 1 || changes[0].Resource != "preferences" {
+		t.Errorf("the changes after pruning were %+v %v", changes, err)
+	}
+}
@@ -0,0 +1,1307 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	randomBytes(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// uuidPattern matches a UUID in its canonical form.
+var uuidPattern = regexp.MustCompile(`(?i)^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+type memoryDocument struct {
+	id       string
+	document string
+}
+
+type memoryEvent struct {
+	OutboxEvent
+	createdAt   time.Time
+	nextAttempt time.Time
+}
+
+type memoryDelivery struct {
+	WebhookDelivery
+	nextAttempt time.Time
+}
+
+type memoryBag struct {
+	id       string
+	contents string
+	seq      int
+}
+
+// MemoryDB implements every store in memory. Documents are keyed by username
+// and behave the same way as the Postgres tables they stand in for.
+type MemoryDB struct {
+	mu          sync.RWMutex
+	users       map[string]string // username to user ID
+	preferences map[string]memoryDocument
+	sessions    map[string]memoryDocument
+	searches    map[string]memoryDocument
+	bags        map[string]map[string]*memoryBag
+	defaultBags map[string]string
+	clients     map[string]ServiceClientRecord
+	audit       []AuditEntry
+	auditSeq    int64
+	events      []memoryEvent
+	eventSeq    int64
+	changes     []ChangeRecord
+	changeSeq   int64
+	changed     func(username string)
+	webhooks    map[string]WebhookRecord
+	deliveries  []memoryDelivery
+	deliverySeq int64
+	bagSeq      int
+}
+
+// NewMemoryDB returns a new, empty *MemoryDB.
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		users:       make(map[string]string),
+		preferences: make(map[string]memoryDocument),
+		sessions:    make(map[string]memoryDocument),
+		searches:    make(map[string]memoryDocument),
+		bags:        make(map[string]map[string]*memoryBag),
+		defaultBags: make(map[string]string),
+		clients:     make(map[string]ServiceClientRecord),
+		webhooks:    make(map[string]WebhookRecord),
+	}
+}
+
+// Users
+
+func (m *MemoryDB) isUser(ctx context.Context, username string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.users[username]
+	return ok, nil
+}
+
+func (m *MemoryDB) addUser(ctx context.Context, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[username]; !ok {
+		m.users[username] = newUUID()
+	}
+	return nil
+}
+
+// userID must be called with the lock held. Like lookupUserID, it returns
+// sql.ErrNoRows for unknown users.
+func (m *MemoryDB) userID(username string) (string, error) {
+	id, ok := m.users[username]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return id, nil
+}
+
+// Documents, which is what preferences, sessions and saved searches all are.
+
+func (m *MemoryDB) getDocument(docs map[string]memoryDocument, username string) (memoryDocument, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	doc, ok := docs[username]
+	return doc, ok
+}
+
+// putDocument stores a document. If insert is false, only an existing
+// document is replaced, the same way an UPDATE would behave.
+func (m *MemoryDB) putDocument(ctx context.Context, docs map[string]memoryDocument, resource, username, document string, insert bool) error {
+	observeDocument(resource, document)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.userID(username); err != nil {
+		return err
+	}
+	existing, ok := docs[username]
+	before := existing.document
+	switch {
+	case ok:
+		existing.document = document
+		docs[username] = existing
+	case insert:
+		docs[username] = memoryDocument{id: newUUID(), document: document}
+	}
+
+	operation := "update"
+	if insert {
+		operation = "create"
+	}
+	m.addAuditedEvent(newChangeEvent(ctx, username, resource, operation, exportJSON(document)), before, document)
+	return nil
+}
+
+func (m *MemoryDB) deleteDocument(ctx context.Context, docs map[string]memoryDocument, resource, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.userID(username); err != nil {
+		return err
+	}
+	before := docs[username].document
+	delete(docs, username)
+	m.addAuditedEvent(newChangeEvent(ctx, username, resource, "delete", nil), before, "")
+	return nil
+}
+
+// Preferences
+
+func (m *MemoryDB) hasPreferences(ctx context.Context, username string) (bool, error) {
+	_, ok := m.getDocument(m.preferences, username)
+	return ok, nil
+}
+
+func (m *MemoryDB) getPreferences(ctx context.Context, username string) ([]UserPreferencesRecord, error) {
+	doc, ok := m.getDocument(m.preferences, username)
+	if !ok {
+		return nil, nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return []UserPreferencesRecord{{ID: doc.id, UserID: m.users[username], Preferences: doc.document}}, nil
+}
+
+func (m *MemoryDB) insertPreferences(ctx context.Context, username, prefs string) error {
+	return m.putDocument(ctx, m.preferences, "preferences", username, prefs, true)
+}
+
+func (m *MemoryDB) updatePreferences(ctx context.Context, username, prefs string) error {
+	return m.putDocument(ctx, m.preferences, "preferences", username, prefs, false)
+}
+
+func (m *MemoryDB) deletePreferences(ctx context.Context, username string) error {
+	return m.deleteDocument(ctx, m.preferences, "preferences", username)
+}
+
+// Sessions
+
+func (m *MemoryDB) hasSessions(ctx context.Context, username string) (bool, error) {
+	_, ok := m.getDocument(m.sessions, username)
+	return ok, nil
+}
+
+func (m *MemoryDB) getSessions(ctx context.Context, username string) ([]UserSessionRecord, error) {
+	doc, ok := m.getDocument(m.sessions, username)
+	if !ok {
+		return nil, nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return []UserSessionRecord{{ID: doc.id, UserID: m.users[username], Session: doc.document}}, nil
+}
+
+func (m *MemoryDB) insertSession(ctx context.Context, username, session string) error {
+	return m.putDocument(ctx, m.sessions, "sessions", username, session, true)
+}
+
+func (m *MemoryDB) updateSession(ctx context.Context, username, session string) error {
+	return m.putDocument(ctx, m.sessions, "sessions", username, session, false)
+}
+
+func (m *MemoryDB) deleteSession(ctx context.Context, username string) error {
+	return m.deleteDocument(ctx, m.sessions, "sessions", username)
+}
+
+// Saved searches
+
+func (m *MemoryDB) hasSavedSearches(ctx context.Context, username string) (bool, error) {
+	_, ok := m.getDocument(m.searches, username)
+	return ok, nil
+}
+
+func (m *MemoryDB) getSavedSearches(ctx context.Context, username string) ([]string, error) {
+	doc, ok := m.getDocument(m.searches, username)
+	if !ok {
+		return nil, nil
+	}
+	return []string{doc.document}, nil
+}
+
+func (m *MemoryDB) insertSavedSearches(ctx context.Context, username, searches string) error {
+	return m.putDocument(ctx, m.searches, "searches", username, searches, true)
+}
+
+func (m *MemoryDB) updateSavedSearches(ctx context.Context, username, searches string) error {
+	return m.putDocument(ctx, m.searches, "searches", username, searches, false)
+}
+
+func (m *MemoryDB) deleteSavedSearches(ctx context.Context, username string) error {
+	return m.deleteDocument(ctx, m.searches, "searches", username)
+}
+
+// Bags
+
+// bagRecord must be called with the lock held.
+func (m *MemoryDB) bagRecord(username string, bag *memoryBag) (BagRecord, error) {
+	record := BagRecord{ID: bag.id, UserID: m.users[username]}
+	if err := json.Unmarshal([]byte(bag.contents), &record.Contents); err != nil {
+		return record, err
+	}
+	return record, nil
+}
+
+// IsUser returns true if the user exists.
+func (m *MemoryDB) IsUser(ctx context.Context, username string) (bool, error) {
+	return m.isUser(ctx, username)
+}
+
+// HasBags returns true if the user has bags.
+func (m *MemoryDB) HasBags(ctx context.Context, username string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.bags[username]) > 0, nil
+}
+
+// HasDefaultBag returns true if the user has a default bag.
+func (m *MemoryDB) HasDefaultBag(ctx context.Context, username string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.defaultBags[username]
+	return ok, nil
+}
+
+// HasBag returns true if the user has the bag.
+func (m *MemoryDB) HasBag(ctx context.Context, username, bagID string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.bags[username][bagID]
+	return ok, nil
+}
+
+// GetBags returns all of the user's bags in the order they were added.
+func (m *MemoryDB) GetBags(ctx context.Context, username string) ([]BagRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	bags := make([]*memoryBag, 0, len(m.bags[username]))
+	for _, bag := range m.bags[username] {
+		bags = append(bags, bag)
+	}
+	sort.Slice(bags, func(i, j int) bool { return bags[i].seq < bags[j].seq })
+
+	bagList := []BagRecord{}
+	for _, bag := range bags {
+		record, err := m.bagRecord(username, bag)
+		if err != nil {
+			return nil, fmt.Errorf("error reading bag %s for %s: %w", bag.id, username, err)
+		}
+		bagList = append(bagList, record)
+	}
+	return bagList, nil
+}
+
+// GetBag returns one of the user's bags.
+func (m *MemoryDB) GetBag(ctx context.Context, username, bagID string) (BagRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	bag, ok := m.bags[username][bagID]
+	if !ok {
+		return BagRecord{}, fmt.Errorf("error getting bag id %s for %s: %w", bagID, username, sql.ErrNoRows)
+	}
+	return m.bagRecord(username, bag)
+}
+
+// addBag must be called with the lock held.
+func (m *MemoryDB) addBag(ctx context.Context, username, contents string) (string, error) {
+	if _, err := m.userID(username); err != nil {
+		return "", fmt.Errorf("error looking up the user ID in AddBag for %s: %w", username, err)
+	}
+	var check BagContents
+	if err := json.Unmarshal([]byte(contents), &check); err != nil {
+		return "", fmt.Errorf("error adding bag for %s: %w", username, err)
+	}
+
+	if m.bags[username] == nil {
+		m.bags[username] = make(map[string]*memoryBag)
+	}
+	m.bagSeq++
+	bag := &memoryBag{id: newUUID(), contents: contents, seq: m.bagSeq}
+	m.bags[username][bag.id] = bag
+	m.addAuditedEvent(newChangeEvent(ctx, username, "bags", "create", bagEventData{BagID: bag.id, Contents: exportJSON(contents)}), "", bagAuditDocument(contents))
+	return bag.id, nil
+}
+
+// GetDefaultBag returns the user's default bag, creating an empty one if the
+// user doesn't have one yet.
+func (m *MemoryDB) GetDefaultBag(ctx context.Context, username string) (BagRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bagID, ok := m.defaultBags[username]
+	if !ok {
+		var err error
+		if bagID, err = m.addBag(ctx, username, "{}"); err != nil {
+			return BagRecord{}, err
+		}
+		m.defaultBags[username] = bagID
+		m.addAuditedEvent(newChangeEvent(ctx, username, "bags", "set_default", bagEventData{BagID: bagID}), "", bagID)
+	}
+	return m.bagRecord(username, m.bags[username][bagID])
+}
+
+// SetDefaultBag makes the bag the user's default bag.
+func (m *MemoryDB) SetDefaultBag(ctx context.Context, username, bagID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.userID(username); err != nil {
+		return fmt.Errorf("error getting user ID for %s while setting default bag: %w", username, err)
+	}
+	if _, ok := m.bags[username][bagID]; !ok {
+		return fmt.Errorf("error setting the default bag for %s: bag %s does not exist", username, bagID)
+	}
+	before := m.defaultBags[username]
+	m.defaultBags[username] = bagID
+	m.addAuditedEvent(newChangeEvent(ctx, username, "bags", "set_default", bagEventData{BagID: bagID}), before, bagID)
+	return nil
+}
+
+// AddBag adds a new bag for the user and returns its ID.
+func (m *MemoryDB) AddBag(ctx context.Context, username, contents string) (string, error) {
+	observeDocument("bags", contents)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.addBag(ctx, username, contents)
+}
+
+// UpdateBag replaces the contents of one of the user's bags.
+func (m *MemoryDB) UpdateBag(ctx context.Context, username, bagID, contents string) error {
+	observeDocument("bags", contents)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.userID(username); err != nil {
+		return fmt.Errorf("error looking up the user ID in UpdateBag for %s: %w", username, err)
+	}
+	var check BagContents
+	if err := json.Unmarshal([]byte(contents), &check); err != nil {
+		return fmt.Errorf("error updating bag %s for %s: %w", bagID, username, err)
+	}
+	var before string
+	if bag, ok := m.bags[username][bagID]; ok {
+		before = bagAuditDocument(bag.contents)
+		bag.contents = contents
+	}
+	m.addAuditedEvent(newChangeEvent(ctx, username, "bags", "update", bagEventData{BagID: bagID, Contents: exportJSON(contents)}), before, bagAuditDocument(contents))
+	return nil
+}
+
+// UpdateDefaultBag replaces the contents of the user's default bag.
+func (m *MemoryDB) UpdateDefaultBag(ctx context.Context, username, contents string) error {
+	defaultBag, err := m.GetDefaultBag(ctx, username)
+	if err != nil {
+		return fmt.Errorf("error updating default bag for %s: %w", username, err)
+	}
+	return m.UpdateBag(ctx, username, defaultBag.ID, contents)
+}
+
+// DeleteBag deletes one of the user's bags.
+func (m *MemoryDB) DeleteBag(ctx context.Context, username, bagID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.userID(username); err != nil {
+		return fmt.Errorf("error looking up the user ID in DeleteBag for %s: %w", username, err)
+	}
+	var before string
+	if bag, ok := m.bags[username][bagID]; ok {
+		before = bagAuditDocument(bag.contents)
+	}
+	delete(m.bags[username], bagID)
+	if m.defaultBags[username] == bagID {
+		delete(m.defaultBags, username)
+	}
+	m.addAuditedEvent(newChangeEvent(ctx, username, "bags", "delete", bagEventData{BagID: bagID}), before, "")
+	return nil
+}
+
+// DeleteDefaultBag deletes the user's default bag. A new, empty one is
+// created the next time it's requested.
+func (m *MemoryDB) DeleteDefaultBag(ctx context.Context, username string) error {
+	defaultBag, err := m.GetDefaultBag(ctx, username)
+	if err != nil {
+		return fmt.Errorf("error deleting default bag for %s: %w", username, err)
+	}
+	return m.DeleteBag(ctx, username, defaultBag.ID)
+}
+
+// DeleteAllBags deletes all of the user's bags.
+func (m *MemoryDB) DeleteAllBags(ctx context.Context, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.userID(username); err != nil {
+		return fmt.Errorf("error looking up the user ID for %s: %w", username, err)
+	}
+	bags := make(map[string]string, len(m.bags[username]))
+	for id, bag := range m.bags[username] {
+		bags[id] = bag.contents
+	}
+	delete(m.bags, username)
+	delete(m.defaultBags, username)
+	m.addAuditedEvent(newChangeEvent(ctx, username, "bags", "delete_all", nil), bagsAuditDocument(bags), "")
+	return nil
+}
+
+// Profiles
+
+// getProfile reads every part of the profile under a single lock.
+func (m *MemoryDB) getProfile(ctx context.Context, username string) (*UserProfileRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, err := m.userID(username); err != nil {
+		return nil, err
+	}
+
+	record := &UserProfileRecord{
+		Preferences:   m.preferences[username].document,
+		Session:       m.sessions[username].document,
+		SavedSearches: m.searches[username].document,
+	}
+	if bagID, ok := m.defaultBags[username]; ok {
+		bag, err := m.bagRecord(username, m.bags[username][bagID])
+		if err != nil {
+			return nil, err
+		}
+		record.DefaultBag = &bag
+	}
+	return record, nil
+}
+
+// Exports
+
+// exportUser copies all of the user's data under a single lock.
+func (m *MemoryDB) exportUser(ctx context.Context, username string) (*UserExport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	userID, err := m.userID(username)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &UserExport{
+		Username:      username,
+		UserID:        userID,
+		Preferences:   []exportDocument{},
+		Sessions:      []exportDocument{},
+		SavedSearches: []exportDocument{},
+		Bags:          []exportBag{},
+	}
+	for _, part := range []struct {
+		docs map[string]memoryDocument
+		dest *[]exportDocument
+	}{
+		{m.preferences, &export.Preferences},
+		{m.sessions, &export.Sessions},
+		{m.searches, &export.SavedSearches},
+	} {
+		if doc, ok := part.docs[username]; ok {
+			*part.dest = append(*part.dest, exportDocument{ID: doc.id, Document: doc.document})
+		}
+	}
+
+	bags := make([]*memoryBag, 0, len(m.bags[username]))
+	for _, bag := range m.bags[username] {
+		bags = append(bags, bag)
+	}
+	sort.Slice(bags, func(i, j int) bool { return bags[i].seq < bags[j].seq })
+	for _, bag := range bags {
+		export.Bags = append(export.Bags, exportBag{
+			ID:       bag.id,
+			Contents: bag.contents,
+			Default:  m.defaultBags[username] == bag.id,
+		})
+	}
+
+	return export, nil
+}
+
+// Purges
+
+// purgeUser deletes all of the user's data under a single lock.
+func (m *MemoryDB) purgeUser(ctx context.Context, username string, dryRun bool, entry *AuditEntry) (*PurgeReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.userID(username); err != nil {
+		return nil, err
+	}
+
+	report := &PurgeReport{Username: username, DryRun: dryRun}
+	for _, part := range []struct {
+		docs  map[string]memoryDocument
+		count *int64
+	}{
+		{m.preferences, &report.Preferences},
+		{m.sessions, &report.Sessions},
+		{m.searches, &report.SavedSearches},
+	} {
+		if _, ok := part.docs[username]; ok {
+			*part.count = 1
+		}
+	}
+	report.Bags = int64(len(m.bags[username]))
+	if _, ok := m.defaultBags[username]; ok {
+		report.DefaultBags = 1
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	detail, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	delete(m.preferences, username)
+	delete(m.sessions, username)
+	delete(m.searches, username)
+	delete(m.bags, username)
+	delete(m.defaultBags, username)
+
+	audited := *entry
+	audited.Detail = detail
+	m.appendAudit(audited)
+	m.addEvent(newChangeEvent(ctx, username, "users", "purge", report))
+
+	return report, nil
+}
+
+// Merges
+
+// mergeUsers moves the source user's data to the target user under a single
+// lock.
+func (m *MemoryDB) mergeUsers(ctx context.Context, source, target, policy string, entry *AuditEntry) (*MergeReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.userID(source); err != nil {
+		return nil, err
+	}
+
+	_, targetExists := m.users[target]
+	report := &MergeReport{Source: source, Target: target, Policy: policy, CreatedTarget: !targetExists}
+
+	// Work out every document before changing anything so that a failure
+	// leaves the data as it was.
+	parts := []struct {
+		docs    map[string]memoryDocument
+		outcome *string
+		merged  memoryDocument
+	}{
+		{docs: m.preferences, outcome: &report.Preferences},
+		{docs: m.sessions, outcome: &report.Sessions},
+		{docs: m.searches, outcome: &report.SavedSearches},
+	}
+	for i := range parts {
+		part := &parts[i]
+		sourceDoc, hasSource := part.docs[source]
+		targetDoc, hasTarget := part.docs[target]
+		switch {
+		case !hasSource:
+			*part.outcome = mergeNone
+		case !hasTarget:
+			*part.outcome = mergeMoved
+			part.merged = sourceDoc
+		default:
+			document, outcome, err := resolveDocuments(policy, sourceDoc.document, targetDoc.document)
+			if err != nil {
+				return nil, err
+			}
+			*part.outcome = outcome
+			part.merged = memoryDocument{id: targetDoc.id, document: document}
+		}
+	}
+
+	if report.CreatedTarget {
+		m.users[target] = newUUID()
+	}
+	for _, part := range parts {
+		if *part.outcome != mergeNone {
+			part.docs[target] = part.merged
+			delete(part.docs, source)
+		}
+	}
+
+	// The source user's bags go after the target user's, in their original
+	// order.
+	moved := make([]*memoryBag, 0, len(m.bags[source]))
+	for _, bag := range m.bags[source] {
+		moved = append(moved, bag)
+	}
+	sort.Slice(moved, func(i, j int) bool { return moved[i].seq < moved[j].seq })
+	if len(moved) > 0 && m.bags[target] == nil {
+		m.bags[target] = make(map[string]*memoryBag)
+	}
+	for _, bag := range moved {
+		m.bagSeq++
+		bag.seq = m.bagSeq
+		m.bags[target][bag.id] = bag
+	}
+	delete(m.bags, source)
+	report.BagsMoved = int64(len(moved))
+
+	report.DefaultBag = resolveDefaultBag(policy, m.defaultBags[source], m.defaultBags[target])
+	if report.DefaultBag != "" {
+		m.defaultBags[target] = report.DefaultBag
+	}
+	delete(m.defaultBags, source)
+
+	detail, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	audited := *entry
+	audited.Detail = detail
+	m.appendAudit(audited)
+	m.addEvent(newChangeEvent(ctx, target, "users", "merge", report))
+	m.addChange(newChangeEvent(ctx, source, "users", "purge", report))
+
+	return report, nil
+}
+
+// Imports
+
+// bagOwner must be called with the lock held. It returns the user that has
+// the bag and the bag, or nil if no one has it.
+func (m *MemoryDB) bagOwner(bagID string) (string, *memoryBag) {
+	for username, bags := range m.bags {
+		if bag, ok := bags[bagID]; ok {
+			return username, bag
+		}
+	}
+	return "", nil
+}
+
+// importRecords stores the records under a single lock.
+func (m *MemoryDB) importRecords(ctx context.Context, records []ImportRecord, policy string, dryRun bool, entry *AuditEntry) (*ImportBatch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	documents := map[string]map[string]memoryDocument{
+		"preferences": m.preferences,
+		"sessions":    m.sessions,
+		"searches":    m.searches,
+	}
+
+	// A dry run doesn't change anything, so it keeps track of what it would
+	// have added, and who for, to give the later records the same outcomes as
+	// a real import.
+	wouldAdd := make(map[string]string)
+
+	batch := &ImportBatch{Outcomes: make([]string, 0, len(records))}
+	for n := range records {
+		record := &records[n]
+		username := record.Username
+
+		if _, ok := m.users[username]; !ok && wouldAdd["users/"+username] == "" {
+			batch.UsersCreated++
+			if dryRun {
+				wouldAdd["users/"+username] = username
+			} else {
+				m.users[username] = newUUID()
+			}
+		}
+
+		var (
+			key, owner, before, bagID string
+			exists                    bool
+		)
+		if record.Resource == "bags" {
+			if bagID = record.ID; bagID == "" {
+				bagID = newUUID()
+			}
+			key = "bags/" + bagID
+			var bag *memoryBag
+			if owner, bag = m.bagOwner(bagID); bag != nil {
+				before, exists = bag.contents, true
+			}
+		} else {
+			key = record.Resource + "/" + username
+			var doc memoryDocument
+			doc, exists = documents[record.Resource][username]
+			owner, before = username, doc.document
+		}
+		if added, ok := wouldAdd[key]; ok {
+			owner, exists = added, true
+		}
+
+		outcome := importCreated
+		switch {
+		case !exists:
+		case owner != username:
+			outcome = importTaken
+		case policy == importSkip:
+			outcome = importSkipped
+		case policy == importFail:
+			outcome = importConflict
+		default:
+			outcome = importUpdated
+		}
+		batch.Outcomes = append(batch.Outcomes, outcome)
+		if outcome != importCreated && outcome != importUpdated {
+			continue
+		}
+		if dryRun {
+			wouldAdd[key] = username
+			continue
+		}
+
+		replaced := outcome == importUpdated
+		document := string(record.Document)
+		if record.Resource == "bags" {
+			if m.bags[username] == nil {
+				m.bags[username] = make(map[string]*memoryBag)
+			}
+			if replaced {
+				m.bags[username][bagID].contents = document
+			} else {
+				m.bagSeq++
+				m.bags[username][bagID] = &memoryBag{id: bagID, contents: document, seq: m.bagSeq}
+			}
+		} else {
+			doc := documents[record.Resource][username]
+			if !replaced {
+				doc.id = newUUID()
+			}
+			doc.document = document
+			documents[record.Resource][username] = doc
+		}
+
+		audited, err := record.importAudit(entry, bagID, before, replaced)
+		if err != nil {
+			return nil, err
+		}
+		m.appendAudit(audited)
+		m.addEvent(record.importEvent(ctx, bagID, replaced))
+
+		if record.Default {
+			audited, err = defaultBagAudit(entry, username, bagID, m.defaultBags[username])
+			if err != nil {
+				return nil, err
+			}
+			m.defaultBags[username] = bagID
+			m.appendAudit(audited)
+			m.addEvent(newChangeEvent(ctx, username, "bags", "set_default", bagEventData{BagID: bagID}))
+		}
+	}
+	return batch, nil
+}
+
+// Audit log
+
+// appendAudit must be called with the lock held.
+func (m *MemoryDB) appendAudit(entry AuditEntry) {
+	m.auditSeq++
+	entry.ID = m.auditSeq
+	m.audit = append(m.audit, entry)
+}
+
+func (m *MemoryDB) recordAudit(ctx context.Context, entry *AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.appendAudit(*entry)
+	return nil
+}
+
+func (m *MemoryDB) queryAudit(ctx context.Context, filter *AuditFilter) ([]AuditEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries := []AuditEntry{}
+	for i := len(m.audit) - 1; i >= 0 && len(entries) < filter.Limit; i-- {
+		if filter.matches(&m.audit[i]) {
+			entries = append(entries, m.audit[i])
+		}
+	}
+	return entries, nil
+}
+
+func (m *MemoryDB) pruneAudit(ctx context.Context, cutoff time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.audit[:0]
+	for _, entry := range m.audit {
+		if !entry.OccurredAt.Before(cutoff) {
+			kept = append(kept, entry)
+		}
+	}
+	pruned := int64(len(m.audit) - len(kept))
+	m.audit = kept
+	return pruned, nil
+}
+
+// Event outbox
+
+// addAuditedEvent is addEvent for a change to one of the user's documents,
+// which is also recorded in the audit log. before and after are the document
+// as it was and as the change left it. It must be called with the lock held.
+func (m *MemoryDB) addAuditedEvent(event *ChangeEvent, before, after string) {
+	m.appendAudit(*eventAudit(event, before, after))
+	m.addEvent(event)
+}
+
+// addEvent must be called with the lock held, by the method making the change.
+// It also adds the change to the change log.
+func (m *MemoryDB) addEvent(event *ChangeEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		// Events only hold values that can always be encoded.
+		panic(err)
+	}
+	m.eventSeq++
+	m.events = append(m.events, memoryEvent{
+		OutboxEvent: OutboxEvent{ID: m.eventSeq, RoutingKey: event.routingKey(), Payload: payload},
+		createdAt:   time.Now(),
+	})
+
+	for _, webhook := range m.webhooks {
+		if webhook.matches(event) {
+			m.deliverySeq++
+			m.deliveries = append(m.deliveries, memoryDelivery{
+				WebhookDelivery: WebhookDelivery{
+					ID:        m.deliverySeq,
+					WebhookID: webhook.ID,
+					EventType: event.Type,
+					Payload:   payload,
+					CreatedAt: time.Now().UTC(),
+				},
+			})
+		}
+	}
+
+	m.addChange(event)
+}
+
+// addChange must be called with the lock held. It adds the event to the change
+// log in place of the changes it supersedes.
+func (m *MemoryDB) addChange(event *ChangeEvent) {
+	change, err := newChangeRecord(event)
+	if err != nil {
+		panic(err)
+	}
+
+	kept := m.changes[:0]
+	for i := range m.changes {
+		if !change.supersedes(&m.changes[i]) {
+			kept = append(kept, m.changes[i])
+		}
+	}
+	m.changes = kept
+
+	m.changeSeq++
+	change.ID = m.changeSeq
+	m.changes = append(m.changes, *change)
+	if m.changed != nil {
+		m.changed(event.Username)
+	}
+}
+
+func (m *MemoryDB) claimEvents(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	events := []OutboxEvent{}
+	for i := range m.events {
+		if len(events) == limit {
+			break
+		}
+		if m.events[i].nextAttempt.After(now) {
+			continue
+		}
+		m.events[i].nextAttempt = now.Add(lease)
+		events = append(events, m.events[i].OutboxEvent)
+	}
+	return events, nil
+}
+
+func (m *MemoryDB) deleteEvent(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.events {
+		if m.events[i].ID == id {
+			m.events = append(m.events[:i], m.events[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) retryEvent(ctx context.Context, id int64, delay time.Duration, lastErr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.events {
+		if m.events[i].ID == id {
+			m.events[i].Attempts++
+			m.events[i].nextAttempt = time.Now().Add(delay)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) pruneEvents(ctx context.Context, cutoff time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.events[:0]
+	for _, event := range m.events {
+		if !event.createdAt.Before(cutoff) {
+			kept = append(kept, event)
+		}
+	}
+	pruned := int64(len(m.events) - len(kept))
+	m.events = kept
+	return pruned, nil
+}
+
+// Change log
+
+// onChange makes fn get called with the username whenever a user's data
+// changes.
+func (m *MemoryDB) onChange(fn func(username string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.changed = fn
+}
+
+func (m *MemoryDB) userChanges(ctx context.Context, username string, after int64, limit int) ([]ChangeRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	changes := []ChangeRecord{}
+	for _, change := range m.changes {
+		if len(changes) == limit {
+			break
+		}
+		if change.ID > after && change.Username == username {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+func (m *MemoryDB) changesSince(ctx context.Context, after int64, limit int) ([]ChangeRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	changes := []ChangeRecord{}
+	for _, change := range m.changes {
+		if len(changes) == limit {
+			break
+		}
+		if change.ID > after {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+func (m *MemoryDB) lastChangeID(ctx context.Context) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.changeSeq, nil
+}
+
+func (m *MemoryDB) pruneTombstones(ctx context.Context, cutoff time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.changes[:0]
+	for _, change := range m.changes {
+		if !change.Deleted || !change.OccurredAt.Before(cutoff) {
+			kept = append(kept, change)
+		}
+	}
+	pruned := int64(len(m.changes) - len(kept))
+	m.changes = kept
+	return pruned, nil
+}
+
+// Webhooks
+
+func (m *MemoryDB) insertWebhook(ctx context.Context, webhook *WebhookRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.webhooks[webhook.ID] = *webhook
+	return nil
+}
+
+func (m *MemoryDB) listWebhooks(ctx context.Context) ([]WebhookRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	webhooks := []WebhookRecord{}
+	for _, webhook := range m.webhooks {
+		webhooks = append(webhooks, webhook)
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		if !webhooks[i].CreatedAt.Equal(webhooks[j].CreatedAt) {
+			return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+		}
+		return webhooks[i].ID < webhooks[j].ID
+	})
+	return webhooks, nil
+}
+
+func (m *MemoryDB) getWebhook(ctx context.Context, id string) (*WebhookRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	webhook, ok := m.webhooks[id]
+	if !ok {
+		return nil, nil
+	}
+	return &webhook, nil
+}
+
+func (m *MemoryDB) deleteWebhook(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.webhooks[id]; !ok {
+		return errWebhookNotFound
+	}
+	delete(m.webhooks, id)
+
+	kept := m.deliveries[:0]
+	for _, delivery := range m.deliveries {
+		if delivery.WebhookID != id {
+			kept = append(kept, delivery)
+		}
+	}
+	m.deliveries = kept
+	return nil
+}
+
+// findDelivery must be called with the lock held. It returns nil if there's
+// no delivery with the ID.
+func (m *MemoryDB) findDelivery(id int64) *memoryDelivery {
+	for i := range m.deliveries {
+		if m.deliveries[i].ID == id {
+			return &m.deliveries[i]
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) claimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	deliveries := []WebhookDelivery{}
+	for i := range m.deliveries {
+		if len(deliveries) == limit {
+			break
+		}
+		delivery := &m.deliveries[i]
+		if delivery.FailedAt != nil || delivery.nextAttempt.After(now) {
+			continue
+		}
+		delivery.nextAttempt = now.Add(lease)
+
+		claimed := delivery.WebhookDelivery
+		webhook := m.webhooks[delivery.WebhookID]
+		claimed.URL, claimed.Secret = webhook.URL, webhook.Secret
+		deliveries = append(deliveries, claimed)
+	}
+	return deliveries, nil
+}
+
+func (m *MemoryDB) deleteDelivery(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.deliveries {
+		if m.deliveries[i].ID == id {
+			m.deliveries = append(m.deliveries[:i], m.deliveries[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) retryDelivery(ctx context.Context, id int64, delay time.Duration, lastErr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if delivery := m.findDelivery(id); delivery != nil {
+		delivery.Attempts++
+		delivery.nextAttempt = time.Now().Add(delay)
+		delivery.LastError = lastErr
+	}
+	return nil
+}
+
+func (m *MemoryDB) failDelivery(ctx context.Context, id int64, lastErr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if delivery := m.findDelivery(id); delivery != nil {
+		now := time.Now().UTC()
+		delivery.Attempts++
+		delivery.FailedAt = &now
+		delivery.LastError = lastErr
+	}
+	return nil
+}
+
+func (m *MemoryDB) failedDeliveries(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range m.deliveries {
+		if len(deliveries) == limit {
+			break
+		}
+		if delivery.WebhookID == webhookID && delivery.FailedAt != nil {
+			deliveries = append(deliveries, delivery.WebhookDelivery)
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *MemoryDB) redeliver(ctx context.Context, webhookID string, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delivery := m.findDelivery(id)
+	if delivery == nil || delivery.WebhookID != webhookID || delivery.FailedAt == nil {
+		return errDeliveryNotFound
+	}
+	delivery.Attempts = 0
+	delivery.FailedAt = nil
+	delivery.nextAttempt = time.Time{}
+	return nil
+}
+
+func (m *MemoryDB) pruneDeliveries(ctx context.Context, cutoff time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.deliveries[:0]
+	for _, delivery := range m.deliveries {
+		if !delivery.CreatedAt.Before(cutoff) {
+			kept = append(kept, delivery)
+		}
+	}
+	pruned := int64(len(m.deliveries) - len(kept))
+	m.deliveries = kept
+	return pruned, nil
+}
+
+// Service clients
+
+func (m *MemoryDB) getClient(ctx context.Context, name string) (*ServiceClientRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	client, ok := m.clients[name]
+	if !ok {
+		return nil, nil
+	}
+	return &client, nil
+}
+
+func (m *MemoryDB) listClients(ctx context.Context) ([]ServiceClientRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	clients := []ServiceClientRecord{}
+	for _, client := range m.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	return clients, nil
+}
+
+func (m *MemoryDB) insertClient(ctx context.Context, name, keyHash string, scopes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.clients[name]; ok {
+		return errClientExists
+	}
+	now := time.Now()
+	m.clients[name] = ServiceClientRecord{Name: name, KeyHash: keyHash, Scopes: scopes, CreatedAt: now, RotatedAt: now}
+	return nil
+}
+
+func (m *MemoryDB) updateClientKey(ctx context.Context, name, keyHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	client, ok := m.clients[name]
+	if !ok {
+		return errClientNotFound
+	}
+	client.KeyHash = keyHash
+	client.RotatedAt = time.Now()
+	m.clients[name] = client
+	return nil
+}
+
+func (m *MemoryDB) updateClientScopes(ctx context.Context, name string, scopes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	client, ok := m.clients[name]
+	if !ok {
+		return errClientNotFound
+	}
+	client.Scopes = scopes
+	m.clients[name] = client
+	return nil
+}
+
+func (m *MemoryDB) revokeClient(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.clients[name]; !ok {
+		return errClientNotFound
+	}
+	delete(m.clients, name)
+	return nil
+}
+
+// Stats
+
+func (m *MemoryDB) storageStats(ctx context.Context) (*StorageStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := &StorageStats{
+		Users:          int64(len(m.users)),
+		Preferences:    int64(len(m.preferences)),
+		Sessions:       int64(len(m.sessions)),
+		SavedSearches:  int64(len(m.searches)),
+		ServiceClients: int64(len(m.clients)),
+		AuditEntries:   int64(len(m.audit)),
+		PendingEvents:  int64(len(m.events)),
+		Changes:        int64(len(m.changes)),
+		Webhooks:       int64(len(m.webhooks)),
+	}
+	for _, bags := range m.bags {
+		stats.Bags += int64(len(bags))
+	}
+	for i := range m.deliveries {
+		if m.deliveries[i].FailedAt == nil {
+			stats.PendingDeliveries++
+		} else {
+			stats.DeadDeliveries++
+		}
+	}
+	return stats, nil
+}
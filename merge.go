@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// MergeApp moves a user's data to another user when their username changes or
+// two accounts are merged.
+type MergeApp struct {
+	merges mergeDB
+	router *mux.Router
+}
+
+// NewMergeApp returns a new *MergeApp.
+func NewMergeApp(db mergeDB, router *mux.Router) *MergeApp {
+	mergeApp := &MergeApp{
+		merges: db,
+		router: router,
+	}
+	mergeApp.router.HandleFunc("/admin/users/{username}/merge", mergeApp.MergeUser).Methods(http.MethodPost)
+	return mergeApp
+}
+
+type mergeRequest struct {
+	Target string `json:"target"`
+	Policy string `json:"policy"`
+}
+
+// validateMerge returns an error if the source user can't be merged into the
+// target user with the policy.
+func validateMerge(source, target, policy string) error {
+	if target == "" {
+		return errors.New("a target user is required")
+	}
+	if target == source {
+		return errors.New("a user can't be merged into themselves")
+	}
+	if !mergePolicies[policy] {
+		return fmt.Errorf("invalid policy %q; use keep-source, keep-target or deep-merge", policy)
+	}
+	return nil
+}
+
+func readMergeRequest(request *http.Request) (*mergeRequest, error) {
+	var body mergeRequest
+
+	bodyBuffer, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading body: %w", err)
+	}
+
+	if err = json.Unmarshal(bodyBuffer, &body); err != nil {
+		return nil, fmt.Errorf("error parsing request body: %w", err)
+	}
+
+	return &body, nil
+}
+
+// MergeUser moves all of the user's preferences, sessions, saved searches and
+// bags to the target user given in the request body, creating the target user
+// if they don't exist yet, which is how a user is renamed.
+func (m *MergeApp) MergeUser(writer http.ResponseWriter, r *http.Request) {
+	source := mux.Vars(r)["username"]
+
+	body, err := readMergeRequest(r)
+	if err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+	if err = validateMerge(source, body.Target, body.Policy); err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	report, err := m.merges.mergeUsers(r.Context(), source, body.Target, body.Policy, newAuditEntry(r, body.Target, "users", "merge"))
+	if err == sql.ErrNoRows {
+		handleNonUser(writer, r, source)
+		return
+	}
+	if err != nil {
+		errored(writer, r, fmt.Sprintf("error merging %s into %s: %s", source, body.Target, err))
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"service": "merge",
+		"actor":   requestActor(r),
+	}).Infof("merged %s into %s with the %s policy", source, body.Target, body.Policy)
+
+	writeJSON(writer, r, report)
+}
+
+// runMerge implements the merge subcommand: "merge <source> <target>
+// <policy>". The report is written to standard output.
+func runMerge(ctx context.Context, merges mergeDB, args []string, stdout io.Writer) error {
+	if len(args) != 3 {
+		return fmt.Errorf("usage: user-info merge <source> <target> keep-source|keep-target|deep-merge")
+	}
+	source, target, policy := args[0], args[1], args[2]
+
+	if err := validateMerge(source, target, policy); err != nil {
+		return err
+	}
+
+	entry := &AuditEntry{
+		OccurredAt: time.Now().UTC(),
+		Actor:      "command-line",
+		TargetUser: target,
+		Resource:   "users",
+		Operation:  "merge",
+	}
+	report, err := merges.mergeUsers(ctx, source, target, policy, entry)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("user %s does not exist", source)
+	}
+	if err != nil {
+		return fmt.Errorf("error merging %s into %s: %w", source, target, err)
+	}
+
+	return writeCommandJSON(stdout, report)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// The merge policies decide what happens when both users have the same kind
+// of document.
+const (
+	mergeKeepSource = "keep-source"
+	mergeKeepTarget = "keep-target"
+	mergeDeep       = "deep-merge"
+)
+
+var mergePolicies = map[string]bool{
+	mergeKeepSource: true,
+	mergeKeepTarget: true,
+	mergeDeep:       true,
+}
+
+// The outcomes reported for each kind of document.
+const (
+	mergeNone       = "none"
+	mergeMoved      = "moved"
+	mergeKeptSource = "kept-source"
+	mergeKeptTarget = "kept-target"
+	mergeMerged     = "merged"
+)
+
+// MergeReport describes what happened to each part of the source user's data
+// when it was merged into the target user.
+type MergeReport struct {
+	Source        string `json:"source"`
+	Target        string `json:"target"`
+	Policy        string `json:"policy"`
+	CreatedTarget bool   `json:"created_target"`
+	Preferences   string `json:"preferences"`
+	Sessions      string `json:"sessions"`
+	SavedSearches string `json:"saved_searches"`
+	BagsMoved     int64  `json:"bags_moved"`
+	DefaultBag    string `json:"default_bag,omitempty"`
+}
+
+// mergeDB defines the interface for moving one user's data to another.
+type mergeDB interface {
+	// mergeUsers moves all of the source user's data to the target user,
+	// creating the target user if needed, and records the audit entry, all or
+	// nothing. The source user is left without any data. It returns
+	// sql.ErrNoRows if the source user doesn't exist.
+	mergeUsers(ctx context.Context, source, target, policy string, entry *AuditEntry) (*MergeReport, error)
+}
+
+// deepMerge merges the source value into the target value. Objects are merged
+// key by key; any other conflicting values, arrays included, keep the target's
+// value.
+func deepMerge(target, source interface{}) interface{} {
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		return target
+	}
+	sourceObject, ok := source.(map[string]interface{})
+	if !ok {
+		return target
+	}
+
+	for key, value := range sourceObject {
+		if existing, ok := targetObject[key]; ok {
+			targetObject[key] = deepMerge(existing, value)
+		} else {
+			targetObject[key] = value
+		}
+	}
+	return targetObject
+}
+
+// resolveDocuments returns the document to keep when both users have one, and
+// the outcome to report.
+func resolveDocuments(policy, source, target string) (string, string, error) {
+	switch policy {
+	case mergeKeepSource:
+		return source, mergeKeptSource, nil
+	case mergeKeepTarget:
+		return target, mergeKeptTarget, nil
+	}
+
+	var sourceValue, targetValue interface{}
+	if err := json.Unmarshal([]byte(source), &sourceValue); err != nil {
+		return "", "", fmt.Errorf("the source document is not valid JSON: %w", err)
+	}
+	if err := json.Unmarshal([]byte(target), &targetValue); err != nil {
+		return "", "", fmt.Errorf("the target document is not valid JSON: %w", err)
+	}
+
+	merged, err := json.Marshal(deepMerge(targetValue, sourceValue))
+	if err != nil {
+		return "", "", err
+	}
+	return string(merged), mergeMerged, nil
+}
+
+// resolveDefaultBag returns which of the two default bag IDs the target user
+// keeps. Either may be empty if the user doesn't have a default bag.
+func resolveDefaultBag(policy, source, target string) string {
+	if source != "" && (target == "" || policy == mergeKeepSource) {
+		return source
+	}
+	return target
+}
+
+// mergeTables lists the single-document tables to merge, along with where
+// each one's outcome goes in the report.
+var mergeTables = []struct {
+	table, column string
+	outcome       func(*MergeReport) *string
+}{
+	{"user_preferences", "preferences", func(r *MergeReport) *string { return &r.Preferences }},
+	{"user_sessions", "session", func(r *MergeReport) *string { return &r.Sessions }},
+	{"user_saved_searches", "saved_searches", func(r *MergeReport) *string { return &r.SavedSearches }},
+}
+
+// MergeDB implements the mergeDB interface on top of the DE database.
+type MergeDB struct {
+	db *tracedDB
+}
+
+// NewMergeDB returns a newly created *MergeDB.
+func NewMergeDB(db *sql.DB) *MergeDB {
+	return &MergeDB{
+		db: newTracedDB(db),
+	}
+}
+
+// lockDocument returns the ID and contents of the user's document in the
+// table, or sql.ErrNoRows if they don't have one.
+func lockDocument(ctx context.Context, tx *tracedTx, table, column, userID string) (string, string, error) {
+	var id, document string
+	query := fmt.Sprintf(`SELECT id, %s FROM %s WHERE user_id = $1 FOR UPDATE`, column, table)
+	err := tx.QueryRowContext(ctx, query, userID).Scan(&id, &document)
+	return id, document, err
+}
+
+// mergeDocument moves the source user's document in the table to the target
+// user, resolving a conflict with the policy, and returns the outcome.
+func mergeDocument(ctx context.Context, tx *tracedTx, table, column, sourceID, targetID, policy string) (string, error) {
+	sourceDocID, sourceDoc, err := lockDocument(ctx, tx, table, column, sourceID)
+	if err == sql.ErrNoRows {
+		return mergeNone, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	targetDocID, targetDoc, err := lockDocument(ctx, tx, table, column, targetID)
+	if err == sql.ErrNoRows {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET user_id = $1 WHERE id = $2`, table), targetID, sourceDocID)
+		return mergeMoved, err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	document, outcome, err := resolveDocuments(policy, sourceDoc, targetDoc)
+	if err != nil {
+		return "", fmt.Errorf("error merging %s: %w", table, err)
+	}
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET %s = $1 WHERE id = $2`, table, column), document, targetDocID); err != nil {
+		return "", err
+	}
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = $1`, table), sourceDocID); err != nil {
+		return "", err
+	}
+	return outcome, nil
+}
+
+// defaultBagID returns the ID of the user's default bag, or an empty string if
+// they don't have one.
+func defaultBagID(ctx context.Context, tx *tracedTx, userID string) (string, error) {
+	var bagID string
+	err := tx.QueryRowContext(ctx, `SELECT bag_id FROM default_bags WHERE user_id = $1 FOR UPDATE`, userID).Scan(&bagID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return bagID, err
+}
+
+// mergeUsers moves the source user's data to the target user in one
+// transaction.
+func (m *MergeDB) mergeUsers(ctx context.Context, source, target, policy string, entry *AuditEntry) (*MergeReport, error) {
+	ctx, done := startOperation(ctx, "MergeDB.mergeUsers")
+	defer done()
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	// Both user rows are locked in the same order every time so that two
+	// merges of the same pair of users can't deadlock.
+	rows, err := tx.QueryContext(ctx, `SELECT username, id FROM users WHERE username IN ($1, $2) ORDER BY username FOR UPDATE`, source, target)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]string)
+	for rows.Next() {
+		var username, id string
+		if err = rows.Scan(&username, &id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids[username] = id
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sourceID, ok := ids[source]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	report := &MergeReport{Source: source, Target: target, Policy: policy}
+	targetID, ok := ids[target]
+	if !ok {
+		if err = tx.QueryRowContext(ctx, `INSERT INTO users (username) VALUES ($1) RETURNING id`, target).Scan(&targetID); err != nil {
+			return nil, err
+		}
+		report.CreatedTarget = true
+	}
+
+	for _, t := range mergeTables {
+		if *t.outcome(report), err = mergeDocument(ctx, tx, t.table, t.column, sourceID, targetID, policy); err != nil {
+			return nil, err
+		}
+	}
+
+	sourceDefault, err := defaultBagID(ctx, tx, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	targetDefault, err := defaultBagID(ctx, tx, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.ExecContext(ctx, `UPDATE bags SET user_id = $1 WHERE user_id = $2`, targetID, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	if report.BagsMoved, err = result.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	report.DefaultBag = resolveDefaultBag(policy, sourceDefault, targetDefault)
+	if sourceDefault != "" {
+		if report.DefaultBag == sourceDefault {
+			if _, err = tx.ExecContext(ctx, `DELETE FROM default_bags WHERE user_id = $1`, targetID); err != nil {
+				return nil, err
+			}
+			_, err = tx.ExecContext(ctx, `UPDATE default_bags SET user_id = $1 WHERE user_id = $2`, targetID, sourceID)
+		} else {
+			_, err = tx.ExecContext(ctx, `DELETE FROM default_bags WHERE user_id = $1`, sourceID)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if entry.Detail, err = json.Marshal(report); err != nil {
+		return nil, err
+	}
+	if err = insertAuditEntry(ctx, tx, entry); err != nil {
+		return nil, err
+	}
+	if err = insertEvent(ctx, tx, newChangeEvent(ctx, target, "users", "merge", report)); err != nil {
+		return nil, err
+	}
+
+	// Readers of the change log also need to hear that the source user's data
+	// is gone. The merge event already tells the subscribers of the outbox.
+	if err = insertChange(ctx, tx, newChangeEvent(ctx, source, "users", "purge", report)); err != nil {
+		return nil, err
+	}
+
+	for _, username := range []string{source, target} {
+		for _, kind := range documentCaches {
+			if err = notifyInvalidation(ctx, tx, kind, username); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return report, tx.Commit()
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// This file contains a small implementation of the Prometheus text exposition
+// format. It only supports what the service needs: labelled counters,
+// labelled histograms and gauges that are read at scrape time.
+
+var (
+	durationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	sizeBuckets     = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304}
+)
+
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+// Registry holds the metrics exposed at /metrics.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// ServeHTTP writes out every registered metric.
+func (r *Registry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	r.mu.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mu.Unlock()
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range collectors {
+		c.writeTo(writer)
+	}
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabelValue(extra[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+	labelSets  map[string][]string
+}
+
+// NewCounterVec creates a CounterVec and registers it with the registry.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:      name,
+		help:      help,
+		labels:    labels,
+		values:    make(map[string]float64),
+		labelSets: make(map[string][]string),
+	}
+	r.register(c)
+	return c
+}
+
+// Add adds delta to the counter with the given label values.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	key := labelKey(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.labelSets[key]; !ok {
+		c.labelSets[key] = values
+	}
+	c.values[key] += delta
+}
+
+// Inc adds one to the counter with the given label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, c.labelSets[key]), formatFloat(c.values[key]))
+	}
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	values     map[string]*histogramValue
+}
+
+// NewHistogramVec creates a HistogramVec and registers it with the registry.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records a single observation for the given label values.
+func (h *HistogramVec) Observe(observation float64, values ...string) {
+	key := labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{labelValues: values, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, bound := range h.buckets {
+		if observation <= bound {
+			v.counts[i]++
+		}
+	}
+	v.sum += observation
+	v.count++
+}
+
+func (h *HistogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, v.labelValues, "le", formatFloat(bound)), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, v.labelValues, "le", "+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, v.labelValues), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, v.labelValues), v.count)
+	}
+}
+
+// gaugeFunc is a gauge or counter whose value is read when metrics are
+// scraped.
+type gaugeFunc struct {
+	name, help, kind string
+	fn               func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by fn at scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFunc{name: name, help: help, kind: "gauge", fn: fn})
+}
+
+// NewCounterFunc registers a counter whose value is computed by fn at scrape
+// time.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFunc{name: name, help: help, kind: "counter", fn: fn})
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", g.name, g.help, g.name, g.kind, g.name, formatFloat(g.fn()))
+}
+
+// metrics is the registry served at /metrics.
+var metrics = &Registry{}
+
+var (
+	httpRequests = metrics.NewCounterVec(
+		"user_info_http_requests_total",
+		"Number of HTTP requests handled, by route template, method and status.",
+		"route", "method", "status",
+	)
+	httpRequestDuration = metrics.NewHistogramVec(
+		"user_info_http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by route template, method and status.",
+		durationBuckets,
+		"route", "method", "status",
+	)
+	dbQueryDuration = metrics.NewHistogramVec(
+		"user_info_db_query_duration_seconds",
+		"Time taken by database operations, by operation.",
+		durationBuckets,
+		"operation",
+	)
+	documentBytesWritten = metrics.NewHistogramVec(
+		"user_info_document_bytes_written",
+		"Size of the documents written to each store.",
+		sizeBuckets,
+		"store",
+	)
+)
+
+// observeDB records how long a database operation took. It's meant to be
+// deferred at the top of a storage method:
+//
+//	defer observeDB("PrefsDB.getPreferences", time.Now())
+func observeDB(operation string, start time.Time) {
+	dbQueryDuration.Observe(time.Since(start).Seconds(), operation)
+}
+
+// observeDocument records the size of a document written to a store.
+func observeDocument(store string, document string) {
+	documentBytesWritten.Observe(float64(len(document)), store)
+}
+
+// registerDBStats exposes the connection pool statistics for db.
+func registerDBStats(db *sql.DB) {
+	metrics.NewGaugeFunc("user_info_db_max_open_connections", "Maximum number of open connections to the database.", func() float64 {
+		return float64(db.Stats().MaxOpenConnections)
+	})
+	metrics.NewGaugeFunc("user_info_db_open_connections", "Number of established connections to the database.", func() float64 {
+		return float64(db.Stats().OpenConnections)
+	})
+	metrics.NewGaugeFunc("user_info_db_in_use_connections", "Number of database connections currently in use.", func() float64 {
+		return float64(db.Stats().InUse)
+	})
+	metrics.NewGaugeFunc("user_info_db_idle_connections", "Number of idle database connections.", func() float64 {
+		return float64(db.Stats().Idle)
+	})
+	metrics.NewCounterFunc("user_info_db_wait_count_total", "Number of times a connection had to be waited for.", func() float64 {
+		return float64(db.Stats().WaitCount)
+	})
+	metrics.NewCounterFunc("user_info_db_wait_duration_seconds_total", "Total time spent waiting for a connection.", func() float64 {
+		return db.Stats().WaitDuration.Seconds()
+	})
+}
+
+// metricsMiddleware is a mux.MiddlewareFunc that records request counts and
+// latencies by route template, so usernames don't end up in label values.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := newResponseRecorder(writer)
+
+		next.ServeHTTP(recorder, r)
+
+		var tpl string
+		if route := mux.CurrentRoute(r); route != nil {
+			tpl, _ = route.GetPathTemplate()
+		}
+		status := strconv.Itoa(recorder.status)
+		httpRequests.Inc(tpl, r.Method, status)
+		httpRequestDuration.Observe(time.Since(start).Seconds(), tpl, r.Method, status)
+	})
+}
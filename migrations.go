@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migration is a versioned change to the Postgres schema. A migration without
+// a Down statement can't be reverted.
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migrations lists every schema change in the order they're applied. Never
+// edit or reorder a migration that has been released; add a new one instead.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		// The tables used to be created outside of this service, so this only
+		// creates whatever is missing and leaves existing tables alone.
+		Up: `
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+CREATE TABLE IF NOT EXISTS users (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    username varchar(512) NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS user_preferences (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    user_id uuid NOT NULL UNIQUE REFERENCES users(id),
+    preferences text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_sessions (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    user_id uuid NOT NULL UNIQUE REFERENCES users(id),
+    session text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_saved_searches (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    user_id uuid NOT NULL UNIQUE REFERENCES users(id),
+    saved_searches text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS bags (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    user_id uuid NOT NULL REFERENCES users(id),
+    contents json NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS default_bags (
+    user_id uuid NOT NULL PRIMARY KEY REFERENCES users(id),
+    bag_id uuid NOT NULL REFERENCES bags(id) ON DELETE CASCADE
+);
+`,
+	},
+	{
+		Version: 2,
+		Name:    "service clients",
+		// Service clients came before migrations did, so the table may have
+		// been created by hand from the same DDL.
+		Up: `
+CREATE TABLE IF NOT EXISTS service_clients (
+    name text NOT NULL PRIMARY KEY,
+    key_hash text NOT NULL,
+    scopes text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    rotated_at timestamp with time zone NOT NULL DEFAULT now(),
+    revoked_at timestamp with time zone
+);
+`,
+		Down: `DROP TABLE service_clients;`,
+	},
+	{
+		Version: 3,
+		Name:    "index bags by user",
+		Up:      `CREATE INDEX IF NOT EXISTS bags_user_id_idx ON bags (user_id);`,
+		Down:    `DROP INDEX IF EXISTS bags_user_id_idx;`,
+	},
+	{
+		Version: 4,
+		Name:    "audit log",
+		Up: `
+CREATE TABLE audit_log (
+    id bigserial NOT NULL PRIMARY KEY,
+    occurred_at timestamp with time zone NOT NULL DEFAULT now(),
+    actor text NOT NULL,
+    target_user text NOT NULL,
+    resource text NOT NULL,
+    operation text NOT NULL,
+    request_id text NOT NULL DEFAULT '',
+    detail jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX audit_log_target_user_idx ON audit_log (target_user, occurred_at);
+`,
+		Down: `DROP TABLE audit_log;`,
+	},
+	{
+		Version: 5,
+		Name:    "audit log hashes",
+		Up: `
+ALTER TABLE audit_log
+    ADD COLUMN before_hash text NOT NULL DEFAULT '',
+    ADD COLUMN after_hash text NOT NULL DEFAULT '';
+
+CREATE INDEX audit_log_actor_idx ON audit_log (actor, occurred_at);
+CREATE INDEX audit_log_resource_idx ON audit_log (resource, occurred_at);
+CREATE INDEX audit_log_occurred_at_idx ON audit_log (occurred_at);
+`,
+		Down: `
+DROP INDEX audit_log_occurred_at_idx;
+DROP INDEX audit_log_resource_idx;
+DROP INDEX audit_log_actor_idx;
+
+ALTER TABLE audit_log
+    DROP COLUMN after_hash,
+    DROP COLUMN before_hash;
+`,
+	},
+	{
+		Version: 6,
+		Name:    "event outbox",
+		Up: `
+CREATE TABLE event_outbox (
+    id bigserial NOT NULL PRIMARY KEY,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    routing_key text NOT NULL,
+    payload jsonb NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_error text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX event_outbox_next_attempt_at_idx ON event_outbox (next_attempt_at, id);
+`,
+		Down: `DROP TABLE event_outbox;`,
+	},
+	{
+		Version: 7,
+		Name:    "change log",
+		Up: `
+CREATE TABLE user_changes (
+    id bigserial NOT NULL PRIMARY KEY,
+    occurred_at timestamp with time zone NOT NULL DEFAULT now(),
+    username text NOT NULL,
+    resource text NOT NULL,
+    operation text NOT NULL,
+    etag text NOT NULL DEFAULT '',
+    document jsonb
+);
+
+CREATE INDEX user_changes_username_idx ON user_changes (username, id);
+CREATE INDEX user_changes_occurred_at_idx ON user_changes (occurred_at);
+`,
+		Down: `DROP TABLE user_changes;`,
+	},
+	{
+		Version: 8,
+		Name:    "change log tombstones and positions",
+		Up: `
+ALTER TABLE user_changes ADD COLUMN record_id text NOT NULL DEFAULT '';
+ALTER TABLE user_changes ADD COLUMN deleted boolean NOT NULL DEFAULT false;
+
+CREATE INDEX user_changes_record_idx ON user_changes (username, resource, record_id);
+CREATE INDEX user_changes_tombstones_idx ON user_changes (occurred_at) WHERE deleted;
+
+CREATE SEQUENCE user_changes_position_seq;
+
+ALTER TABLE user_changes ADD COLUMN position bigint;
+UPDATE user_changes SET position = id;
+SELECT setval('user_changes_position_seq', (SELECT COALESCE(max(id), 0) + 1 FROM user_changes), false);
+
+CREATE UNIQUE INDEX user_changes_position_idx ON user_changes (position);
+CREATE INDEX user_changes_username_position_idx ON user_changes (username, position);
+CREATE INDEX user_changes_unpositioned_idx ON user_changes (id) WHERE position IS NULL;
+`,
+		Down: `
+DROP INDEX user_changes_unpositioned_idx;
+DROP INDEX user_changes_username_position_idx;
+DROP INDEX user_changes_position_idx;
+
+ALTER TABLE user_changes DROP COLUMN position;
+DROP SEQUENCE user_changes_position_seq;
+
+DROP INDEX user_changes_tombstones_idx;
+DROP INDEX user_changes_record_idx;
+
+ALTER TABLE user_changes DROP COLUMN deleted;
+ALTER TABLE user_changes DROP COLUMN record_id;
+`,
+	},
+	{
+		Version: 9,
+		Name:    "webhooks",
+		Up: `
+CREATE TABLE webhooks (
+    id uuid NOT NULL PRIMARY KEY,
+    url text NOT NULL,
+    secret text NOT NULL,
+    event_types text NOT NULL,
+    username text NOT NULL DEFAULT '',
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE webhook_deliveries (
+    id bigserial NOT NULL PRIMARY KEY,
+    webhook_id uuid NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_type text NOT NULL,
+    payload jsonb NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_error text NOT NULL DEFAULT '',
+    failed_at timestamp with time zone
+);
+
+CREATE INDEX webhook_deliveries_next_attempt_at_idx ON webhook_deliveries (next_attempt_at, id) WHERE failed_at IS NULL;
+CREATE INDEX webhook_deliveries_failed_idx ON webhook_deliveries (webhook_id, id) WHERE failed_at IS NOT NULL;
+`,
+		Down: `
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;
+`,
+	},
+}
+
+// migrationsTable records which migrations have been applied.
+const migrationsTable = "user_info_schema_migrations"
+
+// migrationLockKey is the Postgres advisory lock held while migrations are
+// applied or reverted, so that replicas starting at the same time don't run
+// them concurrently.
+const migrationLockKey = 4315736291
+
+// MigrationStatus describes whether a single migration has been applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Migrator applies and reverts the schema migrations.
+type Migrator struct {
+	db         *sql.DB
+	migrations []migration
+}
+
+// NewMigrator returns a new *Migrator for the database.
+func NewMigrator(db *sql.DB) *Migrator {
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+	}
+}
+
+// withLock runs fn on a single connection that holds the migration lock. It
+// blocks until any other replica holding the lock has finished.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("error taking the migration lock: %w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey); err != nil {
+			log.Errorf("error releasing the migration lock: %s", err)
+		}
+	}()
+
+	query := `CREATE TABLE IF NOT EXISTS ` + migrationsTable + ` (
+                  version integer NOT NULL PRIMARY KEY,
+                  name text NOT NULL,
+                  applied_at timestamp with time zone NOT NULL DEFAULT now()
+              )`
+	if _, err = conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("error creating %s: %w", migrationsTable, err)
+	}
+
+	return fn(conn)
+}
+
+// applied returns when each applied migration was applied, by version.
+func (m *Migrator) applied(ctx context.Context, q queryer) (map[int]time.Time, error) {
+	rows, err := q.QueryContext(ctx, `SELECT version, applied_at FROM `+migrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, statement, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, statement); err != nil {
+		tx.Rollback() // nolint:errcheck
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, record, args...); err != nil {
+		tx.Rollback() // nolint:errcheck
+		return err
+	}
+	return tx.Commit()
+}
+
+// Up applies every pending migration in order, each in its own transaction,
+// and returns the versions it applied.
+func (m *Migrator) Up(ctx context.Context) ([]int, error) {
+	var done []int
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+
+			log.Infof("applying migration %d (%s)", mig.Version, mig.Name)
+			record := `INSERT INTO ` + migrationsTable + ` (version, name) VALUES ($1, $2)`
+			if err = m.run(ctx, conn, mig.Up, record, mig.Version, mig.Name); err != nil {
+				return fmt.Errorf("error applying migration %d (%s): %w", mig.Version, mig.Name, err)
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the most recently applied migrations, up to steps of them, and
+// returns the versions it reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]int, error) {
+	var done []int
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			if mig.Down == "" {
+				return fmt.Errorf("migration %d (%s) can't be reverted", mig.Version, mig.Name)
+			}
+
+			log.Infof("reverting migration %d (%s)", mig.Version, mig.Name)
+			record := `DELETE FROM ` + migrationsTable + ` WHERE version = $1`
+			if err = m.run(ctx, conn, mig.Down, record, mig.Version); err != nil {
+				return fmt.Errorf("error reverting migration %d (%s): %w", mig.Version, mig.Name, err)
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status returns the status of every known migration. It doesn't take the
+// migration lock or create anything.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var exists bool
+	if err := m.db.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, migrationsTable).Scan(&exists); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]time.Time)
+	if exists {
+		var err error
+		if applied, err = m.applied(ctx, m.db); err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		status := MigrationStatus{Version: mig.Version, Name: mig.Name}
+		if appliedAt, ok := applied[mig.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// CheckCurrent returns an error if any migration hasn't been applied.
+func (m *Migrator) CheckCurrent(ctx context.Context) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("error checking the schema version: %w", err)
+	}
+
+	var pending int
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("the database schema is missing %d migration(s); run `user-info migrate up`", pending)
+	}
+	return nil
+}
+
+// runMigrate implements the migrate subcommand: "migrate up", "migrate down
+// [steps]" or "migrate status".
+func runMigrate(ctx context.Context, db *sql.DB, args []string, out io.Writer) error {
+	m := NewMigrator(db)
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: user-info migrate up|down [steps]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := m.Up(ctx)
+		fmt.Fprintf(out, "applied %d migration(s)\n", len(done))
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		done, err := m.Down(ctx, steps)
+		fmt.Fprintf(out, "reverted %d migration(s)\n", len(done))
+		return err
+
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return w.Flush()
+
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
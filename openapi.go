@@ -0,0 +1,1110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// openAPIDocument describes every route the service registers. TestOpenAPICoversRoutes
+// fails if a route is added without being documented here.
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "user-info",
+    "description": "A service for getting user-related information like sessions, preferences, saved searches and bags. The admin endpoints are only served when authentication is enabled.",
+    "version": "2.9.0"
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+      "apiKey": {"type": "apiKey", "in": "header", "name": "X-Api-Key"}
+    },
+    "parameters": {
+      "username": {
+        "name": "username", "in": "path", "required": true,
+        "description": "The user's username, with or without the user domain.",
+        "schema": {"type": "string"}
+      },
+      "bagID": {
+        "name": "bagID", "in": "path", "required": true,
+        "schema": {"type": "string", "format": "uuid"}
+      },
+      "client": {
+        "name": "client", "in": "path", "required": true,
+        "schema": {"type": "string", "pattern": "^[a-z0-9][a-z0-9_-]*$"}
+      },
+      "webhook": {
+        "name": "webhook", "in": "path", "required": true,
+        "schema": {"type": "string", "format": "uuid"}
+      }
+    },
+    "schemas": {
+      "Problem": {
+        "type": "object",
+        "required": ["type", "title", "status"],
+        "properties": {
+          "type": {"type": "string"},
+          "title": {"type": "string"},
+          "status": {"type": "integer"},
+          "detail": {"type": "string"},
+          "instance": {"type": "string"},
+          "request_id": {"type": "string"},
+          "user": {"type": "string"}
+        }
+      },
+      "Document": {
+        "type": "object",
+        "description": "An arbitrary JSON object owned by the DE UI."
+      },
+      "Health": {
+        "type": "object",
+        "properties": {
+          "status": {"type": "string", "enum": ["ok", "unavailable"]},
+          "checks": {
+            "type": "object",
+            "description": "The result of each check, keyed by name. Each result has a status, and may have a detail and a duration_ms."
+          }
+        }
+      },
+      "Bag": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string", "format": "uuid"},
+          "contents": {"$ref": "#/components/schemas/Document"},
+          "user_id": {"type": "string", "format": "uuid"}
+        }
+      },
+      "BagList": {
+        "type": "object",
+        "properties": {
+          "bags": {"type": "array", "items": {"$ref": "#/components/schemas/Bag"}}
+        }
+      },
+      "Profile": {
+        "type": "object",
+        "description": "The parts of a user's profile. Parts that weren't requested are left out.",
+        "properties": {
+          "username": {"type": "string"},
+          "preferences": {"$ref": "#/components/schemas/Document"},
+          "session": {"$ref": "#/components/schemas/Document"},
+          "saved_searches": {"$ref": "#/components/schemas/Document"},
+          "default_bag": {"$ref": "#/components/schemas/Bag", "nullable": true}
+        }
+      },
+      "PurgeReport": {
+        "type": "object",
+        "properties": {
+          "username": {"type": "string"},
+          "dry_run": {"type": "boolean"},
+          "preferences": {"type": "integer"},
+          "sessions": {"type": "integer"},
+          "saved_searches": {"type": "integer"},
+          "bags": {"type": "integer"},
+          "default_bags": {"type": "integer"}
+        }
+      },
+      "MergeReport": {
+        "type": "object",
+        "properties": {
+          "source": {"type": "string"},
+          "target": {"type": "string"},
+          "policy": {"type": "string", "enum": ["keep-source", "keep-target", "deep-merge"]},
+          "created_target": {"type": "boolean"},
+          "preferences": {"$ref": "#/components/schemas/MergeOutcome"},
+          "sessions": {"$ref": "#/components/schemas/MergeOutcome"},
+          "saved_searches": {"$ref": "#/components/schemas/MergeOutcome"},
+          "bags_moved": {"type": "integer"},
+          "default_bag": {"type": "string", "format": "uuid"}
+        }
+      },
+      "MergeOutcome": {
+        "type": "string",
+        "enum": ["none", "moved", "kept-source", "kept-target", "merged"]
+      },
+      "ImportRecord": {
+        "type": "object",
+        "required": ["resource", "username", "document"],
+        "properties": {
+          "resource": {"type": "string", "enum": ["preferences", "sessions", "searches", "bags"]},
+          "username": {"type": "string"},
+          "id": {"type": "string", "format": "uuid", "description": "The bag's ID. Bags without one get a new ID."},
+          "default": {"type": "boolean", "description": "Make the bag the user's default bag."},
+          "document": {}
+        }
+      },
+      "ImportReport": {
+        "type": "object",
+        "properties": {
+          "policy": {"type": "string", "enum": ["skip", "overwrite", "fail"]},
+          "dry_run": {"type": "boolean"},
+          "records": {"type": "integer"},
+          "created": {"type": "integer"},
+          "updated": {"type": "integer"},
+          "skipped": {"type": "integer"},
+          "failed": {"type": "integer"},
+          "users_created": {"type": "integer"},
+          "errors": {"type": "array", "items": {"type": "object", "properties": {"line": {"type": "integer"}, "error": {"type": "string"}}}},
+          "errors_omitted": {"type": "integer", "description": "The number of failed lines left out of errors, which lists at most 1000."}
+        }
+      },
+      "AuditEntry": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "occurred_at": {"type": "string", "format": "date-time"},
+          "actor": {"type": "string", "description": "The user who made the change, client:<name> for a service client, or anonymous."},
+          "target_user": {"type": "string"},
+          "resource": {"type": "string"},
+          "operation": {"type": "string"},
+          "request_id": {"type": "string"},
+          "before_hash": {"type": "string", "description": "The SHA-256 of the document before the change, if there was one."},
+          "after_hash": {"type": "string", "description": "The SHA-256 of the document after the change, if there is one."},
+          "detail": {"type": "object"}
+        }
+      },
+      "ChangeRecord": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64", "description": "The change's position in the change log, which increases in the order changes were committed."},
+          "occurred_at": {"type": "string", "format": "date-time"},
+          "username": {"type": "string"},
+          "resource": {"type": "string", "description": "preferences, sessions, searches, bags or users."},
+          "record_id": {"type": "string", "description": "The bag's ID for changes to a bag, or default for changes to the default bag."},
+          "operation": {"type": "string"},
+          "deleted": {"type": "boolean", "description": "Whether this is the tombstone of a delete. Deleting all of a user's bags leaves a single tombstone with the resource bags and operation delete_all and no record_id, in place of the changes to each of their bags; drop all of the user's bags when you see one. Purging a user, or merging them into another user, leaves a single tombstone with the resource users and operation purge in place of every change to their data; drop all of the user's records when you see one."},
+          "etag": {"type": "string"},
+          "document": {"description": "The data that describes the change."}
+        }
+      },
+      "BagID": {
+        "type": "object",
+        "properties": {"id": {"type": "string", "format": "uuid"}}
+      },
+      "ClientScopes": {
+        "type": "object",
+        "required": ["scopes"],
+        "additionalProperties": false,
+        "properties": {
+          "scopes": {
+            "type": "array",
+            "minItems": 1,
+            "description": "Scopes look like resource:action, where the resource is the first segment of a route's path, except for export for GET /users/{username}/export and purge for DELETE /users/{username}/data, and the action is read, write or *.",
+            "items": {"type": "string", "pattern": "^(\\*|[a-z]+:(\\*|read|write))$"}
+          }
+        }
+      },
+      "Client": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "scopes": {"type": "array", "items": {"type": "string"}},
+          "created_at": {"type": "string", "format": "date-time"},
+          "rotated_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "ClientKey": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "scopes": {"type": "array", "items": {"type": "string"}},
+          "api_key": {"type": "string"}
+        }
+      },
+      "Webhook": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string", "format": "uuid"},
+          "url": {"type": "string", "format": "uri"},
+          "event_types": {"type": "array", "items": {"type": "string"}, "description": "Event types, or * for every event. The event types are the routing keys of the events published to AMQP without the user-info. prefix: preferences, sessions and searches followed by .create, .update or .delete, bags followed by .create, .update, .delete, .delete_all or .set_default, and users.purge and users.merge. Names with a singular resource or a past-tense operation, such as preferences.updated or bag.deleted, are accepted and stored as preferences.update and bags.delete. Sessions don't expire in user-info, so there is no session.expired event; it's out of scope for webhooks until there is."},
+          "username": {"type": "string", "description": "Only events for this user's data. Omitted for every user."},
+          "created_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "WebhookDelivery": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "webhook_id": {"type": "string", "format": "uuid"},
+          "event_type": {"type": "string"},
+          "payload": {"type": "object", "description": "The event, as it's posted to the webhook."},
+          "attempts": {"type": "integer"},
+          "last_error": {"type": "string"},
+          "created_at": {"type": "string", "format": "date-time"},
+          "failed_at": {"type": "string", "format": "date-time"}
+        }
+      }
+    },
+    "requestBodies": {
+      "Document": {
+        "required": true,
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Document"}}}
+      },
+      "AnyJSON": {
+        "required": true,
+        "content": {"application/json": {"schema": {}}}
+      },
+      "ClientScopes": {
+        "required": true,
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ClientScopes"}}}
+      }
+    },
+    "responses": {
+      "Greeting": {
+        "description": "A plain text greeting.",
+        "content": {"text/plain": {"schema": {"type": "string"}}}
+      },
+      "Document": {
+        "description": "The stored document.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Document"}}}
+      },
+      "Empty": {
+        "description": "The operation succeeded."
+      },
+      "Health": {
+        "description": "The overall status and the result of each check.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Health"}}}
+      },
+      "Problem": {
+        "description": "An error, described as RFC 7807 problem details.",
+        "content": {"application/problem+json": {"schema": {"$ref": "#/components/schemas/Problem"}}}
+      }
+    }
+  },
+  "security": [{"bearer": []}, {"apiKey": []}],
+  "paths": {
+    "/": {
+      "get": {
+        "summary": "Greeting for the service.",
+        "security": [],
+        "responses": {"200": {"$ref": "#/components/responses/Greeting"}}
+      }
+    },
+    "/debug/vars": {
+      "get": {
+        "summary": "Runtime statistics published through expvar.",
+        "responses": {"200": {"description": "expvar JSON.", "content": {"application/json": {"schema": {"type": "object"}}}}}
+      }
+    },
+    "/healthz": {
+      "get": {
+        "summary": "Liveness check. Succeeds as long as the process is serving requests.",
+        "security": [],
+        "responses": {"200": {"$ref": "#/components/responses/Health"}}
+      }
+    },
+    "/readyz": {
+      "get": {
+        "summary": "Readiness check. Fails if the database is unreachable, the connection pool is saturated or the service is shutting down.",
+        "security": [],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Health"},
+          "503": {"$ref": "#/components/responses/Health"}
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "summary": "Metrics in the Prometheus text exposition format.",
+        "security": [],
+        "responses": {"200": {"description": "The metrics.", "content": {"text/plain": {"schema": {"type": "string"}}}}}
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This document.",
+        "security": [],
+        "responses": {"200": {"description": "The OpenAPI document.", "content": {"application/json": {"schema": {"type": "object"}}}}}
+      }
+    },
+    "/preferences/": {
+      "get": {
+        "summary": "Greeting for the preferences endpoints.",
+        "security": [],
+        "responses": {"200": {"$ref": "#/components/responses/Greeting"}}
+      }
+    },
+    "/preferences/{username}": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "get": {
+        "summary": "Get a user's preferences.",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Document"},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "put": {
+        "summary": "Set a user's preferences.",
+        "requestBody": {"$ref": "#/components/requestBodies/Document"},
+        "responses": {
+          "200": {"description": "The new preferences, wrapped in a preferences object.", "content": {"application/json": {"schema": {"type": "object", "properties": {"preferences": {"$ref": "#/components/schemas/Document"}}}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "post": {
+        "summary": "Set a user's preferences.",
+        "requestBody": {"$ref": "#/components/requestBodies/Document"},
+        "responses": {
+          "200": {"description": "The new preferences, wrapped in a preferences object.", "content": {"application/json": {"schema": {"type": "object", "properties": {"preferences": {"$ref": "#/components/schemas/Document"}}}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a user's preferences.",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Empty"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/sessions/": {
+      "get": {
+        "summary": "Greeting for the sessions endpoints.",
+        "security": [],
+        "responses": {"200": {"$ref": "#/components/responses/Greeting"}}
+      }
+    },
+    "/sessions/{username}": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "get": {
+        "summary": "Get a user's session.",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Document"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "put": {
+        "summary": "Set a user's session.",
+        "requestBody": {"$ref": "#/components/requestBodies/Document"},
+        "responses": {
+          "200": {"description": "The new session, wrapped in a session object.", "content": {"application/json": {"schema": {"type": "object", "properties": {"session": {"$ref": "#/components/schemas/Document"}}}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "post": {
+        "summary": "Set a user's session.",
+        "requestBody": {"$ref": "#/components/requestBodies/Document"},
+        "responses": {
+          "200": {"description": "The new session, wrapped in a session object.", "content": {"application/json": {"schema": {"type": "object", "properties": {"session": {"$ref": "#/components/schemas/Document"}}}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a user's session.",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Empty"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/searches/": {
+      "get": {
+        "summary": "Greeting for the saved searches endpoints.",
+        "security": [],
+        "responses": {"200": {"$ref": "#/components/responses/Greeting"}}
+      }
+    },
+    "/searches/{username}": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "get": {
+        "summary": "Get a user's saved searches.",
+        "responses": {
+          "200": {"description": "The saved searches.", "content": {"application/json": {"schema": {}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "put": {
+        "summary": "Set a user's saved searches.",
+        "requestBody": {"$ref": "#/components/requestBodies/AnyJSON"},
+        "responses": {
+          "200": {"description": "The new saved searches.", "content": {"application/json": {"schema": {"type": "object", "properties": {"saved_searches": {}}}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "post": {
+        "summary": "Set a user's saved searches.",
+        "requestBody": {"$ref": "#/components/requestBodies/AnyJSON"},
+        "responses": {
+          "200": {"description": "The new saved searches.", "content": {"application/json": {"schema": {"type": "object", "properties": {"saved_searches": {}}}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a user's saved searches.",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Empty"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/bags/": {
+      "get": {
+        "summary": "Greeting for the bags endpoints.",
+        "security": [],
+        "responses": {"200": {"$ref": "#/components/responses/Greeting"}}
+      }
+    },
+    "/bags/{username}": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "head": {
+        "summary": "Check whether the user has any bags.",
+        "responses": {
+          "200": {"description": "The user has at least one bag."},
+          "404": {"description": "The user has no bags."}
+        }
+      },
+      "get": {
+        "summary": "List a user's bags.",
+        "responses": {
+          "200": {"description": "The user's bags.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BagList"}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "put": {
+        "summary": "Add a bag for the user.",
+        "requestBody": {"$ref": "#/components/requestBodies/Document"},
+        "responses": {
+          "200": {"description": "The ID of the new bag.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BagID"}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "delete": {
+        "summary": "Delete all of a user's bags.",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Empty"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/bags/{username}/default": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "get": {
+        "summary": "Get the user's default bag, creating it if necessary.",
+        "responses": {
+          "200": {"description": "The default bag.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Bag"}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "post": {
+        "summary": "Replace the contents of the user's default bag.",
+        "requestBody": {"$ref": "#/components/requestBodies/Document"},
+        "responses": {
+          "200": {"description": "The updated default bag.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Bag"}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "delete": {
+        "summary": "Delete the user's default bag. A new empty one is created in its place.",
+        "responses": {
+          "200": {"description": "The new default bag.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Bag"}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/bags/{username}/{bagID}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/username"},
+        {"$ref": "#/components/parameters/bagID"}
+      ],
+      "get": {
+        "summary": "Get one of the user's bags.",
+        "responses": {
+          "200": {"description": "The bag.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Bag"}}}},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "post": {
+        "summary": "Replace the contents of one of the user's bags.",
+        "requestBody": {"$ref": "#/components/requestBodies/Document"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/Empty"},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "delete": {
+        "summary": "Delete one of the user's bags.",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Empty"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/users/{username}/profile": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "get": {
+        "summary": "Get the user's preferences, session, saved searches and default bag in one response. The default bag is null if the user doesn't have one yet.",
+        "parameters": [
+          {
+            "name": "include", "in": "query", "required": false,
+            "description": "A comma-separated list of the parts to include: preferences, session, saved_searches and default_bag. Every part is included by default.",
+            "schema": {"type": "string"}
+          },
+          {
+            "name": "If-None-Match", "in": "header", "required": false,
+            "description": "An ETag from a previous response.",
+            "schema": {"type": "string"}
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "The profile.",
+            "headers": {"ETag": {"description": "Changes whenever any included part changes.", "schema": {"type": "string"}}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Profile"}}}
+          },
+          "304": {"description": "The profile hasn't changed since the ETag in If-None-Match was issued."},
+          "400": {"$ref": "#/components/responses/Problem"},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/users/{username}/events": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "get": {
+        "summary": "Stream changes to the user's preferences, sessions, saved searches and bags as Server-Sent Events.",
+        "description": "Each event's data is a JSON object with the change's id, occurred_at, username, resource, operation and the etag of the new document, and its id is the change's id. The stream ends after a while and the client is expected to reconnect with the last ID it received, which also works against other replicas. Without an ID, only changes made after the request are sent.",
+        "parameters": [
+          {
+            "name": "documents", "in": "query", "required": false,
+            "description": "Include the new document in each event.",
+            "schema": {"type": "boolean"}
+          },
+          {
+            "name": "Last-Event-ID", "in": "header", "required": false,
+            "description": "Resume the stream after the event with this ID.",
+            "schema": {"type": "integer", "format": "int64", "minimum": 0}
+          },
+          {
+            "name": "last_event_id", "in": "query", "required": false,
+            "description": "The same as Last-Event-ID, for clients that can't set headers. The header takes precedence.",
+            "schema": {"type": "integer", "format": "int64", "minimum": 0}
+          }
+        ],
+        "responses": {
+          "200": {"description": "The event stream.", "content": {"text/event-stream": {"schema": {"type": "string"}}}},
+          "400": {"$ref": "#/components/responses/Problem"},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/users/{username}/export": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "get": {
+        "summary": "Export everything stored for the user as a zip archive.",
+        "description": "The archive holds preferences.json, sessions.json, saved_searches.json and bags.json, taken from a single consistent snapshot, and a manifest.json listing the size and SHA-256 checksum of each of them.",
+        "responses": {
+          "200": {"description": "The archive.", "content": {"application/zip": {"schema": {"type": "string", "format": "binary"}}}},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/users/{username}/data": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "delete": {
+        "summary": "Delete all of the user's preferences, sessions, saved searches and bags in one transaction, and record it in the audit log. Only administrators and service clients with the purge:write scope may do this.",
+        "parameters": [
+          {
+            "name": "dry_run", "in": "query", "required": false,
+            "description": "Report what would be deleted without deleting anything.",
+            "schema": {"type": "boolean"}
+          }
+        ],
+        "responses": {
+          "200": {"description": "The number of records of each kind that were, or would be, deleted.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PurgeReport"}}}},
+          "400": {"$ref": "#/components/responses/Problem"},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/admin/users/{username}/merge": {
+      "parameters": [{"$ref": "#/components/parameters/username"}],
+      "post": {
+        "summary": "Move all of the user's preferences, sessions, saved searches and bags to the target user in one transaction, creating the target user if needed. Documents that both users have are resolved with the policy; deep-merge merges JSON objects key by key and keeps the target's value for any other conflict. Bags are concatenated and the target keeps its own default bag unless the policy is keep-source.",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {
+            "type": "object",
+            "required": ["target", "policy"],
+            "properties": {
+              "target": {"type": "string"},
+              "policy": {"type": "string", "enum": ["keep-source", "keep-target", "deep-merge"]}
+            }
+          }}}
+        },
+        "responses": {
+          "200": {"description": "What happened to each part of the user's data.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/MergeReport"}}}},
+          "400": {"$ref": "#/components/responses/Problem"},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/admin/import": {
+      "post": {
+        "summary": "Import users' data from JSON Lines, one ImportRecord per line, creating the users that don't exist.",
+        "description": "Records are stored in batches of batch_size, each in its own transaction. Lines that can't be imported are listed in the report and don't stop the rest of the import. A record that runs into an error is rolled back on its own; only a batch that runs out of time, after user_info.db.timeouts.ImportDB.importRecords (5m by default), fails as a whole. The policy decides what happens to a record for a document the user already has, or a bag ID they already have: skip leaves it alone, overwrite replaces it and fail reports the line as an error. A dry run checks each batch as if the ones before it hadn't been imported. The body is streamed rather than validated up front, but it can't be larger than 1 GiB and no line can be longer than 10 MiB; the import stops at the first line that is, keeping only the batches that were already stored.",
+        "parameters": [
+          {"name": "policy", "in": "query", "required": false, "schema": {"type": "string", "enum": ["skip", "overwrite", "fail"], "default": "skip"}},
+          {"name": "dry_run", "in": "query", "required": false, "description": "Report what would be imported without importing it.", "schema": {"type": "boolean", "default": false}},
+          {"name": "batch_size", "in": "query", "required": false, "schema": {"type": "integer", "minimum": 1, "maximum": 5000, "default": 500}}
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {"application/x-ndjson": {"schema": {"$ref": "#/components/schemas/ImportRecord"}}}
+        },
+        "responses": {
+          "200": {"description": "What happened to the records.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ImportReport"}}}},
+          "400": {"$ref": "#/components/responses/Problem"},
+          "413": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/admin/audit": {
+      "get": {
+        "summary": "Query the audit log of changes to users' data, newest first.",
+        "parameters": [
+          {"name": "user", "in": "query", "required": false, "description": "Only changes to this user's data.", "schema": {"type": "string"}},
+          {"name": "actor", "in": "query", "required": false, "description": "Only changes made by this actor.", "schema": {"type": "string"}},
+          {"name": "resource", "in": "query", "required": false, "description": "Only changes to this resource, such as preferences or bags.", "schema": {"type": "string"}},
+          {"name": "since", "in": "query", "required": false, "description": "Only changes made at or after this time.", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "until", "in": "query", "required": false, "description": "Only changes made before this time.", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "limit", "in": "query", "required": false, "description": "The most entries to return.", "schema": {"type": "integer", "minimum": 1, "maximum": 1000, "default": 100}}
+        ],
+        "responses": {
+          "200": {"description": "The matching entries.", "content": {"application/json": {"schema": {"type": "object", "properties": {"entries": {"type": "array", "items": {"$ref": "#/components/schemas/AuditEntry"}}}}}}},
+          "400": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/changes": {
+      "get": {
+        "summary": "Read the changes to everyone's data in the order they were committed. Administrators only.",
+        "description": "Only the latest change to each record is kept, so a consumer that starts without a cursor and follows it ends up with the current data. Deletes are kept as tombstones for user_info.changes.tombstone_retention; a consumer that falls further behind than that has to start over. Deleting all of a user's bags, purging a user and merging them away don't leave a tombstone for each record they deleted: a bags delete_all tombstone stands for all of the user's bags and a users purge tombstone for all of the user's data, so consumers have to drop every matching record they hold for that user. The target of a merge gets a users merge change rather than a change for each record that was moved to it, so consumers have to read that user's data again.",
+        "parameters": [
+          {"name": "since", "in": "query", "required": false, "description": "The cursor returned by the previous page. Without one, the feed starts from the beginning.", "schema": {"type": "integer", "format": "int64", "minimum": 0}},
+          {"name": "limit", "in": "query", "required": false, "description": "The most changes to return.", "schema": {"type": "integer", "minimum": 1, "maximum": 1000, "default": 100}}
+        ],
+        "responses": {
+          "200": {"description": "The changes after the cursor, oldest first, and the cursor for the next page.", "content": {"application/json": {"schema": {"type": "object", "properties": {"changes": {"type": "array", "items": {"$ref": "#/components/schemas/ChangeRecord"}}, "cursor": {"type": "integer", "format": "int64"}}}}}},
+          "400": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/admin/clients": {
+      "get": {
+        "summary": "List the active service clients.",
+        "responses": {
+          "200": {"description": "The clients.", "content": {"application/json": {"schema": {"type": "object", "properties": {"clients": {"type": "array", "items": {"$ref": "#/components/schemas/Client"}}}}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/admin/clients/{client}": {
+      "parameters": [{"$ref": "#/components/parameters/client"}],
+      "get": {
+        "summary": "Get a service client.",
+        "responses": {
+          "200": {"description": "The client.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Client"}}}},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "put": {
+        "summary": "Create a service client. The API key is only returned once.",
+        "requestBody": {"$ref": "#/components/requestBodies/ClientScopes"},
+        "responses": {
+          "201": {"description": "The new client and its API key.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ClientKey"}}}},
+          "409": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "post": {
+        "summary": "Replace the scopes granted to a service client.",
+        "requestBody": {"$ref": "#/components/requestBodies/ClientScopes"},
+        "responses": {
+          "200": {"description": "The client's new scopes.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ClientKey"}}}},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "delete": {
+        "summary": "Revoke a service client's credentials.",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Empty"},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/admin/webhooks": {
+      "get": {
+        "summary": "List the registered webhooks.",
+        "responses": {
+          "200": {"description": "The webhooks.", "content": {"application/json": {"schema": {"type": "object", "properties": {"webhooks": {"type": "array", "items": {"$ref": "#/components/schemas/Webhook"}}}}}}},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "post": {
+        "summary": "Register a webhook. The secret that signs its deliveries is only returned once.",
+        "description": "Each event is posted to the URL as JSON, with its type in X-User-Info-Event, the delivery's ID in X-User-Info-Delivery and sha256= followed by the hex-encoded HMAC-SHA256 of the body, keyed with the secret, in X-User-Info-Signature. Anything but a 2xx response is retried with exponential backoff until user_info.webhooks.max_attempts, after which the delivery goes on the webhook's dead-letter list. Unless user_info.webhooks.allow_private_destinations is set, the URL can't point at a loopback, link-local or private address, and deliveries are refused if its name resolves to one.",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {
+            "type": "object",
+            "required": ["url", "event_types"],
+            "properties": {
+              "url": {"type": "string", "format": "uri"},
+              "event_types": {"type": "array", "items": {"type": "string"}, "minItems": 1},
+              "username": {"type": "string"}
+            }
+          }}}
+        },
+        "responses": {
+          "201": {"description": "The new webhook and its secret.", "content": {"application/json": {"schema": {"allOf": [{"$ref": "#/components/schemas/Webhook"}, {"type": "object", "properties": {"secret": {"type": "string"}}}]}}}},
+          "400": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/admin/webhooks/{webhook}": {
+      "parameters": [{"$ref": "#/components/parameters/webhook"}],
+      "get": {
+        "summary": "Get a webhook.",
+        "responses": {
+          "200": {"description": "The webhook.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Webhook"}}}},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "delete": {
+        "summary": "Remove a webhook, discarding its pending deliveries and dead letters.",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Empty"},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/admin/webhooks/{webhook}/dead-letters": {
+      "parameters": [{"$ref": "#/components/parameters/webhook"}],
+      "get": {
+        "summary": "List the deliveries to a webhook that failed every attempt, oldest first.",
+        "parameters": [
+          {"name": "limit", "in": "query", "required": false, "description": "The most deliveries to return.", "schema": {"type": "integer", "minimum": 1, "maximum": 1000, "default": 100}}
+        ],
+        "responses": {
+          "200": {"description": "The dead letters.", "content": {"application/json": {"schema": {"type": "object", "properties": {"deliveries": {"type": "array", "items": {"$ref": "#/components/schemas/WebhookDelivery"}}}}}}},
+          "400": {"$ref": "#/components/responses/Problem"},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/admin/webhooks/{webhook}/dead-letters/{delivery}/redeliver": {
+      "parameters": [
+        {"$ref": "#/components/parameters/webhook"},
+        {"name": "delivery", "in": "path", "required": true, "schema": {"type": "integer", "format": "int64"}}
+      ],
+      "post": {
+        "summary": "Take a delivery off the dead-letter list and queue it again with a fresh set of attempts.",
+        "responses": {
+          "202": {"description": "The delivery was queued."},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/admin/clients/{client}/rotate": {
+      "parameters": [{"$ref": "#/components/parameters/client"}],
+      "post": {
+        "summary": "Replace a service client's API key. The old key stops working immediately.",
+        "responses": {
+          "200": {"description": "The client's new API key.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ClientKey"}}}},
+          "404": {"$ref": "#/components/responses/Problem"},
+          "default": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    }
+  }
+}`
+
+// serveOpenAPI writes out the OpenAPI document.
+func serveOpenAPI(writer http.ResponseWriter, r *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(writer, openAPIDocument)
+}
+
+// schema is the subset of the OpenAPI schema object that request validation
+// understands.
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	Pattern              string             `json:"pattern"`
+	Enum                 []interface{}      `json:"enum"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+type requestBody struct {
+	Ref      string               `json:"$ref"`
+	Required bool                 `json:"required"`
+	Content  map[string]mediaType `json:"content"`
+}
+
+type operation struct {
+	RequestBody *requestBody `json:"requestBody"`
+}
+
+type openAPISpec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas       map[string]*schema      `json:"schemas"`
+		RequestBodies map[string]*requestBody `json:"requestBodies"`
+	} `json:"components"`
+}
+
+func parseOpenAPI() (*openAPISpec, error) {
+	var spec openAPISpec
+	if err := json.Unmarshal([]byte(openAPIDocument), &spec); err != nil {
+		return nil, fmt.Errorf("error parsing the OpenAPI document: %w", err)
+	}
+	return &spec, nil
+}
+
+// operation returns the operation documented for the route template and
+// method, if there is one.
+func (s *openAPISpec) operation(tpl, method string) (*operation, bool) {
+	item, ok := s.Paths[tpl]
+	if !ok {
+		return nil, false
+	}
+	raw, ok := item[strings.ToLower(method)]
+	if !ok {
+		return nil, false
+	}
+	var op operation
+	if err := json.Unmarshal(raw, &op); err != nil {
+		return nil, false
+	}
+	return &op, true
+}
+
+func (s *openAPISpec) resolveBody(body *requestBody) *requestBody {
+	if body != nil && body.Ref != "" {
+		return s.Components.RequestBodies[strings.TrimPrefix(body.Ref, "#/components/requestBodies/")]
+	}
+	return body
+}
+
+func (s *openAPISpec) resolveSchema(sc *schema) *schema {
+	for sc != nil && sc.Ref != "" {
+		sc = s.Components.Schemas[strings.TrimPrefix(sc.Ref, "#/components/schemas/")]
+	}
+	return sc
+}
+
+// validate checks value against the schema and returns a description of the
+// first problem it finds.
+func (s *openAPISpec) validate(sc *schema, value interface{}, path string) error {
+	sc = s.resolveSchema(sc)
+	if sc == nil {
+		return nil
+	}
+
+	if len(sc.Enum) > 0 {
+		found := false
+		for _, allowed := range sc.Enum {
+			if allowed == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %v", path, sc.Enum)
+		}
+	}
+
+	switch sc.Type {
+	case "":
+		return nil
+
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+		for _, name := range sc.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s.%s is required", path, name)
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := sc.Properties[name]
+			if !ok {
+				if sc.AdditionalProperties != nil && !*sc.AdditionalProperties {
+					return fmt.Errorf("%s.%s is not allowed", path, name)
+				}
+				continue
+			}
+			if err := s.validate(prop, obj[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+		if sc.MinItems != nil && len(arr) < *sc.MinItems {
+			return fmt.Errorf("%s must have at least %d items", path, *sc.MinItems)
+		}
+		for i, item := range arr {
+			if err := s.validate(sc.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+		if sc.Pattern != "" {
+			matched, err := regexp.MatchString(sc.Pattern, str)
+			if err != nil {
+				return fmt.Errorf("invalid pattern for %s: %w", path, err)
+			}
+			if !matched {
+				return fmt.Errorf("%s must match %s", path, sc.Pattern)
+			}
+		}
+
+	case "integer":
+		num, ok := value.(float64)
+		if !ok || num != float64(int64(num)) {
+			return fmt.Errorf("%s must be an integer", path)
+		}
+
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s must be a number", path)
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+	}
+
+	return nil
+}
+
+// maxValidatedBodySize is the largest JSON request body that SpecValidator
+// will read in order to check it.
+const maxValidatedBodySize = 10 << 20
+
+// SpecValidator is a middleware that rejects request bodies that don't match
+// the schemas in the OpenAPI document.
+type SpecValidator struct {
+	spec *openAPISpec
+}
+
+// NewSpecValidator returns a new *SpecValidator.
+func NewSpecValidator() (*SpecValidator, error) {
+	spec, err := parseOpenAPI()
+	if err != nil {
+		return nil, err
+	}
+	return &SpecValidator{spec: spec}, nil
+}
+
+// Middleware is a mux.MiddlewareFunc that validates JSON request bodies.
+func (v *SpecValidator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		var tpl string
+		if route := mux.CurrentRoute(r); route != nil {
+			tpl, _ = route.GetPathTemplate()
+		}
+
+		op, ok := v.spec.operation(tpl, r.Method)
+		if !ok {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		// Only JSON bodies are checked. Anything else, like the JSON Lines of
+		// an import, is streamed to the handler as it is.
+		body := v.spec.resolveBody(op.RequestBody)
+		if body == nil {
+			next.ServeHTTP(writer, r)
+			return
+		}
+		media, isJSON := body.Content["application/json"]
+		if !isJSON {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		bodyBuffer, err := ioutil.ReadAll(http.MaxBytesReader(writer, r.Body, maxValidatedBodySize))
+		if err != nil && len(bodyBuffer) >= maxValidatedBodySize {
+			tooLarge(writer, r, fmt.Sprintf("the request body is larger than %d bytes", maxValidatedBodySize))
+			return
+		}
+		if err != nil {
+			errored(writer, r, fmt.Sprintf("Error reading body: %s", err))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(bodyBuffer))
+
+		if len(bodyBuffer) == 0 {
+			if body.Required {
+				badRequest(writer, r, "a request body is required")
+				return
+			}
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		var parsed interface{}
+		if err = json.Unmarshal(bodyBuffer, &parsed); err != nil {
+			badRequest(writer, r, fmt.Sprintf("Error parsing request body: %s", err))
+			return
+		}
+
+		if err = v.spec.validate(media.Schema, parsed, "body"); err != nil {
+			badRequest(writer, r, fmt.Sprintf("request body does not match the API description: %s", err))
+			return
+		}
+
+		next.ServeHTTP(writer, r)
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -74,10 +75,10 @@ func (u *UserPreferencesApp) Greeting(writer http.ResponseWriter, r *http.Reques
 	fmt.Fprintf(writer, "Hello from user-preferences.\n")
 }
 
-func (u *UserPreferencesApp) getUserPreferencesForRequest(username string, wrap bool) ([]byte, error) {
+func (u *UserPreferencesApp) getUserPreferencesForRequest(ctx context.Context, username string, wrap bool) ([]byte, error) {
 	var retval UserPreferencesRecord
 
-	prefs, err := u.prefs.getPreferences(username)
+	prefs, err := u.prefs.getPreferences(ctx, username)
 	if err != nil {
 		return nil, fmt.Errorf("Error getting preferences for username %s: %s", username, err)
 	}
@@ -115,26 +116,27 @@ func (u *UserPreferencesApp) GetRequest(writer http.ResponseWriter, r *http.Requ
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		badRequest(writer, r, "Missing username in URL")
 		return
 	}
 
-	log.WithFields(log.Fields{
+	requestLog(r).WithFields(log.Fields{
 		"service": "preferences",
 	}).Info("Getting user preferences for ", username)
-	if userExists, err = u.prefs.isUser(username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+	if userExists, err = u.prefs.isUser(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		handleNonUser(writer, username)
+		handleNonUser(writer, r, username)
 		return
 	}
 
-	jsoned, err := u.getUserPreferencesForRequest(username, false)
+	jsoned, err := u.getUserPreferencesForRequest(r.Context(), username, false)
 	if err != nil {
-		errored(writer, err.Error())
+		errored(writer, r, err.Error())
+		return
 	}
 
 	writer.Write(jsoned) // nolint:errcheck
@@ -157,53 +159,53 @@ func (u *UserPreferencesApp) PostRequest(writer http.ResponseWriter, r *http.Req
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		badRequest(writer, r, "Missing username in URL")
 		return
 	}
 
-	if userExists, err = u.prefs.isUser(username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+	if userExists, err = u.prefs.isUser(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		handleNonUser(writer, username)
+		handleNonUser(writer, r, username)
 		return
 	}
 
-	if hasPrefs, err = u.prefs.hasPreferences(username); err != nil {
-		errored(writer, fmt.Sprintf("Error checking preferences for user %s: %s", username, err))
+	if hasPrefs, err = u.prefs.hasPreferences(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error checking preferences for user %s: %s", username, err))
 		return
 	}
 
 	var checked map[string]interface{}
 	bodyBuffer, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		errored(writer, fmt.Sprintf("Error reading body: %s", err))
+		errored(writer, r, fmt.Sprintf("Error reading body: %s", err))
 		return
 	}
 
 	if err = json.Unmarshal(bodyBuffer, &checked); err != nil {
-		errored(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		badRequest(writer, r, fmt.Sprintf("Error parsing request body: %s", err))
 		return
 	}
 
 	bodyString := string(bodyBuffer)
 	if !hasPrefs {
-		if err = u.prefs.insertPreferences(username, bodyString); err != nil {
-			errored(writer, fmt.Sprintf("Error inserting preferences for user %s: %s", username, err))
+		if err = u.prefs.insertPreferences(r.Context(), username, bodyString); err != nil {
+			errored(writer, r, fmt.Sprintf("Error inserting preferences for user %s: %s", username, err))
 			return
 		}
 	} else {
-		if err = u.prefs.updatePreferences(username, bodyString); err != nil {
-			errored(writer, fmt.Sprintf("Error updating preferences for user %s: %s", username, err))
+		if err = u.prefs.updatePreferences(r.Context(), username, bodyString); err != nil {
+			errored(writer, r, fmt.Sprintf("Error updating preferences for user %s: %s", username, err))
 			return
 		}
 	}
 
-	jsoned, err := u.getUserPreferencesForRequest(username, true)
+	jsoned, err := u.getUserPreferencesForRequest(r.Context(), username, true)
 	if err != nil {
-		errored(writer, err.Error())
+		errored(writer, r, err.Error())
 		return
 	}
 
@@ -222,22 +224,22 @@ func (u *UserPreferencesApp) DeleteRequest(writer http.ResponseWriter, r *http.R
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		badRequest(writer, r, "Missing username in URL")
 		return
 	}
 
-	if userExists, err = u.prefs.isUser(username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+	if userExists, err = u.prefs.isUser(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		handleNonUser(writer, username)
+		handleNonUser(writer, r, username)
 		return
 	}
 
-	if hasPrefs, err = u.prefs.hasPreferences(username); err != nil {
-		errored(writer, fmt.Sprintf("Error checking preferences for user %s: %s", username, err))
+	if hasPrefs, err = u.prefs.hasPreferences(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error checking preferences for user %s: %s", username, err))
 		return
 	}
 
@@ -245,7 +247,7 @@ func (u *UserPreferencesApp) DeleteRequest(writer http.ResponseWriter, r *http.R
 		return
 	}
 
-	if err = u.prefs.deletePreferences(username); err != nil {
-		errored(writer, fmt.Sprintf("Error deleting preferences for user %s: %s", username, err))
+	if err = u.prefs.deletePreferences(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error deleting preferences for user %s: %s", username, err))
 	}
 }
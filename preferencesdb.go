@@ -1,49 +1,54 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-
-	"github.com/cyverse-de/queries"
 )
 
 type pDB interface {
-	isUser(username string) (bool, error)
+	isUser(ctx context.Context, username string) (bool, error)
 
 	// DB defines the interface for interacting with the user-prefs database.
-	hasPreferences(username string) (bool, error)
-	getPreferences(username string) ([]UserPreferencesRecord, error)
-	insertPreferences(username, prefs string) error
-	updatePreferences(username, prefs string) error
-	deletePreferences(username string) error
+	hasPreferences(ctx context.Context, username string) (bool, error)
+	getPreferences(ctx context.Context, username string) ([]UserPreferencesRecord, error)
+	insertPreferences(ctx context.Context, username, prefs string) error
+	updatePreferences(ctx context.Context, username, prefs string) error
+	deletePreferences(ctx context.Context, username string) error
 }
 
 // PrefsDB implements the DB interface for interacting with the user-preferences
 // database.
 type PrefsDB struct {
-	db *sql.DB
+	db *tracedDB
 }
 
 // NewPrefsDB returns a newly created *PrefsDB.
 func NewPrefsDB(db *sql.DB) *PrefsDB {
 	return &PrefsDB{
-		db: db,
+		db: newTracedDB(db),
 	}
 }
 
 // isUser returns whether or not the user exists in the database preferences.
-func (p *PrefsDB) isUser(username string) (bool, error) {
-	return queries.IsUser(p.db, username)
+func (p *PrefsDB) isUser(ctx context.Context, username string) (bool, error) {
+	ctx, done := startOperation(ctx, "PrefsDB.isUser")
+	defer done()
+
+	return userExists(ctx, p.db, username)
 }
 
 // hasPreferences returns whether or not the given user has preferences already.
-func (p *PrefsDB) hasPreferences(username string) (bool, error) {
+func (p *PrefsDB) hasPreferences(ctx context.Context, username string) (bool, error) {
+	ctx, done := startOperation(ctx, "PrefsDB.hasPreferences")
+	defer done()
+
 	query := `SELECT COUNT(p.*)
               FROM user_preferences p,
                    users u
              WHERE p.user_id = u.id
                AND u.username = $1`
 	var count int64
-	if err := p.db.QueryRow(query, username).Scan(&count); err != nil {
+	if err := p.db.QueryRowContext(ctx, query, username).Scan(&count); err != nil {
 		return false, err
 	}
 	return count > 0, nil
@@ -51,7 +56,10 @@ func (p *PrefsDB) hasPreferences(username string) (bool, error) {
 
 // getPreferences returns a []UserPreferencesRecord of all of the preferences associated
 // with the provided username.
-func (p *PrefsDB) getPreferences(username string) ([]UserPreferencesRecord, error) {
+func (p *PrefsDB) getPreferences(ctx context.Context, username string) ([]UserPreferencesRecord, error) {
+	ctx, done := startOperation(ctx, "PrefsDB.getPreferences")
+	defer done()
+
 	query := `SELECT p.id AS id,
                    p.user_id AS user_id,
                    p.preferences AS preferences
@@ -60,7 +68,7 @@ func (p *PrefsDB) getPreferences(username string) ([]UserPreferencesRecord, erro
              WHERE p.user_id = u.id
                AND u.username = $1`
 
-	rows, err := p.db.Query(query, username)
+	rows, err := p.db.QueryContext(ctx, query, username)
 	if err != nil {
 		return nil, err
 	}
@@ -82,33 +90,56 @@ func (p *PrefsDB) getPreferences(username string) ([]UserPreferencesRecord, erro
 	return prefs, nil
 }
 
-func (p *PrefsDB) mutation(query, username string, args ...interface{}) error {
-	userID, err := queries.UserID(p.db, username)
-	if err != nil {
-		return err
-	}
-	allargs := append([]interface{}{userID}, args...)
-	_, err = p.db.Exec(query, allargs...)
-	return err
+// mutation runs the query with the user's ID as the first argument, in the
+// same transaction as adding the event to the outbox and the audit log. after
+// is the user's preferences once the query has run.
+func (p *PrefsDB) mutation(ctx context.Context, event *ChangeEvent, query, username, after string, args ...interface{}) error {
+	return withEvent(ctx, p.db, event, after, func(tx *tracedTx) (string, error) {
+		userID, err := lookupUserID(ctx, tx, username)
+		if err != nil {
+			return "", err
+		}
+		before, err := currentDocument(ctx, tx, "user_preferences", "preferences", userID)
+		if err != nil {
+			return "", err
+		}
+		allargs := append([]interface{}{userID}, args...)
+		_, err = tx.ExecContext(ctx, query, allargs...)
+		return before, err
+	})
 }
 
 // insertPreferences adds new preferences to the database for the user.
-func (p *PrefsDB) insertPreferences(username, prefs string) error {
+func (p *PrefsDB) insertPreferences(ctx context.Context, username, prefs string) error {
+	ctx, done := startOperation(ctx, "PrefsDB.insertPreferences")
+	defer done()
+	observeDocument("preferences", prefs)
+
 	query := `INSERT INTO user_preferences (user_id, preferences)
                  VALUES ($1, $2)`
-	return p.mutation(query, username, prefs)
+	event := newChangeEvent(ctx, username, "preferences", "create", exportJSON(prefs))
+	return p.mutation(ctx, event, query, username, prefs, prefs)
 }
 
 // updatePreferences updates the preferences in the database for the user.
-func (p *PrefsDB) updatePreferences(username, prefs string) error {
+func (p *PrefsDB) updatePreferences(ctx context.Context, username, prefs string) error {
+	ctx, done := startOperation(ctx, "PrefsDB.updatePreferences")
+	defer done()
+	observeDocument("preferences", prefs)
+
 	query := `UPDATE ONLY user_preferences
                     SET preferences = $2
                   WHERE user_id = $1`
-	return p.mutation(query, username, prefs)
+	event := newChangeEvent(ctx, username, "preferences", "update", exportJSON(prefs))
+	return p.mutation(ctx, event, query, username, prefs, prefs)
 }
 
 // deletePreferences deletes the user's preferences from the database.
-func (p *PrefsDB) deletePreferences(username string) error {
+func (p *PrefsDB) deletePreferences(ctx context.Context, username string) error {
+	ctx, done := startOperation(ctx, "PrefsDB.deletePreferences")
+	defer done()
+
 	query := `DELETE FROM ONLY user_preferences WHERE user_id = $1`
-	return p.mutation(query, username)
+	event := newChangeEvent(ctx, username, "preferences", "delete", nil)
+	return p.mutation(ctx, event, query, username, "")
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// The parts of a profile that can be requested with ?include=.
+var profileParts = []string{"preferences", "session", "saved_searches", "default_bag"}
+
+// ProfileApp serves a user's preferences, session, saved searches and default
+// bag in a single response.
+type ProfileApp struct {
+	profiles profileDB
+	router   *mux.Router
+}
+
+// NewProfileApp returns a new *ProfileApp.
+func NewProfileApp(db profileDB, router *mux.Router) *ProfileApp {
+	profileApp := &ProfileApp{
+		profiles: db,
+		router:   router,
+	}
+	profileApp.router.HandleFunc("/users/{username}/profile", profileApp.GetProfile).Methods(http.MethodGet)
+	return profileApp
+}
+
+// parseInclude returns the set of parts named in the include query parameter,
+// which is a comma-separated list. Every part is included by default.
+func parseInclude(r *http.Request) (map[string]bool, error) {
+	include := make(map[string]bool)
+
+	values := r.URL.Query()["include"]
+	if len(values) == 0 {
+		for _, part := range profileParts {
+			include[part] = true
+		}
+		return include, nil
+	}
+
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			valid := false
+			for _, known := range profileParts {
+				if part == known {
+					valid = true
+					break
+				}
+			}
+			if !valid {
+				return nil, fmt.Errorf("unknown profile part %q; expected one of %s", part, strings.Join(profileParts, ", "))
+			}
+			include[part] = true
+		}
+	}
+	return include, nil
+}
+
+// buildProfile converts the stored documents into the response body, in the
+// same form that the individual endpoints return them.
+func buildProfile(username string, record *UserProfileRecord, include map[string]bool) (map[string]interface{}, error) {
+	profile := map[string]interface{}{"username": username}
+
+	if include["preferences"] {
+		prefs, err := convertPrefs(&UserPreferencesRecord{Preferences: record.Preferences}, false)
+		if err != nil {
+			return nil, fmt.Errorf("error converting preferences: %w", err)
+		}
+		if prefs == nil {
+			prefs = map[string]interface{}{}
+		}
+		profile["preferences"] = prefs
+	}
+
+	if include["session"] {
+		session, err := convertSessions(&UserSessionRecord{Session: record.Session}, false)
+		if err != nil {
+			return nil, fmt.Errorf("error converting session: %w", err)
+		}
+		if session == nil {
+			session = map[string]interface{}{}
+		}
+		profile["session"] = session
+	}
+
+	if include["saved_searches"] {
+		// Saved searches aren't parsed when they're stored, so ones that
+		// aren't JSON come back as a string, just as they're exported.
+		searches := json.RawMessage("{}")
+		if record.SavedSearches != "" {
+			searches = exportJSON(record.SavedSearches)
+		}
+		profile["saved_searches"] = searches
+	}
+
+	if include["default_bag"] {
+		profile["default_bag"] = record.DefaultBag
+	}
+
+	return profile, nil
+}
+
+// profileETag returns a strong ETag covering the whole response body.
+func profileETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches returns true if the If-None-Match header matches the ETag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// GetProfile handles writing out a user's combined profile. A default bag is
+// not created if the user doesn't have one; default_bag is null instead.
+func (p *ProfileApp) GetProfile(writer http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	include, err := parseInclude(r)
+	if err != nil {
+		badRequest(writer, r, err.Error())
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"service": "profile",
+	}).Info("Getting the profile for ", username)
+
+	record, err := p.profiles.getProfile(r.Context(), username)
+	if err == sql.ErrNoRows {
+		handleNonUser(writer, r, username)
+		return
+	}
+	if err != nil {
+		errored(writer, r, fmt.Sprintf("error getting the profile for %s: %s", username, err))
+		return
+	}
+
+	profile, err := buildProfile(username, record, include)
+	if err != nil {
+		errored(writer, r, fmt.Sprintf("error building the profile for %s: %s", username, err))
+		return
+	}
+
+	jsoned, err := json.Marshal(profile)
+	if err != nil {
+		errored(writer, r, fmt.Sprintf("error JSON encoding the profile for %s: %s", username, err))
+		return
+	}
+
+	etag := profileETag(jsoned)
+	writer.Header().Set("ETag", etag)
+	writer.Header().Set("Cache-Control", "private, no-cache")
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if _, err = writer.Write(jsoned); err != nil {
+		requestLog(r).Error(err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+// UserProfileRecord holds everything the DE reads about a user when they log
+// in. The documents are empty and DefaultBag is nil when the user doesn't
+// have them.
+type UserProfileRecord struct {
+	Preferences   string
+	Session       string
+	SavedSearches string
+	DefaultBag    *BagRecord
+}
+
+// profileDB defines the interface for reading a user's combined profile.
+type profileDB interface {
+	// getProfile returns sql.ErrNoRows if the user doesn't exist.
+	getProfile(ctx context.Context, username string) (*UserProfileRecord, error)
+}
+
+// ProfilesDB implements the profileDB interface on top of the DE database.
+type ProfilesDB struct {
+	db *tracedDB
+}
+
+// NewProfilesDB returns a newly created *ProfilesDB.
+func NewProfilesDB(db *sql.DB) *ProfilesDB {
+	return &ProfilesDB{
+		db: newTracedDB(db),
+	}
+}
+
+// getProfile reads every part of the profile with a single statement, so the
+// parts are consistent with each other and only one round trip is made.
+func (p *ProfilesDB) getProfile(ctx context.Context, username string) (*UserProfileRecord, error) {
+	ctx, done := startOperation(ctx, "ProfilesDB.getProfile")
+	defer done()
+
+	query := `SELECT COALESCE((SELECT p.preferences FROM user_preferences p WHERE p.user_id = u.id LIMIT 1), ''),
+                     COALESCE((SELECT s.session FROM user_sessions s WHERE s.user_id = u.id LIMIT 1), ''),
+                     COALESCE((SELECT ss.saved_searches FROM user_saved_searches ss WHERE ss.user_id = u.id LIMIT 1), ''),
+                     u.id,
+                     b.id,
+                     b.contents
+                FROM users u
+           LEFT JOIN default_bags d ON d.user_id = u.id
+           LEFT JOIN bags b ON b.id = d.bag_id
+               WHERE u.username = $1`
+
+	var (
+		record      UserProfileRecord
+		userID      string
+		bagID       sql.NullString
+		bagContents []byte
+	)
+	err := p.db.QueryRowContext(ctx, query, username).Scan(
+		&record.Preferences,
+		&record.Session,
+		&record.SavedSearches,
+		&userID,
+		&bagID,
+		&bagContents,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if bagID.Valid {
+		record.DefaultBag = &BagRecord{ID: bagID.String, UserID: userID}
+		if err = json.Unmarshal(bagContents, &record.DefaultBag.Contents); err != nil {
+			return nil, err
+		}
+	}
+
+	return &record, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// PurgeApp deletes all of a user's data when their account is deprovisioned.
+type PurgeApp struct {
+	purges purgeDB
+	router *mux.Router
+}
+
+// NewPurgeApp returns a new *PurgeApp.
+func NewPurgeApp(db purgeDB, router *mux.Router) *PurgeApp {
+	purgeApp := &PurgeApp{
+		purges: db,
+		router: router,
+	}
+	purgeApp.router.HandleFunc("/users/{username}/data", purgeApp.DeleteData).Methods(http.MethodDelete)
+	return purgeApp
+}
+
+// DeleteData deletes the user's preferences, sessions, saved searches and
+// bags, and reports how many of each were deleted. With ?dry_run=true nothing
+// is deleted and the report says what would have been.
+func (p *PurgeApp) DeleteData(writer http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	dryRun := false
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			badRequest(writer, r, fmt.Sprintf("invalid dry_run value %q", value))
+			return
+		}
+	}
+
+	report, err := p.purges.purgeUser(r.Context(), username, dryRun, newAuditEntry(r, username, "users", "purge"))
+	if err == sql.ErrNoRows {
+		handleNonUser(writer, r, username)
+		return
+	}
+	if err != nil {
+		errored(writer, r, fmt.Sprintf("error purging the data for %s: %s", username, err))
+		return
+	}
+
+	if !dryRun {
+		requestLog(r).WithFields(log.Fields{
+			"service": "purge",
+			"actor":   requestActor(r),
+		}).Infof("purged the data for %s", username)
+	}
+
+	writeJSON(writer, r, report)
+}
+
+// runPurgeUser implements the purge-user subcommand: "purge-user [--dry-run]
+// [--json] <username>". The report is written to standard output.
+func runPurgeUser(ctx context.Context, purges purgeDB, args []string, stdout io.Writer) error {
+	flags := newCommandFlags("purge-user", "user-info purge-user [--dry-run] [--json] <username>")
+	dryRun := flags.Bool("dry-run", false, "Report what would be deleted without deleting it")
+	if err := flags.parse(args, 1, 1); err != nil {
+		return err
+	}
+	username := flags.Arg(0)
+
+	entry := &AuditEntry{
+		OccurredAt: time.Now().UTC(),
+		Actor:      "command-line",
+		TargetUser: username,
+		Resource:   "users",
+		Operation:  "purge",
+	}
+	report, err := purges.purgeUser(ctx, username, *dryRun, entry)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	if err != nil {
+		return fmt.Errorf("error purging the data for %s: %w", username, err)
+	}
+
+	if *flags.json {
+		return writeCommandJSON(stdout, report)
+	}
+
+	if report.DryRun {
+		fmt.Fprintf(stdout, "would delete the data for %s:\n", username)
+	} else {
+		fmt.Fprintf(stdout, "deleted the data for %s:\n", username)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "  preferences\t%d\n", report.Preferences)
+	fmt.Fprintf(w, "  sessions\t%d\n", report.Sessions)
+	fmt.Fprintf(w, "  saved searches\t%d\n", report.SavedSearches)
+	fmt.Fprintf(w, "  bags\t%d\n", report.Bags)
+	fmt.Fprintf(w, "  default bags\t%d\n", report.DefaultBags)
+	return w.Flush()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+// PurgeReport lists how many rows of each kind were (or, for a dry run, would
+// be) deleted for a user.
+type PurgeReport struct {
+	Username      string `json:"username"`
+	DryRun        bool   `json:"dry_run"`
+	Preferences   int64  `json:"preferences"`
+	Sessions      int64  `json:"sessions"`
+	SavedSearches int64  `json:"saved_searches"`
+	Bags          int64  `json:"bags"`
+	DefaultBags   int64  `json:"default_bags"`
+}
+
+// purgeDB defines the interface for deleting all of a user's data at once.
+type purgeDB interface {
+	// purgeUser deletes everything stored for the user and records the audit
+	// entry, all or nothing. Nothing is deleted or recorded for a dry run.
+	// It returns sql.ErrNoRows if the user doesn't exist.
+	purgeUser(ctx context.Context, username string, dryRun bool, entry *AuditEntry) (*PurgeReport, error)
+}
+
+// PurgeDB implements the purgeDB interface on top of the DE database.
+type PurgeDB struct {
+	db *tracedDB
+}
+
+// NewPurgeDB returns a newly created *PurgeDB.
+func NewPurgeDB(db *sql.DB) *PurgeDB {
+	return &PurgeDB{
+		db: newTracedDB(db),
+	}
+}
+
+// purgeTables lists the tables to purge, in an order that satisfies the
+// foreign keys, along with where each one's count goes in the report. The
+// users row itself is kept since other DE services refer to it.
+var purgeTables = []struct {
+	table string
+	count func(*PurgeReport) *int64
+}{
+	{"default_bags", func(r *PurgeReport) *int64 { return &r.DefaultBags }},
+	{"bags", func(r *PurgeReport) *int64 { return &r.Bags }},
+	{"user_preferences", func(r *PurgeReport) *int64 { return &r.Preferences }},
+	{"user_sessions", func(r *PurgeReport) *int64 { return &r.Sessions }},
+	{"user_saved_searches", func(r *PurgeReport) *int64 { return &r.SavedSearches }},
+}
+
+// purgeUser deletes the user's rows from every table in one transaction.
+func (p *PurgeDB) purgeUser(ctx context.Context, username string, dryRun bool, entry *AuditEntry) (*PurgeReport, error) {
+	ctx, done := startOperation(ctx, "PurgeDB.purgeUser")
+	defer done()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	// Locking the user's row keeps a concurrent write from adding data for
+	// the user while it's being purged.
+	var userID string
+	if err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE username = $1 FOR UPDATE`, username).Scan(&userID); err != nil {
+		return nil, err
+	}
+
+	report := &PurgeReport{Username: username, DryRun: dryRun}
+	for _, t := range purgeTables {
+		count := t.count(report)
+		if dryRun {
+			err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+t.table+` WHERE user_id = $1`, userID).Scan(count)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		result, err := tx.ExecContext(ctx, `DELETE FROM `+t.table+` WHERE user_id = $1`, userID)
+		if err != nil {
+			return nil, err
+		}
+		if *count, err = result.RowsAffected(); err != nil {
+			return nil, err
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	if entry.Detail, err = json.Marshal(report); err != nil {
+		return nil, err
+	}
+	if err = insertAuditEntry(ctx, tx, entry); err != nil {
+		return nil, err
+	}
+	if err = insertEvent(ctx, tx, newChangeEvent(ctx, username, "users", "purge", report)); err != nil {
+		return nil, err
+	}
+	for _, kind := range documentCaches {
+		if err = notifyInvalidation(ctx, tx, kind, username); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, tx.Commit()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// rateLimitGroups are the route groups that can be rate limited. Each group
+// is configured under user_info.rate_limit.<group>.
+var rateLimitGroups = []string{"preferences", "sessions", "searches", "bags"}
+
+// rateLimit describes a token bucket: Rate tokens are added per second, up to
+// a maximum of Burst. A Rate of zero disables the limit.
+type rateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// bucketSet holds the token buckets for a single limit, keyed by user or
+// client name. The number of buckets is bounded; when it's full the bucket
+// that was used least recently is dropped.
+type bucketSet struct {
+	mu      sync.Mutex
+	limit   rateLimit
+	maxKeys int
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+func newBucketSet(limit rateLimit, maxKeys int) *bucketSet {
+	return &bucketSet{
+		limit:   limit,
+		maxKeys: maxKeys,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// refill returns the key's bucket with the tokens it has gained since it was
+// last used. A key without a bucket gets a full one. s.mu must be held.
+func (s *bucketSet) refill(key string, now time.Time) *bucket {
+	if elem, ok := s.buckets[key]; ok {
+		s.lru.MoveToFront(elem)
+		b := elem.Value.(*bucket)
+		b.tokens = math.Min(s.limit.Burst, b.tokens+now.Sub(b.last).Seconds()*s.limit.Rate)
+		b.last = now
+		return b
+	}
+
+	if s.lru.Len() >= s.maxKeys {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.buckets, oldest.Value.(*bucket).key)
+	}
+	b := &bucket{key: key, tokens: s.limit.Burst, last: now}
+	s.buckets[key] = s.lru.PushFront(b)
+	return b
+}
+
+// take removes a token from the key's bucket. If the bucket is empty it
+// returns false along with how long the caller should wait before retrying.
+func (s *bucketSet) take(key string, now time.Time) (bool, time.Duration) {
+	refused, wait := takeTokens(now, []bucketKey{{s, key}})
+	return refused < 0, wait
+}
+
+// bucketKey names a bucket in a set.
+type bucketKey struct {
+	set *bucketSet
+	key string
+}
+
+// takeTokens removes a token from every one of the buckets, but only if they
+// all have one, so that a request one limit refuses doesn't count against the
+// others. Otherwise it returns the index of the first empty bucket and how
+// long the caller should wait for it; it returns -1 when the tokens were
+// taken. The sets have to be distinct and always given in the same order.
+func takeTokens(now time.Time, keys []bucketKey) (int, time.Duration) {
+	buckets := make([]*bucket, len(keys))
+	for i, k := range keys {
+		if k.set.limit.Rate <= 0 {
+			continue
+		}
+		k.set.mu.Lock()
+		defer k.set.mu.Unlock()
+		buckets[i] = k.set.refill(k.key, now)
+	}
+
+	for i, b := range buckets {
+		if b != nil && b.tokens < 1 {
+			return i, time.Duration((1 - b.tokens) / keys[i].set.limit.Rate * float64(time.Second))
+		}
+	}
+	for _, b := range buckets {
+		if b != nil {
+			b.tokens--
+		}
+	}
+	return -1, 0
+}
+
+// RateLimiter is a middleware that applies token bucket limits per user and
+// per calling client to each route group.
+//
+// Buckets are kept in memory, so each replica enforces its limits on its own:
+// with N replicas behind a load balancer a caller can make up to N times the
+// configured rate. The number of buckets kept per limit is bounded by
+// user_info.rate_limit.max_keys. Evicting an idle bucket refills it, which
+// only ever errs in the caller's favor.
+//
+// Callers without a client identity are limited by address. Behind a proxy
+// or ingress every such caller has the proxy's address and they all share one
+// bucket, unless user_info.rate_limit.client_ip_header names the header the
+// proxy puts the caller's address in.
+type RateLimiter struct {
+	users    map[string]*bucketSet
+	clients  map[string]*bucketSet
+	ipHeader string
+	now      func() time.Time
+}
+
+// NewRateLimiter returns a new *RateLimiter configured from the
+// user_info.rate_limit section of the configuration. It returns an error if a
+// limit could never let a request through.
+func NewRateLimiter(cfg *viper.Viper) (*RateLimiter, error) {
+	cfg.SetDefault("user_info.rate_limit.max_keys", 10000)
+	maxKeys := cfg.GetInt("user_info.rate_limit.max_keys")
+	if maxKeys < 1 {
+		return nil, fmt.Errorf("user_info.rate_limit.max_keys must be at least 1, not %d", maxKeys)
+	}
+
+	rl := &RateLimiter{
+		users:    make(map[string]*bucketSet),
+		clients:  make(map[string]*bucketSet),
+		ipHeader: cfg.GetString("user_info.rate_limit.client_ip_header"),
+		now:      time.Now,
+	}
+
+	for _, group := range rateLimitGroups {
+		prefix := fmt.Sprintf("user_info.rate_limit.%s.", group)
+		cfg.SetDefault(prefix+"user_rate", 5)
+		cfg.SetDefault(prefix+"user_burst", 20)
+		cfg.SetDefault(prefix+"client_rate", 200)
+		cfg.SetDefault(prefix+"client_burst", 400)
+
+		for _, caller := range []string{"user", "client"} {
+			limit := rateLimit{
+				Rate:  cfg.GetFloat64(prefix + caller + "_rate"),
+				Burst: cfg.GetFloat64(prefix + caller + "_burst"),
+			}
+			if limit.Rate < 0 {
+				return nil, fmt.Errorf("%s%s_rate must not be negative", prefix, caller)
+			}
+			if limit.Rate > 0 && limit.Burst < 1 {
+				return nil, fmt.Errorf("%s%s_burst must be at least 1", prefix, caller)
+			}
+
+			if caller == "user" {
+				rl.users[group] = newBucketSet(limit, maxKeys)
+			} else {
+				rl.clients[group] = newBucketSet(limit, maxKeys)
+			}
+		}
+	}
+
+	return rl, nil
+}
+
+// clientKey identifies the caller for the per-client limits. Unauthenticated
+// callers are identified by their address, taken from the configured header
+// if the request has it. The header is only trusted as far as the proxy that
+// sets it: the last address in it is the one that proxy added, and anything
+// before that could have come from the caller.
+func (rl *RateLimiter) clientKey(r *http.Request) string {
+	if id, ok := IdentityFromContext(r.Context()); ok && id.Client != "" {
+		return id.Client
+	}
+	if rl.ipHeader != "" {
+		values := r.Header[http.CanonicalHeaderKey(rl.ipHeader)]
+		if len(values) > 0 {
+			addrs := strings.Split(values[len(values)-1], ",")
+			if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+				return addr
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Middleware is a mux.MiddlewareFunc that responds with 429 Too Many Requests
+// when the caller has used up either its user or its client bucket.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		var tpl string
+		if route := mux.CurrentRoute(r); route != nil {
+			tpl, _ = route.GetPathTemplate()
+		}
+		group := routeResource(tpl)
+
+		users, ok := rl.users[group]
+		if !ok {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		// The user's bucket comes before the client's, which is the order
+		// takeTokens needs every caller to lock them in.
+		var limits []bucketKey
+		username, hasUser := mux.Vars(r)["username"]
+		if hasUser {
+			limits = append(limits, bucketKey{users, strings.ToLower(username)})
+		}
+		client := rl.clientKey(r)
+		limits = append(limits, bucketKey{rl.clients[group], client})
+
+		if refused, wait := takeTokens(rl.now(), limits); refused >= 0 {
+			if limits[refused].set == users {
+				tooManyRequests(writer, r, wait, fmt.Sprintf("rate limit exceeded for %s requests for user %s", group, username))
+			} else {
+				tooManyRequests(writer, r, wait, fmt.Sprintf("rate limit exceeded for %s requests from %s", group, client))
+			}
+			return
+		}
+
+		next.ServeHTTP(writer, r)
+	})
+}
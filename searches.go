@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -48,22 +49,22 @@ func (s *SavedSearchesApp) GetRequest(writer http.ResponseWriter, r *http.Reques
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		badRequest(writer, r, "Missing username in URL")
 		return
 	}
 
-	if userExists, err = s.searches.isUser(username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+	if userExists, err = s.searches.isUser(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		handleNonUser(writer, username)
+		handleNonUser(writer, r, username)
 		return
 	}
 
-	if searches, err = s.searches.getSavedSearches(username); err != nil {
-		errored(writer, err.Error())
+	if searches, err = s.searches.getSavedSearches(r.Context(), username); err != nil {
+		errored(writer, r, err.Error())
 		return
 	}
 
@@ -92,48 +93,48 @@ func (s *SavedSearchesApp) PostRequest(writer http.ResponseWriter, r *http.Reque
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		badRequest(writer, r, "Missing username in URL")
 		return
 	}
 
 	bodyBuffer, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		errored(writer, fmt.Sprintf("Error reading body: %s", err))
+		errored(writer, r, fmt.Sprintf("Error reading body: %s", err))
 		return
 	}
 
 	// Make sure valid JSON was uploaded in the body.
 	var parsedBody interface{}
 	if err = json.Unmarshal(bodyBuffer, &parsedBody); err != nil {
-		badRequest(writer, fmt.Sprintf("Error parsing body: %s", err.Error()))
+		badRequest(writer, r, fmt.Sprintf("Error parsing body: %s", err.Error()))
 		return
 	}
 
 	bodyString := string(bodyBuffer)
 
-	if userExists, err = s.searches.isUser(username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+	if userExists, err = s.searches.isUser(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		handleNonUser(writer, username)
+		handleNonUser(writer, r, username)
 		return
 	}
 
-	if hasSearches, err = s.searches.hasSavedSearches(username); err != nil {
-		errored(writer, err.Error())
+	if hasSearches, err = s.searches.hasSavedSearches(r.Context(), username); err != nil {
+		errored(writer, r, err.Error())
 		return
 	}
 
-	var upsert func(string, string) error
+	var upsert func(context.Context, string, string) error
 	if hasSearches {
 		upsert = s.searches.updateSavedSearches
 	} else {
 		upsert = s.searches.insertSavedSearches
 	}
-	if err = upsert(username, bodyString); err != nil {
-		errored(writer, err.Error())
+	if err = upsert(r.Context(), username, bodyString); err != nil {
+		errored(writer, r, err.Error())
 		return
 	}
 
@@ -142,7 +143,7 @@ func (s *SavedSearchesApp) PostRequest(writer http.ResponseWriter, r *http.Reque
 	}
 	jsoned, err := json.Marshal(retval)
 	if err != nil {
-		errored(writer, err.Error())
+		errored(writer, r, err.Error())
 		return
 	}
 
@@ -160,20 +161,21 @@ func (s *SavedSearchesApp) DeleteRequest(writer http.ResponseWriter, r *http.Req
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		badRequest(writer, r, "Missing username in URL")
 		return
 	}
 
-	if userExists, err = s.searches.isUser(username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+	if userExists, err = s.searches.isUser(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
+		handleNonUser(writer, r, username)
 		return
 	}
 
-	if err = s.searches.deleteSavedSearches(username); err != nil {
-		errored(writer, err.Error())
+	if err = s.searches.deleteSavedSearches(r.Context(), username); err != nil {
+		errored(writer, r, err.Error())
 	}
 }
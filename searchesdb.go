@@ -1,42 +1,47 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-
-	"github.com/cyverse-de/queries"
 )
 
 // seDB defines the interface for interacting with storage. Mostly included
 // to make unit tests easier to write.
 type seDB interface {
-	isUser(string) (bool, error)
-	hasSavedSearches(string) (bool, error)
-	getSavedSearches(string) ([]string, error)
-	insertSavedSearches(string, string) error
-	updateSavedSearches(string, string) error
-	deleteSavedSearches(string) error
+	isUser(context.Context, string) (bool, error)
+	hasSavedSearches(context.Context, string) (bool, error)
+	getSavedSearches(context.Context, string) ([]string, error)
+	insertSavedSearches(context.Context, string, string) error
+	updateSavedSearches(context.Context, string, string) error
+	deleteSavedSearches(context.Context, string) error
 }
 
 // SearchesDB implements the DB interface for interacting with the saved-searches
 // database.
 type SearchesDB struct {
-	db *sql.DB
+	db *tracedDB
 }
 
 // NewSearchesDB returns a new *SearchesDB.
 func NewSearchesDB(db *sql.DB) *SearchesDB {
 	return &SearchesDB{
-		db: db,
+		db: newTracedDB(db),
 	}
 }
 
 // isUser returns whether or not the user exists in the saved searches database.
-func (se *SearchesDB) isUser(username string) (bool, error) {
-	return queries.IsUser(se.db, username)
+func (se *SearchesDB) isUser(ctx context.Context, username string) (bool, error) {
+	ctx, done := startOperation(ctx, "SearchesDB.isUser")
+	defer done()
+
+	return userExists(ctx, se.db, username)
 }
 
 // hasSavedSearches returns whether or not the given user has saved searches already.
-func (se *SearchesDB) hasSavedSearches(username string) (bool, error) {
+func (se *SearchesDB) hasSavedSearches(ctx context.Context, username string) (bool, error) {
+	ctx, done := startOperation(ctx, "SearchesDB.hasSavedSearches")
+	defer done()
+
 	var (
 		err    error
 		exists bool
@@ -49,7 +54,7 @@ func (se *SearchesDB) hasSavedSearches(username string) (bool, error) {
                WHERE s.user_id = u.id
                  AND u.username = $1) AS exists`
 
-	if err = se.db.QueryRow(query, username).Scan(&exists); err != nil {
+	if err = se.db.QueryRowContext(ctx, query, username).Scan(&exists); err != nil {
 		return false, err
 	}
 
@@ -58,7 +63,10 @@ func (se *SearchesDB) hasSavedSearches(username string) (bool, error) {
 
 // getSavedSearches returns all of the saved searches associated with the
 // provided username.
-func (se *SearchesDB) getSavedSearches(username string) ([]string, error) {
+func (se *SearchesDB) getSavedSearches(ctx context.Context, username string) ([]string, error) {
+	ctx, done := startOperation(ctx, "SearchesDB.getSavedSearches")
+	defer done()
+
 	var (
 		err    error
 		retval []string
@@ -71,7 +79,7 @@ func (se *SearchesDB) getSavedSearches(username string) ([]string, error) {
              WHERE s.user_id = u.id
                AND u.username = $1`
 
-	if rows, err = se.db.Query(query, username); err != nil {
+	if rows, err = se.db.QueryContext(ctx, query, username); err != nil {
 		return nil, err
 	}
 	defer rows.Close()
@@ -92,52 +100,87 @@ func (se *SearchesDB) getSavedSearches(username string) ([]string, error) {
 }
 
 // insertSavedSearches adds new saved searches to the database for the user.
-func (se *SearchesDB) insertSavedSearches(username, searches string) error {
-	var (
-		err    error
-		userID string
-	)
+func (se *SearchesDB) insertSavedSearches(ctx context.Context, username, searches string) error {
+	ctx, done := startOperation(ctx, "SearchesDB.insertSavedSearches")
+	defer done()
+	observeDocument("searches", searches)
 
 	query := `INSERT INTO user_saved_searches (user_id, saved_searches) VALUES ($1, $2)`
 
-	if userID, err = queries.UserID(se.db, username); err != nil {
-		return err
-	}
+	event := newChangeEvent(ctx, username, "searches", "create", exportJSON(searches))
+	return withEvent(ctx, se.db, event, searches, func(tx *tracedTx) (string, error) {
+		var (
+			err    error
+			userID string
+			before string
+		)
 
-	_, err = se.db.Exec(query, userID, searches)
-	return err
+		if userID, err = lookupUserID(ctx, tx, username); err != nil {
+			return "", err
+		}
+		if before, err = currentDocument(ctx, tx, "user_saved_searches", "saved_searches", userID); err != nil {
+			return "", err
+		}
+
+		_, err = tx.ExecContext(ctx, query, userID, searches)
+		return before, err
+	})
 }
 
 // updateSavedSearches updates the saved searches in the database for the user.
-func (se *SearchesDB) updateSavedSearches(username, searches string) error {
-	var (
-		err    error
-		userID string
-	)
+func (se *SearchesDB) updateSavedSearches(ctx context.Context, username, searches string) error {
+	ctx, done := startOperation(ctx, "SearchesDB.updateSavedSearches")
+	defer done()
+	observeDocument("searches", searches)
 
 	query := `UPDATE ONLY user_saved_searches SET saved_searches = $2 WHERE user_id = $1`
 
-	if userID, err = queries.UserID(se.db, username); err != nil {
-		return err
-	}
+	event := newChangeEvent(ctx, username, "searches", "update", exportJSON(searches))
+	return withEvent(ctx, se.db, event, searches, func(tx *tracedTx) (string, error) {
+		var (
+			err    error
+			userID string
+			before string
+		)
 
-	_, err = se.db.Exec(query, userID, searches)
-	return err
+		if userID, err = lookupUserID(ctx, tx, username); err != nil {
+			return "", err
+		}
+		if before, err = currentDocument(ctx, tx, "user_saved_searches", "saved_searches", userID); err != nil {
+			return "", err
+		}
+
+		_, err = tx.ExecContext(ctx, query, userID, searches)
+		return before, err
+	})
 }
 
 // deleteSavedSearches removes the user's saved sessions from the database.
-func (se *SearchesDB) deleteSavedSearches(username string) error {
-	var (
-		err    error
-		userID string
-	)
+func (se *SearchesDB) deleteSavedSearches(ctx context.Context, username string) error {
+	ctx, done := startOperation(ctx, "SearchesDB.deleteSavedSearches")
+	defer done()
 
 	query := `DELETE FROM ONLY user_saved_searches WHERE user_id = $1`
 
-	if userID, err = queries.UserID(se.db, username); err != nil {
+	// Deleting the saved searches of a user who can't be looked up has always
+	// succeeded without doing anything.
+	var lookupErr error
+	event := newChangeEvent(ctx, username, "searches", "delete", nil)
+	err := withEvent(ctx, se.db, event, "", func(tx *tracedTx) (string, error) {
+		var userID string
+		if userID, lookupErr = lookupUserID(ctx, tx, username); lookupErr != nil {
+			return "", lookupErr
+		}
+		before, err := currentDocument(ctx, tx, "user_saved_searches", "saved_searches", userID)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = tx.ExecContext(ctx, query, userID)
+		return before, err
+	})
+	if lookupErr != nil {
 		return nil
 	}
-
-	_, err = se.db.Exec(query, userID)
 	return err
 }
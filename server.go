@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+type shutdownHook struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// Server serves HTTP requests until it's told to stop, then drains in-flight
+// requests and shuts down background workers before returning.
+type Server struct {
+	http            *http.Server
+	health          *HealthApp
+	drainDelay      time.Duration
+	shutdownTimeout time.Duration
+	hooks           []shutdownHook
+}
+
+// NewServer returns a new *Server configured from the user_info.server
+// section of the configuration. health may be nil.
+func NewServer(cfg *viper.Viper, handler http.Handler, health *HealthApp) *Server {
+	cfg.SetDefault("user_info.server.read_header_timeout", "10s")
+	cfg.SetDefault("user_info.server.read_timeout", "30s")
+	cfg.SetDefault("user_info.server.write_timeout", "60s")
+	cfg.SetDefault("user_info.server.idle_timeout", "120s")
+	cfg.SetDefault("user_info.server.drain_delay", "5s")
+	cfg.SetDefault("user_info.server.shutdown_timeout", "30s")
+
+	return &Server{
+		http: &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: cfg.GetDuration("user_info.server.read_header_timeout"),
+			ReadTimeout:       cfg.GetDuration("user_info.server.read_timeout"),
+			WriteTimeout:      cfg.GetDuration("user_info.server.write_timeout"),
+			IdleTimeout:       cfg.GetDuration("user_info.server.idle_timeout"),
+		},
+		health:          health,
+		drainDelay:      cfg.GetDuration("user_info.server.drain_delay"),
+		shutdownTimeout: cfg.GetDuration("user_info.server.shutdown_timeout"),
+	}
+}
+
+// OnShutdown registers fn to be called once the server has stopped handling
+// requests. Hooks run in the order they were registered and share the
+// shutdown deadline.
+func (s *Server) OnShutdown(name string, fn func(context.Context) error) {
+	s.hooks = append(s.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// OnStop registers fn to be called as soon as the server starts shutting
+// down, before waiting for in-flight requests. It's for ending long-lived
+// requests that would otherwise hold up the shutdown.
+func (s *Server) OnStop(fn func()) {
+	s.http.RegisterOnShutdown(fn)
+}
+
+// Run serves requests on listener until a signal arrives on stop, then shuts
+// down gracefully:
+//
+//  1. readiness starts failing so that no new traffic is routed here,
+//  2. after the drain delay the listener is closed and in-flight requests
+//     are given until the shutdown deadline to finish,
+//  3. the shutdown hooks are run, flushing background workers and closing
+//     the database.
+//
+// Run returns an error if the server fails to serve or doesn't shut down
+// cleanly before the deadline.
+func (s *Server) Run(listener net.Listener, stop <-chan os.Signal) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.http.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-stop:
+		log.Infof("received %s, shutting down", sig)
+	}
+
+	if s.health != nil {
+		s.health.SetDraining(true)
+	}
+	if s.drainDelay > 0 {
+		log.Infof("waiting %s for load balancers to stop sending traffic", s.drainDelay)
+		time.Sleep(s.drainDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	var shutdownErr error
+	if err := s.http.Shutdown(ctx); err != nil {
+		log.Errorf("error waiting for in-flight requests: %s", err)
+		shutdownErr = err
+	}
+
+	for _, hook := range s.hooks {
+		if err := hook.fn(ctx); err != nil {
+			log.Errorf("error shutting down %s: %s", hook.name, err)
+			if shutdownErr == nil {
+				shutdownErr = err
+			}
+		}
+	}
+
+	log.Info("shutdown complete")
+	return shutdownErr
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -36,8 +37,8 @@ func (u *UserSessionsApp) Greeting(writer http.ResponseWriter, r *http.Request)
 	fmt.Fprintf(writer, "Hello from user-sessions.\n")
 }
 
-func (u *UserSessionsApp) getUserSessionForRequest(username string, wrap bool) ([]byte, error) {
-	sessions, err := u.sessions.getSessions(username)
+func (u *UserSessionsApp) getUserSessionForRequest(ctx context.Context, username string, wrap bool) ([]byte, error) {
+	sessions, err := u.sessions.getSessions(ctx, username)
 	if err != nil {
 		return nil, fmt.Errorf("Error getting sessions for username %s: %s", username, err)
 	}
@@ -76,26 +77,27 @@ func (u *UserSessionsApp) GetRequest(writer http.ResponseWriter, r *http.Request
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		badRequest(writer, r, "Missing username in URL")
 		return
 	}
 
-	log.WithFields(log.Fields{
+	requestLog(r).WithFields(log.Fields{
 		"service": "sessions",
 	}).Info("Getting user session for ", username)
-	if userExists, err = u.sessions.isUser(username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+	if userExists, err = u.sessions.isUser(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		badRequest(writer, fmt.Sprintf("User %s does not exist", username))
+		handleNonUser(writer, r, username)
 		return
 	}
 
-	jsoned, err := u.getUserSessionForRequest(username, false)
+	jsoned, err := u.getUserSessionForRequest(r.Context(), username, false)
 	if err != nil {
-		errored(writer, err.Error())
+		errored(writer, r, err.Error())
+		return
 	}
 
 	writer.Write(jsoned) // nolint:errcheck
@@ -118,53 +120,53 @@ func (u *UserSessionsApp) PostRequest(writer http.ResponseWriter, r *http.Reques
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		badRequest(writer, r, "Missing username in URL")
 		return
 	}
 
-	if userExists, err = u.sessions.isUser(username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+	if userExists, err = u.sessions.isUser(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		badRequest(writer, fmt.Sprintf("User %s does not exist", username))
+		handleNonUser(writer, r, username)
 		return
 	}
 
-	if hasSession, err = u.sessions.hasSessions(username); err != nil {
-		errored(writer, fmt.Sprintf("Error checking session for user %s: %s", username, err))
+	if hasSession, err = u.sessions.hasSessions(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error checking session for user %s: %s", username, err))
 		return
 	}
 
 	var checked map[string]interface{}
 	bodyBuffer, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		errored(writer, fmt.Sprintf("Error reading body: %s", err))
+		errored(writer, r, fmt.Sprintf("Error reading body: %s", err))
 		return
 	}
 
 	if err = json.Unmarshal(bodyBuffer, &checked); err != nil {
-		errored(writer, fmt.Sprintf("Error parsing request body: %s", err))
+		badRequest(writer, r, fmt.Sprintf("Error parsing request body: %s", err))
 		return
 	}
 
 	bodyString := string(bodyBuffer)
 	if !hasSession {
-		if err = u.sessions.insertSession(username, bodyString); err != nil {
-			errored(writer, fmt.Sprintf("Error inserting session for user %s: %s", username, err))
+		if err = u.sessions.insertSession(r.Context(), username, bodyString); err != nil {
+			errored(writer, r, fmt.Sprintf("Error inserting session for user %s: %s", username, err))
 			return
 		}
 	} else {
-		if err = u.sessions.updateSession(username, bodyString); err != nil {
-			errored(writer, fmt.Sprintf("Error updating session for user %s: %s", username, err))
+		if err = u.sessions.updateSession(r.Context(), username, bodyString); err != nil {
+			errored(writer, r, fmt.Sprintf("Error updating session for user %s: %s", username, err))
 			return
 		}
 	}
 
-	jsoned, err := u.getUserSessionForRequest(username, true)
+	jsoned, err := u.getUserSessionForRequest(r.Context(), username, true)
 	if err != nil {
-		errored(writer, err.Error())
+		errored(writer, r, err.Error())
 		return
 	}
 
@@ -183,22 +185,22 @@ func (u *UserSessionsApp) DeleteRequest(writer http.ResponseWriter, r *http.Requ
 	)
 
 	if username, ok = v["username"]; !ok {
-		badRequest(writer, "Missing username in URL")
+		badRequest(writer, r, "Missing username in URL")
 		return
 	}
 
-	if userExists, err = u.sessions.isUser(username); err != nil {
-		badRequest(writer, fmt.Sprintf("Error checking for username %s: %s", username, err))
+	if userExists, err = u.sessions.isUser(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error checking for username %s: %s", username, err))
 		return
 	}
 
 	if !userExists {
-		badRequest(writer, fmt.Sprintf("User %s does not exist", username))
+		handleNonUser(writer, r, username)
 		return
 	}
 
-	if hasSession, err = u.sessions.hasSessions(username); err != nil {
-		errored(writer, fmt.Sprintf("Error checking session for user %s: %s", username, err))
+	if hasSession, err = u.sessions.hasSessions(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error checking session for user %s: %s", username, err))
 		return
 	}
 
@@ -206,7 +208,7 @@ func (u *UserSessionsApp) DeleteRequest(writer http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if err = u.sessions.deleteSession(username); err != nil {
-		errored(writer, fmt.Sprintf("Error deleting session for user %s: %s", username, err))
+	if err = u.sessions.deleteSession(r.Context(), username); err != nil {
+		errored(writer, r, fmt.Sprintf("Error deleting session for user %s: %s", username, err))
 	}
 }
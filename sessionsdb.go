@@ -1,10 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-
-	"github.com/cyverse-de/queries"
 )
 
 // UserSessionRecord represents a user session stored in the database
@@ -46,42 +45,48 @@ func convertSessions(record *UserSessionRecord, wrap bool) (map[string]interface
 }
 
 type sDB interface {
-	isUser(username string) (bool, error)
+	isUser(ctx context.Context, username string) (bool, error)
 
 	// DB defines the interface for interacting with the user-sessions database.
-	hasSessions(username string) (bool, error)
-	getSessions(username string) ([]UserSessionRecord, error)
-	insertSession(username, session string) error
-	updateSession(username, session string) error
-	deleteSession(username string) error
+	hasSessions(ctx context.Context, username string) (bool, error)
+	getSessions(ctx context.Context, username string) ([]UserSessionRecord, error)
+	insertSession(ctx context.Context, username, session string) error
+	updateSession(ctx context.Context, username, session string) error
+	deleteSession(ctx context.Context, username string) error
 }
 
 // SessionsDB handles interacting with the sessions database.
 type SessionsDB struct {
-	db *sql.DB
+	db *tracedDB
 }
 
 // NewSessionsDB returns a newly created *SessionsDB
 func NewSessionsDB(db *sql.DB) *SessionsDB {
 	return &SessionsDB{
-		db: db,
+		db: newTracedDB(db),
 	}
 }
 
 // isUser returnes whether or not the user is present in the sessions database.
-func (s *SessionsDB) isUser(username string) (bool, error) {
-	return queries.IsUser(s.db, username)
+func (s *SessionsDB) isUser(ctx context.Context, username string) (bool, error) {
+	ctx, done := startOperation(ctx, "SessionsDB.isUser")
+	defer done()
+
+	return userExists(ctx, s.db, username)
 }
 
 // hasSessions returns whether or not the given user has a session already.
-func (s *SessionsDB) hasSessions(username string) (bool, error) {
+func (s *SessionsDB) hasSessions(ctx context.Context, username string) (bool, error) {
+	ctx, done := startOperation(ctx, "SessionsDB.hasSessions")
+	defer done()
+
 	query := `SELECT COUNT(s.*)
               FROM user_sessions s,
                    users u
              WHERE s.user_id = u.id
                AND u.username = $1`
 	var count int64
-	if err := s.db.QueryRow(query, username).Scan(&count); err != nil {
+	if err := s.db.QueryRowContext(ctx, query, username).Scan(&count); err != nil {
 		return false, err
 	}
 	return count > 0, nil
@@ -89,7 +94,10 @@ func (s *SessionsDB) hasSessions(username string) (bool, error) {
 
 // getSessions returns a []UserSessionRecord of all of the sessions associated
 // with the provided username.
-func (s *SessionsDB) getSessions(username string) ([]UserSessionRecord, error) {
+func (s *SessionsDB) getSessions(ctx context.Context, username string) ([]UserSessionRecord, error) {
+	ctx, done := startOperation(ctx, "SessionsDB.getSessions")
+	defer done()
+
 	query := `SELECT s.id AS id,
                    s.user_id AS user_id,
                    s.session AS session
@@ -98,7 +106,7 @@ func (s *SessionsDB) getSessions(username string) ([]UserSessionRecord, error) {
              WHERE s.user_id = u.id
                AND u.username = $1`
 
-	rows, err := s.db.Query(query, username)
+	rows, err := s.db.QueryContext(ctx, query, username)
 	if err != nil {
 		return nil, err
 	}
@@ -121,37 +129,69 @@ func (s *SessionsDB) getSessions(username string) ([]UserSessionRecord, error) {
 }
 
 // insertSession adds a new session to the database for the user.
-func (s *SessionsDB) insertSession(username, session string) error {
+func (s *SessionsDB) insertSession(ctx context.Context, username, session string) error {
+	ctx, done := startOperation(ctx, "SessionsDB.insertSession")
+	defer done()
+	observeDocument("sessions", session)
+
 	query := `INSERT INTO user_sessions (user_id, session)
                  VALUES ($1, $2)`
-	userID, err := queries.UserID(s.db, username)
-	if err != nil {
-		return err
-	}
-	_, err = s.db.Exec(query, userID, session)
-	return err
+	event := newChangeEvent(ctx, username, "sessions", "create", exportJSON(session))
+	return withEvent(ctx, s.db, event, session, func(tx *tracedTx) (string, error) {
+		userID, err := lookupUserID(ctx, tx, username)
+		if err != nil {
+			return "", err
+		}
+		before, err := currentDocument(ctx, tx, "user_sessions", "session", userID)
+		if err != nil {
+			return "", err
+		}
+		_, err = tx.ExecContext(ctx, query, userID, session)
+		return before, err
+	})
 }
 
 // updateSession updates the session in the database for the user.
-func (s *SessionsDB) updateSession(username, session string) error {
+func (s *SessionsDB) updateSession(ctx context.Context, username, session string) error {
+	ctx, done := startOperation(ctx, "SessionsDB.updateSession")
+	defer done()
+	observeDocument("sessions", session)
+
 	query := `UPDATE ONLY user_sessions
                     SET session = $2
                   WHERE user_id = $1`
-	userID, err := queries.UserID(s.db, username)
-	if err != nil {
-		return err
-	}
-	_, err = s.db.Exec(query, userID, session)
-	return err
+	event := newChangeEvent(ctx, username, "sessions", "update", exportJSON(session))
+	return withEvent(ctx, s.db, event, session, func(tx *tracedTx) (string, error) {
+		userID, err := lookupUserID(ctx, tx, username)
+		if err != nil {
+			return "", err
+		}
+		before, err := currentDocument(ctx, tx, "user_sessions", "session", userID)
+		if err != nil {
+			return "", err
+		}
+		_, err = tx.ExecContext(ctx, query, userID, session)
+		return before, err
+	})
 }
 
 // deleteSession deletes the user's session from the database.
-func (s *SessionsDB) deleteSession(username string) error {
+func (s *SessionsDB) deleteSession(ctx context.Context, username string) error {
+	ctx, done := startOperation(ctx, "SessionsDB.deleteSession")
+	defer done()
+
 	query := `DELETE FROM ONLY user_sessions WHERE user_id = $1`
-	userID, err := queries.UserID(s.db, username)
-	if err != nil {
-		return err
-	}
-	_, err = s.db.Exec(query, userID)
-	return err
+	event := newChangeEvent(ctx, username, "sessions", "delete", nil)
+	return withEvent(ctx, s.db, event, "", func(tx *tracedTx) (string, error) {
+		userID, err := lookupUserID(ctx, tx, username)
+		if err != nil {
+			return "", err
+		}
+		before, err := currentDocument(ctx, tx, "user_sessions", "session", userID)
+		if err != nil {
+			return "", err
+		}
+		_, err = tx.ExecContext(ctx, query, userID)
+		return before, err
+	})
 }
@@ -0,0 +1,1557 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSupported is whether this build includes the SQLite backend.
+const sqliteSupported = true
+
+// sqliteSchema mirrors the parts of the DE schema that the service uses.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+    id TEXT PRIMARY KEY,
+    username TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS user_preferences (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL UNIQUE REFERENCES users(id),
+    preferences TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_sessions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL UNIQUE REFERENCES users(id),
+    session TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_saved_searches (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL UNIQUE REFERENCES users(id),
+    saved_searches TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS bags (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id),
+    contents TEXT NOT NULL,
+    seq INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS default_bags (
+    user_id TEXT PRIMARY KEY REFERENCES users(id),
+    bag_id TEXT NOT NULL REFERENCES bags(id)
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    occurred_at TIMESTAMP NOT NULL,
+    actor TEXT NOT NULL,
+    target_user TEXT NOT NULL,
+    resource TEXT NOT NULL,
+    operation TEXT NOT NULL,
+    request_id TEXT NOT NULL DEFAULT '',
+    before_hash TEXT NOT NULL DEFAULT '',
+    after_hash TEXT NOT NULL DEFAULT '',
+    detail TEXT NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_occurred_at_idx ON audit_log (occurred_at);
+
+CREATE TABLE IF NOT EXISTS event_outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    routing_key TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS event_outbox_next_attempt_at_idx ON event_outbox (next_attempt_at, id);
+
+CREATE TABLE IF NOT EXISTS user_changes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    occurred_at TIMESTAMP NOT NULL,
+    username TEXT NOT NULL,
+    resource TEXT NOT NULL,
+    record_id TEXT NOT NULL DEFAULT '',
+    operation TEXT NOT NULL,
+    deleted BOOLEAN NOT NULL DEFAULT 0,
+    etag TEXT NOT NULL DEFAULT '',
+    document TEXT
+);
+
+CREATE INDEX IF NOT EXISTS user_changes_username_idx ON user_changes (username, id);
+CREATE INDEX IF NOT EXISTS user_changes_occurred_at_idx ON user_changes (occurred_at);
+CREATE INDEX IF NOT EXISTS user_changes_record_idx ON user_changes (username, resource, record_id);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id TEXT PRIMARY KEY,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    event_types TEXT NOT NULL,
+    username TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id TEXT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_type TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    failed_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_next_attempt_at_idx ON webhook_deliveries (next_attempt_at, id);
+
+CREATE TABLE IF NOT EXISTS service_clients (
+    name TEXT PRIMARY KEY,
+    key_hash TEXT NOT NULL,
+    scopes TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    rotated_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
+`
+
+// SQLiteDB implements every store on top of a SQLite database file.
+type SQLiteDB struct {
+	db      *tracedDB
+	changed func(username string)
+}
+
+// OpenSQLiteStorage opens (or creates) the SQLite database at path and returns
+// a *Storage backed by it.
+func OpenSQLiteStorage(path string) (*Storage, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000", path))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time.
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close() // nolint:errcheck
+		return nil, fmt.Errorf("error creating the SQLite schema: %w", err)
+	}
+
+	s := &SQLiteDB{db: &tracedDB{DB: db, system: "sqlite"}}
+	return &Storage{
+		Backend:     "sqlite",
+		Users:       s,
+		Preferences: s,
+		Sessions:    s,
+		Searches:    s,
+		Bags:        s,
+		Clients:     s,
+		Profiles:    s,
+		Exports:     s,
+		Purges:      s,
+		Merges:      s,
+		Audit:       s,
+		Outbox:      s,
+		Changes:     s,
+		Webhooks:    s,
+		Stats:       s,
+		Imports:     s,
+		DB:          db,
+	}, nil
+}
+
+// Users
+
+func (s *SQLiteDB) isUser(ctx context.Context, username string) (bool, error) {
+	var count int64
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE username = ?`, username).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *SQLiteDB) addUser(ctx context.Context, username string) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO users (id, username) VALUES (?, ?) ON CONFLICT (username) DO NOTHING`, newUUID(), username)
+	return err
+}
+
+// sqliteUserID is lookupUserID for SQLite's placeholders.
+func sqliteUserID(ctx context.Context, q queryer, username string) (string, error) {
+	var userID string
+	if err := q.QueryRowContext(ctx, `SELECT id FROM users WHERE username = ?`, username).Scan(&userID); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// Documents. Preferences, sessions and saved searches are all stored the same
+// way, in a table with a single document per user.
+
+type sqliteDocumentTable struct {
+	table, column, resource string
+}
+
+var (
+	sqlitePreferences = sqliteDocumentTable{"user_preferences", "preferences", "preferences"}
+	sqliteSessions    = sqliteDocumentTable{"user_sessions", "session", "sessions"}
+	sqliteSearches    = sqliteDocumentTable{"user_saved_searches", "saved_searches", "searches"}
+)
+
+func (s *SQLiteDB) hasDocument(ctx context.Context, t sqliteDocumentTable, username string) (bool, error) {
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM %s d JOIN users u ON d.user_id = u.id WHERE u.username = ?`, t.table)
+	var count int64
+	if err := s.db.QueryRowContext(ctx, query, username).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// getDocument returns the ID, user ID and contents of the user's document.
+func (s *SQLiteDB) getDocument(ctx context.Context, t sqliteDocumentTable, username string) ([][3]string, error) {
+	query := fmt.Sprintf(`SELECT d.id, d.user_id, d.%s FROM %s d JOIN users u ON d.user_id = u.id WHERE u.username = ?`, t.column, t.table)
+	rows, err := s.db.QueryContext(ctx, query, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var docs [][3]string
+	for rows.Next() {
+		var doc [3]string
+		if err = rows.Scan(&doc[0], &doc[1], &doc[2]); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+func (s *SQLiteDB) insertDocument(ctx context.Context, t sqliteDocumentTable, username, document string) error {
+	observeDocument(t.resource, document)
+	event := newChangeEvent(ctx, username, t.resource, "create", exportJSON(document))
+	return s.withEvent(ctx, event, document, func(tx *tracedTx) (string, error) {
+		userID, err := sqliteUserID(ctx, tx, username)
+		if err != nil {
+			return "", err
+		}
+		before, err := t.current(ctx, tx, userID)
+		if err != nil {
+			return "", err
+		}
+		query := fmt.Sprintf(`INSERT INTO %s (id, user_id, %s) VALUES (?, ?, ?)`, t.table, t.column)
+		_, err = tx.ExecContext(ctx, query, newUUID(), userID, document)
+		return before, err
+	})
+}
+
+func (s *SQLiteDB) updateDocument(ctx context.Context, t sqliteDocumentTable, username, document string) error {
+	observeDocument(t.resource, document)
+	event := newChangeEvent(ctx, username, t.resource, "update", exportJSON(document))
+	return s.withEvent(ctx, event, document, func(tx *tracedTx) (string, error) {
+		userID, err := sqliteUserID(ctx, tx, username)
+		if err != nil {
+			return "", err
+		}
+		before, err := t.current(ctx, tx, userID)
+		if err != nil {
+			return "", err
+		}
+		query := fmt.Sprintf(`UPDATE %s SET %s = ? WHERE user_id = ?`, t.table, t.column)
+		_, err = tx.ExecContext(ctx, query, document, userID)
+		return before, err
+	})
+}
+
+func (s *SQLiteDB) deleteDocument(ctx context.Context, t sqliteDocumentTable, username string) error {
+	event := newChangeEvent(ctx, username, t.resource, "delete", nil)
+	return s.withEvent(ctx, event, "", func(tx *tracedTx) (string, error) {
+		userID, err := sqliteUserID(ctx, tx, username)
+		if err != nil {
+			return "", err
+		}
+		before, err := t.current(ctx, tx, userID)
+		if err != nil {
+			return "", err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE user_id = ?`, t.table), userID)
+		return before, err
+	})
+}
+
+// current returns the user's document, or an empty string if they don't have
+// one. SQLite has a single writer, so it can't change before the transaction
+// ends.
+func (t sqliteDocumentTable) current(ctx context.Context, tx *tracedTx, userID string) (string, error) {
+	var document string
+	err := tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT %s FROM %s WHERE user_id = ?`, t.column, t.table), userID).Scan(&document)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return document, err
+}
+
+// Preferences
+
+func (s *SQLiteDB) hasPreferences(ctx context.Context, username string) (bool, error) {
+	return s.hasDocument(ctx, sqlitePreferences, username)
+}
+
+func (s *SQLiteDB) getPreferences(ctx context.Context, username string) ([]UserPreferencesRecord, error) {
+	docs, err := s.getDocument(ctx, sqlitePreferences, username)
+	if err != nil {
+		return nil, err
+	}
+	var prefs []UserPreferencesRecord
+	for _, doc := range docs {
+		prefs = append(prefs, UserPreferencesRecord{ID: doc[0], UserID: doc[1], Preferences: doc[2]})
+	}
+	return prefs, nil
+}
+
+func (s *SQLiteDB) insertPreferences(ctx context.Context, username, prefs string) error {
+	return s.insertDocument(ctx, sqlitePreferences, username, prefs)
+}
+
+func (s *SQLiteDB) updatePreferences(ctx context.Context, username, prefs string) error {
+	return s.updateDocument(ctx, sqlitePreferences, username, prefs)
+}
+
+func (s *SQLiteDB) deletePreferences(ctx context.Context, username string) error {
+	return s.deleteDocument(ctx, sqlitePreferences, username)
+}
+
+// Sessions
+
+func (s *SQLiteDB) hasSessions(ctx context.Context, username string) (bool, error) {
+	return s.hasDocument(ctx, sqliteSessions, username)
+}
+
+func (s *SQLiteDB) getSessions(ctx context.Context, username string) ([]UserSessionRecord, error) {
+	docs, err := s.getDocument(ctx, sqliteSessions, username)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []UserSessionRecord
+	for _, doc := range docs {
+		sessions = append(sessions, UserSessionRecord{ID: doc[0], UserID: doc[1], Session: doc[2]})
+	}
+	return sessions, nil
+}
+
+func (s *SQLiteDB) insertSession(ctx context.Context, username, session string) error {
+	return s.insertDocument(ctx, sqliteSessions, username, session)
+}
+
+func (s *SQLiteDB) updateSession(ctx context.Context, username, session string) error {
+	return s.updateDocument(ctx, sqliteSessions, username, session)
+}
+
+func (s *SQLiteDB) deleteSession(ctx context.Context, username string) error {
+	return s.deleteDocument(ctx, sqliteSessions, username)
+}
+
+// Saved searches
+
+func (s *SQLiteDB) hasSavedSearches(ctx context.Context, username string) (bool, error) {
+	return s.hasDocument(ctx, sqliteSearches, username)
+}
+
+func (s *SQLiteDB) getSavedSearches(ctx context.Context, username string) ([]string, error) {
+	docs, err := s.getDocument(ctx, sqliteSearches, username)
+	if err != nil {
+		return nil, err
+	}
+	var searches []string
+	for _, doc := range docs {
+		searches = append(searches, doc[2])
+	}
+	return searches, nil
+}
+
+func (s *SQLiteDB) insertSavedSearches(ctx context.Context, username, searches string) error {
+	return s.insertDocument(ctx, sqliteSearches, username, searches)
+}
+
+func (s *SQLiteDB) updateSavedSearches(ctx context.Context, username, searches string) error {
+	return s.updateDocument(ctx, sqliteSearches, username, searches)
+}
+
+func (s *SQLiteDB) deleteSavedSearches(ctx context.Context, username string) error {
+	return s.deleteDocument(ctx, sqliteSearches, username)
+}
+
+// Bags
+
+func scanBag(row interface{ Scan(...interface{}) error }) (BagRecord, error) {
+	var (
+		record   BagRecord
+		contents string
+	)
+	if err := row.Scan(&record.ID, &contents, &record.UserID); err != nil {
+		return record, err
+	}
+	err := json.Unmarshal([]byte(contents), &record.Contents)
+	return record, err
+}
+
+// IsUser returns true if the user exists.
+func (s *SQLiteDB) IsUser(ctx context.Context, username string) (bool, error) {
+	return s.isUser(ctx, username)
+}
+
+func (s *SQLiteDB) count(ctx context.Context, query string, args ...interface{}) (bool, error) {
+	var count int64
+	if err := s.db.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// HasBags returns true if the user has bags.
+func (s *SQLiteDB) HasBags(ctx context.Context, username string) (bool, error) {
+	return s.count(ctx, `SELECT COUNT(*) FROM bags b JOIN users u ON b.user_id = u.id WHERE u.username = ?`, username)
+}
+
+// HasDefaultBag returns true if the user has a default bag.
+func (s *SQLiteDB) HasDefaultBag(ctx context.Context, username string) (bool, error) {
+	return s.count(ctx, `SELECT COUNT(*) FROM default_bags d JOIN users u ON d.user_id = u.id WHERE u.username = ?`, username)
+}
+
+// HasBag returns true if the user has the bag.
+func (s *SQLiteDB) HasBag(ctx context.Context, username, bagID string) (bool, error) {
+	return s.count(ctx, `SELECT COUNT(*) FROM bags b JOIN users u ON b.user_id = u.id WHERE u.username = ? AND b.id = ?`, username, bagID)
+}
+
+// GetBags returns all of the user's bags in the order they were added.
+func (s *SQLiteDB) GetBags(ctx context.Context, username string) ([]BagRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT b.id, b.contents, b.user_id FROM bags b JOIN users u ON b.user_id = u.id WHERE u.username = ? ORDER BY b.seq`, username)
+	if err != nil {
+		return nil, fmt.Errorf("error getting all bags for %s: %w", username, err)
+	}
+	defer rows.Close()
+
+	bagList := []BagRecord{}
+	for rows.Next() {
+		record, err := scanBag(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning record while getting bags for %s: %w", username, err)
+		}
+		bagList = append(bagList, record)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error from rows object while getting bags for %s: %w", username, err)
+	}
+	return bagList, nil
+}
+
+// GetBag returns one of the user's bags.
+func (s *SQLiteDB) GetBag(ctx context.Context, username, bagID string) (BagRecord, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT b.id, b.contents, b.user_id FROM bags b JOIN users u ON b.user_id = u.id WHERE u.username = ? AND b.id = ?`, username, bagID)
+	record, err := scanBag(row)
+	if err != nil {
+		return record, fmt.Errorf("error getting bag id %s for %s: %w", bagID, username, err)
+	}
+	return record, nil
+}
+
+// GetDefaultBag returns the user's default bag, creating an empty one if the
+// user doesn't have one yet.
+func (s *SQLiteDB) GetDefaultBag(ctx context.Context, username string) (BagRecord, error) {
+	hasDefault, err := s.HasDefaultBag(ctx, username)
+	if err != nil {
+		return BagRecord{}, fmt.Errorf("error from HasDefaultBag in GetDefaultBag for %s: %w", username, err)
+	}
+
+	if !hasDefault {
+		bagID, err := s.AddBag(ctx, username, "{}")
+		if err != nil {
+			return BagRecord{}, fmt.Errorf("error adding bag for user %s: %w", username, err)
+		}
+		if err = s.SetDefaultBag(ctx, username, bagID); err != nil {
+			return BagRecord{}, fmt.Errorf("error setting the default bag for %s: %w", username, err)
+		}
+	}
+
+	row := s.db.QueryRowContext(ctx, `SELECT b.id, b.contents, b.user_id FROM bags b JOIN default_bags d ON b.id = d.bag_id JOIN users u ON d.user_id = u.id WHERE u.username = ?`, username)
+	record, err := scanBag(row)
+	if err != nil {
+		return record, fmt.Errorf("error getting default bag for %s from the database: %w", username, err)
+	}
+	return record, nil
+}
+
+// SetDefaultBag makes the bag the user's default bag.
+func (s *SQLiteDB) SetDefaultBag(ctx context.Context, username, bagID string) error {
+	event := newChangeEvent(ctx, username, "bags", "set_default", bagEventData{BagID: bagID})
+	return s.withEvent(ctx, event, bagID, func(tx *tracedTx) (string, error) {
+		userID, err := sqliteUserID(ctx, tx, username)
+		if err != nil {
+			return "", fmt.Errorf("error getting user ID for %s while setting default bag: %w", username, err)
+		}
+		before, err := sqliteDefaultBagID(ctx, tx, userID)
+		if err != nil {
+			return "", fmt.Errorf("error getting the default bag for %s: %w", username, err)
+		}
+		query := `INSERT INTO default_bags (user_id, bag_id) VALUES (?, ?) ON CONFLICT (user_id) DO UPDATE SET bag_id = excluded.bag_id`
+		if _, err = tx.ExecContext(ctx, query, userID, bagID); err != nil {
+			return "", fmt.Errorf("error setting the default bag for %s: %w", username, err)
+		}
+		return before, nil
+	})
+}
+
+// AddBag adds a new bag for the user and returns its ID.
+func (s *SQLiteDB) AddBag(ctx context.Context, username, contents string) (string, error) {
+	observeDocument("bags", contents)
+	bagID := newUUID()
+	event := newChangeEvent(ctx, username, "bags", "create", bagEventData{BagID: bagID, Contents: exportJSON(contents)})
+	err := s.withEvent(ctx, event, bagAuditDocument(contents), func(tx *tracedTx) (string, error) {
+		userID, err := sqliteUserID(ctx, tx, username)
+		if err != nil {
+			return "", fmt.Errorf("error looking up the user ID in AddBag for %s: %w", username, err)
+		}
+		var check BagContents
+		if err = json.Unmarshal([]byte(contents), &check); err != nil {
+			return "", fmt.Errorf("error adding bag for %s: %w", username, err)
+		}
+
+		query := `INSERT INTO bags (id, user_id, contents, seq) VALUES (?, ?, ?, (SELECT COALESCE(MAX(seq), 0) + 1 FROM bags))`
+		if _, err = tx.ExecContext(ctx, query, bagID, userID, contents); err != nil {
+			return "", fmt.Errorf("error adding bag for %s: %w", username, err)
+		}
+		return "", nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return bagID, nil
+}
+
+// UpdateBag replaces the contents of one of the user's bags.
+func (s *SQLiteDB) UpdateBag(ctx context.Context, username, bagID, contents string) error {
+	observeDocument("bags", contents)
+	event := newChangeEvent(ctx, username, "bags", "update", bagEventData{BagID: bagID, Contents: exportJSON(contents)})
+	return s.withEvent(ctx, event, bagAuditDocument(contents), func(tx *tracedTx) (string, error) {
+		userID, err := sqliteUserID(ctx, tx, username)
+		if err != nil {
+			return "", fmt.Errorf("error looking up the user ID in UpdateBag for %s: %w", username, err)
+		}
+		var check BagContents
+		if err = json.Unmarshal([]byte(contents), &check); err != nil {
+			return "", fmt.Errorf("error updating bag %s for %s: %w", bagID, username, err)
+		}
+		before, err := sqliteCurrentBag(ctx, tx, userID, bagID)
+		if err != nil {
+			return "", fmt.Errorf("error getting bag %s for %s: %w", bagID, username, err)
+		}
+		if _, err = tx.ExecContext(ctx, `UPDATE bags SET contents = ? WHERE id = ? AND user_id = ?`, contents, bagID, userID); err != nil {
+			return "", fmt.Errorf("error updating bag %s for %s: %w", bagID, username, err)
+		}
+		return before, nil
+	})
+}
+
+// UpdateDefaultBag replaces the contents of the user's default bag.
+func (s *SQLiteDB) UpdateDefaultBag(ctx context.Context, username, contents string) error {
+	defaultBag, err := s.GetDefaultBag(ctx, username)
+	if err != nil {
+		return fmt.Errorf("error updating default bag for %s: %w", username, err)
+	}
+	return s.UpdateBag(ctx, username, defaultBag.ID, contents)
+}
+
+// DeleteBag deletes one of the user's bags.
+func (s *SQLiteDB) DeleteBag(ctx context.Context, username, bagID string) error {
+	event := newChangeEvent(ctx, username, "bags", "delete", bagEventData{BagID: bagID})
+	return s.withEvent(ctx, event, "", func(tx *tracedTx) (string, error) {
+		userID, err := sqliteUserID(ctx, tx, username)
+		if err != nil {
+			return "", fmt.Errorf("error looking up the user ID in DeleteBag for %s: %w", username, err)
+		}
+		before, err := sqliteCurrentBag(ctx, tx, userID, bagID)
+		if err != nil {
+			return "", fmt.Errorf("error getting bag %s for %s: %w", bagID, username, err)
+		}
+		if _, err = tx.ExecContext(ctx, `DELETE FROM default_bags WHERE user_id = ? AND bag_id = ?`, userID, bagID); err != nil {
+			return "", fmt.Errorf("error deleting bag %s for %s: %w", bagID, username, err)
+		}
+		if _, err = tx.ExecContext(ctx, `DELETE FROM bags WHERE id = ? AND user_id = ?`, bagID, userID); err != nil {
+			return "", fmt.Errorf("error deleting bag %s for %s: %w", bagID, username, err)
+		}
+		return before, nil
+	})
+}
+
+// DeleteDefaultBag deletes the user's default bag. A new, empty one is
+// created the next time it's requested.
+func (s *SQLiteDB) DeleteDefaultBag(ctx context.Context, username string) error {
+	defaultBag, err := s.GetDefaultBag(ctx, username)
+	if err != nil {
+		return fmt.Errorf("error deleting default bag for %s: %w", username, err)
+	}
+	return s.DeleteBag(ctx, username, defaultBag.ID)
+}
+
+// DeleteAllBags deletes all of the user's bags.
+func (s *SQLiteDB) DeleteAllBags(ctx context.Context, username string) error {
+	event := newChangeEvent(ctx, username, "bags", "delete_all", nil)
+	return s.withEvent(ctx, event, "", func(tx *tracedTx) (string, error) {
+		userID, err := sqliteUserID(ctx, tx, username)
+		if err != nil {
+			return "", fmt.Errorf("error looking up the user ID for %s: %w", username, err)
+		}
+		before, err := sqliteCurrentBags(ctx, tx, userID)
+		if err != nil {
+			return "", fmt.Errorf("error getting the bags for %s: %w", username, err)
+		}
+		if _, err = tx.ExecContext(ctx, `DELETE FROM default_bags WHERE user_id = ?`, userID); err != nil {
+			return "", fmt.Errorf("error deleting all bags for %s: %w", username, err)
+		}
+		if _, err = tx.ExecContext(ctx, `DELETE FROM bags WHERE user_id = ?`, userID); err != nil {
+			return "", fmt.Errorf("error deleting all bags for %s: %w", username, err)
+		}
+		return before, nil
+	})
+}
+
+// sqliteCurrentBag is lockBag for SQLite.
+func sqliteCurrentBag(ctx context.Context, tx *tracedTx, userID, bagID string) (string, error) {
+	var contents string
+	err := tx.QueryRowContext(ctx, `SELECT contents FROM bags WHERE id = ? AND user_id = ?`, bagID, userID).Scan(&contents)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return bagAuditDocument(contents), nil
+}
+
+// sqliteCurrentBags is lockBags for SQLite.
+func sqliteCurrentBags(ctx context.Context, tx *tracedTx, userID string) (string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, contents FROM bags WHERE user_id = ?`, userID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	bags := make(map[string]string)
+	for rows.Next() {
+		var id, contents string
+		if err = rows.Scan(&id, &contents); err != nil {
+			return "", err
+		}
+		bags[id] = contents
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+	return bagsAuditDocument(bags), nil
+}
+
+// Profiles
+
+// getProfile reads every part of the profile with a single statement.
+func (s *SQLiteDB) getProfile(ctx context.Context, username string) (*UserProfileRecord, error) {
+	query := `SELECT COALESCE((SELECT p.preferences FROM user_preferences p WHERE p.user_id = u.id), ''),
+                     COALESCE((SELECT se.session FROM user_sessions se WHERE se.user_id = u.id), ''),
+                     COALESCE((SELECT ss.saved_searches FROM user_saved_searches ss WHERE ss.user_id = u.id), ''),
+                     u.id,
+                     b.id,
+                     b.contents
+                FROM users u
+           LEFT JOIN default_bags d ON d.user_id = u.id
+           LEFT JOIN bags b ON b.id = d.bag_id
+               WHERE u.username = ?`
+
+	var (
+		record      UserProfileRecord
+		userID      string
+		bagID       sql.NullString
+		bagContents sql.NullString
+	)
+	err := s.db.QueryRowContext(ctx, query, username).Scan(
+		&record.Preferences,
+		&record.Session,
+		&record.SavedSearches,
+		&userID,
+		&bagID,
+		&bagContents,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if bagID.Valid {
+		record.DefaultBag = &BagRecord{ID: bagID.String, UserID: userID}
+		if err = json.Unmarshal([]byte(bagContents.String), &record.DefaultBag.Contents); err != nil {
+			return nil, err
+		}
+	}
+	return &record, nil
+}
+
+// Exports
+
+// exportUser reads all of the user's data in a single transaction.
+func (s *SQLiteDB) exportUser(ctx context.Context, username string) (*UserExport, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	export := &UserExport{Username: username}
+	if err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE username = ?`, username).Scan(&export.UserID); err != nil {
+		return nil, err
+	}
+
+	if export.Preferences, err = exportDocuments(ctx, tx, `SELECT id, preferences FROM user_preferences WHERE user_id = ? ORDER BY id`, export.UserID); err != nil {
+		return nil, err
+	}
+	if export.Sessions, err = exportDocuments(ctx, tx, `SELECT id, session FROM user_sessions WHERE user_id = ? ORDER BY id`, export.UserID); err != nil {
+		return nil, err
+	}
+	if export.SavedSearches, err = exportDocuments(ctx, tx, `SELECT id, saved_searches FROM user_saved_searches WHERE user_id = ? ORDER BY id`, export.UserID); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT b.id, b.contents, d.bag_id IS NOT NULL
+                FROM bags b
+           LEFT JOIN default_bags d ON d.bag_id = b.id AND d.user_id = b.user_id
+               WHERE b.user_id = ?
+            ORDER BY b.seq`
+	if export.Bags, err = exportBags(ctx, tx, query, export.UserID); err != nil {
+		return nil, err
+	}
+
+	return export, tx.Commit()
+}
+
+// Purges
+
+// purgeUser deletes the user's rows from every table in one transaction.
+func (s *SQLiteDB) purgeUser(ctx context.Context, username string, dryRun bool, entry *AuditEntry) (*PurgeReport, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	var userID string
+	if err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE username = ?`, username).Scan(&userID); err != nil {
+		return nil, err
+	}
+
+	report := &PurgeReport{Username: username, DryRun: dryRun}
+	for _, t := range purgeTables {
+		count := t.count(report)
+		if dryRun {
+			if err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+t.table+` WHERE user_id = ?`, userID).Scan(count); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		result, err := tx.ExecContext(ctx, `DELETE FROM `+t.table+` WHERE user_id = ?`, userID)
+		if err != nil {
+			return nil, err
+		}
+		if *count, err = result.RowsAffected(); err != nil {
+			return nil, err
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	if entry.Detail, err = json.Marshal(report); err != nil {
+		return nil, err
+	}
+	if err = sqliteInsertAuditEntry(ctx, tx, entry); err != nil {
+		return nil, err
+	}
+	if err = sqliteInsertEvent(ctx, tx, newChangeEvent(ctx, username, "users", "purge", report)); err != nil {
+		return nil, err
+	}
+
+	return report, s.commit(tx, username)
+}
+
+// sqliteInsertAuditEntry is insertAuditEntry for SQLite's placeholders.
+func sqliteInsertAuditEntry(ctx context.Context, q queryer, entry *AuditEntry) error {
+	detail := entry.Detail
+	if detail == nil {
+		detail = json.RawMessage("{}")
+	}
+	query := `INSERT INTO audit_log (occurred_at, actor, target_user, resource, operation, request_id, before_hash, after_hash, detail)
+                   VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := q.ExecContext(ctx, query, entry.OccurredAt.UTC(), entry.Actor, entry.TargetUser, entry.Resource, entry.Operation, entry.RequestID,
+		entry.BeforeHash, entry.AfterHash, string(detail))
+	return err
+}
+
+// Audit log
+
+func (s *SQLiteDB) recordAudit(ctx context.Context, entry *AuditEntry) error {
+	return sqliteInsertAuditEntry(ctx, s.db, entry)
+}
+
+func (s *SQLiteDB) queryAudit(ctx context.Context, filter *AuditFilter) ([]AuditEntry, error) {
+	where, args := filter.where(func(int) string { return "?" })
+	args = append(args, filter.Limit)
+	query := fmt.Sprintf(`SELECT %s FROM audit_log%s ORDER BY occurred_at DESC, id DESC LIMIT ?`, auditColumns, where)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAuditEntries(rows)
+}
+
+func (s *SQLiteDB) pruneAudit(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM audit_log WHERE occurred_at < ?`, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Merges
+
+// sqliteMergeDocument is mergeDocument for SQLite.
+func sqliteMergeDocument(ctx context.Context, tx *tracedTx, table, column, sourceID, targetID, policy string) (string, error) {
+	var sourceDocID, sourceDoc, targetDocID, targetDoc string
+	query := fmt.Sprintf(`SELECT id, %s FROM %s WHERE user_id = ?`, column, table)
+
+	err := tx.QueryRowContext(ctx, query, sourceID).Scan(&sourceDocID, &sourceDoc)
+	if err == sql.ErrNoRows {
+		return mergeNone, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.QueryRowContext(ctx, query, targetID).Scan(&targetDocID, &targetDoc)
+	if err == sql.ErrNoRows {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET user_id = ? WHERE id = ?`, table), targetID, sourceDocID)
+		return mergeMoved, err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	document, outcome, err := resolveDocuments(policy, sourceDoc, targetDoc)
+	if err != nil {
+		return "", fmt.Errorf("error merging %s: %w", table, err)
+	}
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET %s = ? WHERE id = ?`, table, column), document, targetDocID); err != nil {
+		return "", err
+	}
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = ?`, table), sourceDocID); err != nil {
+		return "", err
+	}
+	return outcome, nil
+}
+
+func sqliteDefaultBagID(ctx context.Context, tx *tracedTx, userID string) (string, error) {
+	var bagID string
+	err := tx.QueryRowContext(ctx, `SELECT bag_id FROM default_bags WHERE user_id = ?`, userID).Scan(&bagID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return bagID, err
+}
+
+// mergeUsers moves the source user's data to the target user in one
+// transaction.
+func (s *SQLiteDB) mergeUsers(ctx context.Context, source, target, policy string, entry *AuditEntry) (*MergeReport, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	var sourceID, targetID string
+	if err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE username = ?`, source).Scan(&sourceID); err != nil {
+		return nil, err
+	}
+
+	report := &MergeReport{Source: source, Target: target, Policy: policy}
+	err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE username = ?`, target).Scan(&targetID)
+	if err == sql.ErrNoRows {
+		targetID = newUUID()
+		_, err = tx.ExecContext(ctx, `INSERT INTO users (id, username) VALUES (?, ?)`, targetID, target)
+		report.CreatedTarget = true
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range mergeTables {
+		if *t.outcome(report), err = sqliteMergeDocument(ctx, tx, t.table, t.column, sourceID, targetID, policy); err != nil {
+			return nil, err
+		}
+	}
+
+	sourceDefault, err := sqliteDefaultBagID(ctx, tx, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	targetDefault, err := sqliteDefaultBagID(ctx, tx, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Shifting seq past every existing bag puts the source user's bags after
+	// the target user's, in their original order.
+	query := `UPDATE bags SET user_id = ?, seq = seq + (SELECT COALESCE(MAX(seq), 0) FROM bags) WHERE user_id = ?`
+	result, err := tx.ExecContext(ctx, query, targetID, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	if report.BagsMoved, err = result.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	report.DefaultBag = resolveDefaultBag(policy, sourceDefault, targetDefault)
+	if sourceDefault != "" {
+		if report.DefaultBag == sourceDefault {
+			if _, err = tx.ExecContext(ctx, `DELETE FROM default_bags WHERE user_id = ?`, targetID); err != nil {
+				return nil, err
+			}
+			_, err = tx.ExecContext(ctx, `UPDATE default_bags SET user_id = ? WHERE user_id = ?`, targetID, sourceID)
+		} else {
+			_, err = tx.ExecContext(ctx, `DELETE FROM default_bags WHERE user_id = ?`, sourceID)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if entry.Detail, err = json.Marshal(report); err != nil {
+		return nil, err
+	}
+	if err = sqliteInsertAuditEntry(ctx, tx, entry); err != nil {
+		return nil, err
+	}
+	if err = sqliteInsertEvent(ctx, tx, newChangeEvent(ctx, target, "users", "merge", report)); err != nil {
+		return nil, err
+	}
+	if err = sqliteInsertChange(ctx, tx, newChangeEvent(ctx, source, "users", "purge", report)); err != nil {
+		return nil, err
+	}
+
+	return report, s.commit(tx, target, source)
+}
+
+// Imports
+
+// sqliteImportUserID is importUserID for SQLite.
+func sqliteImportUserID(ctx context.Context, tx *tracedTx, username string, ids map[string]string, batch *ImportBatch) (string, error) {
+	if id, ok := ids[username]; ok {
+		return id, nil
+	}
+
+	id, err := sqliteUserID(ctx, tx, username)
+	if err == sql.ErrNoRows {
+		id = newUUID()
+		_, err = tx.ExecContext(ctx, `INSERT INTO users (id, username) VALUES (?, ?)`, id, username)
+		batch.UsersCreated++
+	}
+	if err != nil {
+		return "", err
+	}
+	ids[username] = id
+	return id, nil
+}
+
+// sqliteImportDocument is importDocument for SQLite.
+func sqliteImportDocument(ctx context.Context, tx *tracedTx, record *ImportRecord, userID, policy string, entry *AuditEntry) (string, error) {
+	t := importTables[record.Resource]
+
+	var docID, before string
+	query := fmt.Sprintf(`SELECT id, %s FROM %s WHERE user_id = ?`, t.column, t.table)
+	err := tx.QueryRowContext(ctx, query, userID).Scan(&docID, &before)
+	replaced := err == nil
+	switch {
+	case err == sql.ErrNoRows:
+		query = fmt.Sprintf(`INSERT INTO %s (id, user_id, %s) VALUES (?, ?, ?)`, t.table, t.column)
+		_, err = tx.ExecContext(ctx, query, newUUID(), userID, string(record.Document))
+	case err != nil:
+	case policy == importSkip:
+		return importSkipped, nil
+	case policy == importFail:
+		return importConflict, nil
+	default:
+		query = fmt.Sprintf(`UPDATE %s SET %s = ? WHERE id = ?`, t.table, t.column)
+		_, err = tx.ExecContext(ctx, query, string(record.Document), docID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return sqliteImportRecorded(ctx, tx, record, "", before, replaced, entry)
+}
+
+// sqliteImportBag is importBag for SQLite.
+func sqliteImportBag(ctx context.Context, tx *tracedTx, record *ImportRecord, userID, policy string, entry *AuditEntry) (string, error) {
+	bagID := record.ID
+	if bagID == "" {
+		bagID = newUUID()
+	}
+
+	var owner, before string
+	err := tx.QueryRowContext(ctx, `SELECT user_id, contents FROM bags WHERE id = ?`, bagID).Scan(&owner, &before)
+	replaced := err == nil
+	switch {
+	case err == sql.ErrNoRows:
+		query := `INSERT INTO bags (id, user_id, contents, seq) VALUES (?, ?, ?, (SELECT COALESCE(MAX(seq), 0) + 1 FROM bags))`
+		_, err = tx.ExecContext(ctx, query, bagID, userID, string(record.Document))
+	case err != nil:
+	case owner != userID:
+		return importTaken, nil
+	case policy == importSkip:
+		return importSkipped, nil
+	case policy == importFail:
+		return importConflict, nil
+	default:
+		_, err = tx.ExecContext(ctx, `UPDATE bags SET contents = ? WHERE id = ?`, string(record.Document), bagID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	outcome, err := sqliteImportRecorded(ctx, tx, record, bagID, before, replaced, entry)
+	if err != nil || !record.Default {
+		return outcome, err
+	}
+
+	previous, err := sqliteDefaultBagID(ctx, tx, userID)
+	if err != nil {
+		return "", err
+	}
+	query := `INSERT INTO default_bags (user_id, bag_id) VALUES (?, ?) ON CONFLICT (user_id) DO UPDATE SET bag_id = excluded.bag_id`
+	if _, err = tx.ExecContext(ctx, query, userID, bagID); err != nil {
+		return "", err
+	}
+	audited, err := defaultBagAudit(entry, record.Username, bagID, previous)
+	if err != nil {
+		return "", err
+	}
+	if err = sqliteInsertAuditEntry(ctx, tx, &audited); err != nil {
+		return "", err
+	}
+	if err = sqliteInsertEvent(ctx, tx, newChangeEvent(ctx, record.Username, "bags", "set_default", bagEventData{BagID: bagID})); err != nil {
+		return "", err
+	}
+	return outcome, nil
+}
+
+// sqliteImportRecorded is importRecorded for SQLite.
+func sqliteImportRecorded(ctx context.Context, tx *tracedTx, record *ImportRecord, bagID, before string, replaced bool, entry *AuditEntry) (string, error) {
+	audited, err := record.importAudit(entry, bagID, before, replaced)
+	if err != nil {
+		return "", err
+	}
+	if err = sqliteInsertAuditEntry(ctx, tx, &audited); err != nil {
+		return "", err
+	}
+	if err = sqliteInsertEvent(ctx, tx, record.importEvent(ctx, bagID, replaced)); err != nil {
+		return "", err
+	}
+	if replaced {
+		return importUpdated, nil
+	}
+	return importCreated, nil
+}
+
+// sqliteImportRecord is importRecord for SQLite.
+func sqliteImportRecord(ctx context.Context, tx *tracedTx, record *ImportRecord, policy string, ids map[string]string, batch *ImportBatch, entry *AuditEntry) (string, error) {
+	userID, err := sqliteImportUserID(ctx, tx, record.Username, ids, batch)
+	if err != nil {
+		return "", err
+	}
+	if record.Resource == "bags" {
+		return sqliteImportBag(ctx, tx, record, userID, policy, entry)
+	}
+	return sqliteImportDocument(ctx, tx, record, userID, policy, entry)
+}
+
+// importRecords stores the records in one transaction, with a savepoint for
+// each, which a dry run rolls back.
+func (s *SQLiteDB) importRecords(ctx context.Context, records []ImportRecord, policy string, dryRun bool, entry *AuditEntry) (*ImportBatch, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	batch := &ImportBatch{Outcomes: make([]string, 0, len(records))}
+	ids := make(map[string]string)
+	var changed []string
+	seen := make(map[string]bool)
+	for n := range records {
+		record := &records[n]
+		usersCreated := batch.UsersCreated
+
+		if _, err = tx.ExecContext(ctx, `SAVEPOINT import_record`); err != nil {
+			return nil, err
+		}
+		outcome, err := sqliteImportRecord(ctx, tx, record, policy, ids, batch, entry)
+		if err != nil && ctx.Err() != nil {
+			return nil, fmt.Errorf("error importing %s for %s: %w", record.Resource, record.Username, err)
+		}
+		if err != nil {
+			if _, rollbackErr := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT import_record`); rollbackErr != nil {
+				return nil, rollbackErr
+			}
+			if batch.UsersCreated > usersCreated {
+				delete(ids, record.Username)
+				batch.UsersCreated = usersCreated
+			}
+			batch.fail(record, err)
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, `RELEASE SAVEPOINT import_record`); err != nil {
+			return nil, err
+		}
+		batch.Outcomes = append(batch.Outcomes, outcome)
+		if (outcome == importCreated || outcome == importUpdated) && !seen[record.Username] {
+			seen[record.Username] = true
+			changed = append(changed, record.Username)
+		}
+	}
+
+	if dryRun {
+		return batch, nil
+	}
+	return batch, s.commit(tx, changed...)
+}
+
+// Event outbox
+
+// sqliteInsertEvent is insertEvent for SQLite's placeholders. Nothing is
+// notified until the transaction is passed to commit.
+func sqliteInsertEvent(ctx context.Context, q queryer, event *ChangeEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `INSERT INTO event_outbox (routing_key, payload) VALUES (?, ?)`, event.routingKey(), string(payload))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	query := `INSERT INTO webhook_deliveries (webhook_id, event_type, payload, created_at, next_attempt_at)
+                   SELECT id, ?, ?, ?, ?
+                     FROM webhooks
+                    WHERE (instr(' ' || event_types || ' ', ' ' || ? || ' ') > 0 OR instr(' ' || event_types || ' ', ' ` + allWebhookEvents + ` ') > 0)
+                      AND (username = '' OR username = ?)`
+	if _, err = q.ExecContext(ctx, query, event.Type, string(payload), now, now, event.Type, event.Username); err != nil {
+		return err
+	}
+
+	return sqliteInsertChange(ctx, q, event)
+}
+
+// sqliteInsertChange is insertChange for SQLite. SQLite only has one writer
+// at a time, so changes are already numbered in the order they're committed.
+func sqliteInsertChange(ctx context.Context, q queryer, event *ChangeEvent) error {
+	change, err := newChangeRecord(event)
+	if err != nil {
+		return err
+	}
+
+	where, args := change.supersededWhere(func(int) string { return "?" })
+	if _, err = q.ExecContext(ctx, `DELETE FROM user_changes WHERE `+where, args...); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO user_changes (occurred_at, username, resource, record_id, operation, deleted, etag, document)
+                   VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = q.ExecContext(ctx, query, change.OccurredAt, change.Username, change.Resource, change.RecordID, change.Operation,
+		change.Deleted, change.ETag, change.documentArg())
+	return err
+}
+
+// commit commits a transaction that changed the users' data and reports the
+// changes to the function passed to onChange.
+func (s *SQLiteDB) commit(tx *tracedTx, usernames ...string) error {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if s.changed != nil {
+		for _, username := range usernames {
+			s.changed(username)
+		}
+	}
+	return nil
+}
+
+// withEvent is withEvent for SQLite.
+func (s *SQLiteDB) withEvent(ctx context.Context, event *ChangeEvent, after string, fn func(tx *tracedTx) (string, error)) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	before, err := fn(tx)
+	if err != nil {
+		return err
+	}
+	if err = sqliteInsertAuditEntry(ctx, tx, eventAudit(event, before, after)); err != nil {
+		return err
+	}
+	if err = sqliteInsertEvent(ctx, tx, event); err != nil {
+		return err
+	}
+	return s.commit(tx, event.Username)
+}
+
+func (s *SQLiteDB) claimEvents(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	now := time.Now().UTC()
+	query := `SELECT id, routing_key, payload, attempts FROM event_outbox WHERE next_attempt_at <= ? ORDER BY id LIMIT ?`
+	rows, err := tx.QueryContext(ctx, query, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	events := []OutboxEvent{}
+	for rows.Next() {
+		var (
+			event   OutboxEvent
+			payload string
+		)
+		if err = rows.Scan(&event.ID, &event.RoutingKey, &payload, &event.Attempts); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		event.Payload = []byte(payload)
+		events = append(events, event)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, event := range events {
+		if _, err = tx.ExecContext(ctx, `UPDATE event_outbox SET next_attempt_at = ? WHERE id = ?`, now.Add(lease), event.ID); err != nil {
+			return nil, err
+		}
+	}
+	return events, tx.Commit()
+}
+
+func (s *SQLiteDB) deleteEvent(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM event_outbox WHERE id = ?`, id)
+	return err
+}
+
+func (s *SQLiteDB) retryEvent(ctx context.Context, id int64, delay time.Duration, lastErr string) error {
+	query := `UPDATE event_outbox SET attempts = attempts + 1, next_attempt_at = ?, last_error = ? WHERE id = ?`
+	_, err := s.db.ExecContext(ctx, query, time.Now().UTC().Add(delay), lastErr, id)
+	return err
+}
+
+func (s *SQLiteDB) pruneEvents(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM event_outbox WHERE created_at < ?`, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Change log
+
+// onChange makes fn get called with the username whenever a user's data
+// changes. It must be called before the storage is used.
+func (s *SQLiteDB) onChange(fn func(username string)) {
+	s.changed = fn
+}
+
+func (s *SQLiteDB) userChanges(ctx context.Context, username string, after int64, limit int) ([]ChangeRecord, error) {
+	query := `SELECT ` + changeColumns + ` FROM user_changes WHERE username = ? AND id > ? ORDER BY id LIMIT ?`
+	rows, err := s.db.QueryContext(ctx, query, username, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanChanges(rows)
+}
+
+func (s *SQLiteDB) changesSince(ctx context.Context, after int64, limit int) ([]ChangeRecord, error) {
+	query := `SELECT ` + changeColumns + ` FROM user_changes WHERE id > ? ORDER BY id LIMIT ?`
+	rows, err := s.db.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanChanges(rows)
+}
+
+func (s *SQLiteDB) lastChangeID(ctx context.Context) (int64, error) {
+	var id int64
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(max(id), 0) FROM user_changes`).Scan(&id)
+	return id, err
+}
+
+func (s *SQLiteDB) pruneTombstones(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM user_changes WHERE deleted AND occurred_at < ?`, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Webhooks
+
+func (s *SQLiteDB) insertWebhook(ctx context.Context, webhook *WebhookRecord) error {
+	query := `INSERT INTO webhooks (id, url, secret, event_types, username, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := s.db.ExecContext(ctx, query, webhook.ID, webhook.URL, webhook.Secret, joinEventTypes(webhook.EventTypes),
+		webhook.Username, webhook.CreatedAt)
+	return err
+}
+
+func (s *SQLiteDB) listWebhooks(ctx context.Context) ([]WebhookRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+webhookColumns+` FROM webhooks ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []WebhookRecord{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, *webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *SQLiteDB) getWebhook(ctx context.Context, id string) (*WebhookRecord, error) {
+	webhook, err := scanWebhook(s.db.QueryRowContext(ctx, `SELECT `+webhookColumns+` FROM webhooks WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return webhook, err
+}
+
+// deleteWebhook deletes the deliveries itself, since SQLite only enforces
+// foreign keys when they're turned on.
+func (s *SQLiteDB) deleteWebhook(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if err = expectOneRow(result, errWebhookNotFound); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) claimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	now := time.Now().UTC()
+	query := `SELECT ` + deliveryColumns + `
+                FROM webhook_deliveries d
+                JOIN webhooks w ON w.id = d.webhook_id
+               WHERE d.failed_at IS NULL
+                 AND d.next_attempt_at <= ?
+            ORDER BY d.id
+               LIMIT ?`
+	rows, err := tx.QueryContext(ctx, query, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := scanDeliveries(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, delivery := range deliveries {
+		_, err = tx.ExecContext(ctx, `UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id = ?`, now.Add(lease), delivery.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deliveries, tx.Commit()
+}
+
+func (s *SQLiteDB) deleteDelivery(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE id = ?`, id)
+	return err
+}
+
+func (s *SQLiteDB) retryDelivery(ctx context.Context, id int64, delay time.Duration, lastErr string) error {
+	query := `UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt_at = ?, last_error = ? WHERE id = ?`
+	_, err := s.db.ExecContext(ctx, query, time.Now().UTC().Add(delay), lastErr, id)
+	return err
+}
+
+func (s *SQLiteDB) failDelivery(ctx context.Context, id int64, lastErr string) error {
+	query := `UPDATE webhook_deliveries SET attempts = attempts + 1, failed_at = ?, last_error = ? WHERE id = ?`
+	_, err := s.db.ExecContext(ctx, query, time.Now().UTC(), lastErr, id)
+	return err
+}
+
+func (s *SQLiteDB) failedDeliveries(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	query := `SELECT ` + deliveryColumns + `
+                FROM webhook_deliveries d
+                JOIN webhooks w ON w.id = d.webhook_id
+               WHERE d.webhook_id = ?
+                 AND d.failed_at IS NOT NULL
+            ORDER BY d.id
+               LIMIT ?`
+	rows, err := s.db.QueryContext(ctx, query, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+func (s *SQLiteDB) redeliver(ctx context.Context, webhookID string, id int64) error {
+	query := `UPDATE webhook_deliveries
+                 SET attempts = 0, failed_at = NULL, next_attempt_at = ?
+               WHERE id = ? AND webhook_id = ? AND failed_at IS NOT NULL`
+	result, err := s.db.ExecContext(ctx, query, time.Now().UTC(), id, webhookID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, errDeliveryNotFound)
+}
+
+func (s *SQLiteDB) pruneDeliveries(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE created_at < ?`, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Service clients
+
+func (s *SQLiteDB) getClient(ctx context.Context, name string) (*ServiceClientRecord, error) {
+	var (
+		record ServiceClientRecord
+		scopes string
+	)
+	query := `SELECT name, key_hash, scopes, created_at, rotated_at FROM service_clients WHERE name = ? AND revoked_at IS NULL`
+	err := s.db.QueryRowContext(ctx, query, name).Scan(&record.Name, &record.KeyHash, &scopes, &record.CreatedAt, &record.RotatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record.Scopes = splitScopes(scopes)
+	return &record, nil
+}
+
+func (s *SQLiteDB) listClients(ctx context.Context) ([]ServiceClientRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, scopes, created_at, rotated_at FROM service_clients WHERE revoked_at IS NULL ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []ServiceClientRecord{}
+	for rows.Next() {
+		var (
+			record ServiceClientRecord
+			scopes string
+		)
+		if err = rows.Scan(&record.Name, &scopes, &record.CreatedAt, &record.RotatedAt); err != nil {
+			return nil, err
+		}
+		record.Scopes = splitScopes(scopes)
+		clients = append(clients, record)
+	}
+	return clients, rows.Err()
+}
+
+func (s *SQLiteDB) insertClient(ctx context.Context, name, keyHash string, scopes []string) error {
+	now := time.Now().UTC()
+	query := `INSERT INTO service_clients (name, key_hash, scopes, created_at, rotated_at)
+                   VALUES (?, ?, ?, ?, ?)
+              ON CONFLICT (name) DO UPDATE
+                      SET key_hash = excluded.key_hash,
+                          scopes = excluded.scopes,
+                          created_at = excluded.created_at,
+                          rotated_at = excluded.rotated_at,
+                          revoked_at = NULL
+                    WHERE service_clients.revoked_at IS NOT NULL`
+	result, err := s.db.ExecContext(ctx, query, name, keyHash, joinScopes(scopes), now, now)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, errClientExists)
+}
+
+func (s *SQLiteDB) updateClientKey(ctx context.Context, name, keyHash string) error {
+	query := `UPDATE service_clients SET key_hash = ?, rotated_at = ? WHERE name = ? AND revoked_at IS NULL`
+	result, err := s.db.ExecContext(ctx, query, keyHash, time.Now().UTC(), name)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, errClientNotFound)
+}
+
+func (s *SQLiteDB) updateClientScopes(ctx context.Context, name string, scopes []string) error {
+	query := `UPDATE service_clients SET scopes = ? WHERE name = ? AND revoked_at IS NULL`
+	result, err := s.db.ExecContext(ctx, query, joinScopes(scopes), name)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, errClientNotFound)
+}
+
+func (s *SQLiteDB) revokeClient(ctx context.Context, name string) error {
+	query := `UPDATE service_clients SET revoked_at = ? WHERE name = ? AND revoked_at IS NULL`
+	result, err := s.db.ExecContext(ctx, query, time.Now().UTC(), name)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, errClientNotFound)
+}
+
+// Stats
+
+func (s *SQLiteDB) storageStats(ctx context.Context) (*StorageStats, error) {
+	return scanStats(s.db.QueryRowContext(ctx, statsQuery))
+}
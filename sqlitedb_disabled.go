@@ -0,0 +1,15 @@
+//go:build !sqlite
+// +build !sqlite
+
+package main
+
+import "errors"
+
+// sqliteSupported is whether this build includes the SQLite backend.
+const sqliteSupported = false
+
+// OpenSQLiteStorage always fails in builds without the sqlite build tag, which
+// needs cgo. Build with -tags sqlite to use the SQLite backend.
+func OpenSQLiteStorage(path string) (*Storage, error) {
+	return nil, errors.New("this build does not include SQLite support; rebuild with -tags sqlite")
+}
@@ -0,0 +1,31 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteStorageContract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "user-info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := OpenSQLiteStorage(filepath.Join(dir, "user-info.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	if err = storage.Users.addUser(context.Background(), contractUser); err != nil {
+		t.Fatal(err)
+	}
+	testStorageContract(t, storage)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// runStats implements the stats subcommand: "stats [--json]". It writes the
+// number of each kind of record in storage to standard output.
+func runStats(ctx context.Context, stats statsDB, args []string, stdout io.Writer) error {
+	flags := newCommandFlags("stats", "user-info stats [--json]")
+	if err := flags.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	counts, err := stats.storageStats(ctx)
+	if err != nil {
+		return fmt.Errorf("error counting the stored records: %w", err)
+	}
+
+	if *flags.json {
+		return writeCommandJSON(stdout, counts)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	for _, row := range []struct {
+		name  string
+		count int64
+	}{
+		{"users", counts.Users},
+		{"preferences", counts.Preferences},
+		{"sessions", counts.Sessions},
+		{"saved searches", counts.SavedSearches},
+		{"bags", counts.Bags},
+		{"service clients", counts.ServiceClients},
+		{"audit log entries", counts.AuditEntries},
+		{"unpublished events", counts.PendingEvents},
+		{"change log entries", counts.Changes},
+		{"webhooks", counts.Webhooks},
+		{"pending webhook deliveries", counts.PendingDeliveries},
+		{"dead webhook deliveries", counts.DeadDeliveries},
+	} {
+		fmt.Fprintf(w, "%s\t%d\n", row.name, row.count)
+	}
+	return w.Flush()
+}
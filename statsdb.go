@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// StorageStats counts what's stored, for the stats subcommand.
+type StorageStats struct {
+	Users             int64 `json:"users"`
+	Preferences       int64 `json:"preferences"`
+	Sessions          int64 `json:"sessions"`
+	SavedSearches     int64 `json:"saved_searches"`
+	Bags              int64 `json:"bags"`
+	ServiceClients    int64 `json:"service_clients"`
+	AuditEntries      int64 `json:"audit_entries"`
+	PendingEvents     int64 `json:"pending_events"`
+	Changes           int64 `json:"changes"`
+	Webhooks          int64 `json:"webhooks"`
+	PendingDeliveries int64 `json:"pending_deliveries"`
+	DeadDeliveries    int64 `json:"dead_deliveries"`
+}
+
+// statsDB defines the interface for counting what's stored.
+type statsDB interface {
+	storageStats(ctx context.Context) (*StorageStats, error)
+}
+
+// statsQuery counts everything in one statement, so that the counts are
+// consistent with each other. It works on both Postgres and SQLite.
+const statsQuery = `SELECT (SELECT COUNT(*) FROM users),
+                           (SELECT COUNT(*) FROM user_preferences),
+                           (SELECT COUNT(*) FROM user_sessions),
+                           (SELECT COUNT(*) FROM user_saved_searches),
+                           (SELECT COUNT(*) FROM bags),
+                           (SELECT COUNT(*) FROM service_clients WHERE revoked_at IS NULL),
+                           (SELECT COUNT(*) FROM audit_log),
+                           (SELECT COUNT(*) FROM event_outbox),
+                           (SELECT COUNT(*) FROM user_changes),
+                           (SELECT COUNT(*) FROM webhooks),
+                           (SELECT COUNT(*) FROM webhook_deliveries WHERE failed_at IS NULL),
+                           (SELECT COUNT(*) FROM webhook_deliveries WHERE failed_at IS NOT NULL)`
+
+// scanStats reads the result of statsQuery.
+func scanStats(row *sql.Row) (*StorageStats, error) {
+	var stats StorageStats
+	err := row.Scan(&stats.Users, &stats.Preferences, &stats.Sessions, &stats.SavedSearches, &stats.Bags, &stats.ServiceClients,
+		&stats.AuditEntries, &stats.PendingEvents, &stats.Changes, &stats.Webhooks, &stats.PendingDeliveries, &stats.DeadDeliveries)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// StatsDB implements the statsDB interface on top of the DE database.
+type StatsDB struct {
+	db *tracedDB
+}
+
+// NewStatsDB returns a newly created *StatsDB.
+func NewStatsDB(db *sql.DB) *StatsDB {
+	return &StatsDB{
+		db: newTracedDB(db),
+	}
+}
+
+func (s *StatsDB) storageStats(ctx context.Context) (*StorageStats, error) {
+	ctx, done := startOperation(ctx, "StatsDB.storageStats")
+	defer done()
+
+	return scanStats(s.db.QueryRowContext(ctx, statsQuery))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/cyverse-de/dbutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Storage holds the stores used by the apps. Every backend provides all of
+// them.
+type Storage struct {
+	Backend     string
+	Users       uDB
+	Preferences pDB
+	Sessions    sDB
+	Searches    seDB
+	Bags        bDB
+	Clients     cDB
+	Profiles    profileDB
+	Exports     exportDB
+	Purges      purgeDB
+	Merges      mergeDB
+	Audit       auditDB
+	Outbox      outboxDB
+	Changes     changesDB
+	Webhooks    webhookDB
+	Stats       statsDB
+	Imports     importDB
+
+	// DB is the underlying database handle, or nil for the in-memory backend.
+	DB *sql.DB
+}
+
+// NewPostgresStorage returns a *Storage backed by the DE database.
+func NewPostgresStorage(db *sql.DB) *Storage {
+	return &Storage{
+		Backend:     "postgres",
+		Users:       NewUsersDB(db),
+		Preferences: NewPrefsDB(db),
+		Sessions:    NewSessionsDB(db),
+		Searches:    NewSearchesDB(db),
+		Bags:        NewBagsAPI(db),
+		Clients:     NewClientsDB(db),
+		Profiles:    NewProfilesDB(db),
+		Exports:     NewExportDB(db),
+		Purges:      NewPurgeDB(db),
+		Merges:      NewMergeDB(db),
+		Audit:       NewAuditDB(db),
+		Outbox:      NewOutboxDB(db),
+		Changes:     NewChangesDB(db),
+		Webhooks:    NewWebhooksDB(db),
+		Stats:       NewStatsDB(db),
+		Imports:     NewImportDB(db),
+		DB:          db,
+	}
+}
+
+// NewMemoryStorage returns a *Storage that keeps everything in memory. It's
+// meant for local development and tests; nothing survives a restart.
+func NewMemoryStorage() *Storage {
+	m := NewMemoryDB()
+	return &Storage{
+		Backend:     "memory",
+		Users:       m,
+		Preferences: m,
+		Sessions:    m,
+		Searches:    m,
+		Bags:        m,
+		Clients:     m,
+		Profiles:    m,
+		Exports:     m,
+		Purges:      m,
+		Merges:      m,
+		Audit:       m,
+		Outbox:      m,
+		Changes:     m,
+		Webhooks:    m,
+		Stats:       m,
+		Imports:     m,
+	}
+}
+
+// OpenStorage opens the backend selected by user_info.storage.backend, which
+// is one of "postgres" (the default), "memory" or "sqlite". The users listed
+// in user_info.storage.users are created if they don't exist.
+func OpenStorage(cfg *viper.Viper) (*Storage, error) {
+	cfg.SetDefault("user_info.storage.backend", "postgres")
+	cfg.SetDefault("user_info.storage.sqlite.path", "user-info.db")
+
+	var (
+		storage *Storage
+		err     error
+	)
+
+	switch backend := cfg.GetString("user_info.storage.backend"); backend {
+	case "postgres":
+		var db *sql.DB
+		if db, err = openPostgres(cfg.GetString("db.uri")); err != nil {
+			return nil, err
+		}
+		storage = NewPostgresStorage(db)
+	case "memory":
+		storage = NewMemoryStorage()
+	case "sqlite":
+		if storage, err = OpenSQLiteStorage(cfg.GetString("user_info.storage.sqlite.path")); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+
+	for _, username := range cfg.GetStringSlice("user_info.storage.users") {
+		if err = storage.Users.addUser(context.Background(), username); err != nil {
+			storage.Close() // nolint:errcheck
+			return nil, fmt.Errorf("error adding user %s: %w", username, err)
+		}
+	}
+
+	return storage, nil
+}
+
+func openPostgres(dburi string) (*sql.DB, error) {
+	connector, err := dbutil.NewDefaultConnector("1m")
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Connecting to the database...")
+	db, err := connector.Connect("postgres", dburi)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Connected to the database.")
+
+	if err := db.Ping(); err != nil {
+		db.Close() // nolint:errcheck
+		return nil, err
+	}
+	log.Info("Successfully pinged the database")
+
+	return db, nil
+}
+
+// Close releases the resources held by the storage backend.
+func (s *Storage) Close() error {
+	if s.DB != nil {
+		return s.DB.Close()
+	}
+	return nil
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// This file contains a minimal tracer that follows the W3C Trace Context
+// recommendation for propagation and exports spans using the OTLP/HTTP JSON
+// encoding, so that spans can be sent to any OpenTelemetry collector.
+
+const traceparentHeader = "traceparent"
+
+// Span kinds and status codes as defined by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	statusCodeError = 2
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext is the part of a span that's propagated between services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// parseTraceparent parses a W3C traceparent header value.
+func parseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// Version 00 has exactly four fields; later versions may add more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != 16 {
+		return sc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != 8 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	if sc.TraceID == (TraceID{}) || sc.SpanID == (SpanID{}) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// traceparent formats the span context as a W3C traceparent header value.
+func (sc SpanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// Span records a single timed operation.
+type Span struct {
+	tracer     *Tracer
+	Context    SpanContext
+	ParentID   SpanID
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Err        error
+	mu         sync.Mutex
+}
+
+// SetAttribute adds an attribute to the span. It's safe to call on a nil span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed. It's safe to call on a nil span.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Err = err
+}
+
+// Finish ends the span and queues it for export. It's safe to call on a nil
+// span.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.Context.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the current span, if there is one.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanExporter sends finished spans somewhere.
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// Tracer creates spans and exports them in batches in the background.
+type Tracer struct {
+	serviceName string
+	sampleRatio float64
+	exporter    SpanExporter
+	queue       chan *Span
+	flush       chan chan struct{}
+	mu          sync.RWMutex
+	closed      bool
+	done        chan struct{}
+	batchSize   int
+	interval    time.Duration
+}
+
+// tracer is the process-wide tracer. Tracing is disabled while it's nil.
+var tracer *Tracer
+
+// NewTracer returns a new *Tracer that exports spans through exporter.
+func NewTracer(serviceName string, sampleRatio float64, exporter SpanExporter) *Tracer {
+	t := &Tracer{
+		serviceName: serviceName,
+		sampleRatio: sampleRatio,
+		exporter:    exporter,
+		queue:       make(chan *Span, 2048),
+		flush:       make(chan chan struct{}),
+		done:        make(chan struct{}),
+		batchSize:   256,
+		interval:    5 * time.Second,
+	}
+	go t.run()
+	return t
+}
+
+// NewTracerFromConfig returns a new *Tracer configured from the
+// user_info.tracing section of the configuration.
+func NewTracerFromConfig(cfg *viper.Viper) (*Tracer, error) {
+	cfg.SetDefault("user_info.tracing.exporter", "otlp")
+	cfg.SetDefault("user_info.tracing.otlp_endpoint", "http://localhost:4318/v1/traces")
+	cfg.SetDefault("user_info.tracing.service_name", "user-info")
+	cfg.SetDefault("user_info.tracing.sample_ratio", 1.0)
+
+	serviceName := cfg.GetString("user_info.tracing.service_name")
+
+	var exporter SpanExporter
+	switch cfg.GetString("user_info.tracing.exporter") {
+	case "otlp":
+		exporter = NewOTLPExporter(cfg.GetString("user_info.tracing.otlp_endpoint"), serviceName)
+	case "stdout":
+		exporter = NewWriterExporter(os.Stdout, serviceName)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", cfg.GetString("user_info.tracing.exporter"))
+	}
+
+	return NewTracer(serviceName, cfg.GetFloat64("user_info.tracing.sample_ratio"), exporter), nil
+}
+
+// enqueue queues the span for export. Spans that finish after Shutdown are
+// dropped.
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		log.Warn("dropping span because the export queue is full")
+	}
+}
+
+func (t *Tracer) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := t.exporter.ExportSpans(batch); err != nil {
+		log.Errorf("error exporting %d spans: %s", len(batch), err)
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case s, ok := <-t.queue:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= t.batchSize {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		case flushed := <-t.flush:
+			// Drain whatever has already been queued before exporting.
+			for drained := false; !drained; {
+				select {
+				case s, ok := <-t.queue:
+					if !ok {
+						// Shutdown closed the queue, so this is the last
+						// export.
+						t.export(batch)
+						close(flushed)
+						return
+					}
+					batch = append(batch, s)
+				default:
+					drained = true
+				}
+			}
+			t.export(batch)
+			batch = nil
+			close(flushed)
+		}
+	}
+}
+
+// Flush exports every span that has finished so far. After Shutdown there's
+// nothing left to flush.
+func (t *Tracer) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case t.flush <- flushed:
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown exports any remaining spans and stops the background exporter.
+// Spans that finish afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand doesn't fail on supported platforms.
+		panic(err)
+	}
+}
+
+func (t *Tracer) sample(traceID TraceID) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	if t.sampleRatio <= 0 {
+		return false
+	}
+	// Use the random part of the trace ID so every service sampling the
+	// same trace makes the same decision.
+	return float64(binary.BigEndian.Uint64(traceID[8:]))/float64(^uint64(0)) < t.sampleRatio
+}
+
+// start creates a new span. If parent is nil a new trace is started.
+func (t *Tracer) start(parent *SpanContext, name string, kind int) *Span {
+	s := &Span{
+		tracer:     t,
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+	}
+	randomBytes(s.Context.SpanID[:])
+
+	if parent != nil {
+		s.Context.TraceID = parent.TraceID
+		s.Context.Sampled = parent.Sampled
+		s.ParentID = parent.SpanID
+	} else {
+		randomBytes(s.Context.TraceID[:])
+		s.Context.Sampled = t.sample(s.Context.TraceID)
+	}
+
+	return s
+}
+
+// StartSpan starts a child of the span in ctx, or a new trace if there isn't
+// one. It returns a nil span when tracing is disabled; Span's methods accept
+// nil receivers so callers don't need to check.
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	var parent *SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		parent = &p.Context
+	}
+
+	s := tracer.start(parent, name, kind)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// tracingMiddleware is a mux.MiddlewareFunc that creates a server span for each
+// request, continuing the caller's trace if it sent a traceparent header.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if tracer == nil {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		var tpl string
+		if route := mux.CurrentRoute(r); route != nil {
+			tpl, _ = route.GetPathTemplate()
+		}
+
+		var parent *SpanContext
+		if sc, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			parent = &sc
+		}
+
+		span := tracer.start(parent, fmt.Sprintf("%s %s", r.Method, tpl), spanKindServer)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", tpl)
+		span.SetAttribute("http.target", r.URL.Path)
+		defer span.Finish()
+
+		recorder := newResponseRecorder(writer)
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), spanKey{}, span)))
+
+		span.SetAttribute("http.status_code", strconv.Itoa(recorder.status))
+		if recorder.status >= 500 {
+			span.SetError(fmt.Errorf("%d %s", recorder.status, http.StatusText(recorder.status)))
+		}
+	})
+}
+
+var (
+	sqlWhitespace     = regexp.MustCompile(`\s+`)
+	sqlStringLiterals = regexp.MustCompile(`'(?:[^']|'')*'`)
+	sqlNumbers        = regexp.MustCompile(`(^|[^$\w.])\d+(?:\.\d+)?\b`)
+)
+
+// sanitizeSQL collapses whitespace and replaces literal values so that no
+// user data ends up in span attributes.
+func sanitizeSQL(query string) string {
+	query = sqlStringLiterals.ReplaceAllString(query, "?")
+	query = sqlNumbers.ReplaceAllString(query, "${1}?")
+	return strings.TrimSpace(sqlWhitespace.ReplaceAllString(query, " "))
+}
+
+// tracedDB wraps *sql.DB so that every statement run through it gets its own
+// client span.
+type tracedDB struct {
+	*sql.DB
+	system string
+}
+
+func newTracedDB(db *sql.DB) *tracedDB {
+	return &tracedDB{DB: db, system: "postgresql"}
+}
+
+func startSQLSpan(ctx context.Context, system, query string) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	statement := sanitizeSQL(query)
+	verb := statement
+	if i := strings.Index(statement, " "); i > 0 {
+		verb = statement[:i]
+	}
+	ctx, span := StartSpan(ctx, strings.ToUpper(verb), spanKindClient)
+	span.SetAttribute("db.system", system)
+	span.SetAttribute("db.statement", statement)
+	return ctx, span
+}
+
+func (t *tracedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startSQLSpan(ctx, t.system, query)
+	defer span.Finish()
+	rows, err := t.DB.QueryContext(ctx, query, args...)
+	span.SetError(err)
+	return rows, err
+}
+
+func (t *tracedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, span := startSQLSpan(ctx, t.system, query)
+	defer span.Finish()
+	return t.DB.QueryRowContext(ctx, query, args...)
+}
+
+func (t *tracedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startSQLSpan(ctx, t.system, query)
+	defer span.Finish()
+	result, err := t.DB.ExecContext(ctx, query, args...)
+	span.SetError(err)
+	return result, err
+}
+
+// tracedTx wraps *sql.Tx the same way, for the statements run in a
+// transaction started with tracedDB.BeginTx.
+type tracedTx struct {
+	*sql.Tx
+	system string
+}
+
+// BeginTx starts a transaction whose statements are traced.
+func (t *tracedDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*tracedTx, error) {
+	tx, err := t.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedTx{Tx: tx, system: t.system}, nil
+}
+
+func (t *tracedTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startSQLSpan(ctx, t.system, query)
+	defer span.Finish()
+	rows, err := t.Tx.QueryContext(ctx, query, args...)
+	span.SetError(err)
+	return rows, err
+}
+
+func (t *tracedTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, span := startSQLSpan(ctx, t.system, query)
+	defer span.Finish()
+	return t.Tx.QueryRowContext(ctx, query, args...)
+}
+
+func (t *tracedTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startSQLSpan(ctx, t.system, query)
+	defer span.Finish()
+	result, err := t.Tx.ExecContext(ctx, query, args...)
+	span.SetError(err)
+	return result, err
+}
+
+// OTLP/HTTP JSON encoding of spans.
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func encodeOTLP(serviceName string, spans []*Span) otlpTraces {
+	var scope otlpScopeSpans
+	scope.Scope.Name = serviceName
+
+	for _, s := range spans {
+		s.mu.Lock()
+		encoded := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.ParentID != (SpanID{}) {
+			encoded.ParentSpanID = s.ParentID.String()
+		}
+		for key, value := range s.Attributes {
+			encoded.Attributes = append(encoded.Attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: value}})
+		}
+		if s.Err != nil {
+			encoded.Status = otlpStatus{Code: statusCodeError, Message: s.Err.Error()}
+		}
+		s.mu.Unlock()
+		scope.Spans = append(scope.Spans, encoded)
+	}
+
+	var resource otlpResourceSpans
+	resource.Resource.Attributes = []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: serviceName}}}
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector's OTLP/HTTP endpoint.
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+}
+
+// NewOTLPExporter returns a new *OTLPExporter that sends spans to endpoint,
+// which is usually something like http://otel-collector:4318/v1/traces.
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ExportSpans implements SpanExporter.
+func (e *OTLPExporter) ExportSpans(spans []*Span) error {
+	body, err := json.Marshal(encodeOTLP(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %s", res.Status)
+	}
+	return nil
+}
+
+// WriterExporter writes each batch of spans as a line of OTLP JSON. It's
+// meant for local development and tests.
+type WriterExporter struct {
+	mu          sync.Mutex
+	w           io.Writer
+	serviceName string
+}
+
+// NewWriterExporter returns a new *WriterExporter that writes to w.
+func NewWriterExporter(w io.Writer, serviceName string) *WriterExporter {
+	return &WriterExporter{w: w, serviceName: serviceName}
+}
+
+// ExportSpans implements SpanExporter.
+func (e *WriterExporter) ExportSpans(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return json.NewEncoder(e.w).Encode(encodeOTLP(e.serviceName, spans))
+}
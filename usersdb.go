@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// queryer is implemented by *sql.DB, *sql.Tx, *tracedDB and *tracedTx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// userExists returns whether or not the user is present in the users table.
+// It's the context-aware equivalent of queries.IsUser.
+func userExists(ctx context.Context, q queryer, username string) (bool, error) {
+	var count int64
+	query := `SELECT COUNT(*) FROM ( SELECT DISTINCT id FROM users WHERE username = $1 ) AS check_user`
+	if err := q.QueryRowContext(ctx, query, username).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// lookupUserID returns the ID of the user with the given username. It's the
+// context-aware equivalent of queries.UserID.
+func lookupUserID(ctx context.Context, q queryer, username string) (string, error) {
+	var userID string
+	query := `SELECT id FROM users WHERE username = $1`
+	if err := q.QueryRowContext(ctx, query, username).Scan(&userID); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// uDB defines the interface for interacting with the user storage. The users
+// table is normally populated by other DE services; addUser is used to seed
+// users for local development.
+type uDB interface {
+	isUser(ctx context.Context, username string) (bool, error)
+	addUser(ctx context.Context, username string) error
+}
+
+// UsersDB implements the uDB interface for interacting with the users table.
+type UsersDB struct {
+	db *tracedDB
+}
+
+// NewUsersDB returns a newly created *UsersDB.
+func NewUsersDB(db *sql.DB) *UsersDB {
+	return &UsersDB{
+		db: newTracedDB(db),
+	}
+}
+
+// isUser returns whether or not the user exists.
+func (u *UsersDB) isUser(ctx context.Context, username string) (bool, error) {
+	ctx, done := startOperation(ctx, "UsersDB.isUser")
+	defer done()
+
+	return userExists(ctx, u.db, username)
+}
+
+// addUser adds the user if they don't already exist.
+func (u *UsersDB) addUser(ctx context.Context, username string) error {
+	ctx, done := startOperation(ctx, "UsersDB.addUser")
+	defer done()
+
+	query := `INSERT INTO users (username) VALUES ($1) ON CONFLICT (username) DO NOTHING`
+	_, err := u.db.ExecContext(ctx, query, username)
+	return err
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var webhookDeliveries = metrics.NewCounterVec(
+	"user_info_webhook_deliveries_total",
+	"Number of attempts to deliver events to webhooks, by result.",
+	"result",
+)
+
+// The headers sent with every webhook delivery. The signature is the
+// hex-encoded HMAC-SHA256 of the body, keyed with the webhook's secret and
+// prefixed with "sha256=".
+const (
+	webhookEventHeader     = "X-User-Info-Event"
+	webhookDeliveryHeader  = "X-User-Info-Delivery"
+	webhookSignatureHeader = "X-User-Info-Signature"
+)
+
+// newWebhookSecret generates a new random secret for signing deliveries.
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// signPayload returns the value of the signature header for the payload.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload) // nolint:errcheck
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// privateNetworks are the networks, besides loopback and link-local
+// addresses, that webhooks can't be delivered to unless
+// user_info.webhooks.allow_private_destinations is set: the private IPv4
+// ranges, shared address space and IPv6 unique local addresses.
+var privateNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// privateAddress returns whether the address is inside the cluster or on the
+// host rather than out on the internet.
+func privateAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWebhookHost returns an error if the host of a webhook's URL is
+// obviously private. Names that resolve to private addresses are caught when
+// deliveries are made, by checkWebhookDial.
+func checkWebhookHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%s is a private destination", host)
+	}
+	if ip := net.ParseIP(host); ip != nil && privateAddress(ip) {
+		return fmt.Errorf("%s is a private destination", host)
+	}
+	return nil
+}
+
+// checkWebhookDial is a net.Dialer Control function that refuses to connect
+// to private addresses, whatever name they were reached through, including
+// after a redirect.
+func checkWebhookDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || privateAddress(ip) {
+		return fmt.Errorf("%s is a private destination", host)
+	}
+	return nil
+}
+
+// The limits on how many dead letters a single request returns.
+const (
+	defaultDeadLetterLimit = 100
+	maxDeadLetterLimit     = 1000
+)
+
+// WebhooksApp lets administrators register webhooks and look after their
+// deliveries.
+type WebhooksApp struct {
+	webhooks     webhookDB
+	router       *mux.Router
+	allowPrivate bool
+}
+
+// NewWebhooksApp returns a new *WebhooksApp. Webhooks can only be registered
+// for private destinations, such as other services in the cluster, if
+// user_info.webhooks.allow_private_destinations is set.
+func NewWebhooksApp(cfg *viper.Viper, db webhookDB, router *mux.Router) *WebhooksApp {
+	cfg.SetDefault("user_info.webhooks.allow_private_destinations", false)
+
+	webhooksApp := &WebhooksApp{
+		webhooks:     db,
+		router:       router,
+		allowPrivate: cfg.GetBool("user_info.webhooks.allow_private_destinations"),
+	}
+	webhooksApp.router.HandleFunc("/admin/webhooks", webhooksApp.ListWebhooks).Methods(http.MethodGet)
+	webhooksApp.router.HandleFunc("/admin/webhooks", webhooksApp.CreateWebhook).Methods(http.MethodPost)
+	webhooksApp.router.HandleFunc("/admin/webhooks/{webhook}", webhooksApp.GetWebhook).Methods(http.MethodGet)
+	webhooksApp.router.HandleFunc("/admin/webhooks/{webhook}", webhooksApp.DeleteWebhook).Methods(http.MethodDelete)
+	webhooksApp.router.HandleFunc("/admin/webhooks/{webhook}/dead-letters", webhooksApp.ListDeadLetters).Methods(http.MethodGet)
+	webhooksApp.router.HandleFunc("/admin/webhooks/{webhook}/dead-letters/{delivery}/redeliver", webhooksApp.Redeliver).
+		Methods(http.MethodPost)
+	return webhooksApp
+}
+
+// webhookEventAlias returns the event type that name stands for if it's
+// written the way other systems tend to name events, with a singular resource
+// and a past-tense operation, such as bag.deleted for bags.delete.
+func webhookEventAlias(name string) (string, bool) {
+	resource, operation := splitEventType(name)
+	for _, eventType := range webhookEventTypes {
+		knownResource, knownOperation := splitEventType(eventType)
+		plural := resource == knownResource || resource+"s" == knownResource || resource+"es" == knownResource
+		if plural && (operation == knownOperation || operation == knownOperation+"d") {
+			return eventType, true
+		}
+	}
+	return "", false
+}
+
+// splitEventType splits an event type into its resource and operation.
+func splitEventType(eventType string) (string, string) {
+	parts := strings.SplitN(eventType, ".", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+type webhookRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Username   string   `json:"username"`
+}
+
+// readWebhook reads and checks the webhook in the request body, which may
+// only be delivered to a private destination if allowPrivate is set.
+func readWebhook(request *http.Request, allowPrivate bool) (*WebhookRecord, error) {
+	var body webhookRequest
+
+	bodyBuffer, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading body: %w", err)
+	}
+
+	if err = json.Unmarshal(bodyBuffer, &body); err != nil {
+		return nil, fmt.Errorf("error parsing request body: %w", err)
+	}
+
+	target, err := url.Parse(body.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q; use an absolute http or https URL", body.URL)
+	}
+	if !allowPrivate {
+		if err = checkWebhookHost(target.Hostname()); err != nil {
+			return nil, fmt.Errorf("invalid URL %q: %w", body.URL, err)
+		}
+	}
+
+	if len(body.EventTypes) == 0 {
+		return nil, errors.New("at least one event type is required")
+	}
+
+	known := map[string]bool{allWebhookEvents: true}
+	for _, eventType := range webhookEventTypes {
+		known[eventType] = true
+	}
+
+	// Event types written some other way, like bag.deleted, are stored under
+	// the name that deliveries are sent with.
+	eventTypes := make([]string, 0, len(body.EventTypes))
+	for _, eventType := range body.EventTypes {
+		if !known[eventType] {
+			alias, ok := webhookEventAlias(eventType)
+			if !ok {
+				return nil, fmt.Errorf("unknown event type %q; use * or one of %v", eventType, webhookEventTypes)
+			}
+			eventType = alias
+		}
+		eventTypes = append(eventTypes, eventType)
+	}
+
+	return &WebhookRecord{URL: body.URL, EventTypes: eventTypes, Username: body.Username}, nil
+}
+
+// lookupWebhook returns the webhook named in the URL, or writes an error
+// response and returns nil.
+func (w *WebhooksApp) lookupWebhook(writer http.ResponseWriter, request *http.Request) *WebhookRecord {
+	id := mux.Vars(request)["webhook"]
+
+	// Postgres rejects IDs that aren't UUIDs instead of finding nothing.
+	if !uuidPattern.MatchString(id) {
+		notFound(writer, request, fmt.Sprintf("webhook %s does not exist", id))
+		return nil
+	}
+
+	webhook, err := w.webhooks.getWebhook(request.Context(), id)
+	if err != nil {
+		errored(writer, request, fmt.Sprintf("error looking up webhook %s: %s", id, err))
+		return nil
+	}
+	if webhook == nil {
+		notFound(writer, request, fmt.Sprintf("webhook %s does not exist", id))
+		return nil
+	}
+	return webhook
+}
+
+// ListWebhooks lists the registered webhooks.
+func (w *WebhooksApp) ListWebhooks(writer http.ResponseWriter, request *http.Request) {
+	webhooks, err := w.webhooks.listWebhooks(request.Context())
+	if err != nil {
+		errored(writer, request, fmt.Sprintf("error listing webhooks: %s", err))
+		return
+	}
+
+	writeJSON(writer, request, map[string][]WebhookRecord{"webhooks": webhooks})
+}
+
+// CreateWebhook registers a webhook and returns it along with the secret that
+// its deliveries are signed with. The secret cannot be retrieved again.
+func (w *WebhooksApp) CreateWebhook(writer http.ResponseWriter, request *http.Request) {
+	webhook, err := readWebhook(request, w.allowPrivate)
+	if err != nil {
+		badRequest(writer, request, err.Error())
+		return
+	}
+
+	if webhook.Secret, err = newWebhookSecret(); err != nil {
+		errored(writer, request, fmt.Sprintf("error generating a webhook secret: %s", err))
+		return
+	}
+	webhook.ID = newUUID()
+	webhook.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+	if err = w.webhooks.insertWebhook(request.Context(), webhook); err != nil {
+		errored(writer, request, fmt.Sprintf("error creating webhook: %s", err))
+		return
+	}
+
+	requestLog(request).WithFields(log.Fields{"service": "webhooks"}).
+		Infof("created webhook %s for %v to %s", webhook.ID, webhook.EventTypes, webhook.URL)
+	writer.WriteHeader(http.StatusCreated)
+	writeJSON(writer, request, struct {
+		*WebhookRecord
+		Secret string `json:"secret"`
+	}{webhook, webhook.Secret})
+}
+
+// GetWebhook returns a single webhook.
+func (w *WebhooksApp) GetWebhook(writer http.ResponseWriter, request *http.Request) {
+	if webhook := w.lookupWebhook(writer, request); webhook != nil {
+		writeJSON(writer, request, webhook)
+	}
+}
+
+// DeleteWebhook removes a webhook. Its pending deliveries and dead letters
+// are discarded.
+func (w *WebhooksApp) DeleteWebhook(writer http.ResponseWriter, request *http.Request) {
+	webhook := w.lookupWebhook(writer, request)
+	if webhook == nil {
+		return
+	}
+
+	err := w.webhooks.deleteWebhook(request.Context(), webhook.ID)
+	if err == errWebhookNotFound {
+		notFound(writer, request, fmt.Sprintf("webhook %s does not exist", webhook.ID))
+		return
+	}
+	if err != nil {
+		errored(writer, request, fmt.Sprintf("error deleting webhook %s: %s", webhook.ID, err))
+		return
+	}
+
+	requestLog(request).WithFields(log.Fields{"service": "webhooks"}).Infof("deleted webhook %s", webhook.ID)
+}
+
+// ListDeadLetters returns the deliveries to a webhook that failed every
+// attempt, oldest first, up to ?limit=.
+func (w *WebhooksApp) ListDeadLetters(writer http.ResponseWriter, request *http.Request) {
+	limit := defaultDeadLetterLimit
+	if value := request.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxDeadLetterLimit {
+			badRequest(writer, request, fmt.Sprintf("invalid limit %q; use a number from 1 to %d", value, maxDeadLetterLimit))
+			return
+		}
+	}
+
+	webhook := w.lookupWebhook(writer, request)
+	if webhook == nil {
+		return
+	}
+
+	deliveries, err := w.webhooks.failedDeliveries(request.Context(), webhook.ID, limit)
+	if err != nil {
+		errored(writer, request, fmt.Sprintf("error listing dead letters for webhook %s: %s", webhook.ID, err))
+		return
+	}
+
+	writeJSON(writer, request, map[string][]WebhookDelivery{"deliveries": deliveries})
+}
+
+// Redeliver takes a delivery off a webhook's dead-letter list and queues it
+// to be delivered again, with a fresh set of attempts.
+func (w *WebhooksApp) Redeliver(writer http.ResponseWriter, request *http.Request) {
+	value := mux.Vars(request)["delivery"]
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		notFound(writer, request, fmt.Sprintf("delivery %s does not exist", value))
+		return
+	}
+
+	webhook := w.lookupWebhook(writer, request)
+	if webhook == nil {
+		return
+	}
+
+	err = w.webhooks.redeliver(request.Context(), webhook.ID, id)
+	if err == errDeliveryNotFound {
+		notFound(writer, request, fmt.Sprintf("delivery %d is not a dead letter of webhook %s", id, webhook.ID))
+		return
+	}
+	if err != nil {
+		errored(writer, request, fmt.Sprintf("error redelivering %d to webhook %s: %s", id, webhook.ID, err))
+		return
+	}
+
+	requestLog(request).WithFields(log.Fields{"service": "webhooks"}).Infof("queued delivery %d to webhook %s again", id, webhook.ID)
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+// WebhookDispatcher delivers events to the webhooks that subscribe to them.
+// Every event is delivered at least once, and a delivery that keeps failing
+// ends up on the webhook's dead-letter list.
+type WebhookDispatcher struct {
+	webhooks     webhookDB
+	client       *http.Client
+	allowPrivate bool
+	interval     time.Duration
+	batchSize    int
+	lease        time.Duration
+	minRetry     time.Duration
+	maxRetry     time.Duration
+	maxAttempts  int
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// NewWebhookDispatcherFromConfig starts delivering events to webhooks, or
+// returns nil if user_info.webhooks.enabled is false. Deliveries are still
+// queued either way, so a dispatcher started later catches up.
+func NewWebhookDispatcherFromConfig(cfg *viper.Viper, webhooks webhookDB) *WebhookDispatcher {
+	cfg.SetDefault("user_info.webhooks.enabled", true)
+	cfg.SetDefault("user_info.webhooks.poll_interval", "1s")
+	cfg.SetDefault("user_info.webhooks.batch_size", 100)
+	cfg.SetDefault("user_info.webhooks.lease", "1m")
+	cfg.SetDefault("user_info.webhooks.min_retry", "10s")
+	cfg.SetDefault("user_info.webhooks.max_retry", "1h")
+	cfg.SetDefault("user_info.webhooks.max_attempts", 10)
+	cfg.SetDefault("user_info.webhooks.timeout", "10s")
+	cfg.SetDefault("user_info.webhooks.allow_private_destinations", false)
+
+	if !cfg.GetBool("user_info.webhooks.enabled") {
+		return nil
+	}
+
+	d := newWebhookDispatcher(webhooks)
+	d.client.Timeout = cfg.GetDuration("user_info.webhooks.timeout")
+	d.allowPrivate = cfg.GetBool("user_info.webhooks.allow_private_destinations")
+	d.interval = cfg.GetDuration("user_info.webhooks.poll_interval")
+	d.batchSize = cfg.GetInt("user_info.webhooks.batch_size")
+	d.lease = cfg.GetDuration("user_info.webhooks.lease")
+	d.minRetry = cfg.GetDuration("user_info.webhooks.min_retry")
+	d.maxRetry = cfg.GetDuration("user_info.webhooks.max_retry")
+	d.maxAttempts = cfg.GetInt("user_info.webhooks.max_attempts")
+	go d.run()
+	return d
+}
+
+// newWebhookDispatcher returns a dispatcher with the default settings that
+// hasn't been started.
+func newWebhookDispatcher(webhooks webhookDB) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		webhooks:    webhooks,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		interval:    time.Second,
+		batchSize:   100,
+		lease:       time.Minute,
+		minRetry:    10 * time.Second,
+		maxRetry:    time.Hour,
+		maxAttempts: 10,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	// Deliveries go straight to the webhook rather than through a proxy, since
+	// the address that's dialed is the one that's checked.
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: d.checkDial}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	d.client.Transport = transport
+	return d
+}
+
+// checkDial refuses connections to private addresses unless they're allowed.
+func (d *WebhookDispatcher) checkDial(network, address string, conn syscall.RawConn) error {
+	if d.allowPrivate {
+		return nil
+	}
+	return checkWebhookDial(network, address, conn)
+}
+
+// deliver posts the delivery to its webhook, which has to respond with a 2xx
+// status for it to count as delivered.
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery *WebhookDelivery) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(webhookEventHeader, delivery.EventType)
+	request.Header.Set(webhookDeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	request.Header.Set(webhookSignatureHeader, signPayload(delivery.Secret, delivery.Payload))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// Reading some of the body lets the connection be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024)) // nolint:errcheck
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("the webhook responded with %s", response.Status)
+	}
+	return nil
+}
+
+// dispatchPending attempts one batch of the deliveries that are due, oldest
+// first, and returns how many it attempted. Unlike events published to the
+// message broker, deliveries don't have to keep their order, so one that
+// fails doesn't hold up the rest.
+func (d *WebhookDispatcher) dispatchPending(ctx context.Context) (int, error) {
+	deliveries, err := d.webhooks.claimDeliveries(ctx, d.batchSize, d.lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		deliverErr := d.deliver(ctx, delivery)
+
+		switch {
+		case deliverErr == nil:
+			webhookDeliveries.Inc("delivered")
+			// A delivery that can't be removed is delivered again once its
+			// lease runs out.
+			err = d.webhooks.deleteDelivery(ctx, delivery.ID)
+		case delivery.Attempts+1 >= d.maxAttempts:
+			webhookDeliveries.Inc("dead")
+			log.Errorf("giving up on delivery %d to webhook %s: %s", delivery.ID, delivery.WebhookID, deliverErr)
+			err = d.webhooks.failDelivery(ctx, delivery.ID, deliverErr.Error())
+		default:
+			webhookDeliveries.Inc("failed")
+			log.Warnf("error delivering %d to webhook %s: %s", delivery.ID, delivery.WebhookID, deliverErr)
+			err = d.webhooks.retryDelivery(ctx, delivery.ID, backoff(d.minRetry, d.maxRetry, delivery.Attempts), deliverErr.Error())
+		}
+		if err != nil {
+			log.Errorf("error recording the attempt at delivery %d: %s", delivery.ID, err)
+		}
+	}
+	return len(deliveries), nil
+}
+
+func (d *WebhookDispatcher) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Full batches are dispatched back to back to work through a
+			// backlog.
+			for {
+				dispatched, err := d.dispatchPending(context.Background())
+				if err != nil {
+					log.Errorf("error delivering to webhooks: %s", err)
+					break
+				}
+				if dispatched < d.batchSize {
+					break
+				}
+			}
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// Close stops delivering to webhooks. Deliveries that haven't been made yet
+// stay queued.
+func (d *WebhookDispatcher) Close(ctx context.Context) error {
+	close(d.stop)
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+	}
+	return nil
+}
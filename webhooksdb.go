@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errWebhookNotFound  = errors.New("webhook not found")
+	errDeliveryNotFound = errors.New("delivery not found")
+)
+
+// allWebhookEvents subscribes a webhook to every event type.
+const allWebhookEvents = "*"
+
+// webhookEventTypes are the types of the events that webhooks can subscribe
+// to, which are the same as the routing keys of the events published to AMQP
+// without the "user-info." prefix.
+var webhookEventTypes = []string{
+	"preferences.create", "preferences.update", "preferences.delete",
+	"sessions.create", "sessions.update", "sessions.delete",
+	"searches.create", "searches.update", "searches.delete",
+	"bags.create", "bags.update", "bags.delete", "bags.delete_all", "bags.set_default",
+	"users.purge", "users.merge",
+}
+
+// WebhookRecord is a webhook that events are delivered to. The secret signs
+// every delivery and is only shown when the webhook is created.
+type WebhookRecord struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"-"`
+	EventTypes []string  `json:"event_types"`
+	Username   string    `json:"username,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// matches returns whether the webhook subscribes to the event.
+func (w *WebhookRecord) matches(event *ChangeEvent) bool {
+	if w.Username != "" && w.Username != event.Username {
+		return false
+	}
+	for _, eventType := range w.EventTypes {
+		if eventType == allWebhookEvents || eventType == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is an event waiting to be delivered to a webhook, or one
+// that has failed every attempt and is on the dead-letter list. The URL and
+// secret are filled in when the delivery is claimed.
+type WebhookDelivery struct {
+	ID        int64           `json:"id"`
+	WebhookID string          `json:"webhook_id"`
+	EventType string          `json:"event_type"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	FailedAt  *time.Time      `json:"failed_at,omitempty"`
+	URL       string          `json:"-"`
+	Secret    string          `json:"-"`
+}
+
+// webhookDB defines the interface for the registered webhooks and their
+// deliveries. Deliveries are added by the stores, in the same transaction as
+// the change they describe.
+type webhookDB interface {
+	insertWebhook(ctx context.Context, webhook *WebhookRecord) error
+	listWebhooks(ctx context.Context) ([]WebhookRecord, error)
+
+	// getWebhook returns the webhook with the ID, or nil if there isn't one.
+	getWebhook(ctx context.Context, id string) (*WebhookRecord, error)
+
+	// deleteWebhook removes the webhook along with its pending and failed
+	// deliveries.
+	deleteWebhook(ctx context.Context, id string) error
+
+	// claimDeliveries returns up to limit deliveries that are due, oldest
+	// first, and hides them from other dispatchers until the lease runs out.
+	claimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error)
+
+	// deleteDelivery removes a delivery once the webhook has accepted it.
+	deleteDelivery(ctx context.Context, id int64) error
+
+	// retryDelivery records a failed attempt at a delivery and hides it for
+	// the delay.
+	retryDelivery(ctx context.Context, id int64, delay time.Duration, lastErr string) error
+
+	// failDelivery records the last failed attempt at a delivery and moves it
+	// to the dead-letter list.
+	failDelivery(ctx context.Context, id int64, lastErr string) error
+
+	// failedDeliveries returns up to limit of the webhook's dead letters,
+	// oldest first.
+	failedDeliveries(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error)
+
+	// redeliver takes a delivery off the webhook's dead-letter list and makes
+	// it due again, with its attempts reset.
+	redeliver(ctx context.Context, webhookID string, id int64) error
+
+	// pruneDeliveries deletes the deliveries, pending or failed, that were
+	// queued before the cutoff and returns how many there were.
+	pruneDeliveries(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// insertWebhookDeliveries queues the event for delivery to every webhook that
+// subscribes to it. The payload is the encoded event.
+func insertWebhookDeliveries(ctx context.Context, q queryer, event *ChangeEvent, payload []byte) error {
+	query := `INSERT INTO webhook_deliveries (webhook_id, event_type, payload)
+                   SELECT id, $1::text, $2::jsonb
+                     FROM webhooks
+                    WHERE string_to_array(event_types, ' ') && ARRAY[$1::text, '` + allWebhookEvents + `']
+                      AND (username = '' OR username = $3)`
+	_, err := q.ExecContext(ctx, query, event.Type, string(payload), event.Username)
+	return err
+}
+
+// Event types are stored as a single space-separated string, like the scopes
+// of service clients.
+func joinEventTypes(eventTypes []string) string {
+	return strings.Join(eventTypes, " ")
+}
+
+func splitEventTypes(eventTypes string) []string {
+	return strings.Fields(eventTypes)
+}
+
+// deliveryColumns are the columns that scanDeliveries reads, in order.
+const deliveryColumns = `d.id, d.webhook_id, d.event_type, d.payload, d.attempts, d.last_error, d.created_at, d.failed_at, w.url, w.secret`
+
+// scanDeliveries reads deliveries selected with deliveryColumns from
+// webhook_deliveries d joined with webhooks w.
+func scanDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var (
+			delivery WebhookDelivery
+			payload  string
+			failedAt sql.NullTime
+		)
+		err := rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventType, &payload, &delivery.Attempts, &delivery.LastError,
+			&delivery.CreatedAt, &failedAt, &delivery.URL, &delivery.Secret)
+		if err != nil {
+			return nil, err
+		}
+		delivery.Payload = json.RawMessage(payload)
+		delivery.CreatedAt = delivery.CreatedAt.UTC()
+		if failedAt.Valid {
+			failed := failedAt.Time.UTC()
+			delivery.FailedAt = &failed
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// WebhooksDB implements the webhookDB interface on top of the DE database.
+type WebhooksDB struct {
+	db *tracedDB
+}
+
+// NewWebhooksDB returns a newly created *WebhooksDB.
+func NewWebhooksDB(db *sql.DB) *WebhooksDB {
+	return &WebhooksDB{
+		db: newTracedDB(db),
+	}
+}
+
+func (w *WebhooksDB) insertWebhook(ctx context.Context, webhook *WebhookRecord) error {
+	ctx, done := startOperation(ctx, "WebhooksDB.insertWebhook")
+	defer done()
+
+	query := `INSERT INTO webhooks (id, url, secret, event_types, username, created_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := w.db.ExecContext(ctx, query, webhook.ID, webhook.URL, webhook.Secret, joinEventTypes(webhook.EventTypes),
+		webhook.Username, webhook.CreatedAt)
+	return err
+}
+
+// webhookColumns are the columns that scanWebhook reads, in order.
+const webhookColumns = `id, url, secret, event_types, username, created_at`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWebhook(row rowScanner) (*WebhookRecord, error) {
+	var (
+		webhook    WebhookRecord
+		eventTypes string
+	)
+	if err := row.Scan(&webhook.ID, &webhook.URL, &webhook.Secret, &eventTypes, &webhook.Username, &webhook.CreatedAt); err != nil {
+		return nil, err
+	}
+	webhook.EventTypes = splitEventTypes(eventTypes)
+	webhook.CreatedAt = webhook.CreatedAt.UTC()
+	return &webhook, nil
+}
+
+func (w *WebhooksDB) listWebhooks(ctx context.Context) ([]WebhookRecord, error) {
+	ctx, done := startOperation(ctx, "WebhooksDB.listWebhooks")
+	defer done()
+
+	rows, err := w.db.QueryContext(ctx, `SELECT `+webhookColumns+` FROM webhooks ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []WebhookRecord{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, *webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (w *WebhooksDB) getWebhook(ctx context.Context, id string) (*WebhookRecord, error) {
+	ctx, done := startOperation(ctx, "WebhooksDB.getWebhook")
+	defer done()
+
+	webhook, err := scanWebhook(w.db.QueryRowContext(ctx, `SELECT `+webhookColumns+` FROM webhooks WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return webhook, err
+}
+
+func (w *WebhooksDB) deleteWebhook(ctx context.Context, id string) error {
+	ctx, done := startOperation(ctx, "WebhooksDB.deleteWebhook")
+	defer done()
+
+	// The deliveries go with it, through ON DELETE CASCADE.
+	result, err := w.db.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, errWebhookNotFound)
+}
+
+func (w *WebhooksDB) claimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	ctx, done := startOperation(ctx, "WebhooksDB.claimDeliveries")
+	defer done()
+
+	// SKIP LOCKED lets every replica run a dispatcher without any two of them
+	// claiming the same delivery.
+	query := `WITH claimed AS (
+                  UPDATE webhook_deliveries
+                     SET next_attempt_at = now() + $2 * interval '1 second'
+                   WHERE id IN (SELECT id
+                                  FROM webhook_deliveries
+                                 WHERE failed_at IS NULL
+                                   AND next_attempt_at <= now()
+                              ORDER BY id
+                                 LIMIT $1
+                                   FOR UPDATE SKIP LOCKED)
+               RETURNING *
+              )
+              SELECT ` + deliveryColumns + `
+                FROM claimed d
+                JOIN webhooks w ON w.id = d.webhook_id`
+	rows, err := w.db.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := scanDeliveries(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	return deliveries, nil
+}
+
+func (w *WebhooksDB) deleteDelivery(ctx context.Context, id int64) error {
+	ctx, done := startOperation(ctx, "WebhooksDB.deleteDelivery")
+	defer done()
+
+	_, err := w.db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE id = $1`, id)
+	return err
+}
+
+func (w *WebhooksDB) retryDelivery(ctx context.Context, id int64, delay time.Duration, lastErr string) error {
+	ctx, done := startOperation(ctx, "WebhooksDB.retryDelivery")
+	defer done()
+
+	query := `UPDATE webhook_deliveries
+                 SET attempts = attempts + 1,
+                     next_attempt_at = now() + $2 * interval '1 second',
+                     last_error = $3
+               WHERE id = $1`
+	_, err := w.db.ExecContext(ctx, query, id, delay.Seconds(), lastErr)
+	return err
+}
+
+func (w *WebhooksDB) failDelivery(ctx context.Context, id int64, lastErr string) error {
+	ctx, done := startOperation(ctx, "WebhooksDB.failDelivery")
+	defer done()
+
+	query := `UPDATE webhook_deliveries
+                 SET attempts = attempts + 1,
+                     failed_at = now(),
+                     last_error = $2
+               WHERE id = $1`
+	_, err := w.db.ExecContext(ctx, query, id, lastErr)
+	return err
+}
+
+func (w *WebhooksDB) failedDeliveries(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	ctx, done := startOperation(ctx, "WebhooksDB.failedDeliveries")
+	defer done()
+
+	query := `SELECT ` + deliveryColumns + `
+                FROM webhook_deliveries d
+                JOIN webhooks w ON w.id = d.webhook_id
+               WHERE d.webhook_id = $1
+                 AND d.failed_at IS NOT NULL
+            ORDER BY d.id
+               LIMIT $2`
+	rows, err := w.db.QueryContext(ctx, query, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+func (w *WebhooksDB) redeliver(ctx context.Context, webhookID string, id int64) error {
+	ctx, done := startOperation(ctx, "WebhooksDB.redeliver")
+	defer done()
+
+	query := `UPDATE webhook_deliveries
+                 SET attempts = 0,
+                     failed_at = NULL,
+                     next_attempt_at = now()
+               WHERE id = $1
+                 AND webhook_id = $2
+                 AND failed_at IS NOT NULL`
+	result, err := w.db.ExecContext(ctx, query, id, webhookID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result, errDeliveryNotFound)
+}
+
+func (w *WebhooksDB) pruneDeliveries(ctx context.Context, cutoff time.Time) (int64, error) {
+	ctx, done := startOperation(ctx, "WebhooksDB.pruneDeliveries")
+	defer done()
+
+	result, err := w.db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE created_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}